@@ -50,15 +50,34 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/common/tracing"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 )
 
+// agentListTTL is the time the agent list requested from the ams is used for group lookups
+const agentListTTL = time.Second * 10
+
 // remoteAgency holds the channel used for sending messages to remot agency
 type remoteAgency struct {
-	msgIn        chan schemas.ACLMessage // ACL message inbox
-	agencyClient *client.AgencyClient
+	msgIn         *msgQueue                 // ACL messages to be sent; messages with higher priority are sent first
+	batchIn       chan []schemas.ACLMessage // copies of multicast messages sent as one batch
+	agencyClient  *client.AgencyClient
+	undeliverable func(schemas.ACLMessage, string) // handler for messages that cannot be sent
+	stream        *msgStream                       // message stream; nil if http is used
+	streamRetry   time.Time                        // time until which http is used instead of stream
+	ip            string                           // ip of remote agency used for http
+	mutex         *sync.Mutex                      // protects ip
+	tracer        *tracing.Tracer                  // records spans of sent messages
+	metrics       *agencyMetrics                   // statistics of sent messages
+	faults        *faultInjector                   // drops messages during partitions
+	resolve       func(string) (string, error)     // resolves the name of the remote agency
+	transit       *cosim                           // counts messages that cannot be sent
+	logError      *log.Logger
 	// agents map[int]*agent.Agent
 }
 
@@ -90,9 +109,22 @@ func (agency *Agency) aclLookup(agentID int) (acl *ACL, err error) {
 		return
 	}
 	agency.logInfo.Println("Request address of unknown agent")
+	acl, err = agency.remoteACL(agentID, address)
+	return
+}
+
+// remoteACL creates the acl object for a remote agent with known address
+func (agency *Agency) remoteACL(agentID int, address schemas.Address) (acl *ACL, err error) {
+	var ag *Agent
+	var ok bool
 	agentInfo := schemas.AgentInfo{}
 	agency.mutex.Lock()
 	agencyName := agency.info.Name
+	// messages to the gateway are not received by an agency of the co-simulation
+	transit := agency.cosim
+	if agency.gwConfig.Active && address.Agency == agency.gwConfig.Host {
+		transit = nil
+	}
 	agency.mutex.Unlock()
 	if address.Agency == agencyName {
 		err = errors.New("MassiveError")
@@ -109,14 +141,33 @@ func (agency *Agency) aclLookup(agentID int) (acl *ACL, err error) {
 	// check if remote agency is already known
 	if ok {
 		agency.logInfo.Println("New remote agent ", agentID, " in known agency ", address.Agency)
-		ag = newAgent(agentInfo, "", "", remAgency.msgIn, nil, nil, schemas.LoggerConfig{}, nil,
-			false, nil, agency.logError, agency.logInfo)
+		ag = newAgent(agentInfo, "", "", remAgency.msgIn, schemas.InboxBlock, nil, nil, nil, schemas.LoggerConfig{},
+			nil, false, nil, agency.logError, agency.logInfo)
 	} else {
 		agency.logInfo.Println("New remote agent ", agentID, " in unknown agency ", address.Agency)
 		// create new remote agency
 		remAgency = &remoteAgency{
-			msgIn:        make(chan schemas.ACLMessage, 1000),
-			agencyClient: agency.agencyClient,
+			msgIn:         newMsgQueue(1000),
+			batchIn:       make(chan []schemas.ACLMessage),
+			agencyClient:  agency.agencyClient,
+			undeliverable: agency.undeliverable,
+			mutex:         &sync.Mutex{},
+			tracer:        agency.tracer,
+			metrics:       agency.metrics,
+			faults:        agency.faults,
+			resolve:       agency.resolve,
+			transit:       transit,
+			logError:      agency.logError,
+		}
+		if agency.msgStreams {
+			remAgency.stream = newMsgStream(address.Agency, agencyName, agency.agencyClient.Port,
+				func(session string, batch streamBatch) {
+					header := http.Header{}
+					header.Set(streamHeaderAgency, agencyName)
+					header.Set(streamHeaderSession, session)
+					header.Set(streamHeaderSequence, strconv.FormatUint(batch.seq, 10))
+					remAgency.postMsgs(address.Agency, batch.msgs, header)
+				}, agency.logError)
 		}
 		agency.mutex.Lock()
 		agency.remoteAgencies[address.Agency] = remAgency
@@ -131,9 +182,11 @@ func (agency *Agency) aclLookup(agentID int) (acl *ACL, err error) {
 			numRemAgencies < numLocalAgs {
 			go agency.receiveMsgs()
 		}
-		ag = newAgent(agentInfo, "", "", remAgency.msgIn, nil, nil, schemas.LoggerConfig{}, nil,
-			false, nil, agency.logError, agency.logInfo)
+		ag = newAgent(agentInfo, "", "", remAgency.msgIn, schemas.InboxBlock, nil, nil, nil, schemas.LoggerConfig{},
+			nil, false, nil, agency.logError, agency.logInfo)
 	}
+	ag.ACL.transit = transit
+	ag.ACL.batchOut = remAgency.batchIn
 	agency.mutex.Lock()
 	agency.remoteAgents[agentID] = ag
 	agency.mutex.Unlock()
@@ -142,59 +195,179 @@ func (agency *Agency) aclLookup(agentID int) (acl *ACL, err error) {
 	return
 }
 
+// groupLookup returns the IDs of all active agents of the MAS that match. Membership is
+// determined from the agent list of the ams which is cached for agentListTTL. Remote agents
+// found in the list are registered with their address, so that no further address requests
+// are necessary for sending messages to them
+func (agency *Agency) groupLookup(match func(schemas.AgentInfo) bool) (agentIDs []int,
+	err error) {
+	var agents []schemas.AgentInfo
+	agents, err = agency.getAgentList()
+	if err != nil {
+		return
+	}
+	agency.mutex.Lock()
+	agencyName := agency.info.Name
+	agency.mutex.Unlock()
+	for i := range agents {
+		if agents[i].Address.Agency == "" || !match(agents[i]) {
+			continue
+		}
+		agentIDs = append(agentIDs, agents[i].ID)
+		if agents[i].Address.Agency == agencyName {
+			continue
+		}
+		agency.mutex.Lock()
+		_, known := agency.remoteAgents[agents[i].ID]
+		agency.mutex.Unlock()
+		if !known {
+			agency.remoteACL(agents[i].ID, agents[i].Address)
+		}
+	}
+	return
+}
+
+// getAgentList returns the list of agents of the MAS. The list is requested from the ams if the
+// cached list is older than agentListTTL
+func (agency *Agency) getAgentList() (agents []schemas.AgentInfo, err error) {
+	agency.mutex.Lock()
+	if time.Since(agency.agentListUpdate) < agentListTTL {
+		agents = agency.agentList
+		agency.mutex.Unlock()
+		return
+	}
+	masID := agency.info.MASID
+	agency.mutex.Unlock()
+	var agentList schemas.Agents
+	agentList, _, err = agency.amsClient.GetAgents(masID)
+	if err != nil {
+		return
+	}
+	agents = agentList.Inst
+	agency.mutex.Lock()
+	agency.agentList = agents
+	agency.agentListUpdate = time.Now()
+	agency.mutex.Unlock()
+	return
+}
+
 // requestAgentAddress requests the address of an agent from ams
 func (agency *Agency) requestAgentAddress(agentID int) (address schemas.Address, err error) {
 	agency.mutex.Lock()
 	masID := agency.info.MASID
+	gwConfig := agency.gwConfig
 	agency.mutex.Unlock()
+	if agentID < 0 {
+		// agents of other platforms are reached via the gateway
+		if !gwConfig.Active {
+			err = errors.New("no gateway for foreign agent")
+			return
+		}
+		address.Agency = gwConfig.Host
+		return
+	}
 	address, _, err = agency.amsClient.GetAgentAddress(masID, agentID)
 	return
 }
 
-// sendMsgs is to be executed as go routine. It sends msgs to remote agency
+// sendMsgs is to be executed as go routine. It sends msgs to remote agency. Messages are sent
+// via the message stream if available and via http otherwise. Batches are filled with the
+// waiting messages of highest priority first. Copies of a multicast message are sent in one
+// batch after the messages waiting in the queue
 func (remAgency *remoteAgency) sendMsgs(remName string, localName string, logErr *log.Logger) {
-	var err error
-	var ip string
-	var stat int
-	ip, err = getIP(remName)
-	if err != nil {
-		logErr.Println(err)
-		return
-	}
 	for {
-		msg := <-remAgency.msgIn
-		num := len(remAgency.msgIn)
-		if num > 99 {
-			num = 99
+		var msgs []schemas.ACLMessage
+		select {
+		case <-remAgency.msgIn.ready():
+			msgs = remAgency.takeMsgs(100)
+			if len(msgs) == 0 {
+				continue
+			}
+		case batch := <-remAgency.batchIn:
+			// waiting messages have been sent before and are not overtaken by the batch
+			msgs = append(remAgency.takeMsgs(remAgency.msgIn.len()), batch...)
 		}
-		msgs := make([]schemas.ACLMessage, num+1)
-		msgs[0] = msg
-		msgs[0].AgencySender = localName
-		msgs[0].AgencyReceiver = remName
-		for i := 0; i < num; i++ {
-			msgs[i+1] = <-remAgency.msgIn
-			msgs[i+1].AgencySender = localName
-			msgs[i+1].AgencyReceiver = remName
+		for i := range msgs {
+			msgs[i].AgencySender = localName
+			msgs[i].AgencyReceiver = remName
 		}
-		stat, err = remAgency.agencyClient.PostMsgs(ip, msgs)
-		if err != nil || stat != http.StatusCreated {
-			ip, err = getIP(remName)
-			if err != nil {
-				logErr.Println(err)
-				return
-			}
-			stat, err = remAgency.agencyClient.PostMsgs(ip, msgs)
+		if remAgency.faults.partitioned(remName) {
+			logErr.Println("Fault injection: dropping ", len(msgs), " messages to partitioned agency ",
+				remName)
+			remAgency.transit.countLost(len(msgs))
+			continue
+		}
+		spans := make([]*schemas.Span, len(msgs))
+		for i := range msgs {
+			spans[i] = traceMessage(remAgency.tracer, &msgs[i], "agency send",
+				schemas.SpanKindClient, msgs[i].Sender)
+		}
+		start := time.Now()
+		if remAgency.stream != nil && time.Now().After(remAgency.streamRetry) {
+			// messages are sent via http by the stream in case of an error
+			err := remAgency.stream.send(msgs)
 			if err != nil {
-				logErr.Println(err)
-			}
-			if stat != http.StatusCreated {
-				logErr.Println("Wrong http code: " + strconv.Itoa(stat))
+				logErr.Println("Message stream to agency ", remName, " not available: ", err)
+				remAgency.streamRetry = time.Now().Add(streamRetryInterval)
 			}
+			remAgency.metrics.remoteSent(remName, len(msgs), start)
+			endSpans(remAgency.tracer, spans)
+			continue
 		}
+		remAgency.postMsgs(remName, msgs, nil)
+		remAgency.metrics.remoteSent(remName, len(msgs), start)
+		endSpans(remAgency.tracer, spans)
 		// fmt.Println(time.Now().String() + " sent " + strconv.Itoa(len(msgs)) + " messages to agency " + msgs[0].AgencyReceiver)
 	}
 }
 
+// takeMsgs takes up to max messages from the queue with the highest priority first
+func (remAgency *remoteAgency) takeMsgs(max int) (msgs []schemas.ACLMessage) {
+	for i := 0; i < max; i++ {
+		msg, ok := remAgency.msgIn.tryGet()
+		if !ok {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// postMsgs sends msgs to remote agency via http with the additional header fields if any. The ip
+// of the remote agency is requested again in case of an error. Messages that cannot be sent are
+// handed over to undeliverable
+func (remAgency *remoteAgency) postMsgs(remName string, msgs []schemas.ACLMessage,
+	header http.Header) {
+	var err error
+	var stat int
+	remAgency.mutex.Lock()
+	ip := remAgency.ip
+	remAgency.mutex.Unlock()
+	if ip != "" {
+		stat, err = remAgency.agencyClient.PostMsgsHeader(ip, msgs, header)
+		if err == nil && stat == http.StatusCreated {
+			return
+		}
+	}
+	ip, err = remAgency.resolve(remName)
+	if err == nil {
+		remAgency.mutex.Lock()
+		remAgency.ip = ip
+		remAgency.mutex.Unlock()
+		stat, err = remAgency.agencyClient.PostMsgsHeader(ip, msgs, header)
+		if err == nil && stat != http.StatusCreated {
+			err = errors.New("wrong http code: " + strconv.Itoa(stat))
+		}
+	}
+	if err != nil {
+		remAgency.logError.Println(err)
+		remAgency.transit.countLost(len(msgs))
+		for i := range msgs {
+			remAgency.undeliverable(msgs[i], err.Error())
+		}
+	}
+}
+
 // getIP requests IT from DNS
 func getIP(dnsName string) (ip string, err error) {
 	for i := 0; i < 5; i++ {
@@ -208,57 +381,74 @@ func getIP(dnsName string) (ip string, err error) {
 	return
 }
 
-// receiveMsgs is to be executed as go routine. It delivers incoming messages to local agents
+// maxMsgSize returns the maximum size of message batches received from other agencies
+func (agency *Agency) maxMsgSize() (size int) {
+	size = agency.msgMaxSize
+	if size <= 0 {
+		size = aclwire.DefaultMaxSize
+	}
+	return
+}
+
+// receiveMsgs is to be executed as go routine. It delivers incoming messages to local agents.
+// Messages that cannot be delivered are queued for redelivery
 func (agency *Agency) receiveMsgs() {
 	agency.logInfo.Println("Started go routine for message receiving")
 	var msgs []schemas.ACLMessage
 	for {
 		msgs = <-agency.msgIn
+		agency.metrics.agencyReceived(len(msgs))
 		for i := range msgs {
-			var ok bool
-			var ag *Agent
-			agency.mutex.Lock()
-			ag, ok = agency.localAgents[msgs[i].Receiver]
-			agency.mutex.Unlock()
-			if ok {
-				err := ag.ACL.newIncomingMessage(msgs[i])
-				if err != nil {
-					_, err = agency.agencyClient.ReturnMsg(msgs[i].AgencySender, msgs[i])
-					if err != nil {
-						agency.logError.Println(err)
-						return
-					}
-				}
-			} else {
-				_, err := agency.agencyClient.ReturnMsg(msgs[i].AgencySender, msgs[i])
-				if err != nil {
-					agency.logError.Println(err)
-					return
-				}
+			if agency.faults.partitioned(msgs[i].AgencySender) {
+				agency.logInfo.Println("Fault injection: dropping message from partitioned agency ",
+					msgs[i].AgencySender)
+				continue
 			}
+			span := traceMessage(agency.tracer, &msgs[i], "agency receive",
+				schemas.SpanKindServer, msgs[i].Receiver)
+			err := agency.deliverRemote(msgs[i])
+			agency.tracer.End(span, err)
 		}
+		agency.cosim.countReceived(len(msgs))
 	}
 }
 
 // resendUndeliverableMsg resends a messages that has been returned as undeliverable by a
-// remote agency
+// remote agency. The address of the receiver is requested again. If the receiver is not active
+// or still located in the agency that returned the message, the message is undeliverable
 func (agency *Agency) resendUndeliverableMsg(msg schemas.ACLMessage) (err error) {
-	var remAg, locAg *Agent
-	var ok bool
 	agency.mutex.Lock()
-	remAg, ok = agency.remoteAgents[msg.Receiver]
+	remAg, ok := agency.remoteAgents[msg.Receiver]
+	if ok {
+		delete(agency.remoteAgents, msg.Receiver)
+	}
+	locAg, local := agency.localAgents[msg.Sender]
 	agency.mutex.Unlock()
 	if ok {
-		agency.mutex.Lock()
-		locAg, ok = agency.localAgents[msg.Sender]
-		agency.mutex.Unlock()
-		if ok {
-			remAg.ACL.close()
-			agency.mutex.Lock()
-			delete(agency.remoteAgents, msg.Receiver)
-			agency.mutex.Unlock()
-			locAg.ACL.SendMessage(msg)
-		}
+		remAg.ACL.close()
+	}
+	if !local {
+		agency.addDeadLetter(msg, "sender is not a local agent", msg.Sender)
+		return
+	}
+	if msg.Receiver < 0 {
+		// the gateway already tried all addresses of the foreign agent
+		agency.undeliverable(msg, "foreign agent is not reachable")
+		return
+	}
+	var address schemas.Address
+	address, err = agency.requestAgentAddress(msg.Receiver)
+	if err != nil {
+		agency.undeliverable(msg, err.Error())
+		return
+	}
+	if address.Agency == "" || address.Agency == msg.AgencyReceiver {
+		agency.undeliverable(msg, "receiver is not active")
+		return
+	}
+	err = locAg.ACL.SendMessage(msg)
+	if err != nil {
+		agency.undeliverable(msg, err.Error())
 	}
 	return
 }
@@ -48,29 +48,55 @@ THE SOFTWARE.
 package agency
 
 import (
+	"context"
 	"errors"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/tracing"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 )
 
 // ACL provides functionality for agent messaging
 type ACL struct {
-	msgIn         chan schemas.ACLMessage         // ACL message inbox
-	msgInProtocol map[int]chan schemas.ACLMessage // registered handlers for message protocol
-	addrBook      map[int]*ACL                    // ACL address book of other agents
-	mutex         *sync.Mutex                     // mutex for address book
+	msgIn          *msgQueue                              // ACL message inbox
+	msgPending     []schemas.ACLMessage                   // received messages skipped by selective receive
+	pendingChanged chan struct{}                          // closed when msgPending changes
+	msgSuspended   []schemas.ACLMessage                   // messages received while suspended
+	suspended      bool                                   // indicates if incoming messages are buffered
+	suspendCount   int                                    // number of calls of suspend
+	msgInProtocol  map[int]*msgQueue                      // registered handlers for message protocol
+	msgInConv      map[int]*msgQueue                      // inboxes of open conversations
+	protPriority   map[int]int                            // default priority of messages per protocol
+	convCounter    int                                    // number of opened conversations
+	addrBook       map[int]*ACL                           // ACL address book of other agents
+	mutex          *sync.Mutex                            // mutex for address book
+	inboxPolicy    string                                 // overflow policy of inboxes
+	deliverQueue   [numPriorities]chan schemas.ACLMessage // messages waiting for space in an inbox
+	queueLen       [numPriorities]int                     // number of messages in deliverQueue
+	queueRunning   [numPriorities]bool                    // indicates if deliverQueue is drained
+	numDropped     int                                    // number of messages dropped due to overflow
+	numRejected    int                                    // number of messages rejected due to overflow
 	// commIn        chan int                        // ID of agents that have sent messages
 	// commOut       chan int                        // ID of agents that messages have been sent to
-	agentID   int
-	active    bool
-	aclLookup func(int) (*ACL, error)
-	logger    *client.AgentLogger
-	logError  *log.Logger
-	logInfo   *log.Logger
+	agentID     int
+	active      bool
+	ctx         context.Context           // done when the agent is terminated
+	codecs      *codecRegistry            // content languages, encodings and ontologies
+	tracer      *tracing.Tracer           // records spans of sent and received messages; nil if inactive
+	metrics     *agencyMetrics            // statistics of sent and received messages; nil for remote agents
+	faults      *faultInjector            // faults injected into sent messages; nil for remote agents
+	observe     func(schemas.ACLMessage)  // called for every delivered message; optional
+	transit     *cosim                    // counts messages to other agencies; nil for local agents
+	batchOut    chan []schemas.ACLMessage // batches sent to the remote agency; nil for local agents
+	cosim       *cosim                    // counts messages sent by the agent; nil for remote agents
+	aclLookup   func(int) (*ACL, error)
+	groupLookup func(func(schemas.AgentInfo) bool) ([]int, error)
+	logger      *client.AgentLogger
+	logError    *log.Logger
+	logInfo     *log.Logger
 }
 
 // commData stores data about communication with other agent
@@ -79,23 +105,33 @@ type ACL struct {
 // 	numMsgRecv int // number of messages received from this agent
 // }
 
-// newACL creates a new ACL object
-func newACL(agentID int, msgIn chan schemas.ACLMessage,
-	aclLookup func(int) (*ACL, error), cmaplog *client.AgentLogger,
+// newACL creates a new ACL object. The capacity of msgIn is used for all inboxes of the agent
+func newACL(ctx context.Context, agentID int, msgIn *msgQueue, inboxPolicy string,
+	aclLookup func(int) (*ACL, error),
+	groupLookup func(func(schemas.AgentInfo) bool) ([]int, error), cmaplog *client.AgentLogger,
 	logErr *log.Logger, logInf *log.Logger) (acl *ACL) {
 	acl = &ACL{
 		mutex:         &sync.Mutex{},
 		msgIn:         msgIn,
-		msgInProtocol: make(map[int]chan schemas.ACLMessage),
+		inboxPolicy:   inboxPolicy,
+		msgInProtocol: make(map[int]*msgQueue),
+		msgInConv:     make(map[int]*msgQueue),
+		protPriority:  make(map[int]int),
 		// commIn:        make(chan int, 5000),
 		// commOut:       make(chan int, 5000),
-		addrBook:  make(map[int]*ACL),
-		agentID:   agentID,
-		active:    true,
-		aclLookup: aclLookup,
-		logger:    cmaplog,
-		logError:  logErr,
-		logInfo:   logInf,
+		addrBook:    make(map[int]*ACL),
+		agentID:     agentID,
+		active:      true,
+		ctx:         ctx,
+		codecs:      newCodecRegistry(),
+		aclLookup:   aclLookup,
+		groupLookup: groupLookup,
+		logger:      cmaplog,
+		logError:    logErr,
+		logInfo:     logInf,
+	}
+	for i := range acl.deliverQueue {
+		acl.deliverQueue[i] = make(chan schemas.ACLMessage, msgIn.capacity)
 	}
 	return
 }
@@ -107,15 +143,26 @@ func newACL(agentID int, msgIn chan schemas.ACLMessage,
 // 	return
 // }
 
-// close closes the acl
+// close closes the acl. Senders waiting for space in one of the inboxes are released
 func (acl *ACL) close() {
 	acl.mutex.Lock()
 	acl.logInfo.Println("Closing ACL of agent ", acl.agentID)
 	acl.active = false
+	inboxes := []*msgQueue{acl.msgIn}
+	for _, inbox := range acl.msgInProtocol {
+		inboxes = append(inboxes, inbox)
+	}
+	for _, inbox := range acl.msgInConv {
+		inboxes = append(inboxes, inbox)
+	}
 	acl.mutex.Unlock()
+	for i := range inboxes {
+		inboxes[i].close()
+	}
 }
 
-// NewMessage returns a new initiaized message
+// NewMessage returns a new initiaized message. The priority is set to the default priority of
+// the protocol
 func (acl *ACL) NewMessage(receiver int, prot int, perf int,
 	content string) (msg schemas.ACLMessage, err error) {
 	msg.Sender = acl.agentID
@@ -124,13 +171,25 @@ func (acl *ACL) NewMessage(receiver int, prot int, perf int,
 		err = errors.New("non fipa-conform performative")
 	}
 	msg.Protocol = prot
+	acl.mutex.Lock()
+	msg.Priority = acl.protPriority[prot]
+	acl.mutex.Unlock()
 	msg.Performative = perf
 	msg.Content = content
 	// msg.Timestamp = time.Now()
 	return
 }
 
-// RecvMessages retrieves all messages since last call of this function
+// SetProtocolPriority sets the default priority of messages created for the given protocol with
+// NewMessage or NewReply. Protocol behaviors use it for all messages they send
+func (acl *ACL) SetProtocolPriority(prot int, priority int) {
+	acl.mutex.Lock()
+	acl.protPriority[prot] = priority
+	acl.mutex.Unlock()
+}
+
+// RecvMessages retrieves all messages since last call of this function. Messages with higher
+// priority are returned first
 func (acl *ACL) RecvMessages() (num int, msgs []schemas.ACLMessage, err error) {
 	acl.mutex.Lock()
 	if !acl.active {
@@ -138,38 +197,146 @@ func (acl *ACL) RecvMessages() (num int, msgs []schemas.ACLMessage, err error) {
 		err = errors.New("acl not active")
 		return
 	}
+	msgs = acl.msgPending
+	acl.msgPending = nil
+	acl.notifyPending()
 	acl.mutex.Unlock()
-	num = 0
+	num = len(msgs)
 	err = nil
 	for {
-		select {
-		case msgtemp := <-acl.msgIn:
-			msgs = append(msgs, msgtemp)
-			num++
-		default:
+		msgtemp, ok := acl.msgIn.tryGet()
+		if !ok {
 			return
 		}
+		msgs = append(msgs, msgtemp)
+		num++
 	}
 }
 
-// RecvMessageWait retrieves next message and blocks if no message is available
+// RecvMessageWait retrieves next message and blocks if no message is available. An error is
+// returned if the agent is terminated while waiting
 func (acl *ACL) RecvMessageWait() (msg schemas.ACLMessage, err error) {
-	acl.mutex.Lock()
-	if !acl.active {
+	msg, err = acl.RecvMessageWaitContext(context.Background())
+	return
+}
+
+// RecvMessageWaitContext retrieves next message and blocks until a message is available, ctx is
+// done or the agent is terminated
+func (acl *ACL) RecvMessageWaitContext(ctx context.Context) (msg schemas.ACLMessage, err error) {
+	for {
+		acl.mutex.Lock()
+		if !acl.active {
+			acl.mutex.Unlock()
+			err = errors.New("acl not active")
+			return
+		}
+		if len(acl.msgPending) > 0 {
+			msg = acl.msgPending[0]
+			acl.msgPending = acl.msgPending[1:]
+			acl.notifyPending()
+			acl.mutex.Unlock()
+			return
+		}
+		pending := acl.pendingChange()
 		acl.mutex.Unlock()
-		err = errors.New("acl not active")
-		return
+		var ok bool
+		msg, ok = acl.msgIn.tryGet()
+		if ok {
+			return
+		}
+		select {
+		case <-acl.msgIn.ready():
+		case <-pending:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-acl.ctx.Done():
+			err = errors.New("acl not active")
+			return
+		}
+	}
+}
+
+// RecvMessageMatch retrieves the first message that matches and blocks until such a message is
+// available or timeout has expired. Messages that do not match stay in the inbox in the order
+// of their arrival. A timeout of zero means that no timeout is used
+func (acl *ACL) RecvMessageMatch(match MessageMatcher,
+	timeout time.Duration) (msg schemas.ACLMessage, err error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	msg, err = acl.RecvMessageMatchContext(ctx, match)
+	if err == context.DeadlineExceeded {
+		err = errors.New("no matching message received before timeout")
 	}
-	acl.mutex.Unlock()
-	err = nil
-	msg = <-acl.msgIn
 	return
 }
 
+// RecvMessageMatchContext retrieves the first message that matches and blocks until such a
+// message is available, ctx is done or the agent is terminated. Messages that do not match stay
+// in the inbox in the order of their arrival
+func (acl *ACL) RecvMessageMatchContext(ctx context.Context,
+	match MessageMatcher) (msg schemas.ACLMessage, err error) {
+	for {
+		acl.mutex.Lock()
+		if !acl.active {
+			acl.mutex.Unlock()
+			err = errors.New("acl not active")
+			return
+		}
+		for i := range acl.msgPending {
+			if match(acl.msgPending[i]) {
+				msg = acl.msgPending[i]
+				acl.msgPending = append(acl.msgPending[:i], acl.msgPending[i+1:]...)
+				acl.notifyPending()
+				acl.mutex.Unlock()
+				return
+			}
+		}
+		pending := acl.pendingChange()
+		ready := acl.msgIn.ready()
+		if acl.pendingFull() {
+			// wait for other receivers to take pending messages
+			ready = nil
+		}
+		acl.mutex.Unlock()
+		if ready != nil {
+			var ok bool
+			msg, ok = acl.msgIn.tryGet()
+			if ok {
+				if match(msg) {
+					return
+				}
+				acl.addPending(msg)
+				continue
+			}
+		}
+		select {
+		case <-ready:
+		case <-pending:
+		case <-ctx.Done():
+			msg = schemas.ACLMessage{}
+			err = ctx.Err()
+			return
+		case <-acl.ctx.Done():
+			msg = schemas.ACLMessage{}
+			err = errors.New("acl not active")
+			return
+		}
+	}
+}
+
 // SendMessage sends a message
 func (acl *ACL) SendMessage(msg schemas.ACLMessage) (err error) {
-	var aclRecv *ACL
-	var ok bool
+	err = acl.send(msg, acl.deliverMessage)
+	return
+}
+
+// send injects faults into msg and hands it over to deliver
+func (acl *ACL) send(msg schemas.ACLMessage, deliver func(schemas.ACLMessage) error) (err error) {
 	msg.Timestamp = time.Now()
 
 	acl.mutex.Lock()
@@ -179,11 +346,36 @@ func (acl *ACL) SendMessage(msg schemas.ACLMessage) (err error) {
 	}
 
 	msg.Sender = acl.agentID
-	aclRecv, ok = acl.addrBook[msg.Receiver]
+	acl.mutex.Unlock()
+	span := traceMessage(acl.tracer, &msg, "ACL send", schemas.SpanKindProducer, acl.agentID)
+	defer func() {
+		acl.tracer.End(span, err)
+		acl.metrics.msgSent(msg, err)
+	}()
+	// messages held back or delayed by fault injection are in transit until handed over
+	acl.cosim.countPending(1)
+	err = acl.faults.send(msg, deliver, func() { acl.cosim.countPending(-1) })
+	if err != nil {
+		return
+	}
+	err = acl.logger.NewLog("msg", "ACL send", msg.String())
+	// acl.mutex.Lock()
+	// if acl.analysis {
+	// 	acl.commOut <- msg.Receiver
+	// }
+	// acl.mutex.Unlock()
+	return
+}
+
+// deliverMessage hands msg over to the ACL of the receiver. The address book is updated if
+// the receiver is unknown or has moved
+func (acl *ACL) deliverMessage(msg schemas.ACLMessage) (err error) {
+	acl.mutex.Lock()
+	aclRecv, ok := acl.addrBook[msg.Receiver]
 	acl.mutex.Unlock()
 	if ok {
 		err = aclRecv.newIncomingMessage(msg)
-		if err != nil {
+		if err != nil && err != ErrInboxFull {
 			acl.mutex.Lock()
 			delete(acl.addrBook, msg.Receiver)
 			acl.mutex.Unlock()
@@ -206,36 +398,247 @@ func (acl *ACL) SendMessage(msg schemas.ACLMessage) (err error) {
 		acl.mutex.Unlock()
 		err = aclRecv.newIncomingMessage(msg)
 	}
+	return
+}
+
+// SendMessageToType sends a copy of msg to all agents of the MAS with the given type. If
+// aSubtype is not empty, only agents with this subtype are addressed. The number of agents the
+// message has been sent to is returned
+func (acl *ACL) SendMessageToType(msg schemas.ACLMessage, aType string,
+	aSubtype string) (num int, err error) {
+	num, err = acl.sendMulticast(msg, func(info schemas.AgentInfo) bool {
+		return info.Spec.AType == aType && (aSubtype == "" || info.Spec.ASubtype == aSubtype)
+	})
+	return
+}
+
+// SendMessageToGroup sends a copy of msg to all members of the named group
+func (acl *ACL) SendMessageToGroup(msg schemas.ACLMessage, group string) (num int, err error) {
+	num, err = acl.sendMulticast(msg, func(info schemas.AgentInfo) bool {
+		for i := range info.Spec.Groups {
+			if info.Spec.Groups[i] == group {
+				return true
+			}
+		}
+		return false
+	})
+	return
+}
+
+// SendMessageToNode sends a copy of msg to all agents attached to the given graph node
+func (acl *ACL) SendMessageToNode(msg schemas.ACLMessage, nodeID int) (num int, err error) {
+	num, err = acl.sendMulticast(msg, func(info schemas.AgentInfo) bool {
+		return info.Spec.NodeID == nodeID
+	})
+	return
+}
+
+// SendMessageBroadcast sends a copy of msg to all other agents of the MAS
+func (acl *ACL) SendMessageBroadcast(msg schemas.ACLMessage) (num int, err error) {
+	num, err = acl.sendMulticast(msg, func(info schemas.AgentInfo) bool {
+		return true
+	})
+	return
+}
+
+// sendMulticast sends a copy of msg to all agents that match. The sending agent is excluded.
+// The copies to agents of the same remote agency are sent in one batch
+func (acl *ACL) sendMulticast(msg schemas.ACLMessage,
+	match func(schemas.AgentInfo) bool) (num int, err error) {
+	if acl.groupLookup == nil {
+		err = errors.New("group messaging not available")
+		return
+	}
+	var receivers []int
+	receivers, err = acl.groupLookup(match)
 	if err != nil {
 		return
 	}
-	err = acl.logger.NewLog("msg", "ACL send", msg.String())
-	// acl.mutex.Lock()
-	// if acl.analysis {
-	// 	acl.commOut <- msg.Receiver
-	// }
-	// acl.mutex.Unlock()
+	batch := &multicastBatch{
+		acl:    acl,
+		mutex:  &sync.Mutex{},
+		groups: make(map[chan []schemas.ACLMessage]*batchGroup),
+	}
+	for _, id := range receivers {
+		if id == acl.agentID {
+			continue
+		}
+		msg.Receiver = id
+		errSend := acl.send(msg, batch.add)
+		if errSend != nil {
+			// continue with the remaining receivers and report the first error
+			if err == nil {
+				err = errSend
+			}
+			continue
+		}
+		num++
+	}
+	failed, errBatch := batch.flush()
+	num -= failed
+	if err == nil {
+		err = errBatch
+	}
 	return
 }
 
-// newIncomingMessage adds message to channel for incoming messages
+// multicastBatch collects the copies of a multicast message per remote agency
+type multicastBatch struct {
+	acl     *ACL
+	mutex   *sync.Mutex
+	flushed bool                                      // copies are delivered directly afterwards
+	groups  map[chan []schemas.ACLMessage]*batchGroup // copies per remote agency
+}
+
+// batchGroup holds the copies of a multicast message to one remote agency
+type batchGroup struct {
+	acl  *ACL // ACL of one of the receivers
+	msgs []schemas.ACLMessage
+}
+
+// add collects msg if the receiver is an agent of a remote agency and delivers it directly
+// otherwise. Copies delayed by fault injection are delivered directly after the flush
+func (batch *multicastBatch) add(msg schemas.ACLMessage) (err error) {
+	aclRecv, err := batch.acl.receiverACL(msg.Receiver)
+	if err != nil {
+		return
+	}
+	batch.mutex.Lock()
+	if aclRecv.batchOut == nil || batch.flushed {
+		batch.mutex.Unlock()
+		err = batch.acl.deliverMessage(msg)
+		return
+	}
+	group, ok := batch.groups[aclRecv.batchOut]
+	if !ok {
+		group = &batchGroup{acl: aclRecv}
+		batch.groups[aclRecv.batchOut] = group
+	}
+	group.msgs = append(group.msgs, msg)
+	batch.mutex.Unlock()
+	return
+}
+
+// flush sends the collected copies with one batch per remote agency. The number of copies
+// that could not be sent and the first error are returned
+func (batch *multicastBatch) flush() (failed int, err error) {
+	batch.mutex.Lock()
+	batch.flushed = true
+	groups := batch.groups
+	batch.groups = nil
+	batch.mutex.Unlock()
+	for _, group := range groups {
+		errGroup := group.acl.receiveBatch(group.msgs)
+		if errGroup != nil {
+			failed += len(group.msgs)
+			if err == nil {
+				err = errGroup
+			}
+		}
+	}
+	return
+}
+
+// receiverACL returns the ACL of the receiver from the address book and requests it otherwise
+func (acl *ACL) receiverACL(agentID int) (aclRecv *ACL, err error) {
+	acl.mutex.Lock()
+	aclRecv, ok := acl.addrBook[agentID]
+	acl.mutex.Unlock()
+	if ok {
+		return
+	}
+	aclRecv, err = acl.aclLookup(agentID)
+	if err != nil {
+		return
+	}
+	acl.mutex.Lock()
+	acl.addrBook[agentID] = aclRecv
+	acl.mutex.Unlock()
+	return
+}
+
+// receiveBatch hands msgs over to the remote agency of this ACL as one batch
+func (acl *ACL) receiveBatch(msgs []schemas.ACLMessage) (err error) {
+	acl.mutex.Lock()
+	if !acl.active {
+		acl.mutex.Unlock()
+		err = errors.New("acl not active")
+		return
+	}
+	acl.mutex.Unlock()
+	spans := make([]*schemas.Span, len(msgs))
+	for i := range msgs {
+		spans[i] = traceMessage(acl.tracer, &msgs[i], "ACL receive", schemas.SpanKindConsumer,
+			acl.agentID)
+	}
+	acl.transit.countSent(len(msgs))
+	acl.batchOut <- msgs
+	for i := range msgs {
+		acl.metrics.msgReceived(msgs[i])
+	}
+	endSpans(acl.tracer, spans)
+	return
+}
+
+// newIncomingMessage adds message to channel for incoming messages. If the inbox is full, the
+// overflow policy is applied
 func (acl *ACL) newIncomingMessage(msg schemas.ACLMessage) (err error) {
+	_, err = acl.receive(msg, true)
+	return
+}
+
+// receive adds message to the respective inbox. If the inbox is full and the block policy is
+// used, receive waits for space in the inbox if block is true and returns false otherwise
+func (acl *ACL) receive(msg schemas.ACLMessage, block bool) (delivered bool, err error) {
 	acl.mutex.Lock()
 	if !acl.active {
 		acl.mutex.Unlock()
-		return errors.New("acl not active")
+		err = errors.New("acl not active")
+		return
+	}
+	span := traceMessage(acl.tracer, &msg, "ACL receive", schemas.SpanKindConsumer, acl.agentID)
+	acl.transit.countSent(1)
+	defer func() {
+		if !delivered {
+			acl.transit.countLost(1)
+		}
+		if delivered || err != nil {
+			acl.tracer.End(span, err)
+		}
+		if delivered {
+			acl.metrics.msgReceived(msg)
+			if acl.observe != nil {
+				acl.observe(msg)
+			}
+		}
+	}()
+	if acl.suspended {
+		acl.msgSuspended = append(acl.msgSuspended, msg)
+		acl.mutex.Unlock()
+		delivered = true
+		err = acl.logger.NewLog("msg", "ACL receive while suspended", msg.String())
+		return
 	}
 	acl.mutex.Unlock()
+	delivered, err = acl.route(msg, block)
+	return
+}
+
+// route adds message to the inbox of the conversation or protocol behavior it belongs to or to
+// the agent inbox otherwise
+func (acl *ACL) route(msg schemas.ACLMessage, block bool) (delivered bool, err error) {
 	acl.logInfo.Println("New message for agent ", msg.Receiver)
 	acl.mutex.Lock()
-	inbox, ok := acl.msgInProtocol[msg.Protocol]
+	// only replies to open conversations are diverted
+	inbox, ok := acl.msgInConv[msg.InReplyTo]
+	if !ok {
+		inbox, ok = acl.msgInProtocol[msg.Protocol]
+	}
 	acl.mutex.Unlock()
-	if ok {
-		inbox <- msg
-	} else {
-		acl.msgIn <- msg
+	if !ok {
+		inbox = acl.msgIn
 	}
-	err = acl.logger.NewLog("msg", "ACL receive", msg.String())
+	delivered, err = acl.enqueue(inbox, msg, block)
 	// acl.mutex.Lock()
 	// if acl.analysis {
 	// 	acl.commIn <- msg.Sender
@@ -244,16 +647,111 @@ func (acl *ACL) newIncomingMessage(msg schemas.ACLMessage) (err error) {
 	return
 }
 
-// registerProtocolChannel registers the protocol channel with the messaging service
-func (acl *ACL) registerProtocolChannel(prot int,
-	protChannel chan schemas.ACLMessage) (err error) {
+// suspend buffers all incoming messages until resume is called
+func (acl *ACL) suspend() (err error) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	if !acl.active {
+		err = errors.New("acl not active")
+		return
+	}
+	acl.suspended = true
+	acl.suspendCount++
+	return
+}
+
+// resume delivers the messages buffered while suspended in the order of their arrival and stops
+// buffering afterwards. The delivery is aborted if the agent is suspended again in the meantime
+func (acl *ACL) resume() (err error) {
 	acl.mutex.Lock()
 	if !acl.active {
 		acl.mutex.Unlock()
+		err = errors.New("acl not active")
+		return
+	}
+	count := acl.suspendCount
+	acl.mutex.Unlock()
+	go func() {
+		for {
+			acl.mutex.Lock()
+			if acl.suspendCount != count {
+				// the remaining messages are delivered by the next resume
+				acl.mutex.Unlock()
+				return
+			}
+			msgs := acl.msgSuspended
+			acl.msgSuspended = nil
+			if len(msgs) == 0 || !acl.active {
+				acl.suspended = false
+				acl.mutex.Unlock()
+				return
+			}
+			acl.mutex.Unlock()
+			for i := range msgs {
+				_, errRoute := acl.route(msgs[i], true)
+				if errRoute != nil {
+					acl.logError.Println("Delivery of buffered message to agent ", acl.agentID,
+						" failed: ", errRoute)
+				}
+			}
+		}
+	}()
+	return
+}
+
+// takeMessages removes and returns all messages that have been received but not yet been taken
+// by the agent
+func (acl *ACL) takeMessages() (msgs []schemas.ACLMessage) {
+	acl.mutex.Lock()
+	msgs = acl.msgPending
+	acl.msgPending = nil
+	acl.notifyPending()
+	acl.mutex.Unlock()
+	for {
+		msg, ok := acl.msgIn.tryGet()
+		if !ok {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	acl.mutex.Lock()
+	protQueues := make([]*msgQueue, 0, len(acl.msgInProtocol))
+	for _, q := range acl.msgInProtocol {
+		protQueues = append(protQueues, q)
+	}
+	acl.mutex.Unlock()
+	for i := range protQueues {
+		for {
+			msg, ok := protQueues[i].tryGet()
+			if !ok {
+				break
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	acl.mutex.Lock()
+	msgs = append(msgs, acl.msgSuspended...)
+	acl.msgSuspended = nil
+	acl.mutex.Unlock()
+	return
+}
+
+// restoreMessages puts messages taken from the agent back in front of the messages buffered
+// while suspended
+func (acl *ACL) restoreMessages(msgs []schemas.ACLMessage) {
+	acl.mutex.Lock()
+	acl.msgSuspended = append(append([]schemas.ACLMessage{}, msgs...), acl.msgSuspended...)
+	acl.mutex.Unlock()
+}
+
+// registerProtocolChannel registers the protocol channel with the messaging service
+func (acl *ACL) registerProtocolChannel(prot int, protChannel *msgQueue) (err error) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	if !acl.active {
 		return errors.New("acl not active")
 	}
 	_, ok := acl.msgInProtocol[prot]
-	acl.mutex.Unlock()
 	if !ok {
 		acl.msgInProtocol[prot] = protChannel
 	} else {
@@ -265,8 +763,8 @@ func (acl *ACL) registerProtocolChannel(prot int,
 // deregisterProtocolChannel deregisters the protocol channel with the messaging service
 func (acl *ACL) deregisterProtocolChannel(prot int) (err error) {
 	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
 	_, ok := acl.msgInProtocol[prot]
-	acl.mutex.Unlock()
 	if ok {
 		delete(acl.msgInProtocol, prot)
 	} else {
@@ -274,3 +772,18 @@ func (acl *ACL) deregisterProtocolChannel(prot int) (err error) {
 	}
 	return
 }
+
+// rerouteMessages routes the messages left in the inbox of a finished protocol behavior to the
+// protocol behavior registered next or to the agent inbox
+func (acl *ACL) rerouteMessages(protChannel *msgQueue) {
+	for {
+		msg, ok := protChannel.tryGet()
+		if !ok {
+			return
+		}
+		_, err := acl.route(msg, true)
+		if err != nil {
+			acl.logError.Println("Rerouting of message to agent ", acl.agentID, " failed: ", err)
+		}
+	}
+}
@@ -50,6 +50,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -59,6 +60,8 @@ import (
 	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/common/tracing"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 	"github.com/RWTH-ACS/clonemap/pkg/status"
 )
@@ -69,38 +72,74 @@ type Agency struct {
 	loggerConfig schemas.LoggerConfig
 	dfConfig     schemas.DFConfig
 	mqttConfig   schemas.MQTTConfig
+	gwConfig     schemas.GatewayConfig
 	masName      string
 	masCustom    string
 	// agents    []schemas.AgentInfo // list of agents in agency
-	localAgents    map[int]*Agent
-	remoteAgents   map[int]*Agent
-	remoteAgencies map[string]*remoteAgency
-	mutex          *sync.Mutex // mutex to protect agents from concurrent reads and writes
-	agentTask      func(*Agent) error
-	msgIn          chan []schemas.ACLMessage
-	logCollector   *client.LogCollector
-	mqttCollector  *mqttCollector
-	dfClient       *client.DFClient
-	amsClient      *client.AMSClient
-	agencyClient   *client.AgencyClient
-	logInfo        *log.Logger // logger for info logging
-	logError       *log.Logger // logger for error logging
-	errChan        chan error
+	localAgents     map[int]*Agent
+	remoteAgents    map[int]*Agent
+	remoteAgencies  map[string]*remoteAgency
+	agentList       []schemas.AgentInfo          // cached agent list of the MAS for group lookups
+	agentListUpdate time.Time                    // time of the last agent list request
+	deadLetters     []deadLetter                 // messages that could not be delivered
+	deadLetterRevs  map[int]int                  // revisions of the persisted dead letters per agent
+	deadLetterDirty map[int]bool                 // agents with a running flush; true if dead letters are unstored
+	deadLetterMutex *sync.Mutex                  // serializes persisting of dead letters
+	retryQueues     map[int][]schemas.ACLMessage // messages waiting for redelivery per receiver
+	migrations      map[int]string               // IDs of the migrations local agents have been received with
+	msgStreams      bool                         // indicates if message streams are used for sending
+	msgMaxSize      int                          // maximum size of received message batches in bytes
+	streamSessions  map[string]streamSession     // last batches received via streams per agency
+	mutex           *sync.Mutex                  // mutex to protect agents from concurrent reads and writes
+	agentTask       func(*Agent) error
+	msgIn           chan []schemas.ACLMessage
+	logCollector    *client.LogCollector
+	mqttCollector   *mqttCollector
+	dfClient        *client.DFClient
+	codecs          *codecRegistry  // content codecs shared by all local agents
+	tracer          *tracing.Tracer // records spans of message exchanges; nil if inactive
+	metrics         *agencyMetrics  // statistics exposed via /metrics
+	faults          *faultInjector  // faults injected into the message path
+	cosim           *cosim          // state of the co-simulation; nil if not active
+	amsClient       *client.AMSClient
+	agencyClient    *client.AgencyClient
+	transport       http.RoundTripper            // transport of requests to other modules; default if nil
+	resolve         func(string) (string, error) // resolves the name of a remote agency
+	logInterval     time.Duration                // maximum time logs are collected before they are sent
+	onDeliver       func(schemas.ACLMessage)     // called for every message delivered to a local agent
+	stop            chan struct{}                // closed when the agency is stopped
+	logInfo         *log.Logger                  // logger for info logging
+	logError        *log.Logger                  // logger for error logging
+}
+
+// LocalConfig is the configuration of an agency started within the process of its caller
+type LocalConfig struct {
+	Name      string                   // hostname of the agency: mas-{id}-im-{id}-agency-{id}
+	Transport http.RoundTripper        // transport of requests to other modules
+	OnDeliver func(schemas.ACLMessage) // called for every message delivered to a local agent; optional
+	LogError  *log.Logger
+	LogInfo   *log.Logger
 }
 
 // StartAgency is the entrance function of agency
 func StartAgency(task func(*Agent) error) (err error) {
 	agency := &Agency{
-		mutex:          &sync.Mutex{},
-		agentTask:      task,
-		localAgents:    make(map[int]*Agent),
-		remoteAgents:   make(map[int]*Agent),
-		remoteAgencies: make(map[string]*remoteAgency),
-		msgIn:          make(chan []schemas.ACLMessage, 1000),
-		amsClient:      client.NewAMSClient(time.Second*60, time.Second*1, 4),
-		agencyClient:   client.NewAgencyClient(time.Second*60, time.Second*1, 4),
-		logError:       log.New(os.Stderr, "[ERROR] ", log.LstdFlags),
-		errChan:        make(chan error),
+		mutex:           &sync.Mutex{},
+		deadLetterMutex: &sync.Mutex{},
+		agentTask:       task,
+		localAgents:     make(map[int]*Agent),
+		remoteAgents:    make(map[int]*Agent),
+		remoteAgencies:  make(map[string]*remoteAgency),
+		streamSessions:  make(map[string]streamSession),
+		msgIn:           make(chan []schemas.ACLMessage, 1000),
+		codecs:          newCodecRegistry(),
+		metrics:         newAgencyMetrics(),
+		amsClient:       client.NewAMSClient(time.Second*60, time.Second*1, 4),
+		agencyClient:    client.NewAgencyClient(time.Second*60, time.Second*1, 4),
+		resolve:         getIP,
+		logInterval:     time.Second * 15,
+		stop:            make(chan struct{}),
+		logError:        log.New(os.Stderr, "[ERROR] ", log.LstdFlags),
 	}
 	err = agency.init()
 	if err != nil {
@@ -128,6 +167,67 @@ func StartAgency(task func(*Agent) error) (err error) {
 	return
 }
 
+// NewLocalAgency creates an agency that runs within the process of its caller. Requests to other
+// modules are sent via the transport of config. Agents are started with task after the agency has
+// received its configuration from the AMS. The agency does not listen on a port, requests have to
+// be served with Handler
+func NewLocalAgency(config LocalConfig, task func(*Agent) error) (agency *Agency, err error) {
+	agency = &Agency{
+		mutex:           &sync.Mutex{},
+		deadLetterMutex: &sync.Mutex{},
+		agentTask:       task,
+		localAgents:     make(map[int]*Agent),
+		remoteAgents:    make(map[int]*Agent),
+		remoteAgencies:  make(map[string]*remoteAgency),
+		streamSessions:  make(map[string]streamSession),
+		msgIn:           make(chan []schemas.ACLMessage, 1000),
+		codecs:          newCodecRegistry(),
+		metrics:         newAgencyMetrics(),
+		amsClient:       client.NewAMSClient(time.Second*10, time.Millisecond*100, 4),
+		agencyClient:    client.NewAgencyClient(time.Second*10, time.Millisecond*100, 4),
+		transport:       config.Transport,
+		resolve:         func(name string) (string, error) { return name, nil },
+		logInterval:     time.Millisecond * 100,
+		onDeliver:       config.OnDeliver,
+		stop:            make(chan struct{}),
+		logError:        config.LogError,
+		logInfo:         config.LogInfo,
+	}
+	agency.amsClient.SetTransport(config.Transport)
+	agency.agencyClient.SetTransport(config.Transport)
+	agency.agencyClient.Encoding = aclwire.ContentTypeProtobuf
+	err = agency.setup(config.Name)
+	if err != nil {
+		return
+	}
+	go agency.receiveMsgs()
+	return
+}
+
+// Handler returns the http handler serving the API of the agency
+func (agency *Agency) Handler() (handler http.Handler) {
+	handler = agency.server(10000).Handler
+	return
+}
+
+// Stop terminates all local agents as well as the log, mqtt and trace collectors of the agency
+func (agency *Agency) Stop() {
+	agency.mutex.Lock()
+	select {
+	case <-agency.stop:
+		agency.mutex.Unlock()
+		return
+	default:
+		close(agency.stop)
+	}
+	for i := range agency.localAgents {
+		agency.localAgents[i].Terminate()
+	}
+	agency.mutex.Unlock()
+	agency.mqttCollector.close()
+	agency.tracer.Close()
+}
+
 // init determines the ID of agency from the container hostname and address suffix from env
 func (agency *Agency) init() (err error) {
 	logType := os.Getenv("CLONEMAP_LOG_LEVEL")
@@ -140,6 +240,35 @@ func (agency *Agency) init() (err error) {
 		err = errors.New("Wrong log type: " + logType)
 		return
 	}
+	// encoding of messages sent to other agencies
+	switch os.Getenv("CLONEMAP_MSG_ENCODING") {
+	case "json":
+		agency.agencyClient.Encoding = aclwire.ContentTypeJSON
+	case "protobuf", "":
+		agency.agencyClient.Encoding = aclwire.ContentTypeProtobuf
+	default:
+		err = errors.New("Wrong message encoding: " + os.Getenv("CLONEMAP_MSG_ENCODING"))
+		return
+	}
+	agency.agencyClient.Compression = os.Getenv("CLONEMAP_MSG_COMPRESSION") == "true"
+	// maximum size of message batches received from other agencies
+	if size := os.Getenv("CLONEMAP_MSG_MAX_SIZE"); size != "" {
+		agency.msgMaxSize, err = strconv.Atoi(size)
+		if err != nil || agency.msgMaxSize <= 0 {
+			err = errors.New("Wrong maximum message size: " + size)
+			return
+		}
+	}
+	// transport of messages sent to other agencies; http is used as fallback for streams
+	switch os.Getenv("CLONEMAP_MSG_TRANSPORT") {
+	case "stream", "":
+		agency.msgStreams = true
+	case "http":
+		agency.msgStreams = false
+	default:
+		err = errors.New("Wrong message transport: " + os.Getenv("CLONEMAP_MSG_TRANSPORT"))
+		return
+	}
 	// agency ID is extracted from hostname mas-{id}-agency-{id}
 	//fmt.Println("Getting hostname")
 	var temp string
@@ -147,6 +276,13 @@ func (agency *Agency) init() (err error) {
 	if err != nil {
 		return
 	}
+	err = agency.setup(temp)
+	return
+}
+
+// setup extracts the IDs of the agency from its hostname temp, requests the configuration from the
+// AMS and starts the agents
+func (agency *Agency) setup(temp string) (err error) {
 	agency.logInfo.Println("Starting agency ", temp)
 	hostname := strings.Split(temp, "-")
 	agency.mutex.Lock()
@@ -182,6 +318,7 @@ func (agency *Agency) init() (err error) {
 	agency.loggerConfig = agencyInfoFull.Logger
 	agency.dfConfig = agencyInfoFull.DF
 	agency.mqttConfig = agencyInfoFull.MQTT
+	agency.gwConfig = agencyInfoFull.Gateway
 	agency.masName = agencyInfoFull.MASName
 	agency.masCustom = agencyInfoFull.MASCustom
 	agency.mutex.Unlock()
@@ -194,13 +331,30 @@ func (agency *Agency) init() (err error) {
 	}
 
 	agency.mutex.Lock()
-	agency.logCollector = client.NewLogCollector(agency.info.MASID, agency.loggerConfig,
-		agency.logError, agency.logInfo)
+	var logClient *client.LoggerClient
+	if agency.loggerConfig.Active {
+		logClient = client.NewLoggerClient(agency.loggerConfig.Host, agency.loggerConfig.Port,
+			time.Second*60, time.Second*1, 4)
+		logClient.SetTransport(agency.transport)
+	}
+	agency.logCollector = client.NewLogCollectorClient(agency.info.MASID, agency.loggerConfig,
+		logClient, agency.logInterval, agency.logError, agency.logInfo)
 	agency.dfClient = client.NewDFClient(agency.dfConfig.Host, agency.dfConfig.Port,
 		time.Second*60, time.Second*1, 4)
+	agency.dfClient.SetTransport(agency.transport)
+	agency.dfClient.Observer = agency.metrics.observeDF
 	agency.mqttCollector = newMQTTCollector(agency.mqttConfig, agency.info.Name, agency.logError,
 		agency.logInfo)
+	agency.mqttCollector.metrics = agency.metrics
+	agency.tracer = agency.newTracer(agencyInfoFull.Tracing)
+	agency.faults = newFaultInjector(agency.info.Name, agency.logError, agency.logInfo)
+	agency.cosim = newCosim(agency.info.Name, agencyInfoFull.Cosim, agency.logError,
+		agency.logInfo)
 	agency.mutex.Unlock()
+	err = agency.faults.setConfig(agencyInfoFull.Faults)
+	if err != nil {
+		return
+	}
 
 	go agency.startAgents(agencyInfoFull)
 	return
@@ -209,19 +363,10 @@ func (agency *Agency) init() (err error) {
 // terminate takes care of terminating all parts of the Agency before exiting. It is to be called as a
 // goroutine and waits until an OS signal is inserted into the channel gracefulStop
 func (agency *Agency) terminate(gracefulStop chan os.Signal) {
-	select {
-	case err := <-agency.errChan:
-		agency.logError.Println("Caught error: ", err.Error())
-	case sig := <-gracefulStop:
-		agency.logInfo.Println("Caught signal: ", sig.String())
-	}
+	sig := <-gracefulStop
+	agency.logInfo.Println("Caught signal: ", sig.String())
 	agency.logInfo.Println("Terminating agency")
-	agency.mutex.Lock()
-	for i := range agency.localAgents {
-		agency.localAgents[i].Terminate()
-	}
-	agency.mutex.Unlock()
-	agency.mqttCollector.close()
+	agency.Stop()
 	time.Sleep(time.Second * 2)
 	os.Exit(0)
 }
@@ -229,6 +374,7 @@ func (agency *Agency) terminate(gracefulStop chan os.Signal) {
 // startAgents starts all the agents
 func (agency *Agency) startAgents(agencyInfoFull schemas.AgencyInfoFull) (err error) {
 	agency.logInfo.Println("Starting agents")
+	agency.loadDeadLetters(agencyInfoFull.Agents)
 	for i := 0; i < len(agencyInfoFull.Agents); i++ {
 		err = agency.createAgent(agencyInfoFull.Agents[i])
 		if err != nil {
@@ -241,6 +387,7 @@ func (agency *Agency) startAgents(agencyInfoFull schemas.AgencyInfoFull) (err er
 			return
 		}
 	}
+	agency.cosim.setStarted()
 	return
 }
 
@@ -256,20 +403,263 @@ func (agency *Agency) createAgent(agentInfo schemas.AgentInfo) (err error) {
 	}
 	// allocate port for agent
 	agentInfo.Status.Code = status.Starting
-	msgIn := make(chan schemas.ACLMessage, 1000)
+	ag := agency.newLocalAgent(agentInfo)
 	agency.mutex.Lock()
-	ag := newAgent(agentInfo, agency.masName, agency.masCustom, msgIn, agency.aclLookup,
-		agency.logCollector, agency.loggerConfig, agency.mqttCollector, agency.dfConfig.Active,
-		agency.dfClient, agency.logError, agency.logInfo)
 	agency.localAgents[agentInfo.ID] = ag
 	agency.mutex.Unlock()
-	ag.startAgent(agency.agentTask, agency.errChan)
+	ag.startAgent(agency.agentTask, agency.superviseAgent)
+	return
+}
+
+// newLocalAgent creates a new agent object for agentInfo
+func (agency *Agency) newLocalAgent(agentInfo schemas.AgentInfo) (ag *Agent) {
+	msgIn, inboxPolicy, inboxErr := newInbox(agentInfo.Spec.Inbox)
+	if inboxErr != nil {
+		agency.logError.Println("Agent ", agentInfo.ID, ": ", inboxErr)
+	}
+	agency.mutex.Lock()
+	ag = newAgent(agentInfo, agency.masName, agency.masCustom, msgIn, inboxPolicy,
+		agency.aclLookup, agency.groupLookup, agency.logCollector, agency.loggerConfig,
+		agency.mqttCollector, agency.dfConfig.Active, agency.dfClient, agency.logError,
+		agency.logInfo)
+	if agency.codecs != nil {
+		ag.ACL.codecs = agency.codecs
+	}
+	ag.ACL.tracer = agency.tracer
+	ag.ACL.metrics = agency.metrics
+	ag.ACL.faults = agency.faults
+	ag.ACL.cosim = agency.cosim
+	ag.ACL.observe = agency.onDeliver
+	ag.cosim = agency.cosim
+	agency.mutex.Unlock()
 	return
 }
 
 // getAgentStatus returns status of agent
 func (agency *Agency) getAgentStatus(agentID int) (ret schemas.Status, err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[agentID]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	ret = ag.getStatus()
+	return
+}
+
+// suspendAgent pauses the behaviors of the agent with the given ID and buffers its incoming
+// messages
+func (agency *Agency) suspendAgent(agentID int) (err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[agentID]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	err = ag.suspend()
+	return
+}
+
+// resumeAgent resumes the suspended agent with the given ID
+func (agency *Agency) resumeAgent(agentID int) (err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[agentID]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	err = ag.resume()
+	return
+}
+
+// restartAgent terminates the agent with the given ID and executes the agent task again with
+// the current spec of the agent. The ID is kept and messages that have not been taken by the
+// agent are handed over to the new instance
+func (agency *Agency) restartAgent(agentID int) (err error) {
+	agency.mutex.Lock()
+	oldAg, ok := agency.localAgents[agentID]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	agency.logInfo.Println("Restarting agent ", agentID)
+	_, err = agency.replaceAgent(oldAg, oldAg.getAgentInfo())
+	return
+}
+
+// replaceAgent terminates a local agent and executes the agent task for a new instance created
+// from agentInfo. Messages that have not been taken by the old instance are handed over to the
+// new one
+func (agency *Agency) replaceAgent(oldAg *Agent, agentInfo schemas.AgentInfo) (ag *Agent,
+	err error) {
+	agentID := oldAg.GetAgentID()
+	agentInfo.Status.Code = status.Starting
+	ag = agency.newLocalAgent(agentInfo)
+	agency.mutex.Lock()
+	if agency.localAgents[agentID] != oldAg {
+		agency.mutex.Unlock()
+		ag.Terminate()
+		ag = nil
+		err = errors.New("NotFoundError")
+		return
+	}
+	agency.localAgents[agentID] = ag
+	agency.mutex.Unlock()
+	oldAg.Terminate()
+	msgs := oldAg.ACL.takeMessages()
+	for i := range msgs {
+		err = ag.ACL.deliver(msgs[i])
+		if err != nil {
+			agency.logError.Println("Handover of message to restarted agent ", agentID,
+				" failed: ", err)
+		}
+	}
+	err = ag.startAgent(agency.agentTask, agency.superviseAgent)
+	return
+}
+
+// migrateAgent moves the agent with the given ID to the target agency. The agent is suspended
+// and its info, last saved state and all messages not yet taken are handed over to the target
+// agency. Afterwards messages for the agent are forwarded to the target agency. Senders in other
+// agencies learn about the new address when their messages are returned as undeliverable
+func (agency *Agency) migrateAgent(agentID int, target string) (err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[agentID]
+	agencyName := agency.info.Name
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	if target == "" || target == agencyName {
+		err = errors.New("invalid target agency")
+		return
+	}
+	agency.logInfo.Println("Migrating agent ", agentID, " to agency ", target)
+	err = ag.suspend()
+	if err != nil {
+		return
+	}
+	migration := schemas.AgentMigration{
+		ID: agencyName + "/" + strconv.Itoa(agentID) + "/" +
+			strconv.FormatInt(time.Now().UnixNano(), 10),
+		Agent: ag.getAgentInfo(),
+	}
+	migration.Agent.Address.Agency = target
+	migration.State, _ = ag.Logger.LastState()
+	migration.Messages = ag.ACL.takeMessages()
+	var httpStatus int
+	httpStatus, err = agency.agencyClient.PostMigration(target, migration)
+	if err == nil && httpStatus != http.StatusCreated {
+		err = errors.New("error migrating agent " + strconv.Itoa(agentID) + ": agency replied " +
+			strconv.Itoa(httpStatus))
+	}
+	if err != nil {
+		// agent stays in this agency
+		ag.ACL.restoreMessages(migration.Messages)
+		ag.resume()
+		return
+	}
+
+	// forward messages to the new location of the agent; the remote entry is created before the
+	// local agent is removed so that local senders never miss the agent
+	var acl *ACL
+	acl, err = agency.remoteACL(agentID, migration.Agent.Address)
+	if err != nil {
+		return
+	}
+	agency.mutex.Lock()
+	delete(agency.localAgents, agentID)
+	delete(agency.migrations, agentID)
+	agency.mutex.Unlock()
+	ag.Terminate()
+	msgs := ag.ACL.takeMessages()
+	for i := range msgs {
+		msgs[i].AgencyReceiver = target
+		err = acl.newIncomingMessage(msgs[i])
+		if err != nil {
+			agency.logError.Println("Forwarding of message to migrated agent ", agentID,
+				" failed: ", err)
+			agency.addDeadLetter(msgs[i], err.Error(), agentID)
+		}
+	}
+	err = nil
+	return
+}
+
+// receiveMigration continues the execution of an agent that has been migrated from another
+// agency. A repeated handover of the same migration, e.g. after a timeout, succeeds without
+// starting the agent again. The migration ID is reserved before the agent is created, so that
+// concurrent handovers of the same migration start the agent only once
+func (agency *Agency) receiveMigration(migration schemas.AgentMigration) (err error) {
+	agentInfo := migration.Agent
+	agency.mutex.Lock()
+	_, agExist := agency.localAgents[agentInfo.ID]
+	reserved, inProgress := agency.migrations[agentInfo.ID]
+	if agExist || inProgress {
+		if migration.ID == "" || reserved != migration.ID {
+			err = errors.New("NotAllowedError")
+		}
+		agency.mutex.Unlock()
+		return
+	}
+	if agency.migrations == nil {
+		agency.migrations = make(map[int]string)
+	}
+	agency.migrations[agentInfo.ID] = migration.ID
+	remAg, remExist := agency.remoteAgents[agentInfo.ID]
+	if remExist {
+		delete(agency.remoteAgents, agentInfo.ID)
+	}
+	agency.mutex.Unlock()
+	if remExist {
+		remAg.ACL.close()
+	}
+	agency.logInfo.Println("Receiving migrated agent ", agentInfo.ID)
+	agentInfo.Status.Code = status.Starting
+	ag := agency.newLocalAgent(agentInfo)
+	if migration.State != "" && ag.Logger != nil {
+		err = ag.Logger.UpdateState(migration.State)
+		if err != nil {
+			agency.logError.Println("Handover of state to migrated agent ", agentInfo.ID,
+				" failed: ", err)
+		}
+	}
+	for i := range migration.Messages {
+		err = ag.ACL.deliver(migration.Messages[i])
+		if err != nil {
+			agency.logError.Println("Handover of message to migrated agent ", agentInfo.ID,
+				" failed: ", err)
+		}
+	}
+	agency.mutex.Lock()
+	agency.localAgents[agentInfo.ID] = ag
+	agency.mutex.Unlock()
+	err = ag.startAgent(agency.agentTask, agency.superviseAgent)
+	if err != nil {
+		// release the migration so that it can be handed over again
+		agency.mutex.Lock()
+		delete(agency.localAgents, agentInfo.ID)
+		delete(agency.migrations, agentInfo.ID)
+		agency.mutex.Unlock()
+	}
+	return
+}
 
+// getAgentInbox returns the state of the inboxes of agent
+func (agency *Agency) getAgentInbox(agentID int) (ret schemas.InboxStats, err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[agentID]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("NotFoundError")
+		return
+	}
+	ret, err = ag.ACL.GetInboxStats()
 	return
 }
 
@@ -284,6 +674,7 @@ func (agency *Agency) removeAgent(agentID int) (err error) {
 	ag.Terminate()
 	agency.mutex.Lock()
 	delete(agency.localAgents, agentID)
+	delete(agency.migrations, agentID)
 	agency.mutex.Unlock()
 	return
 }
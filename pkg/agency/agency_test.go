@@ -45,9 +45,2270 @@ THE SOFTWARE.
 package agency
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/common/metrics"
+	"github.com/RWTH-ACS/clonemap/pkg/common/tracing"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/RWTH-ACS/clonemap/pkg/status"
 )
 
 func TestAgency(t *testing.T) {
 	// ToDo
 }
+
+// newTestACLs creates num ACLs which can send messages to each other
+func newTestACLs(num int) (acls []*ACL) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	lookup := func(agentID int) (acl *ACL, err error) {
+		if agentID < 0 || agentID >= len(acls) {
+			err = errors.New("unknown agent")
+			return
+		}
+		acl = acls[agentID]
+		return
+	}
+	for i := 0; i < num; i++ {
+		acls = append(acls, newACL(context.Background(), i, newMsgQueue(1000), schemas.InboxBlock,
+			lookup, nil, nil, logger, logger))
+	}
+	return
+}
+
+// newTestAgents creates num agents without connection to logger, mqtt and df which can send
+// messages to each other
+func newTestAgents(num int) (agents []*Agent) {
+	return newTestAgentsInbox(num, schemas.InboxConfig{})
+}
+
+// newTestAgentsInbox creates agents with the given inbox configuration
+func newTestAgentsInbox(num int, config schemas.InboxConfig) (agents []*Agent) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	lookup := func(agentID int) (acl *ACL, err error) {
+		if agentID < 0 || agentID >= len(agents) {
+			err = errors.New("unknown agent")
+			return
+		}
+		acl = agents[agentID].ACL
+		return
+	}
+	for i := 0; i < num; i++ {
+		info := schemas.AgentInfo{ID: i}
+		msgIn, policy, _ := newInbox(config)
+		agents = append(agents, newAgent(info, "", "", msgIn, policy, lookup, nil, nil,
+			schemas.LoggerConfig{}, nil, false, nil, logger, logger))
+	}
+	return
+}
+
+func TestConversation(t *testing.T) {
+	acls := newTestACLs(2)
+	// answer first request
+	go func() {
+		msg, err := acls[1].RecvMessageWait()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		reply, _ := acls[1].NewReply(msg, schemas.FIPAPerfInform, "re: "+msg.Content)
+		acls[1].SendMessage(reply)
+	}()
+
+	// unrelated message must not be taken as reply
+	msg, _ := acls[1].NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "unrelated")
+	acls[1].SendMessage(msg)
+	msg, _ = acls[0].NewMessage(1, schemas.FIPAProtRequest, schemas.FIPAPerfRequest, "ping")
+	reply, err := acls[0].SendMessageWaitReply(msg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Content != "re: ping" || reply.InReplyTo == 0 {
+		t.Error("unexpected reply: " + reply.String())
+	}
+	_, msgs, _ := acls[0].RecvMessages()
+	if len(msgs) != 1 || msgs[0].Content != "unrelated" {
+		t.Error("unrelated message not delivered to inbox")
+	}
+
+	// replies correlated by the user are not taken for replies to a closed conversation
+	msg, _ = acls[1].NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "manual")
+	msg.InReplyTo = 1
+	acls[1].SendMessage(msg)
+	msg, err = acls[0].RecvMessageWait()
+	if err != nil || msg.Content != "manual" {
+		t.Error("reply correlated by user not delivered to inbox")
+	}
+
+	// no reply within deadline
+	conv, _ := acls[0].NewConversation(50 * time.Millisecond)
+	defer conv.Close()
+	msg, _ = acls[0].NewMessage(1, schemas.FIPAProtRequest, schemas.FIPAPerfRequest, "ping")
+	conv.SendMessage(msg)
+	_, err = conv.RecvReply()
+	if _, ok := err.(*ReplyTimeoutError); !ok {
+		t.Error("expected ReplyTimeoutError, got ", err)
+	}
+}
+
+func TestContractNet(t *testing.T) {
+	agents := newTestAgents(4)
+	rejected := make(chan int, 4)
+	for i := 1; i < 4; i++ {
+		id := i
+		behavior, err := agents[i].NewContractNetParticipantBehavior(
+			func(cfp schemas.ACLMessage) (bool, string, error) {
+				// agent 3 does not propose
+				return id != 3, strconv.Itoa(10 * id), nil
+			},
+			func(accept schemas.ACLMessage) (string, error) {
+				return "done " + accept.Content, nil
+			},
+			func(reject schemas.ACLMessage) error {
+				rejected <- id
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		behavior.Start()
+		defer behavior.Stop()
+	}
+
+	results := make(chan string, 4)
+	cfp := CFPConfig{
+		Participants:  []int{1, 2, 3},
+		Content:       "offer",
+		Deadline:      time.Second,
+		ResultTimeout: time.Second,
+	}
+	behavior, err := agents[0].NewContractNetInitiatorBehavior(cfp,
+		func(proposals []schemas.ACLMessage) []schemas.ACLMessage {
+			if len(proposals) != 2 {
+				t.Error("expected 2 proposals, got ", len(proposals))
+			}
+			// accept cheapest proposal
+			var winners []schemas.ACLMessage
+			for i := range proposals {
+				if len(winners) == 0 || proposals[i].Content < winners[0].Content {
+					winners = []schemas.ACLMessage{proposals[i]}
+				}
+			}
+			return winners
+		},
+		func(result schemas.ACLMessage) error {
+			results <- result.Content
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	behavior.Start()
+
+	select {
+	case res := <-results:
+		if res != "done 10" {
+			t.Error("unexpected result " + res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no result")
+	}
+	select {
+	case id := <-rejected:
+		if id != 2 {
+			t.Error("unexpected rejection of agent ", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("no rejection")
+	}
+
+	// results are not awaited forever if no result timeout is given
+	cfp.ResultTimeout = 0
+	behavior, err = agents[0].NewContractNetInitiatorBehavior(cfp,
+		func(proposals []schemas.ACLMessage) []schemas.ACLMessage { return proposals }, nil)
+	if err != nil ||
+		behavior.(*contractNetInitiatorBehavior).cfp.ResultTimeout != defaultResultTimeout {
+		t.Error("default result timeout not applied ", err)
+	}
+
+	// a failing participant refuses and repeated replies of a participant are counted once
+	agents = newTestAgents(3)
+	answered := make(chan bool)
+	failing, _ := agents[1].NewContractNetParticipantBehavior(
+		func(cfp schemas.ACLMessage) (bool, string, error) {
+			<-answered
+			return false, "", errors.New("no capacity")
+		},
+		func(accept schemas.ACLMessage) (string, error) { return "", nil }, nil)
+	failing.Start()
+	defer failing.Stop()
+	go func() {
+		cfp, _ := agents[2].ACL.RecvMessageWait()
+		for i := 0; i < 2; i++ {
+			reply, _ := agents[2].ACL.NewReply(cfp, schemas.FIPAPerfPropose, strconv.Itoa(i))
+			agents[2].ACL.SendMessage(reply)
+		}
+		answered <- true
+	}()
+	selected := make(chan int, 1)
+	cfp = CFPConfig{Participants: []int{1, 2}, Deadline: time.Second * 5}
+	behavior, _ = agents[0].NewContractNetInitiatorBehavior(cfp,
+		func(proposals []schemas.ACLMessage) []schemas.ACLMessage {
+			selected <- len(proposals)
+			return nil
+		}, nil)
+	behavior.Start()
+	select {
+	case num := <-selected:
+		if num != 1 {
+			t.Error("expected 1 proposal, got ", num)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("initiator waited for the deadline")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	agents := newTestAgents(3)
+	pub, err := agents[0].NewPublisherBehavior(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Start()
+	defer pub.Stop()
+
+	var subs []Behavior
+	values := make(chan string, 10)
+	for i := 1; i < 3; i++ {
+		id := i
+		sub, err := agents[i].NewSubscriberBehavior(0, "value",
+			func(msg schemas.ACLMessage) error {
+				values <- strconv.Itoa(id) + ":" + msg.Content
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.Start()
+		subs = append(subs, sub)
+	}
+	for len(pub.GetSubscribers()) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub.Publish("a")
+	recv := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-values:
+			recv[v] = true
+		case <-time.After(time.Second):
+			t.Fatal("missing inform")
+		}
+	}
+	if !recv["1:a"] || !recv["2:a"] {
+		t.Error("unexpected informs ", recv)
+	}
+
+	// cancel subscription of agent 1 and terminate agent 2
+	subs[0].Stop()
+	for len(pub.GetSubscribers()) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	agents[2].ACL.close()
+	pub.Publish("b")
+	if len(pub.GetSubscribers()) != 0 {
+		t.Error("terminated subscriber has not been removed")
+	}
+	select {
+	case v := <-values:
+		t.Error("unexpected inform " + v)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// subscribers are removed after repeated failed deliveries
+	sub, err := agents[1].NewSubscriberBehavior(0, "value",
+		func(msg schemas.ACLMessage) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Start()
+	for len(pub.GetSubscribers()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub.mutex.Lock()
+	failure := schemas.ACLMessage{Sender: schemas.SystemAgentID, Receiver: 0,
+		Protocol: schemas.FIPAProtSubscribe, Performative: schemas.FIPAPerfFailure,
+		InReplyTo: pub.subscribers[1].token}
+	pub.mutex.Unlock()
+	for i := 0; i < maxSubscriberFailures-1; i++ {
+		agents[0].ACL.newIncomingMessage(failure)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(pub.GetSubscribers()) != 1 {
+		t.Fatal("subscriber removed before ", maxSubscriberFailures, " failures")
+	}
+	agents[0].ACL.newIncomingMessage(failure)
+	for i := 0; len(pub.GetSubscribers()) > 0; i++ {
+		if i == 100 {
+			t.Fatal("subscriber not removed after repeated failures")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sub.Stop()
+	<-sub.Done()
+}
+
+func TestAuction(t *testing.T) {
+	agents := newTestAgents(3)
+	limits := map[int]float64{1: 12, 2: 15}
+	bidderResults := make(chan AuctionResult, 10)
+	for i := 1; i < 3; i++ {
+		limit := limits[i]
+		bid := func(call AuctionCall) bool {
+			return call.Price <= limit
+		}
+		handleResult := func(result AuctionResult) error {
+			bidderResults <- result
+			return nil
+		}
+		english, _ := agents[i].NewEnglishAuctionBidderBehavior(bid, handleResult)
+		english.Start()
+		defer english.Stop()
+		dutch, _ := agents[i].NewDutchAuctionBidderBehavior(bid, handleResult)
+		dutch.Start()
+		defer dutch.Stop()
+	}
+
+	results := make(chan AuctionResult, 1)
+	handleResult := func(result AuctionResult) error {
+		results <- result
+		return nil
+	}
+	config := AuctionConfig{
+		Participants: []int{1, 2},
+		Item:         "energy",
+		StartPrice:   10,
+		Step:         1,
+		ReservePrice: 11,
+		RoundTimeout: time.Second,
+	}
+	auctioneer, err := agents[0].NewEnglishAuctioneerBehavior(config, handleResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auctioneer.Start()
+	res := <-results
+	if !res.Sold || res.Winner != 2 || res.Price < 12 || res.Price > 13 {
+		t.Errorf("unexpected result of english auction %+v", res)
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-bidderResults; r != res {
+			t.Errorf("bidder received wrong result %+v", r)
+		}
+	}
+
+	config.StartPrice = 20
+	config.Step = 2
+	auctioneer, err = agents[0].NewDutchAuctioneerBehavior(config, handleResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auctioneer.Start()
+	res = <-results
+	if !res.Sold || res.Winner != 2 || res.Price != 14 {
+		t.Errorf("unexpected result of dutch auction %+v", res)
+	}
+
+	// reserve price is not reached
+	config.ReservePrice = 16
+	auctioneer, _ = agents[0].NewDutchAuctioneerBehavior(config, handleResult)
+	auctioneer.Start()
+	res = <-results
+	if res.Sold || res.Winner != -1 {
+		t.Errorf("unexpected result of dutch auction %+v", res)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	agents := newTestAgents(5)
+	infos := []schemas.AgentInfo{
+		{ID: 0, Spec: schemas.AgentSpec{AType: "coordinator"}},
+		{ID: 1, Spec: schemas.AgentSpec{AType: "pv", ASubtype: "roof", NodeID: 1}},
+		{ID: 2, Spec: schemas.AgentSpec{AType: "pv", ASubtype: "field", NodeID: 1,
+			Groups: []string{"feeder1"}}},
+		{ID: 3, Spec: schemas.AgentSpec{AType: "load", NodeID: 2, Groups: []string{"feeder1"}}},
+		{ID: 4, Spec: schemas.AgentSpec{AType: "load", NodeID: 2}},
+	}
+	agents[0].ACL.groupLookup = func(match func(schemas.AgentInfo) bool) (ids []int, err error) {
+		for i := range infos {
+			if match(infos[i]) {
+				ids = append(ids, infos[i].ID)
+			}
+		}
+		return
+	}
+	recipients := func() (ids []int) {
+		for i := 1; i < len(agents); i++ {
+			_, msgs, _ := agents[i].ACL.RecvMessages()
+			if len(msgs) > 0 {
+				ids = append(ids, i)
+			}
+		}
+		return
+	}
+	msg, _ := agents[0].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "x")
+	tests := []struct {
+		send func() (int, error)
+		ids  []int
+	}{
+		{func() (int, error) { return agents[0].ACL.SendMessageToType(msg, "pv", "") },
+			[]int{1, 2}},
+		{func() (int, error) { return agents[0].ACL.SendMessageToType(msg, "pv", "field") },
+			[]int{2}},
+		{func() (int, error) { return agents[0].ACL.SendMessageToGroup(msg, "feeder1") },
+			[]int{2, 3}},
+		{func() (int, error) { return agents[0].ACL.SendMessageToNode(msg, 2) },
+			[]int{3, 4}},
+		{func() (int, error) { return agents[0].ACL.SendMessageBroadcast(msg) },
+			[]int{1, 2, 3, 4}},
+	}
+	for i, test := range tests {
+		num, err := test.send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := recipients()
+		if num != len(test.ids) || len(ids) != len(test.ids) {
+			t.Errorf("test %d: sent %d, received by %v, expected %v", i, num, ids, test.ids)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != test.ids[j] {
+				t.Errorf("test %d: received by %v, expected %v", i, ids, test.ids)
+				break
+			}
+		}
+	}
+
+	// copies to agents of a remote agency are sent in one batch
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	remAgency := &remoteAgency{msgIn: newMsgQueue(10), batchIn: make(chan []schemas.ACLMessage, 1)}
+	for _, id := range []int{5, 6} {
+		ag := newAgent(schemas.AgentInfo{}, "", "", remAgency.msgIn, schemas.InboxBlock, nil, nil, nil,
+			schemas.LoggerConfig{}, nil, false, nil, logger, logger)
+		ag.ACL.batchOut = remAgency.batchIn
+		agents[0].ACL.addrBook[id] = ag.ACL
+		infos = append(infos, schemas.AgentInfo{ID: id, Spec: schemas.AgentSpec{AType: "remote"}})
+	}
+	num, err := agents[0].ACL.SendMessageToType(msg, "remote", "")
+	if err != nil || num != 2 {
+		t.Error("multicast to remote agents failed ", num, err)
+	}
+	select {
+	case batch := <-remAgency.batchIn:
+		if len(batch) != 2 || batch[0].Receiver != 5 || batch[1].Receiver != 6 {
+			t.Errorf("unexpected batch %+v", batch)
+		}
+	default:
+		t.Error("no batch sent to remote agency")
+	}
+	if remAgency.msgIn.len() != 0 {
+		t.Error("copies sent individually to remote agency")
+	}
+}
+
+func TestSelectiveReceive(t *testing.T) {
+	acls := newTestACLs(3)
+	for i, perf := range []int{schemas.FIPAPerfInform, schemas.FIPAPerfRequest,
+		schemas.FIPAPerfInform} {
+		msg, _ := acls[i%2+1].NewMessage(0, schemas.FIPAProtNone, perf, strconv.Itoa(i))
+		acls[i%2+1].SendMessage(msg)
+	}
+	msg, err := acls[0].RecvMessageMatch(MatchPerformative(schemas.FIPAPerfRequest), time.Second)
+	if err != nil || msg.Content != "1" {
+		t.Error("unexpected message ", msg.Content, err)
+	}
+	msg, err = acls[0].RecvMessageMatch(MatchAll(MatchSender(1),
+		MatchPerformative(schemas.FIPAPerfInform)), time.Second)
+	if err != nil || msg.Content != "0" {
+		t.Error("unexpected message ", msg.Content, err)
+	}
+	_, err = acls[0].RecvMessageMatch(MatchSender(2), 50*time.Millisecond)
+	if err == nil {
+		t.Error("expected timeout")
+	}
+	// non-matching message is still in inbox
+	msg, _ = acls[0].RecvMessageWait()
+	if msg.Content != "2" {
+		t.Error("unexpected message ", msg.Content)
+	}
+}
+
+func TestSelectiveReceivePending(t *testing.T) {
+	// a waiting receiver is woken when a message is skipped by selective receive
+	agents := newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 2})
+	acl := agents[0].ACL
+	received := make(chan string, 2)
+	go func() {
+		msg, _ := acl.RecvMessageMatch(MatchPerformative(schemas.FIPAPerfRequest), time.Second)
+		received <- msg.Content
+	}()
+	go func() {
+		msg, _ := acl.RecvMessageWait()
+		received <- msg.Content
+	}()
+	time.Sleep(time.Millisecond * 20)
+	acl.deliver(schemas.ACLMessage{Performative: schemas.FIPAPerfInform, Content: "inform"})
+	acl.deliver(schemas.ACLMessage{Performative: schemas.FIPAPerfRequest, Content: "request"})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Millisecond * 500):
+			t.Fatal("receiver not woken")
+		}
+	}
+
+	// the inbox capacity and policy apply to pending messages
+	agents = newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 2,
+		Policy: schemas.InboxDropOldest})
+	acl = agents[0].ACL
+	for i := 0; i < 4; i++ {
+		acl.deliver(schemas.ACLMessage{Performative: schemas.FIPAPerfInform,
+			Content: strconv.Itoa(i)})
+		if i%2 == 1 {
+			acl.RecvMessageMatch(MatchPerformative(schemas.FIPAPerfRequest), time.Millisecond*20)
+		}
+	}
+	stats, _ := acl.GetInboxStats()
+	if stats.Pending != 2 || stats.Dropped != 2 {
+		t.Error("unexpected inbox stats ", stats)
+	}
+	msg, _ := acl.RecvMessageWait()
+	if msg.Content != "2" {
+		t.Error("expected message 2, got ", msg.Content)
+	}
+}
+
+// newTestAgency creates an agency with num local agents
+func newTestAgency(num int) (agency *Agency, agents []*Agent) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	agency = &Agency{
+		mutex:           &sync.Mutex{},
+		deadLetterMutex: &sync.Mutex{},
+		localAgents:     make(map[int]*Agent),
+		remoteAgents:    make(map[int]*Agent),
+		remoteAgencies:  make(map[string]*remoteAgency),
+		streamSessions:  make(map[string]streamSession),
+		msgIn:           make(chan []schemas.ACLMessage, 1000),
+		metrics:         newAgencyMetrics(),
+		faults:          newFaultInjector("local", logger, logger),
+		resolve:         getIP,
+		logError:        logger,
+		logInfo:         logger,
+	}
+	agents = newTestAgents(num)
+	for i := range agents {
+		agents[i].ACL.metrics = agency.metrics
+		agents[i].ACL.faults = agency.faults
+		agency.localAgents[i] = agents[i]
+	}
+	return
+}
+
+// TestFaultInjection tests the faults injected into the message path
+func TestFaultInjection(t *testing.T) {
+	agency, agents := newTestAgency(2)
+	serv := httptest.NewServer(agency.server(10000).Handler)
+	defer serv.Close()
+	cli, host := newTestAgencyClient(serv.URL)
+	send := func(contents ...string) {
+		for _, content := range contents {
+			msg, _ := agents[0].ACL.NewMessage(1, schemas.FIPAProtNone, schemas.FIPAPerfInform,
+				content)
+			agents[0].ACL.SendMessage(msg)
+		}
+	}
+	recv := func() (contents []string) {
+		_, msgs, _ := agents[1].ACL.RecvMessages()
+		for i := range msgs {
+			contents = append(contents, msgs[i].Content)
+		}
+		return
+	}
+
+	// lost messages are reproducible for a given seed
+	config := schemas.FaultConfig{Active: true, Seed: 42,
+		Links: []schemas.LinkFault{{Senders: []int{0}, Receivers: []int{1}, Drop: 0.5}}}
+	var received [2][]string
+	for i := range received {
+		httpStatus, err := cli.PutFaults(host, config)
+		if err != nil || httpStatus != http.StatusOK {
+			t.Fatal("setting faults failed ", httpStatus, err)
+		}
+		for j := 0; j < 100; j++ {
+			send(strconv.Itoa(j))
+		}
+		received[i] = recv()
+	}
+	if len(received[0]) < 25 || len(received[0]) > 75 ||
+		strings.Join(received[0], ",") != strings.Join(received[1], ",") {
+		t.Error("unexpected messages after drop ", received)
+	}
+	ret, _, err := cli.GetFaults(host)
+	if err != nil || ret.Seed != 42 || len(ret.Links) != 1 {
+		t.Error("unexpected fault config ", ret, err)
+	}
+	config.Links[0].Drop = 2
+	if httpStatus, _ := cli.PutFaults(host, config); httpStatus == http.StatusOK {
+		t.Error("invalid probability accepted")
+	}
+
+	// duplication
+	agency.faults.setConfig(schemas.FaultConfig{Active: true,
+		Links: []schemas.LinkFault{{Duplicate: 1}}})
+	send("dup")
+	if ret := recv(); len(ret) != 2 {
+		t.Error("expected duplicated message, got ", ret)
+	}
+
+	// latency; delayed messages are pending in the co-simulation until delivered
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	agents[0].ACL.cosim = newCosim("local", schemas.CosimConfig{Active: true}, logger, logger)
+	agency.faults.setConfig(schemas.FaultConfig{Active: true,
+		Links: []schemas.LinkFault{{Latency: 50, Jitter: 10}}})
+	start := time.Now()
+	send("late")
+	if rep := agents[0].ACL.cosim.report(); rep.Pending != 1 {
+		t.Error("delayed message not pending ", rep)
+	}
+	msg, err := agents[1].ACL.RecvMessageWait()
+	if err != nil || msg.Content != "late" || time.Since(start) < time.Millisecond*40 {
+		t.Error("message not delayed ", msg.Content, time.Since(start), err)
+	}
+	for i := 0; i < 100 && agents[0].ACL.cosim.report().Pending != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if rep := agents[0].ACL.cosim.report(); rep.Pending != 0 {
+		t.Error("delivered message still pending ", rep)
+	}
+	agents[0].ACL.cosim = nil
+
+	// reordering
+	agency.faults.setConfig(schemas.FaultConfig{Active: true,
+		Links: []schemas.LinkFault{{Reorder: 1}}})
+	send("a", "b")
+	if ret := recv(); strings.Join(ret, ",") != "b,a" {
+		t.Error("expected reordered messages, got ", ret)
+	}
+	send("c")
+	msg, err = agents[1].ACL.RecvMessageWait()
+	if err != nil || msg.Content != "c" {
+		t.Error("held message not released ", msg.Content, err)
+	}
+
+	// timed partitions
+	agency.faults.setConfig(schemas.FaultConfig{Active: true, Partitions: []schemas.Partition{
+		{Agencies: []string{"remote"}, Duration: 50}, {Agencies: []string{"local"}, Start: 1000}}})
+	if !agency.faults.partitioned("remote") || agency.faults.partitioned("local") {
+		t.Error("agencies not partitioned")
+	}
+	go agency.receiveMsgs()
+	agency.msgIn <- []schemas.ACLMessage{{Receiver: 1, AgencySender: "remote", Content: "x"}}
+	time.Sleep(time.Millisecond * 60)
+	if agency.faults.partitioned("remote") {
+		t.Error("partition not ended")
+	}
+	agency.msgIn <- []schemas.ACLMessage{{Receiver: 1, AgencySender: "remote", Content: "y"}}
+	msg, err = agents[1].ACL.RecvMessageWait()
+	if err != nil || msg.Content != "y" {
+		t.Error("unexpected message after partition ", msg.Content, err)
+	}
+
+	// partitions are timed relative to the start time distributed with the config
+	agency.faults.setConfig(schemas.FaultConfig{Active: true, Start: time.Now().Add(-time.Second),
+		Partitions: []schemas.Partition{{Agencies: []string{"remote"}, Duration: 500}}})
+	if agency.faults.partitioned("remote") {
+		t.Error("partition not timed relative to start of config")
+	}
+}
+
+// TestFaultDecisions checks that the random decisions about a message do not depend on
+// messages of other links and differ between agencies
+func TestFaultDecisions(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	config := schemas.FaultConfig{Active: true, Seed: 42,
+		Links: []schemas.LinkFault{{Drop: 0.5}}}
+	// run sends 50 messages from each sender and returns the delivered messages per sender
+	run := func(agency string, concurrent bool) (delivered [2]string) {
+		f := newFaultInjector(agency, logger, logger)
+		f.setConfig(config)
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		send := func(sender int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				f.send(schemas.ACLMessage{Sender: sender, Receiver: 5, Content: strconv.Itoa(i)},
+					func(msg schemas.ACLMessage) error {
+						mutex.Lock()
+						delivered[msg.Sender] += msg.Content + ","
+						mutex.Unlock()
+						return nil
+					}, func() {})
+			}
+		}
+		for sender := 0; sender < 2; sender++ {
+			wg.Add(1)
+			if concurrent {
+				go send(sender)
+			} else {
+				send(sender)
+			}
+		}
+		wg.Wait()
+		return
+	}
+	sequential := run("agency-0", false)
+	if concurrent := run("agency-0", true); concurrent != sequential {
+		t.Error("decisions depend on interleaving of senders ", sequential, concurrent)
+	}
+	if other := run("agency-1", false); other == sequential {
+		t.Error("same decisions in different agencies")
+	}
+}
+
+// TestMetrics scrapes the metrics of a local agency after messages have been exchanged
+func TestMetrics(t *testing.T) {
+	agency, agents := newTestAgency(2)
+	serv := httptest.NewServer(agency.server(10000).Handler)
+	defer serv.Close()
+	handled := make(chan struct{}, 10)
+	behavior, _ := agents[1].NewMessageBehavior(schemas.FIPAProtRequest, nil,
+		func(msg schemas.ACLMessage) error {
+			handled <- struct{}{}
+			if msg.Content == "fail" {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+	behavior.Start()
+	defer behavior.Stop()
+	for _, content := range []string{"a", "b", "fail"} {
+		msg, _ := agents[0].ACL.NewMessage(1, schemas.FIPAProtRequest, schemas.FIPAPerfRequest,
+			content)
+		agents[0].ACL.SendMessage(msg)
+		<-handled
+	}
+	// message remains in the inbox of agent 0
+	msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtQuery, schemas.FIPAPerfQueryIf, "q")
+	agents[1].ACL.SendMessage(msg)
+	// message discarded due to inbox overflow
+	agents[0].ACL.overflow(msg, "ACL inbox overflow; dropping message", false)
+	// messages received from other agencies
+	agency.msgIn <- []schemas.ACLMessage{}
+
+	// mqtt and df statistics
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	agency.mqttCollector = newMQTTCollector(schemas.MQTTConfig{}, "agency", logger, logger)
+	agency.mqttCollector.metrics = agency.metrics
+	mq := agency.mqttCollector.newAgentMQTT(context.Background(), 0, nil, logger, logger)
+	mq.active = true
+	mq.SendMessage(schemas.MQTTMessage{Topic: "t"}, 0)
+	dfServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer dfServ.Close()
+	addr := strings.Split(strings.TrimPrefix(dfServ.URL, "http://"), ":")
+	port, _ := strconv.Atoi(addr[1])
+	dfClient := client.NewDFClient(addr[0], port, time.Second, time.Millisecond, 1)
+	dfClient.Observer = agency.metrics.observeDF
+	dfClient.GetSvc(0, "svc")
+
+	resp, err := http.Get(serv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Fatal("unexpected response ", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	samples, err := metrics.ParseText(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]float64{
+		`clonemap_agent_messages_sent_total{agent="0",protocol="1"}`:                       3,
+		`clonemap_agent_messages_sent_total{agent="1",protocol="2"}`:                       1,
+		`clonemap_agent_messages_received_total{agent="1",protocol="1"}`:                   3,
+		`clonemap_agent_handler_duration_seconds_count{agent="1",protocol="1"}`:            3,
+		`clonemap_agent_handler_duration_seconds_bucket{agent="1",protocol="1",le="+Inf"}`: 3,
+		`clonemap_agent_handler_errors_total{agent="1",protocol="1"}`:                      1,
+		`clonemap_agent_inbox_messages{agent="0"}`:                                         1,
+		`clonemap_agent_inbox_messages{agent="1"}`:                                         0,
+		`clonemap_agent_inbox_discarded_messages_total{agent="0"}`:                         1,
+		`clonemap_agency_agents`:                                                           2,
+		`clonemap_agency_remote_agencies`:                                                  0,
+		`clonemap_mqtt_messages_published_total{agent="0"}`:                                1,
+		`clonemap_df_requests_total{op="get_svc",code="200"}`:                              1,
+		`clonemap_df_request_duration_seconds_count{op="get_svc"}`:                         1,
+	}
+	for key, val := range exp {
+		if ret, ok := samples[key]; !ok || ret != val {
+			t.Errorf("expected %s %v, got %v", key, val, ret)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	agency, agents := newTestAgency(1)
+	conv, _ := agents[0].ACL.NewConversation(time.Second)
+	defer conv.Close()
+	msg, _ := agents[0].ACL.NewMessage(7, schemas.FIPAProtRequest, schemas.FIPAPerfRequest, "x")
+	msg.ReplyWith = strconv.Itoa(conv.GetID())
+	agency.undeliverable(msg, "receiver is not active")
+
+	// sender is notified
+	reply, err := conv.RecvReply()
+	if err != nil || reply.Performative != schemas.FIPAPerfFailure ||
+		reply.Sender != schemas.SystemAgentID {
+		t.Error("expected failure message, got ", reply.String(), err)
+	}
+
+	// dead-letter queue is available via REST
+	handler := agency.server(10000).Handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/agency/deadletters", nil))
+	var deadLetters []schemas.DeadLetter
+	json.Unmarshal(w.Body.Bytes(), &deadLetters)
+	if w.Code != http.StatusOK || len(deadLetters) != 1 || deadLetters[0].Message.Receiver != 7 {
+		t.Error("unexpected dead-letter queue ", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/agency/deadletters", nil))
+	deadLetters, _ = agency.getDeadLetters()
+	if w.Code != http.StatusOK || len(deadLetters) != 0 {
+		t.Error("dead-letter queue not cleared")
+	}
+}
+
+// TestDeadLetterPersistence checks that dead letters added during a store are persisted together
+// under the reserved key
+func TestDeadLetterPersistence(t *testing.T) {
+	agency, _ := newTestAgency(1)
+	mutex := &sync.Mutex{}
+	puts := 0
+	var stored schemas.StateUpdate
+	var key string
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		time.Sleep(time.Millisecond * 20)
+		mutex.Lock()
+		puts++
+		json.Unmarshal(body, &stored)
+		key = r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		js, _ := json.Marshal(schemas.StateRevision{Revision: puts})
+		mutex.Unlock()
+		w.Write(js)
+	}))
+	defer serv.Close()
+	addr := strings.Split(strings.TrimPrefix(serv.URL, "http://"), ":")
+	port, _ := strconv.Atoi(addr[1])
+	cli := client.NewLoggerClient(addr[0], port, time.Second, time.Millisecond, 1)
+	agency.loggerConfig.Active = true
+	agency.logCollector = client.NewLogCollectorClient(0, agency.loggerConfig, cli, time.Hour,
+		agency.logError, agency.logInfo)
+
+	for i := 0; i < 50; i++ {
+		agency.addDeadLetter(schemas.ACLMessage{Sender: 0, Receiver: 7}, "x", 0)
+	}
+	for flushing := true; flushing; {
+		time.Sleep(time.Millisecond * 5)
+		agency.mutex.Lock()
+		flushing = len(agency.deadLetterDirty) != 0
+		agency.mutex.Unlock()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	var deadLetters []schemas.DeadLetter
+	json.Unmarshal([]byte(stored.State), &deadLetters)
+	if puts > 2 || len(deadLetters) != 50 {
+		t.Error("expected 50 dead letters stored at most twice, got ", len(deadLetters), " in ",
+			puts, " stores")
+	}
+	if key != deadLetterKey {
+		t.Error("dead letters stored under key ", key)
+	}
+}
+
+func TestRetryDelivery(t *testing.T) {
+	agency, agents := newTestAgency(1)
+	agency.mutex.Lock()
+	delete(agency.localAgents, 0)
+	agency.mutex.Unlock()
+	// messages for an unavailable receiver are queued in order up to the queue capacity
+	for i := 0; i <= retryQueueCapacity; i++ {
+		agency.deliverRemote(schemas.ACLMessage{Sender: 1, Receiver: 0,
+			Content: strconv.Itoa(i)})
+	}
+	deadLetters, _ := agency.getDeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Message.Content != strconv.Itoa(retryQueueCapacity) {
+		t.Error("expected overflowing message in dead-letter queue, got ", deadLetters)
+	}
+	agency.mutex.Lock()
+	agency.localAgents[0] = agents[0]
+	agency.mutex.Unlock()
+	for i := 0; i < retryQueueCapacity; i++ {
+		msg, err := agents[0].ACL.RecvMessageWait()
+		if err != nil || msg.Content != strconv.Itoa(i) {
+			t.Fatal("wrong order of redelivered messages ", msg.Content, err)
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	agency.mutex.Lock()
+	defer agency.mutex.Unlock()
+	if len(agency.retryQueues) != 0 {
+		t.Error("retry queue not removed")
+	}
+}
+
+func TestMsgEncoding(t *testing.T) {
+	agency, _ := newTestAgency(1)
+	serv := httptest.NewServer(agency.server(10000).Handler)
+	defer serv.Close()
+	cli, host := newTestAgencyClient(serv.URL)
+	cli.Compression = true
+	// batch large enough to be compressed
+	msgs := make([]schemas.ACLMessage, 100)
+	for i := range msgs {
+		msgs[i] = schemas.ACLMessage{Sender: i, Receiver: 0, Content: "hello world",
+			Protocol: schemas.FIPAProtQuery, Performative: schemas.FIPAPerfInform}
+	}
+	httpStatus, err := cli.PostMsgs(host, msgs)
+	if err != nil || httpStatus != http.StatusCreated {
+		t.Fatal("PostMsgs failed ", httpStatus, err)
+	}
+	ret := <-agency.msgIn
+	if len(ret) != 100 || ret[99].Content != "hello world" || ret[99].Sender != 99 {
+		t.Error("wrong messages received ", ret)
+	}
+
+	// unknown content types are rejected
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/agency/msgs", nil)
+	req.Header.Set("Content-Type", "application/xml")
+	agency.server(10000).Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Error("expected unsupported media type, got ", w.Code)
+	}
+
+	// agencies only supporting json are detected and served with json from then on
+	var contentTypes []string
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		var msgs []schemas.ACLMessage
+		if json.Unmarshal(body, &msgs) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer legacy.Close()
+	cli, host = newTestAgencyClient(legacy.URL)
+	for i := 0; i < 2; i++ {
+		httpStatus, err = cli.PostMsgs(host, msgs)
+		if err != nil || httpStatus != http.StatusCreated {
+			t.Error("PostMsgs to legacy agency failed ", httpStatus, err)
+		}
+	}
+	if len(contentTypes) != 3 || contentTypes[0] != aclwire.ContentTypeProtobuf ||
+		contentTypes[1] != aclwire.ContentTypeJSON || contentTypes[2] != aclwire.ContentTypeJSON {
+		t.Error("unexpected content types ", contentTypes)
+	}
+
+	// bad requests that are not caused by the encoding do not switch to json
+	contentTypes = nil
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer broken.Close()
+	cli, host = newTestAgencyClient(broken.URL)
+	for i := 0; i < 2; i++ {
+		cli.PostMsgs(host, msgs)
+	}
+	if len(contentTypes) != 4 || contentTypes[2] != aclwire.ContentTypeProtobuf {
+		t.Error("unexpected content types ", contentTypes)
+	}
+
+	// decompressed batches larger than the maximum size are rejected
+	agency.msgMaxSize = 1024
+	comp, _ := aclwire.Compress(make([]byte, 4096))
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/api/agency/msgs", bytes.NewReader(comp))
+	req.Header.Set("Content-Type", aclwire.ContentTypeProtobuf)
+	req.Header.Set("Content-Encoding", aclwire.EncodingGzip)
+	agency.server(10000).Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Error("expected bad request for oversized batch, got ", w.Code)
+	}
+}
+
+// newTestAgencyClient returns an agency client and host name for the test server with url
+func newTestAgencyClient(url string) (cli *client.AgencyClient, host string) {
+	cli = client.NewAgencyClient(time.Second*5, time.Millisecond*10, 1)
+	addr := strings.Split(strings.TrimPrefix(url, "http://"), ":")
+	host = addr[0]
+	cli.Port, _ = strconv.Atoi(addr[1])
+	return
+}
+
+// benchmarkPingPong sends messages back and forth between two agencies like the ping pong
+// benchmark in examples/benchmark
+func benchmarkPingPong(b *testing.B, contentType string, compression bool) {
+	// clients[i] and hosts[i] are used to send messages to agencies[i]
+	var agencies []*Agency
+	var clients []*client.AgencyClient
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		agency, _ := newTestAgency(1)
+		serv := httptest.NewServer(agency.server(10000).Handler)
+		defer serv.Close()
+		cli, host := newTestAgencyClient(serv.URL)
+		cli.Encoding = contentType
+		cli.Compression = compression
+		agencies = append(agencies, agency)
+		clients = append(clients, cli)
+		hosts = append(hosts, host)
+	}
+	msg := schemas.ACLMessage{Sender: 0, Receiver: 1, Content: "hello world",
+		Protocol: schemas.FIPAProtQuery, Performative: schemas.FIPAPerfInform,
+		AgencySender: "mas-0-agency-0-im-0.mas0agencies", AgencyReceiver: "mas-0-agency-1-im-0.mas0agencies"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 2; j++ {
+			msg.Timestamp = time.Now()
+			httpStatus, err := clients[1-j].PostMsgs(hosts[1-j], []schemas.ACLMessage{msg})
+			if err != nil || httpStatus != http.StatusCreated {
+				b.Fatal("PostMsgs failed ", httpStatus, err)
+			}
+			<-agencies[1-j].msgIn
+		}
+	}
+}
+
+func BenchmarkPingPongJSON(b *testing.B) { benchmarkPingPong(b, aclwire.ContentTypeJSON, false) }
+func BenchmarkPingPongProtobuf(b *testing.B) {
+	benchmarkPingPong(b, aclwire.ContentTypeProtobuf, false)
+}
+func BenchmarkPingPongProtobufGzip(b *testing.B) {
+	benchmarkPingPong(b, aclwire.ContentTypeProtobuf, true)
+}
+
+func TestMsgStream(t *testing.T) {
+	agency, agents := newTestAgency(1)
+	serv := httptest.NewServer(agency.server(10000).Handler)
+	defer serv.Close()
+	_, host := newTestAgencyClient(serv.URL)
+	port, _ := strconv.Atoi(strings.Split(serv.URL, ":")[2])
+	var fallbackMsgs []schemas.ACLMessage
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	s := newMsgStream(host, "agency-a", port, func(session string, batch streamBatch) {
+		fallbackMsgs = append(fallbackMsgs, batch.msgs...)
+	}, logger)
+	send := func(from int, to int) {
+		for i := from; i < to; i++ {
+			err := s.send([]schemas.ACLMessage{{Sender: 7, Receiver: 0,
+				Content: strconv.Itoa(i)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	recv := func(from int, to int) {
+		for i := from; i < to; i++ {
+			msg, err := agents[0].ACL.RecvMessageWait()
+			if err != nil || msg.Content != strconv.Itoa(i) {
+				t.Fatal("expected message ", i, ", got ", msg.Content, err)
+			}
+		}
+	}
+	acked := func() bool {
+		for i := 0; i < 100; i++ {
+			s.mutex.Lock()
+			num := len(s.unacked)
+			s.mutex.Unlock()
+			if num == 0 {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	// ordered delivery and acknowledgement
+	send(0, 10)
+	recv(0, 10)
+	if !acked() {
+		t.Error("batches have not been acknowledged")
+	}
+
+	// reconnect after connection loss; batches delivered before are not delivered again, i.e.
+	// the duplicate would be received before message 10
+	s.mutex.Lock()
+	s.unacked = append(s.unacked, streamBatch{seq: s.seq,
+		msgs: []schemas.ACLMessage{{Sender: 7, Receiver: 0, Content: "duplicate"}}})
+	s.closeConn()
+	s.mutex.Unlock()
+	send(10, 20)
+	recv(10, 20)
+	if !acked() {
+		t.Error("batches have not been acknowledged after reconnect")
+	}
+
+	// batches sent via http after the stream failed are discarded if they have already been
+	// received via the stream
+	go agency.receiveMsgs()
+	cli, _ := newTestAgencyClient(serv.URL)
+	s.mutex.Lock()
+	session, seq := s.session, s.seq
+	s.mutex.Unlock()
+	post := func(seq uint64, content string) {
+		header := http.Header{}
+		header.Set(streamHeaderAgency, "agency-a")
+		header.Set(streamHeaderSession, session)
+		header.Set(streamHeaderSequence, strconv.FormatUint(seq, 10))
+		stat, err := cli.PostMsgsHeader(host, []schemas.ACLMessage{{Sender: 7, Receiver: 0,
+			Content: content}}, header)
+		if err != nil || stat != http.StatusCreated {
+			t.Fatal("post failed ", stat, err)
+		}
+	}
+	post(seq, "duplicate")
+	post(seq+1, "20")
+	recv(20, 21)
+
+	// agencies without stream support are served via fallback
+	legacy := httptest.NewServer(http.NotFoundHandler())
+	defer legacy.Close()
+	port, _ = strconv.Atoi(strings.Split(legacy.URL, ":")[2])
+	s = newMsgStream(host, "agency-a", port, func(session string, batch streamBatch) {
+		fallbackMsgs = append(fallbackMsgs, batch.msgs...)
+	}, logger)
+	err := s.send([]schemas.ACLMessage{{Sender: 7, Receiver: 0, Content: "x"}})
+	if err != errStreamUnsupported || len(fallbackMsgs) != 1 {
+		t.Error("expected fallback, got ", err, fallbackMsgs)
+	}
+}
+
+func BenchmarkPingPongStream(b *testing.B) {
+	// streams[i] is used to send messages to agencies[i]
+	var agencies []*Agency
+	var streams []*msgStream
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	for i := 0; i < 2; i++ {
+		agency, _ := newTestAgency(0)
+		serv := httptest.NewServer(agency.server(10000).Handler)
+		defer serv.Close()
+		_, host := newTestAgencyClient(serv.URL)
+		port, _ := strconv.Atoi(strings.Split(serv.URL, ":")[2])
+		agencies = append(agencies, agency)
+		streams = append(streams, newMsgStream(host, "agency", port, nil, logger))
+	}
+	msg := schemas.ACLMessage{Sender: 0, Receiver: 1, Content: "hello world",
+		Protocol: schemas.FIPAProtQuery, Performative: schemas.FIPAPerfInform,
+		AgencySender: "mas-0-agency-0-im-0.mas0agencies", AgencyReceiver: "mas-0-agency-1-im-0.mas0agencies"}
+	var received []chan bool
+	for i := range agencies {
+		// messages to unknown agents are handed over to retryDelivery; signal reception instead
+		ag := newTestAgents(1)[0]
+		ch := make(chan bool, 1)
+		received = append(received, ch)
+		agencies[i].localAgents[msg.Receiver] = ag
+		go func() {
+			for {
+				ag.ACL.RecvMessageWait()
+				ch <- true
+			}
+		}()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 2; j++ {
+			msg.Timestamp = time.Now()
+			err := streams[1-j].send([]schemas.ACLMessage{msg})
+			if err != nil {
+				b.Fatal(err)
+			}
+			<-received[1-j]
+		}
+	}
+}
+
+func TestInboxPolicies(t *testing.T) {
+	send := func(agents []*Agent, num int) {
+		for i := 0; i < num; i++ {
+			msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform,
+				strconv.Itoa(i))
+			agents[1].ACL.SendMessage(msg)
+		}
+	}
+
+	// drop newest
+	agents := newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 3,
+		Policy: schemas.InboxDropNewest})
+	send(agents, 5)
+	stats, _ := agents[0].ACL.GetInboxStats()
+	if stats.Depth != 3 || stats.Dropped != 2 {
+		t.Error("unexpected inbox stats ", stats)
+	}
+	msg, _ := agents[0].ACL.RecvMessageWait()
+	if msg.Content != "0" {
+		t.Error("expected oldest message, got ", msg.Content)
+	}
+
+	// drop oldest
+	agents = newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 3,
+		Policy: schemas.InboxDropOldest})
+	send(agents, 5)
+	msg, _ = agents[0].ACL.RecvMessageWait()
+	if msg.Content != "2" {
+		t.Error("expected message 2, got ", msg.Content)
+	}
+
+	// reject
+	agents = newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 3,
+		Policy: schemas.InboxReject})
+	send(agents, 3)
+	msg, _ = agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "3")
+	if err := agents[1].ACL.SendMessage(msg); err != ErrInboxFull {
+		t.Error("expected inbox full error, got ", err)
+	}
+	msg, err := agents[1].ACL.RecvMessageWait()
+	if err != nil || msg.Performative != schemas.FIPAPerfFailure || msg.Sender != 0 {
+		t.Error("expected failure, got ", msg.String(), err)
+	}
+	stats, _ = agents[0].ACL.GetInboxStats()
+	if stats.Rejected != 1 {
+		t.Error("unexpected inbox stats ", stats)
+	}
+
+	// block: messages delivered by the agency are queued without blocking the agency
+	agents = newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 3})
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			agents[0].ACL.deliver(schemas.ACLMessage{Receiver: 0, Content: strconv.Itoa(i)})
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery blocked")
+	}
+	stats, _ = agents[0].ACL.GetInboxStats()
+	if stats.Depth != 3 || stats.Queued != 2 {
+		t.Error("unexpected inbox stats ", stats)
+	}
+	for i := 0; i < 5; i++ {
+		msg, _ = agents[0].ACL.RecvMessageWait()
+		if msg.Content != strconv.Itoa(i) {
+			t.Error("expected message ", i, ", got ", msg.Content)
+		}
+	}
+
+	// block: a slow agent only delays messages to itself, not to other agents of the agency
+	agency, agents := newTestAgency(2)
+	agents[0].ACL.msgIn = newMsgQueue(3)
+	for i := range agents[0].ACL.deliverQueue {
+		agents[0].ACL.deliverQueue[i] = make(chan schemas.ACLMessage, 3)
+	}
+	go func() {
+		for i := 0; i < 10; i++ {
+			agency.deliverRemote(schemas.ACLMessage{Receiver: 0, Content: strconv.Itoa(i)})
+		}
+		agency.deliverRemote(schemas.ACLMessage{Receiver: 1, Content: "other"})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery blocked by slow agent")
+	}
+	msg, _ = agents[1].ACL.RecvMessageWait()
+	if msg.Content != "other" {
+		t.Error("expected message other, got ", msg.Content)
+	}
+	for i := 0; i < 10; i++ {
+		msg, _ = agents[0].ACL.RecvMessageWait()
+		if msg.Content != strconv.Itoa(i) {
+			t.Error("expected message ", i, ", got ", msg.Content)
+		}
+	}
+
+	// block: senders waiting for space are released when the receiver is closed
+	agents = newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 1})
+	send(agents, 1)
+	errs := make(chan error, 1)
+	go func() {
+		msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "1")
+		errs <- agents[1].ACL.SendMessage(msg)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	select {
+	case err = <-errs:
+		t.Fatal("expected sender to wait for space, got ", err)
+	default:
+	}
+	agents[0].ACL.close()
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Error("expected error for message to closed inbox")
+		}
+	case <-time.After(time.Second):
+		t.Error("sender not released")
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	// urgent messages overtake bulk messages waiting in the inbox and in the delivery queue
+	agents := newTestAgentsInbox(2, schemas.InboxConfig{Capacity: 3})
+	for i := 0; i < 5; i++ {
+		agents[0].ACL.deliver(schemas.ACLMessage{Receiver: 0, Content: strconv.Itoa(i),
+			Priority: schemas.PriorityLow})
+	}
+	agents[0].ACL.deliver(schemas.ACLMessage{Receiver: 0, Content: "normal"})
+	done := make(chan bool)
+	go func() {
+		agents[0].ACL.deliver(schemas.ACLMessage{Receiver: 0, Content: "trip",
+			Priority: schemas.PriorityHigh})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery of urgent message blocked")
+	}
+	expected := []string{"trip", "normal", "0", "1", "2", "3", "4"}
+	for i := range expected {
+		msg, _ := agents[0].ACL.RecvMessageWait()
+		if msg.Content != expected[i] {
+			t.Error("expected message ", expected[i], ", got ", msg.Content)
+		}
+	}
+
+	// default priority of protocol and priority of replies
+	agents[1].ACL.SetProtocolPriority(schemas.FIPAProtRequest, schemas.PriorityHigh)
+	msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtRequest, schemas.FIPAPerfRequest, "")
+	if msg.Priority != schemas.PriorityHigh {
+		t.Error("expected default priority of protocol, got ", msg.Priority)
+	}
+	reply, _ := agents[0].ACL.NewReply(msg, schemas.FIPAPerfAgree, "")
+	if reply.Priority != schemas.PriorityHigh {
+		t.Error("expected priority of request for reply, got ", reply.Priority)
+	}
+}
+
+func TestAgentLifecycle(t *testing.T) {
+	agency, agents := newTestAgency(2)
+	started := make(chan *Agent, 10)
+	agency.agentTask = func(ag *Agent) error {
+		started <- ag
+		return nil
+	}
+	serv := httptest.NewServer(agency.server(10000).Handler)
+	defer serv.Close()
+	cli, host := newTestAgencyClient(serv.URL)
+	handled := make(chan string, 10)
+	behavior, _ := agents[0].NewMessageBehavior(schemas.FIPAProtRequest, nil,
+		func(msg schemas.ACLMessage) error {
+			handled <- msg.Content
+			return nil
+		})
+	behavior.Start()
+
+	// suspended agents buffer messages
+	httpStatus, err := cli.SuspendAgent(host, 0)
+	if err != nil || httpStatus != http.StatusOK {
+		t.Fatal("suspend failed ", httpStatus, err)
+	}
+	if stat, _ := agency.getAgentStatus(0); stat.Code != status.Suspended {
+		t.Error("expected status suspended, got ", stat.Code)
+	}
+	msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtRequest, schemas.FIPAPerfRequest, "a")
+	agents[1].ACL.SendMessage(msg)
+	select {
+	case <-handled:
+		t.Error("message handled by suspended agent")
+	case <-time.After(time.Millisecond * 50):
+	}
+	if stats, _ := agents[0].ACL.GetInboxStats(); stats.Buffered != 1 {
+		t.Error("unexpected inbox stats ", stats)
+	}
+
+	// buffered messages are delivered after resume
+	httpStatus, err = cli.ResumeAgent(host, 0)
+	if err != nil || httpStatus != http.StatusOK {
+		t.Fatal("resume failed ", httpStatus, err)
+	}
+	select {
+	case content := <-handled:
+		if content != "a" {
+			t.Error("expected message a, got ", content)
+		}
+	case <-time.After(time.Second):
+		t.Error("buffered message not delivered")
+	}
+	if stat, _ := agency.getAgentStatus(0); stat.Code != status.Running {
+		t.Error("expected status running, got ", stat.Code)
+	}
+
+	// restarted agents keep their ID and messages not yet taken
+	msg, _ = agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "b")
+	agents[1].ACL.SendMessage(msg)
+	httpStatus, err = cli.RestartAgent(host, 0)
+	if err != nil || httpStatus != http.StatusOK {
+		t.Fatal("restart failed ", httpStatus, err)
+	}
+	select {
+	case ag := <-started:
+		if ag == agents[0] || ag.GetAgentID() != 0 {
+			t.Error("agent task not executed for new agent 0")
+		}
+		msg, err = ag.ACL.RecvMessageWait()
+		if err != nil || msg.Content != "b" {
+			t.Error("expected message b, got ", msg.Content, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("agent not restarted")
+	}
+	if agents[0].getStatus().Code != status.Terminated {
+		t.Error("old instance of agent not terminated")
+	}
+
+	httpStatus, _ = cli.SuspendAgent(host, 5)
+	if httpStatus != http.StatusNotFound {
+		t.Error("expected not found for unknown agent, got ", httpStatus)
+	}
+}
+
+// TestSuspendDuringResume checks that a suspension during the delivery of buffered messages is
+// not cleared by the delivery
+func TestSuspendDuringResume(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	acl := newACL(context.Background(), 0, newMsgQueue(1), schemas.InboxBlock, nil, nil, nil,
+		logger, logger)
+	acl.suspend()
+	for _, content := range []string{"a", "b", "c"} {
+		acl.newIncomingMessage(schemas.ACLMessage{Receiver: 0, Content: content})
+	}
+	acl.resume()
+	// the delivery blocks on the full inbox
+	for acl.msgIn.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	acl.suspend()
+	for _, content := range []string{"a", "b", "c"} {
+		msg, err := acl.RecvMessageWait()
+		if err != nil || msg.Content != content {
+			t.Fatal("expected message ", content, ", got ", msg.Content, err)
+		}
+	}
+	time.Sleep(time.Millisecond * 20)
+	acl.newIncomingMessage(schemas.ACLMessage{Receiver: 0, Content: "d"})
+	acl.mutex.Lock()
+	suspended, buffered := acl.suspended, len(acl.msgSuspended)
+	acl.mutex.Unlock()
+	if !suspended || buffered != 1 {
+		t.Error("suspension cleared by delivery of buffered messages")
+	}
+}
+
+func TestAgentMigration(t *testing.T) {
+	target, _ := newTestAgency(0)
+	started := make(chan *Agent, 10)
+	target.agentTask = func(ag *Agent) error {
+		started <- ag
+		return nil
+	}
+	serv := httptest.NewServer(target.server(10000).Handler)
+	defer serv.Close()
+	cli, host := newTestAgencyClient(serv.URL)
+	target.info.Name = host
+	go target.receiveMsgs()
+	source, agents := newTestAgency(2)
+	source.info.Name = "agency-source"
+	source.agencyClient = cli
+	agents[1].ACL.aclLookup = source.aclLookup
+	sourceServ := httptest.NewServer(source.server(10000).Handler)
+	defer sourceServ.Close()
+	sourceCli, sourceHost := newTestAgencyClient(sourceServ.URL)
+
+	// messages not yet taken by the agent move with it
+	msg, _ := agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "a")
+	agents[1].ACL.SendMessage(msg)
+	time.Sleep(time.Millisecond * 50)
+
+	// a failed handover leaves the agent running in the source agency
+	target.mutex.Lock()
+	target.localAgents[0] = newTestAgents(1)[0]
+	target.mutex.Unlock()
+	httpStatus, _ := sourceCli.MigrateAgent(sourceHost, 0, host)
+	if httpStatus == http.StatusOK {
+		t.Error("expected migration to fail")
+	}
+	if stat, _ := source.getAgentStatus(0); stat.Code != status.Running {
+		t.Error("expected status running after failed migration, got ", stat.Code)
+	}
+	target.mutex.Lock()
+	delete(target.localAgents, 0)
+	target.mutex.Unlock()
+
+	httpStatus, err := sourceCli.MigrateAgent(sourceHost, 0, host)
+	if err != nil || httpStatus != http.StatusOK {
+		t.Fatal("migration failed ", httpStatus, err)
+	}
+	var migrated *Agent
+	select {
+	case migrated = <-started:
+		if migrated.GetAgentID() != 0 {
+			t.Fatal("wrong agent started in target agency ", migrated.GetAgentID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("agent not started in target agency")
+	}
+	msg, err = migrated.ACL.RecvMessageWait()
+	if err != nil || msg.Content != "a" {
+		t.Error("expected message a, got ", msg.Content, err)
+	}
+	if _, err = source.getAgentStatus(0); err == nil {
+		t.Error("agent still present in source agency")
+	}
+	if agents[0].getStatus().Code != status.Terminated {
+		t.Error("old instance of agent not terminated")
+	}
+
+	// a repeated handover of the same migration succeeds without starting the agent again
+	target.mutex.Lock()
+	migration := schemas.AgentMigration{ID: target.migrations[0], Agent: migrated.getAgentInfo()}
+	target.mutex.Unlock()
+	httpStatus, err = cli.PostMigration(host, migration)
+	if err != nil || httpStatus != http.StatusCreated {
+		t.Error("repeated handover failed ", httpStatus, err)
+	}
+	migration.ID = "other"
+	httpStatus, _ = cli.PostMigration(host, migration)
+	if httpStatus == http.StatusCreated {
+		t.Error("expected handover of other migration to fail")
+	}
+	select {
+	case <-started:
+		t.Error("agent started again")
+	default:
+	}
+
+	// messages of local senders are forwarded to the new location
+	msg, _ = agents[1].ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "b")
+	err = agents[1].ACL.SendMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan schemas.ACLMessage, 1)
+	go func() {
+		msg, _ := migrated.ACL.RecvMessageWait()
+		done <- msg
+	}()
+	select {
+	case msg = <-done:
+		if msg.Content != "b" {
+			t.Error("expected message b, got ", msg.Content)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("message not forwarded to migrated agent")
+	}
+	httpStatus, _ = sourceCli.MigrateAgent(sourceHost, 5, host)
+	if httpStatus != http.StatusNotFound {
+		t.Error("expected not found for unknown agent, got ", httpStatus)
+	}
+}
+
+// TestConcurrentMigrationHandover checks that concurrent handovers of the same migration start the
+// agent only once
+func TestConcurrentMigrationHandover(t *testing.T) {
+	target, _ := newTestAgency(0)
+	started := make(chan *Agent, 50)
+	target.agentTask = func(ag *Agent) error {
+		started <- ag
+		return nil
+	}
+	migration := schemas.AgentMigration{ID: "agency-source/0/1",
+		Agent:    schemas.AgentInfo{ID: 0, Address: schemas.Address{Agency: target.info.Name}},
+		Messages: []schemas.ACLMessage{{Receiver: 0, Content: "a"}}}
+	errs := make(chan error, 50)
+	begin := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		go func() {
+			<-begin
+			errs <- target.receiveMigration(migration)
+		}()
+	}
+	close(begin)
+	for i := 0; i < 50; i++ {
+		if err := <-errs; err != nil {
+			t.Error("handover failed ", err)
+		}
+	}
+	var migrated *Agent
+	select {
+	case migrated = <-started:
+	case <-time.After(time.Second):
+		t.Fatal("agent not started")
+	}
+	time.Sleep(time.Millisecond * 20)
+	select {
+	case <-started:
+		t.Error("agent started more than once")
+	default:
+	}
+	if n := migrated.ACL.msgIn.len(); n != 1 {
+		t.Error("expected one message in inbox, got ", n)
+	}
+}
+
+func TestAgentSupervision(t *testing.T) {
+	// ams records reported status
+	reports := make(chan schemas.Status, 20)
+	ams := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var agentStatus schemas.Status
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &agentStatus)
+		reports <- agentStatus
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ams.Close()
+	amsAddr := strings.Split(strings.TrimPrefix(ams.URL, "http://"), ":")
+
+	// failing agent task is restarted up to the maximum number of restarts
+	agency, agents := newTestAgency(1)
+	agency.amsClient = client.NewAMSClient(time.Second, time.Millisecond*10, 1)
+	agency.amsClient.Host = amsAddr[0]
+	agency.amsClient.Port, _ = strconv.Atoi(amsAddr[1])
+	started := make(chan *Agent, 10)
+	agency.agentTask = func(ag *Agent) error {
+		started <- ag
+		panic("task failed")
+	}
+	agents[0].info.Spec.Supervision = schemas.SupervisionConfig{
+		Policy:      schemas.RestartOnFailure,
+		MaxRestarts: 2,
+		Backoff:     1,
+	}
+	agents[0].startAgent(agency.agentTask, agency.superviseAgent)
+	var last *Agent
+	for i := 0; i < 3; i++ {
+		select {
+		case last = <-started:
+		case <-time.After(time.Second):
+			t.Fatal("agent not restarted, number of starts: ", i)
+		}
+	}
+	select {
+	case <-started:
+		t.Error("agent restarted more often than permitted")
+	case <-time.After(time.Millisecond * 100):
+	}
+	stat, err := agency.getAgentStatus(0)
+	if err != nil || stat.Code != status.Error || stat.Restarts != 2 ||
+		!strings.Contains(stat.LastError, "task failed") {
+		t.Error("unexpected status of failed agent ", stat, err)
+	}
+	if last.getStatus().Code != status.Error || len(reports) == 0 {
+		t.Error("failure not reported")
+	}
+	for len(reports) > 0 {
+		<-reports
+	}
+
+	// panicking behaviors terminate agents with policy never without affecting the agency
+	agency, agents = newTestAgency(2)
+	agency.amsClient = client.NewAMSClient(time.Second, time.Millisecond*10, 1)
+	agency.amsClient.Host = amsAddr[0]
+	agency.amsClient.Port, _ = strconv.Atoi(amsAddr[1])
+	agency.agentTask = func(ag *Agent) error {
+		if ag.GetAgentID() == 0 {
+			behavior, _ := ag.NewPeriodicBehavior(time.Millisecond, func() error {
+				panic("behavior failed")
+			})
+			behavior.Start()
+		}
+		return nil
+	}
+	for i := range agents {
+		agents[i].startAgent(agency.agentTask, agency.superviseAgent)
+	}
+	select {
+	case stat = <-reports:
+		if stat.Code != status.Error || !strings.Contains(stat.LastError, "behavior failed") {
+			t.Error("unexpected status reported ", stat)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failure of behavior not reported")
+	}
+	if agents[0].getStatus().Code != status.Error || agents[1].getStatus().Code != status.Running {
+		t.Error("unexpected status of agents ", agents[0].getStatus(), agents[1].getStatus())
+	}
+
+	config := schemas.SupervisionConfig{Backoff: 100, MaxBackoff: 500}
+	if restartBackoff(config, 0) != time.Millisecond*100 ||
+		restartBackoff(config, 2) != time.Millisecond*400 ||
+		restartBackoff(config, 10) != time.Millisecond*500 {
+		t.Error("unexpected restart backoff")
+	}
+}
+
+func TestAgentContext(t *testing.T) {
+	agents := newTestAgents(2)
+	// receive with expired context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	_, err := agents[0].ACL.RecvMessageWaitContext(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Expected deadline to be exceeded, got ", err)
+	}
+	// termination releases blocked receive and terminates behaviors
+	behavior, _ := agents[1].NewPeriodicBehavior(time.Hour, func() error {
+		return nil
+	})
+	behavior.Start()
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := agents[1].ACL.RecvMessageWait()
+		recvErr <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	agents[1].Terminate()
+	select {
+	case err = <-recvErr:
+		if err == nil {
+			t.Error("Expected error on receive of terminated agent")
+		}
+	case <-time.After(time.Second):
+		t.Error("Receive not released on termination")
+	}
+	select {
+	case <-behavior.Done():
+	case <-time.After(time.Second):
+		t.Error("Behavior not terminated")
+	}
+	if agents[1].Context().Err() == nil {
+		t.Error("Context of terminated agent not done")
+	}
+}
+
+func TestCompositeBehaviors(t *testing.T) {
+	agents := newTestAgents(1)
+	ag := agents[0]
+	steps := make(chan string, 100)
+	step := func(name string) func() error {
+		return func() error {
+			steps <- name
+			return nil
+		}
+	}
+	waitDone := func(behavior Behavior) {
+		select {
+		case <-behavior.Done():
+		case <-time.After(time.Second):
+			t.Fatal("behavior not terminated")
+		}
+	}
+	expectSteps := func(expected ...string) {
+		for _, exp := range expected {
+			if s := <-steps; s != exp {
+				t.Error("Expected step ", exp, ", got ", s)
+			}
+		}
+		if len(steps) > 0 {
+			t.Error("unexpected steps")
+		}
+	}
+
+	// sequential execution of one-shot and waker behaviors
+	first, _ := ag.NewWakerBehavior(time.Millisecond*20, step("a"))
+	second, _ := ag.NewOneShotBehavior(step("b"))
+	seq, err := ag.NewSequentialBehavior(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq.Start()
+	waitDone(seq)
+	expectSteps("a", "b")
+
+	// parallel behavior terminates with first child and stops the others
+	fast, _ := ag.NewOneShotBehavior(step("fast"))
+	slow, _ := ag.NewWakerBehavior(time.Hour, step("slow"))
+	periodic, _ := ag.NewPeriodicBehavior(time.Hour, step("periodic"))
+	par, err := ag.NewParallelBehavior(ParallelWhenAny, fast, slow, periodic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	par.Start()
+	waitDone(par)
+	waitDone(slow)
+	waitDone(periodic)
+	expectSteps("fast")
+	if _, err = ag.NewParallelBehavior(4, fast, slow); err == nil {
+		t.Error("Expected error for illegal completion")
+	}
+
+	// fsm loops until counter is reached
+	fsm, _ := ag.NewFSMBehavior()
+	counter := 0
+	fsm.RegisterFirstState("count", func() (Behavior, error) {
+		return ag.NewOneShotBehavior(func() error {
+			counter++
+			return nil
+		})
+	}, func() string {
+		if counter < 3 {
+			return "again"
+		}
+		return "finished"
+	})
+	fsm.RegisterLastState("end", func() (Behavior, error) {
+		return ag.NewOneShotBehavior(step("end"))
+	})
+	if err = fsm.RegisterTransition("count", "count", "again"); err != nil {
+		t.Error(err)
+	}
+	if err = fsm.RegisterTransition("count", "end", "finished"); err != nil {
+		t.Error(err)
+	}
+	if err = fsm.RegisterDefaultTransition("end", "count"); err == nil {
+		t.Error("Expected error for transition from last state")
+	}
+	fsm.Start()
+	waitDone(fsm)
+	expectSteps("end")
+	if counter != 3 {
+		t.Error("Expected 3 executions of state, got ", counter)
+	}
+
+	// periodic and message behaviors terminate if their handler returns ErrBehaviorDone
+	runs := 0
+	periodic, _ = ag.NewPeriodicBehavior(time.Millisecond, func() error {
+		runs++
+		if runs == 2 {
+			return ErrBehaviorDone
+		}
+		return nil
+	})
+	msgBehavior, _ := ag.NewMessageBehavior(schemas.FIPAProtNone, nil,
+		func(msg schemas.ACLMessage) error {
+			steps <- msg.Content
+			return ErrBehaviorDone
+		})
+	last, _ := ag.NewOneShotBehavior(step("last"))
+	seq, _ = ag.NewSequentialBehavior(periodic, msgBehavior, last)
+	seq.Start()
+	for registered := false; !registered; {
+		time.Sleep(time.Millisecond)
+		ag.ACL.mutex.Lock()
+		registered = ag.ACL.msgInProtocol[schemas.FIPAProtNone] != nil
+		ag.ACL.mutex.Unlock()
+	}
+	msg, _ := ag.ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "msg")
+	ag.ACL.SendMessage(msg)
+	waitDone(seq)
+	expectSteps("msg", "last")
+	if runs != 2 {
+		t.Error("Expected 2 runs of periodic behavior, got ", runs)
+	}
+
+	// messages left when a message behavior finishes are passed on instead of being discarded
+	protRegistered := func() (queue *msgQueue) {
+		for queue == nil {
+			time.Sleep(time.Millisecond)
+			ag.ACL.mutex.Lock()
+			queue = ag.ACL.msgInProtocol[schemas.FIPAProtNone]
+			ag.ACL.mutex.Unlock()
+		}
+		return
+	}
+	var queue *msgQueue
+	firstMsg, _ := ag.NewMessageBehavior(schemas.FIPAProtNone, nil,
+		func(msg schemas.ACLMessage) error {
+			steps <- msg.Content
+			msg, _ = ag.ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "b")
+			ag.ACL.SendMessage(msg)
+			for queue.len() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return ErrBehaviorDone
+		})
+	secondMsg, _ := ag.NewMessageBehavior(schemas.FIPAProtNone, nil,
+		func(msg schemas.ACLMessage) error {
+			steps <- msg.Content
+			return ErrBehaviorDone
+		})
+	seq, _ = ag.NewSequentialBehavior(firstMsg, secondMsg)
+	seq.Start()
+	queue = protRegistered()
+	msg, _ = ag.ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "a")
+	ag.ACL.SendMessage(msg)
+	for protRegistered() == queue {
+	}
+	msg, _ = ag.ACL.NewMessage(0, schemas.FIPAProtNone, schemas.FIPAPerfInform, "c")
+	ag.ACL.SendMessage(msg)
+	waitDone(seq)
+	expectSteps("a", "c")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if msg, _ = ag.ACL.RecvMessageWaitContext(ctx); msg.Content != "b" {
+		t.Error("Expected message b in agent inbox, got ", msg.Content)
+	}
+
+	// stopping a composite stops its current child
+	slow, _ = ag.NewWakerBehavior(time.Hour, step("slow"))
+	seq, _ = ag.NewSequentialBehavior(slow)
+	seq.Start()
+	time.Sleep(time.Millisecond * 10)
+	seq.Stop()
+	waitDone(seq)
+	waitDone(slow)
+	expectSteps()
+}
+
+// testClock is a manually advanced clock for scheduled behaviors
+type testClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) NewTimer(d time.Duration) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	timer := &testTimer{deadline: clock.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- clock.now
+	} else {
+		clock.timers = append(clock.timers, timer)
+	}
+	return timer
+}
+
+// Advance sets the clock forward and fires all expired timers
+func (clock *testClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+	var pending []*testTimer
+	for _, timer := range clock.timers {
+		if timer.deadline.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- clock.now
+		}
+	}
+	clock.timers = pending
+}
+
+// waiting returns the number of timers that have not expired
+func (clock *testClock) waiting() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return len(clock.timers)
+}
+
+func (timer *testTimer) C() <-chan time.Time { return timer.c }
+
+func (timer *testTimer) Stop() bool { return true }
+
+func TestScheduledBehavior(t *testing.T) {
+	sched, err := ParseCron("0,15,30,45 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2021, time.March, 1, 10, 7, 30, 0, time.UTC)
+	next, _ := sched.Next(base)
+	if !next.Equal(time.Date(2021, time.March, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Error("unexpected cron activation ", next)
+	}
+	sched, _ = ParseCron("30 8 * * 1-5")
+	next, _ = sched.Next(time.Date(2021, time.March, 5, 9, 0, 0, 0, time.UTC)) // friday
+	if !next.Equal(time.Date(2021, time.March, 8, 8, 30, 0, 0, time.UTC)) {
+		t.Error("unexpected cron activation ", next)
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err = ParseCron(expr); err == nil {
+			t.Error("Expected error for cron expression ", expr)
+		}
+	}
+
+	agents := newTestAgents(1)
+	// runs of fixed rate schedule aligned to quarter hours according to missed runs policy
+	runSchedule := func(policy int) (runs []time.Time) {
+		clock := &testClock{now: base}
+		sched, _ := NewFixedRateSchedule(base.Truncate(time.Minute*15), time.Minute*15)
+		scheduled := make(chan time.Time, 100)
+		behavior, err := agents[0].NewScheduledBehavior(sched,
+			ScheduleConfig{MissedRuns: policy, Clock: clock}, func(s time.Time) error {
+				scheduled <- s
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		behavior.Start()
+		// wait for timer of first run and advance the clock by one hour
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Hour)
+		for clock.waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		behavior.Stop()
+		<-behavior.Done()
+		close(scheduled)
+		for s := range scheduled {
+			runs = append(runs, s)
+		}
+		return
+	}
+	quarter := func(minute int) time.Time {
+		return time.Date(2021, time.March, 1, 10, 0, 0, 0, time.UTC).Add(
+			time.Duration(minute) * time.Minute)
+	}
+	expected := map[int][]time.Time{
+		MissedRunSkip: nil,
+		MissedRunOnce: {quarter(60)},
+		MissedRunAll:  {quarter(15), quarter(30), quarter(45), quarter(60)},
+	}
+	for policy, exp := range expected {
+		runs := runSchedule(policy)
+		if len(runs) != len(exp) {
+			t.Error("Expected runs ", exp, " for policy ", policy, ", got ", runs)
+			continue
+		}
+		for i := range runs {
+			if !runs[i].Equal(exp[i]) {
+				t.Error("Expected runs ", exp, " for policy ", policy, ", got ", runs)
+				break
+			}
+		}
+	}
+
+	// timestamp schedule terminates after last run
+	sched, _ = NewTimestampSchedule(time.Now().Add(time.Millisecond*10),
+		time.Now().Add(time.Millisecond))
+	count := 0
+	behavior, _ := agents[0].NewScheduledBehavior(sched, ScheduleConfig{
+		Jitter: time.Millisecond}, func(s time.Time) error {
+		count++
+		return nil
+	})
+	behavior.Start()
+	select {
+	case <-behavior.Done():
+	case <-time.After(time.Second):
+		t.Fatal("scheduled behavior not terminated")
+	}
+	if count != 2 {
+		t.Error("Expected 2 runs, got ", count)
+	}
+}
+
+type testBid struct {
+	Item  string  `json:"item"`
+	Price float64 `json:"price"`
+}
+
+func TestContentCodecs(t *testing.T) {
+	agents := newTestAgents(2)
+	ont := NewOntology("market")
+	err := ont.RegisterConcept("bid", testBid{}, func(value interface{}) error {
+		if value.(testBid).Price < 0 {
+			return errors.New("negative price")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ont.RegisterConcept("offer", &testBid{}, nil); err == nil {
+		t.Error("Expected error for duplicate type")
+	}
+	for i := range agents {
+		agents[i].ACL.RegisterOntology(ont)
+	}
+
+	// typed values are sent and received with tagged language, encoding and ontology
+	msg, _ := agents[0].ACL.NewMessage(1, 0, schemas.FIPAPerfPropose, "")
+	msg.Encoding = EncodingBase64
+	err = agents[0].ACL.SendContent(msg, &testBid{Item: "power", Price: 4.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = agents[1].ACL.RecvMessageWait()
+	if msg.Language != LanguageJSON || msg.Ontology != "market" {
+		t.Error("message not tagged ", msg)
+	}
+	value, err := agents[1].ACL.Content(msg)
+	if bid, ok := value.(testBid); err != nil || !ok || bid.Item != "power" || bid.Price != 4.5 {
+		t.Error("unexpected content ", value, err)
+	}
+
+	// invalid values are not sent
+	msg, _ = agents[0].ACL.NewMessage(1, 0, schemas.FIPAPerfPropose, "")
+	if err = agents[0].ACL.SendContent(msg, testBid{Price: -1}); err == nil {
+		t.Error("Expected error for invalid value")
+	}
+	if err = agents[0].ACL.SendContent(msg, "string"); err == nil {
+		t.Error("Expected error for value without ontology")
+	}
+
+	// invalid content is answered with not understood
+	contents := []string{`{"bid":{"item":"power","price":-1}}`, `{"bid":{"color":"red"}}`,
+		`{"ask":{}}`, `no json`}
+	for _, content := range contents {
+		msg, _ = agents[0].ACL.NewMessage(1, 0, schemas.FIPAPerfPropose, content)
+		msg.Ontology = "market"
+		agents[0].ACL.SendMessage(msg)
+		msg, _ = agents[1].ACL.RecvMessageWait()
+		if _, err = agents[1].ACL.Content(msg); err == nil {
+			t.Error("Expected error for content ", content)
+		}
+		msg, _ = agents[0].ACL.RecvMessageWait()
+		if msg.Performative != schemas.FIPAPerfNotUnderstood || msg.Sender != 1 {
+			t.Error("Expected not understood reply, got ", msg)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	col := tracing.NewCollector()
+	defer col.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	newTracer := func(agency string) *tracing.Tracer {
+		return tracing.NewTracer(0, agency, tracing.NewOTLPExporter(col.URL(), time.Second,
+			time.Millisecond*10, 1), logger)
+	}
+
+	// agent 0 in agency target, agent 1 in agency source
+	target, targetAgents := newTestAgency(1)
+	target.info.Name = "agency-target"
+	target.tracer = newTracer(target.info.Name)
+	targetAgents[0].ACL.tracer = target.tracer
+	targetAgents[0].ACL.aclLookup = target.aclLookup
+	targetServ := httptest.NewServer(target.server(10000).Handler)
+	defer targetServ.Close()
+	source, sourceAgents := newTestAgency(2)
+	delete(source.localAgents, 0)
+	source.info.Name = "agency-source"
+	source.tracer = newTracer(source.info.Name)
+	sourceAgents[1].ACL.tracer = source.tracer
+	sourceAgents[1].ACL.aclLookup = source.aclLookup
+	sourceServ := httptest.NewServer(source.server(10000).Handler)
+	defer sourceServ.Close()
+	var host string
+	source.agencyClient, host = newTestAgencyClient(targetServ.URL)
+	target.agencyClient, _ = newTestAgencyClient(sourceServ.URL)
+	source.remoteACL(0, schemas.Address{Agency: host})
+	target.remoteACL(1, schemas.Address{Agency: host})
+	go target.receiveMsgs()
+	go source.receiveMsgs()
+
+	// request and reply form one trace
+	go func() {
+		req, err := targetAgents[0].ACL.RecvMessageWait()
+		if err != nil {
+			return
+		}
+		reply, _ := targetAgents[0].ACL.NewReply(req, schemas.FIPAPerfInform, "pong")
+		targetAgents[0].ACL.SendMessage(reply)
+	}()
+	msg, _ := sourceAgents[1].ACL.NewMessage(0, schemas.FIPAProtRequest,
+		schemas.FIPAPerfRequest, "ping")
+	reply, err := sourceAgents[1].ACL.SendMessageWaitReply(msg, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.TraceID) != 32 || len(reply.SpanID) != 16 {
+		t.Fatal("reply without trace ", reply.String())
+	}
+	expected := []struct {
+		name    string
+		agency  string
+		agentID int
+	}{
+		{"ACL send", "agency-source", 1},
+		{"agency send", "agency-source", 1},
+		{"agency receive", "agency-target", 0},
+		{"ACL receive", "agency-target", 0},
+		{"ACL send", "agency-target", 0},
+		{"agency send", "agency-target", 0},
+		{"agency receive", "agency-source", 1},
+		{"ACL receive", "agency-source", 1},
+	}
+	// the agency send span of the request may end after the reply has been received
+	var spans []schemas.Span
+	for i := 0; i < 100 && len(spans) < len(expected); i++ {
+		time.Sleep(time.Millisecond * 10)
+		source.tracer.Flush()
+		target.tracer.Flush()
+		spans = col.Trace(reply.TraceID)
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %+v", len(expected), spans)
+	}
+	// every span is caused by the previous one
+	parent := ""
+	for _, exp := range expected {
+		var span *schemas.Span
+		for i := range spans {
+			if spans[i].ParentSpanID == parent {
+				span = &spans[i]
+			}
+		}
+		if span == nil || span.Name != exp.name || span.Agency != exp.agency ||
+			span.AgentID != exp.agentID {
+			t.Fatalf("expected span %v with parent %q, got %+v", exp, parent, spans)
+		}
+		parent = span.SpanID
+	}
+	if parent != reply.SpanID {
+		t.Error("reply does not carry the span of its delivery")
+	}
+}
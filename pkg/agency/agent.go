@@ -48,9 +48,12 @@ THE SOFTWARE.
 package agency
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/client"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
@@ -70,7 +73,16 @@ type Agent struct {
 	masID      int         // ID of MAS agent is belongs to
 	masName    string
 	masCustom  string
-	status     int                 // Status of agent
+	info       schemas.AgentInfo   // info the agent has been created with; used for restarts
+	status     schemas.Status      // Status of agent
+	resumed    chan struct{}       // closed when the agent is resumed; nil if not suspended
+	supervise  func(*Agent, error) // called when the task or a behavior of the agent fails
+	failed     bool                // true after the first failure of the agent
+	taskDone   bool                // true after the task has returned
+	cosim      *cosim              // state of the co-simulation; nil if not active
+	steps      []*stepBehavior     // started step behaviors
+	ctx        context.Context     // done when the agent is terminated
+	cancel     context.CancelFunc  // cancels ctx
 	ACL        *ACL                // agent communication
 	Logger     *client.AgentLogger // logger object
 	MQTT       *AgentMQTT          // mqtt object
@@ -82,7 +94,8 @@ type Agent struct {
 
 // newAgent creates a new agent
 func newAgent(info schemas.AgentInfo, masName string, masCustom string,
-	msgIn chan schemas.ACLMessage, aclLookup func(int) (*ACL, error), logCol *client.LogCollector,
+	msgIn *msgQueue, inboxPolicy string, aclLookup func(int) (*ACL, error),
+	groupLookup func(func(schemas.AgentInfo) bool) ([]int, error), logCol *client.LogCollector,
 	logConfig schemas.LoggerConfig, mqttCol *mqttCollector, dfActive bool,
 	dfClient *client.DFClient, logErr *log.Logger, logInf *log.Logger) (ag *Agent) {
 	ag = &Agent{
@@ -96,18 +109,22 @@ func newAgent(info schemas.AgentInfo, masName string, masCustom string,
 		masCustom:  masCustom,
 		custom:     info.Spec.Custom,
 		customChan: nil,
+		info:       info,
+		status:     info.Status,
 		mutex:      &sync.Mutex{},
 		logError:   logErr,
 		logInfo:    logInf,
 		active:     true,
 	}
+	ag.ctx, ag.cancel = context.WithCancel(context.Background())
 	// in, out := ag.ACL.getCommDataChannels()
 	if logCol != nil {
 		ag.Logger = logCol.NewAgentLogger(ag.id, ag.logError, ag.logInfo)
 	}
-	ag.ACL = newACL(info.ID, msgIn, aclLookup, ag.Logger, logErr, logInf)
+	ag.ACL = newACL(ag.ctx, info.ID, msgIn, inboxPolicy, aclLookup, groupLookup, ag.Logger, logErr,
+		logInf)
 	if mqttCol != nil {
-		ag.MQTT = mqttCol.newAgentMQTT(ag.id, ag.Logger, ag.logError, ag.logInfo)
+		ag.MQTT = mqttCol.newAgentMQTT(ag.ctx, ag.id, ag.Logger, ag.logError, ag.logInfo)
 	}
 	if dfClient != nil {
 		ag.DF = client.NewAgentDF(ag.masID, ag.id, ag.nodeID, dfActive, dfClient, ag.logError,
@@ -116,21 +133,200 @@ func newAgent(info schemas.AgentInfo, masName string, masCustom string,
 	return
 }
 
-// startAgent starts an agent. It requires an agent task to be executed and the channel to send runtime errors to
-func (agent *Agent) startAgent(task func(*Agent) error, e chan error) (err error) {
+// startAgent starts an agent. It requires an agent task to be executed and the function that
+// supervises the agent in case of a failure
+func (agent *Agent) startAgent(task func(*Agent) error, supervise func(*Agent, error)) (err error) {
+	agent.mutex.Lock()
+	agent.supervise = supervise
+	agent.mutex.Unlock()
+	agent.setStatus(status.Running)
 	go func() {
-		err = task(agent)
+		defer agent.recoverPanic("agent task")
+		defer func() {
+			agent.mutex.Lock()
+			agent.taskDone = true
+			agent.mutex.Unlock()
+		}()
+		err := task(agent)
 		if err != nil {
-			agent.logError.Println("Agent ", agent.GetAgentID(), " encountered runtime error: ", err.Error())
-			agent.status = status.Error
-			e <- err
+			agent.fail(err)
 		}
 	}()
-	agent.status = status.Running
 	agent.logInfo.Println("Started Agent ", agent.GetAgentID())
 	return
 }
 
+// recoverPanic is to be deferred in go routines that execute user code of the agent. A panic is
+// recovered and handled as failure of the agent
+func (agent *Agent) recoverPanic(origin string) {
+	if r := recover(); r != nil {
+		agent.fail(errors.New("panic in " + origin + ": " + fmt.Sprint(r)))
+	}
+}
+
+// fail sets the status of the agent to error and hands it over to its supervisor. Only the first
+// failure of an active agent is handled
+func (agent *Agent) fail(err error) {
+	agent.mutex.Lock()
+	if agent.failed || !agent.active {
+		agent.mutex.Unlock()
+		return
+	}
+	agent.failed = true
+	agent.status.Code = status.Error
+	agent.status.LastUpdate = time.Now()
+	agent.status.LastError = err.Error()
+	supervise := agent.supervise
+	agent.mutex.Unlock()
+	agent.logError.Println("Agent ", agent.GetAgentID(), " encountered runtime error: ", err.Error())
+	agent.Logger.NewLog("error", "Agent failed", err.Error())
+	if supervise != nil {
+		go supervise(agent, err)
+	}
+}
+
+// Context returns a context that is done when the agent is terminated. It can be passed to
+// blocking calls of the agent task or behaviors in order to abort them on termination
+func (agent *Agent) Context() context.Context {
+	return agent.ctx
+}
+
+// Now returns the virtual time of the current step if the MAS is executed as co-simulation and
+// the wall-clock time otherwise
+func (agent *Agent) Now() (t time.Time) {
+	t, ok := agent.cosim.now()
+	if !ok {
+		t = time.Now()
+	}
+	return
+}
+
+// Step returns the number of the current step of the co-simulation. -1 is returned before the
+// first step and if the MAS is not executed as co-simulation
+func (agent *Agent) Step() (step int) {
+	step = agent.cosim.currentStep()
+	return
+}
+
+// registerStepBehavior registers a step behavior that is executed in every step
+func (agent *Agent) registerStepBehavior(behavior *stepBehavior) {
+	agent.mutex.Lock()
+	agent.steps = append(agent.steps, behavior)
+	agent.mutex.Unlock()
+}
+
+// deregisterStepBehavior removes a step behavior
+func (agent *Agent) deregisterStepBehavior(behavior *stepBehavior) {
+	agent.mutex.Lock()
+	for i := range agent.steps {
+		if agent.steps[i] == behavior {
+			agent.steps = append(agent.steps[:i], agent.steps[i+1:]...)
+			break
+		}
+	}
+	agent.mutex.Unlock()
+}
+
+// getStepBehaviors returns the registered step behaviors
+func (agent *Agent) getStepBehaviors() (behaviors []*stepBehavior) {
+	agent.mutex.Lock()
+	behaviors = append(behaviors, agent.steps...)
+	agent.mutex.Unlock()
+	return
+}
+
+// stepReady checks if the agent is ready for the next step, i.e. it has registered a step
+// behavior or its task has returned
+func (agent *Agent) stepReady() (ready bool) {
+	agent.mutex.Lock()
+	ready = agent.taskDone || len(agent.steps) > 0 || !agent.active || agent.failed
+	agent.mutex.Unlock()
+	return
+}
+
+// setStatus sets the status code of the agent
+func (agent *Agent) setStatus(code int) {
+	agent.mutex.Lock()
+	agent.status.Code = code
+	agent.status.LastUpdate = time.Now()
+	agent.mutex.Unlock()
+}
+
+// getStatus returns the status of the agent
+func (agent *Agent) getStatus() (ret schemas.Status) {
+	agent.mutex.Lock()
+	ret = agent.status
+	agent.mutex.Unlock()
+	return
+}
+
+// getAgentInfo returns the info of the agent with its current custom data
+func (agent *Agent) getAgentInfo() (ret schemas.AgentInfo) {
+	agent.mutex.Lock()
+	ret = agent.info
+	ret.Spec.Custom = agent.custom
+	ret.Status = agent.status
+	agent.mutex.Unlock()
+	return
+}
+
+// suspend pauses all behaviors of the agent. Incoming messages are buffered until the agent is
+// resumed
+func (agent *Agent) suspend() (err error) {
+	agent.mutex.Lock()
+	if !agent.active {
+		agent.mutex.Unlock()
+		err = errors.New("agent not active")
+		return
+	}
+	if agent.resumed == nil {
+		agent.resumed = make(chan struct{})
+	}
+	agent.mutex.Unlock()
+	err = agent.ACL.suspend()
+	if err != nil {
+		return
+	}
+	agent.setStatus(status.Suspended)
+	agent.logInfo.Println("Suspended agent ", agent.GetAgentID())
+	return
+}
+
+// resume continues the execution of a suspended agent and delivers the buffered messages
+func (agent *Agent) resume() (err error) {
+	agent.mutex.Lock()
+	if !agent.active {
+		agent.mutex.Unlock()
+		err = errors.New("agent not active")
+		return
+	}
+	if agent.resumed == nil {
+		agent.mutex.Unlock()
+		return
+	}
+	close(agent.resumed)
+	agent.resumed = nil
+	agent.mutex.Unlock()
+	err = agent.ACL.resume()
+	if err != nil {
+		return
+	}
+	agent.setStatus(status.Running)
+	agent.logInfo.Println("Resumed agent ", agent.GetAgentID())
+	return
+}
+
+// waitResumed blocks while the agent is suspended. It is called by behaviors before an action
+// is executed
+func (agent *Agent) waitResumed() {
+	agent.mutex.Lock()
+	resumed := agent.resumed
+	agent.mutex.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
 // GetAgentID returns the agent ID
 func (agent *Agent) GetAgentID() (ret int) {
 	agent.mutex.Lock()
@@ -231,7 +427,15 @@ func (agent *Agent) Terminate() {
 	agent.logInfo.Println("Terminating agent ", agent.GetAgentID())
 	agent.mutex.Lock()
 	agent.active = false
+	if agent.resumed != nil {
+		// release suspended behaviors so that they can terminate
+		close(agent.resumed)
+		agent.resumed = nil
+	}
+	agent.status.Code = status.Terminated
+	agent.status.LastUpdate = time.Now()
 	agent.mutex.Unlock()
+	agent.cancel()
 	agent.ACL.close()
 	agent.Logger.Close()
 	agent.MQTT.close()
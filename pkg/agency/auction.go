@@ -0,0 +1,353 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// implementation of the FIPA English Auction and FIPA Dutch Auction interaction protocols as
+// agent behaviors
+
+package agency
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// AuctionConfig holds the parameters of an auction
+type AuctionConfig struct {
+	Participants []int         // IDs of bidding agents
+	Item         string        // description of the auctioned item
+	StartPrice   float64       // price of the first round
+	Step         float64       // price increment (english) or decrement (dutch) per round
+	ReservePrice float64       // lowest price the item is sold for
+	RoundTimeout time.Duration // time to wait for bids in each round
+}
+
+// AuctionCall is the content of the call for proposals sent to the bidders in each round
+type AuctionCall struct {
+	Item  string  `json:"item"`
+	Round int     `json:"round"`
+	Price float64 `json:"price"`
+}
+
+// AuctionResult is the outcome of an auction which is sent to all participants
+type AuctionResult struct {
+	Item   string  `json:"item"`
+	Sold   bool    `json:"sold"`
+	Winner int     `json:"winner"` // ID of the winning agent; -1 if the item has not been sold
+	Price  float64 `json:"price"`
+}
+
+// auctioneerBehavior conducts one auction
+type auctioneerBehavior struct {
+	ag           *Agent // agent
+	protocol     int    // FIPAProtEnglishAuction or FIPAProtDutchAuction
+	config       AuctionConfig
+	handleResult func(AuctionResult) error // handler for the result of the auction
+	ctrl         chan int                  // control signals
+	done         chan struct{}             // closed when task has returned
+	span         *schemas.Span             // span of the auction; nil if tracing is not active
+	logInfo      *log.Logger
+}
+
+// NewEnglishAuctioneerBehavior creates a behavior that conducts an english auction. The price
+// starts at the start price and is raised by the step in each round in which a bid has been
+// placed. The first bidder of a round leads the auction and is not called in the next round.
+// The auction ends if no bid is placed within the round timeout. The item is sold to the
+// leading bidder if its bid is not lower than the reserve price. The result is sent to all
+// participants and passed to handleResult
+func (agent *Agent) NewEnglishAuctioneerBehavior(config AuctionConfig,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	behavior, err = agent.newAuctioneerBehavior(schemas.FIPAProtEnglishAuction, config,
+		handleResult)
+	return
+}
+
+// NewDutchAuctioneerBehavior creates a behavior that conducts a dutch auction. The price starts
+// at the start price and is lowered by the step in each round without bid. The item is sold to
+// the first bidder. The auction ends without sale once the price falls below the reserve price.
+// The result is sent to all participants and passed to handleResult
+func (agent *Agent) NewDutchAuctioneerBehavior(config AuctionConfig,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	behavior, err = agent.newAuctioneerBehavior(schemas.FIPAProtDutchAuction, config,
+		handleResult)
+	return
+}
+
+// newAuctioneerBehavior creates an auctioneer behavior for the given protocol
+func (agent *Agent) newAuctioneerBehavior(protocol int, config AuctionConfig,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	if len(config.Participants) == 0 {
+		err = errors.New("no participants")
+		return
+	}
+	if config.Step <= 0 {
+		err = errors.New("illegal price step")
+		return
+	}
+	if config.RoundTimeout <= 0 {
+		err = errors.New("illegal round timeout")
+		return
+	}
+	aucBehavior := &auctioneerBehavior{
+		ag:           agent,
+		protocol:     protocol,
+		config:       config,
+		handleResult: handleResult,
+		ctrl:         make(chan int, 10),
+		done:         make(chan struct{}),
+		logInfo:      agent.logInfo,
+	}
+	behavior = aucBehavior
+	return
+}
+
+// Start initiates the auction
+func (aucBehavior *auctioneerBehavior) Start() {
+	go aucBehavior.task()
+}
+
+// Stop aborts the auction
+func (aucBehavior *auctioneerBehavior) Stop() {
+	aucBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the auction has ended
+func (aucBehavior *auctioneerBehavior) Done() <-chan struct{} {
+	return aucBehavior.done
+}
+
+// task conducts the auction and announces the result
+func (aucBehavior *auctioneerBehavior) task() {
+	defer close(aucBehavior.done)
+	defer aucBehavior.ag.recoverPanic("auctioneer behavior")
+	agentID := aucBehavior.ag.GetAgentID()
+	aucBehavior.logInfo.Println("Starting auctioneer behavior for agent ", agentID,
+		" and protocol ", aucBehavior.protocol)
+	aucBehavior.span = aucBehavior.ag.ACL.startSpan("auction")
+	defer aucBehavior.ag.ACL.endSpan(aucBehavior.span, nil)
+	var result AuctionResult
+	var ok bool
+	if aucBehavior.protocol == schemas.FIPAProtEnglishAuction {
+		result, ok = aucBehavior.englishAuction()
+	} else {
+		result, ok = aucBehavior.dutchAuction()
+	}
+	if !ok {
+		aucBehavior.logInfo.Println("Terminating auctioneer behavior for agent ", agentID)
+		return
+	}
+	content, _ := json.Marshal(result)
+	for _, id := range aucBehavior.config.Participants {
+		msg, _ := aucBehavior.ag.ACL.NewMessage(id, aucBehavior.protocol,
+			schemas.FIPAPerfInform, string(content))
+		setSpan(&msg, aucBehavior.span)
+		err := aucBehavior.ag.ACL.SendMessage(msg)
+		if err != nil {
+			aucBehavior.ag.logError.Println("Auction of agent ", agentID, ": ", err)
+		}
+	}
+	if aucBehavior.handleResult != nil {
+		aucBehavior.handleResult(result)
+	}
+}
+
+// englishAuction raises the price until no more bids are placed
+func (aucBehavior *auctioneerBehavior) englishAuction() (result AuctionResult, ok bool) {
+	result.Item = aucBehavior.config.Item
+	leader := -1
+	price := aucBehavior.config.StartPrice
+	for round := 0; ; round++ {
+		var bidders []int
+		for _, id := range aucBehavior.config.Participants {
+			if id != leader {
+				bidders = append(bidders, id)
+			}
+		}
+		var bids []schemas.ACLMessage
+		bids, ok = aucBehavior.callForBids(bidders, round, price, len(bidders))
+		if !ok {
+			return
+		}
+		if len(bids) == 0 {
+			break
+		}
+		leader = bids[0].Sender
+		result.Winner = leader
+		result.Price = price
+		price += aucBehavior.config.Step
+	}
+	result.Sold = leader != -1 && result.Price >= aucBehavior.config.ReservePrice
+	if !result.Sold {
+		result.Winner = -1
+		result.Price = 0
+	}
+	return
+}
+
+// dutchAuction lowers the price until the first bid is placed
+func (aucBehavior *auctioneerBehavior) dutchAuction() (result AuctionResult, ok bool) {
+	result.Item = aucBehavior.config.Item
+	result.Winner = -1
+	price := aucBehavior.config.StartPrice
+	for round := 0; price >= aucBehavior.config.ReservePrice; round++ {
+		var bids []schemas.ACLMessage
+		bids, ok = aucBehavior.callForBids(aucBehavior.config.Participants, round, price, 1)
+		if !ok {
+			return
+		}
+		if len(bids) > 0 {
+			result.Sold = true
+			result.Winner = bids[0].Sender
+			result.Price = price
+			return
+		}
+		price -= aucBehavior.config.Step
+	}
+	ok = true
+	return
+}
+
+// callForBids sends a call for proposals to the bidders and returns the bids received within the
+// round timeout. The round ends early once maxBids bids have been received or all bidders have
+// answered
+func (aucBehavior *auctioneerBehavior) callForBids(bidders []int, round int, price float64,
+	maxBids int) (bids []schemas.ACLMessage, ok bool) {
+	conv, err := aucBehavior.ag.ACL.NewConversation(aucBehavior.config.RoundTimeout)
+	if err != nil {
+		aucBehavior.ag.logError.Println("Auction of agent ", aucBehavior.ag.GetAgentID(), ": ",
+			err)
+		return
+	}
+	defer conv.Close()
+	content, _ := json.Marshal(AuctionCall{
+		Item:  aucBehavior.config.Item,
+		Round: round,
+		Price: price,
+	})
+	for _, id := range bidders {
+		msg, _ := aucBehavior.ag.ACL.NewMessage(id, aucBehavior.protocol,
+			schemas.FIPAPerfCallForProposal, string(content))
+		setSpan(&msg, aucBehavior.span)
+		conv.SendMessage(msg)
+	}
+	for answers := 0; answers < len(bidders) && len(bids) < maxBids; answers++ {
+		var msgs []schemas.ACLMessage
+		msgs, ok = conv.recvReplies(1, aucBehavior.ctrl)
+		if !ok || len(msgs) == 0 {
+			return
+		}
+		if msgs[0].Performative == schemas.FIPAPerfPropose {
+			bids = append(bids, msgs[0])
+		}
+	}
+	ok = true
+	return
+}
+
+// NewEnglishAuctionBidderBehavior creates a behavior that takes part in english auctions. bid is
+// called for each call for proposals and decides whether to bid the called price. The result of
+// the auction is passed to handleResult which may be nil
+func (agent *Agent) NewEnglishAuctionBidderBehavior(bid func(call AuctionCall) bool,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	behavior, err = agent.newBidderBehavior(schemas.FIPAProtEnglishAuction, bid, handleResult)
+	return
+}
+
+// NewDutchAuctionBidderBehavior creates a behavior that takes part in dutch auctions. bid is
+// called for each call for proposals and decides whether to bid the called price. The result of
+// the auction is passed to handleResult which may be nil
+func (agent *Agent) NewDutchAuctionBidderBehavior(bid func(call AuctionCall) bool,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	behavior, err = agent.newBidderBehavior(schemas.FIPAProtDutchAuction, bid, handleResult)
+	return
+}
+
+// newBidderBehavior creates a bidder behavior for the given protocol
+func (agent *Agent) newBidderBehavior(protocol int, bid func(call AuctionCall) bool,
+	handleResult func(AuctionResult) error) (behavior Behavior, err error) {
+	if bid == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	handlePerformative := map[int]func(schemas.ACLMessage) error{
+		schemas.FIPAPerfCallForProposal: func(cfp schemas.ACLMessage) (err error) {
+			if !cfp.ReplyBy.IsZero() && time.Now().After(cfp.ReplyBy) {
+				return
+			}
+			var call AuctionCall
+			err = json.Unmarshal([]byte(cfp.Content), &call)
+			if err != nil {
+				return
+			}
+			perf := schemas.FIPAPerfRefuse
+			if bid(call) {
+				perf = schemas.FIPAPerfPropose
+			}
+			reply, _ := agent.ACL.NewReply(cfp, perf, cfp.Content)
+			err = agent.ACL.SendMessage(reply)
+			return
+		},
+		schemas.FIPAPerfInform: func(inform schemas.ACLMessage) (err error) {
+			if handleResult == nil {
+				return
+			}
+			var result AuctionResult
+			err = json.Unmarshal([]byte(inform.Content), &result)
+			if err != nil {
+				return
+			}
+			err = handleResult(result)
+			return
+		},
+	}
+	behavior, err = agent.NewMessageBehavior(protocol, handlePerformative,
+		func(msg schemas.ACLMessage) (err error) {
+			agent.logInfo.Println("Ignoring auction message for agent ", msg.Receiver)
+			return
+		})
+	return
+}
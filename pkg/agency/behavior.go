@@ -52,10 +52,18 @@ import (
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 )
 
-// Behavior defines execution of a certain behavior
+// ErrBehaviorDone is returned by the handler of a message, MQTT, periodic, custom update or
+// scheduled behavior to terminate the behavior. This allows to use these behaviors as children
+// of sequential, parallel and FSM behaviors which continue after a child has terminated
+var ErrBehaviorDone = errors.New("behavior done")
+
+// Behavior defines execution of a certain behavior. Behaviors are paused while the agent is
+// suspended and terminate as soon as the agent is terminated. A panic in a handler is recovered
+// and handled as failure of the agent
 type Behavior interface {
 	Start()
 	Stop()
+	Done() <-chan struct{} // closed when the started behavior has terminated
 }
 
 // aclProtocolBehavior describes how messages with a certain protocol should be handled
@@ -64,8 +72,9 @@ type aclProtocolBehavior struct {
 	protocol           int                                    // indicates for which protocol handler should be used
 	handlePerformative map[int]func(schemas.ACLMessage) error // handler functions for single performative acts
 	handleDefault      func(schemas.ACLMessage) error         // default handler if no handler for performative is registered
-	msgIn              chan schemas.ACLMessage                // msg inbox
+	msgIn              *msgQueue                              // msg inbox
 	ctrl               chan int                               // control signals
+	done               chan struct{}                          // closed when task has returned
 	logInfo            *log.Logger
 }
 
@@ -82,8 +91,9 @@ func (agent *Agent) NewMessageBehavior(protocol int,
 		protocol:           protocol,
 		handlePerformative: handlePerformative,
 		handleDefault:      handleDefault,
-		msgIn:              make(chan schemas.ACLMessage, 1000),
+		msgIn:              newMsgQueue(agent.ACL.inboxCapacity()),
 		ctrl:               make(chan int, 10),
+		done:               make(chan struct{}),
 		logInfo:            agent.logInfo,
 	}
 	behavior = protBehavior
@@ -100,29 +110,47 @@ func (protBehavior *aclProtocolBehavior) Start() {
 
 // task performs the multiplexing of messages with different performative to handler functions
 func (protBehavior *aclProtocolBehavior) task() {
+	defer close(protBehavior.done)
+	defer protBehavior.ag.recoverPanic("acl behavior")
 	protBehavior.logInfo.Println("Starting acl behavior for agent ", protBehavior.ag.GetAgentID(),
 		" and protocol ", protBehavior.protocol)
 	for {
-		protBehavior.ag.mutex.Lock()
-		act := protBehavior.ag.active
-		protBehavior.ag.mutex.Unlock()
-		if !act {
-			protBehavior.Stop()
-		}
 		select {
-		case msg := <-protBehavior.msgIn:
+		case <-protBehavior.msgIn.ready():
+			msg, ok := protBehavior.msgIn.tryGet()
+			if !ok {
+				continue
+			}
+			protBehavior.ag.waitResumed()
+			start := time.Now()
+			var err error
 			if handle, ok := protBehavior.handlePerformative[msg.Performative]; ok {
-				handle(msg)
+				err = handle(msg)
 			} else {
-				protBehavior.handleDefault(msg)
+				err = protBehavior.handleDefault(msg)
+			}
+			if err == ErrBehaviorDone {
+				protBehavior.ag.ACL.metrics.observeHandler(protBehavior.ag.GetAgentID(),
+					protBehavior.protocol, start, nil)
+				protBehavior.ag.ACL.deregisterProtocolChannel(protBehavior.protocol)
+				protBehavior.ag.ACL.rerouteMessages(protBehavior.msgIn)
+				protBehavior.logInfo.Println("Finished acl behavior for agent ",
+					protBehavior.ag.GetAgentID(), " and protocol ", protBehavior.protocol)
+				return
 			}
+			protBehavior.ag.ACL.metrics.observeHandler(protBehavior.ag.GetAgentID(),
+				protBehavior.protocol, start, err)
 		case command := <-protBehavior.ctrl:
 			switch command {
 			case -1:
+				protBehavior.ag.ACL.rerouteMessages(protBehavior.msgIn)
 				protBehavior.logInfo.Println("Terminating acl behavior for agent ",
 					protBehavior.ag.GetAgentID(), " and protocol ", protBehavior.protocol)
 				return
 			}
+		case <-protBehavior.ag.ctx.Done():
+			protBehavior.ag.ACL.deregisterProtocolChannel(protBehavior.protocol)
+			return
 		}
 	}
 }
@@ -135,6 +163,11 @@ func (protBehavior *aclProtocolBehavior) Stop() {
 	protBehavior.ctrl <- -1
 }
 
+// Done returns a channel that is closed when the message handling has terminated
+func (protBehavior *aclProtocolBehavior) Done() <-chan struct{} {
+	return protBehavior.done
+}
+
 // mqttTopicBehavior describes how mqtt messages with a certain topic should be handled
 type mqttTopicBehavior struct {
 	ag      *Agent                          // agent
@@ -142,6 +175,7 @@ type mqttTopicBehavior struct {
 	handle  func(schemas.MQTTMessage) error // handler function
 	msgIn   chan schemas.MQTTMessage        // msg inbox
 	ctrl    chan int                        // control signals
+	done    chan struct{}                   // closed when task has returned
 	logInfo *log.Logger
 }
 
@@ -158,6 +192,7 @@ func (agent *Agent) NewMQTTTopicBehavior(topic string,
 		handle:  handle,
 		msgIn:   make(chan schemas.MQTTMessage, 100),
 		ctrl:    make(chan int, 10),
+		done:    make(chan struct{}),
 		logInfo: agent.logInfo,
 	}
 	behavior = mqttBehavior
@@ -174,17 +209,17 @@ func (mqttBehavior *mqttTopicBehavior) Start() {
 
 // task performs the execution of the handle function
 func (mqttBehavior *mqttTopicBehavior) task() {
+	defer close(mqttBehavior.done)
+	defer mqttBehavior.ag.recoverPanic("mqtt behavior")
 	mqttBehavior.logInfo.Println("Starting mqtt behavior for agent ", mqttBehavior.ag.GetAgentID())
 	for {
-		mqttBehavior.ag.mutex.Lock()
-		act := mqttBehavior.ag.active
-		mqttBehavior.ag.mutex.Unlock()
-		if !act {
-			mqttBehavior.Stop()
-		}
 		select {
 		case msg := <-mqttBehavior.msgIn:
-			mqttBehavior.handle(msg)
+			mqttBehavior.ag.waitResumed()
+			if mqttBehavior.handle(msg) == ErrBehaviorDone {
+				mqttBehavior.ag.MQTT.deregisterTopicChannel(mqttBehavior.topic)
+				return
+			}
 		case command := <-mqttBehavior.ctrl:
 			switch command {
 			case -1:
@@ -192,6 +227,9 @@ func (mqttBehavior *mqttTopicBehavior) task() {
 					mqttBehavior.ag.GetAgentID())
 				return
 			}
+		case <-mqttBehavior.ag.ctx.Done():
+			mqttBehavior.ag.MQTT.deregisterTopicChannel(mqttBehavior.topic)
+			return
 		}
 	}
 }
@@ -204,12 +242,18 @@ func (mqttBehavior *mqttTopicBehavior) Stop() {
 	mqttBehavior.ctrl <- -1
 }
 
+// Done returns a channel that is closed when the message handling has terminated
+func (mqttBehavior *mqttTopicBehavior) Done() <-chan struct{} {
+	return mqttBehavior.done
+}
+
 // periodicBehavior describes an action that should be performed periodically
 type periodicBehavior struct {
 	ag      *Agent        // agent
 	period  time.Duration // duration between two executions
 	handle  func() error  // handler function
 	ctrl    chan int      // control signals
+	done    chan struct{} // closed when task has returned
 	logInfo *log.Logger
 }
 
@@ -225,6 +269,7 @@ func (agent *Agent) NewPeriodicBehavior(period time.Duration,
 		period:  period,
 		handle:  handle,
 		ctrl:    make(chan int, 10),
+		done:    make(chan struct{}),
 		logInfo: agent.logInfo,
 	}
 	behavior = periodBehavior
@@ -239,17 +284,20 @@ func (periodBehavior *periodicBehavior) Start() {
 
 // task performs the execution of the handle function
 func (periodBehavior *periodicBehavior) task() {
+	defer close(periodBehavior.done)
+	defer periodBehavior.ag.recoverPanic("periodic behavior")
 	periodBehavior.logInfo.Println("Starting periodoc behavior for agent ",
 		periodBehavior.ag.GetAgentID(), " and period ", periodBehavior.period)
+	timer := time.NewTimer(periodBehavior.period)
+	defer timer.Stop()
 	for {
-		periodBehavior.ag.mutex.Lock()
-		act := periodBehavior.ag.active
-		periodBehavior.ag.mutex.Unlock()
-		if !act {
-			periodBehavior.Stop()
-		}
-		time.Sleep(periodBehavior.period)
 		select {
+		case <-timer.C:
+			periodBehavior.ag.waitResumed()
+			if periodBehavior.handle() == ErrBehaviorDone {
+				return
+			}
+			timer.Reset(periodBehavior.period)
 		case command := <-periodBehavior.ctrl:
 			switch command {
 			case -1:
@@ -257,8 +305,8 @@ func (periodBehavior *periodicBehavior) task() {
 					periodBehavior.ag.GetAgentID())
 				return
 			}
-		default:
-			periodBehavior.handle()
+		case <-periodBehavior.ag.ctx.Done():
+			return
 		}
 	}
 }
@@ -269,6 +317,11 @@ func (periodBehavior *periodicBehavior) Stop() {
 	periodBehavior.ctrl <- -1
 }
 
+// Done returns a channel that is closed when the periodic execution has terminated
+func (periodBehavior *periodicBehavior) Done() <-chan struct{} {
+	return periodBehavior.done
+}
+
 // customUpdateBehavior describes an action that should be performed when the custom configuration
 // is updated
 type customUpdateBehavior struct {
@@ -276,6 +329,7 @@ type customUpdateBehavior struct {
 	handle   func(custom string) error // handler function
 	ctrl     chan int                  // control signals
 	customIn chan string               // custom config inbox
+	done     chan struct{}             // closed when task has returned
 	logInfo  *log.Logger
 }
 
@@ -291,6 +345,7 @@ func (agent *Agent) NewCustomUpdateBehavior(
 		handle:   handle,
 		ctrl:     make(chan int, 10),
 		customIn: make(chan string, 10),
+		done:     make(chan struct{}),
 		logInfo:  agent.logInfo,
 	}
 	behavior = custUpBehavior
@@ -306,18 +361,18 @@ func (custUpBehavior *customUpdateBehavior) Start() {
 
 // task performs the execution of the handle function
 func (custUpBehavior *customUpdateBehavior) task() {
+	defer close(custUpBehavior.done)
+	defer custUpBehavior.ag.recoverPanic("custom update behavior")
 	custUpBehavior.logInfo.Println("Starting custom configuration update behavior for agent ",
 		custUpBehavior.ag.GetAgentID())
 	for {
-		custUpBehavior.ag.mutex.Lock()
-		act := custUpBehavior.ag.active
-		custUpBehavior.ag.mutex.Unlock()
-		if !act {
-			custUpBehavior.Stop()
-		}
 		select {
 		case custom := <-custUpBehavior.customIn:
-			custUpBehavior.handle(custom)
+			custUpBehavior.ag.waitResumed()
+			if custUpBehavior.handle(custom) == ErrBehaviorDone {
+				custUpBehavior.ag.deregisterCustomUpdateChannel()
+				return
+			}
 		case command := <-custUpBehavior.ctrl:
 			switch command {
 			case -1:
@@ -325,6 +380,9 @@ func (custUpBehavior *customUpdateBehavior) task() {
 					"behavior for agent ", custUpBehavior.ag.GetAgentID())
 				return
 			}
+		case <-custUpBehavior.ag.ctx.Done():
+			custUpBehavior.ag.deregisterCustomUpdateChannel()
+			return
 		}
 	}
 }
@@ -335,3 +393,112 @@ func (custUpBehavior *customUpdateBehavior) Stop() {
 	// stop behavior
 	custUpBehavior.ctrl <- -1
 }
+
+// Done returns a channel that is closed when the behavior has terminated
+func (custUpBehavior *customUpdateBehavior) Done() <-chan struct{} {
+	return custUpBehavior.done
+}
+
+// stepRequest requests the execution of a step from a step behavior
+type stepRequest struct {
+	step   schemas.CosimStep
+	result chan error // receives the result of the handler
+}
+
+// stepBehavior describes an action that is performed in every step of the co-simulation
+type stepBehavior struct {
+	ag      *Agent                            // agent
+	handle  func(step int, t time.Time) error // handler function
+	ctrl    chan int                          // control signals
+	stepIn  chan stepRequest                  // step inbox
+	done    chan struct{}                     // closed when task has returned
+	logInfo *log.Logger
+}
+
+// NewStepBehavior creates a new handler for the steps of the co-simulation. handle is called
+// with the number and virtual time of every step. The next step is not started before all step
+// behaviors of all agents have returned
+func (agent *Agent) NewStepBehavior(
+	handle func(step int, t time.Time) error) (behavior Behavior, err error) {
+	if handle == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	stepBehav := &stepBehavior{
+		ag:      agent,
+		handle:  handle,
+		ctrl:    make(chan int, 10),
+		stepIn:  make(chan stepRequest, 1),
+		done:    make(chan struct{}),
+		logInfo: agent.logInfo,
+	}
+	behavior = stepBehav
+	return
+}
+
+// Start initiates the handling of steps
+func (stepBehav *stepBehavior) Start() {
+	stepBehav.ag.registerStepBehavior(stepBehav)
+	// execute
+	go stepBehav.task()
+}
+
+// task performs the execution of the handle function
+func (stepBehav *stepBehavior) task() {
+	defer close(stepBehav.done)
+	defer stepBehav.ag.recoverPanic("step behavior")
+	stepBehav.logInfo.Println("Starting step behavior for agent ", stepBehav.ag.GetAgentID())
+	for {
+		select {
+		case req := <-stepBehav.stepIn:
+			stepBehav.ag.waitResumed()
+			req.result <- stepBehav.handle(req.step.Step, req.step.Time)
+		case command := <-stepBehav.ctrl:
+			switch command {
+			case -1:
+				stepBehav.logInfo.Println("Terminating step behavior for agent ",
+					stepBehav.ag.GetAgentID())
+				return
+			}
+		case <-stepBehav.ag.ctx.Done():
+			stepBehav.ag.deregisterStepBehavior(stepBehav)
+			return
+		}
+	}
+}
+
+// execute hands step over to the behavior and waits for the result of the handler until
+// deadline
+func (stepBehav *stepBehavior) execute(step schemas.CosimStep, deadline time.Time) (err error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	req := stepRequest{step: step, result: make(chan error, 1)}
+	select {
+	case stepBehav.stepIn <- req:
+	case <-stepBehav.done:
+		return
+	case <-timer.C:
+		err = errors.New("timeout")
+		return
+	}
+	select {
+	case err = <-req.result:
+	case <-stepBehav.done:
+		err = errors.New("step behavior terminated")
+	case <-timer.C:
+		err = errors.New("timeout")
+	}
+	return
+}
+
+// Stop terminates the behavior
+func (stepBehav *stepBehavior) Stop() {
+	stepBehav.ag.deregisterStepBehavior(stepBehav)
+	// stop behavior
+	stepBehav.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the behavior has terminated
+func (stepBehav *stepBehavior) Done() <-chan struct{} {
+	return stepBehav.done
+}
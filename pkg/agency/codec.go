@@ -0,0 +1,433 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// content languages, encodings and ontologies for the typed content of ACL messages
+
+package agency
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+const (
+	// LanguageJSON is the name of the JSON content language. It is used if no language is set
+	LanguageJSON = "json"
+	// EncodingBase64 is the name of the base64 content encoding
+	EncodingBase64 = "base64"
+)
+
+// ContentLanguage marshals values of ontology concepts to the content of ACL messages. The
+// content has to contain the name of the concept
+type ContentLanguage interface {
+	// Marshal returns the content expression of value, which is an instance of concept
+	Marshal(concept string, value interface{}) (content string, err error)
+	// Unmarshal parses content. newValue has to be called with the concept of the content and
+	// returns a pointer the content is unmarshalled to
+	Unmarshal(content string, newValue func(concept string) (interface{}, error)) (err error)
+}
+
+// ContentEncoding transforms content expressions for transport
+type ContentEncoding interface {
+	Encode(content string) (encoded string, err error)
+	Decode(encoded string) (content string, err error)
+}
+
+// Ontology maps the concepts of a domain to Go types
+type Ontology struct {
+	name     string
+	mutex    *sync.Mutex
+	concepts map[string]ontologyConcept // concepts by name
+	names    map[reflect.Type]string    // concept names by type
+}
+
+// ontologyConcept holds the type and validation of a concept
+type ontologyConcept struct {
+	typ      reflect.Type
+	validate func(value interface{}) error
+}
+
+// NewOntology creates an empty ontology with the given name
+func NewOntology(name string) (ont *Ontology) {
+	ont = &Ontology{
+		name:     name,
+		mutex:    &sync.Mutex{},
+		concepts: make(map[string]ontologyConcept),
+		names:    make(map[reflect.Type]string),
+	}
+	return
+}
+
+// Name returns the name of the ontology
+func (ont *Ontology) Name() string {
+	return ont.name
+}
+
+// RegisterConcept registers the Go type of prototype for concept. prototype may be a value or a
+// pointer. validate is called with a value of the type before it is sent and after it has been
+// received and may be nil
+func (ont *Ontology) RegisterConcept(concept string, prototype interface{},
+	validate func(value interface{}) error) (err error) {
+	if prototype == nil {
+		err = errors.New("illegal prototype")
+		return
+	}
+	typ := reflect.TypeOf(prototype)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	ont.mutex.Lock()
+	defer ont.mutex.Unlock()
+	if _, ok := ont.concepts[concept]; ok {
+		err = errors.New("concept already registered")
+		return
+	}
+	if _, ok := ont.names[typ]; ok {
+		err = errors.New("type already registered")
+		return
+	}
+	ont.concepts[concept] = ontologyConcept{typ: typ, validate: validate}
+	ont.names[typ] = concept
+	return
+}
+
+// concept returns the concept name and validated value of v
+func (ont *Ontology) concept(v interface{}) (concept string, value interface{}, err error) {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if !val.IsValid() || val.Kind() == reflect.Ptr {
+		err = errors.New("illegal value")
+		return
+	}
+	ont.mutex.Lock()
+	concept, ok := ont.names[val.Type()]
+	validate := ont.concepts[concept].validate
+	ont.mutex.Unlock()
+	if !ok {
+		err = errors.New("type " + val.Type().String() + " is not part of ontology " + ont.name)
+		return
+	}
+	value = val.Interface()
+	if validate != nil {
+		err = validate(value)
+	}
+	return
+}
+
+// newValue returns a pointer to a new value of concept
+func (ont *Ontology) newValue(concept string) (ptr interface{}, err error) {
+	ont.mutex.Lock()
+	con, ok := ont.concepts[concept]
+	ont.mutex.Unlock()
+	if !ok {
+		err = errors.New("unknown concept " + concept + " of ontology " + ont.name)
+		return
+	}
+	ptr = reflect.New(con.typ).Interface()
+	return
+}
+
+// contains checks if the type of v is part of the ontology
+func (ont *Ontology) contains(v interface{}) bool {
+	typ := reflect.TypeOf(v)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	ont.mutex.Lock()
+	_, ok := ont.names[typ]
+	ont.mutex.Unlock()
+	return ok
+}
+
+// jsonLanguage implements the JSON content language. The content is an object with the concept
+// as only key
+type jsonLanguage struct{}
+
+// Marshal returns the JSON expression of value
+func (jsonLanguage) Marshal(concept string, value interface{}) (content string, err error) {
+	js, err := json.Marshal(map[string]interface{}{concept: value})
+	content = string(js)
+	return
+}
+
+// Unmarshal parses a JSON expression. Unknown fields are not permitted
+func (jsonLanguage) Unmarshal(content string,
+	newValue func(concept string) (interface{}, error)) (err error) {
+	var expr map[string]json.RawMessage
+	err = json.Unmarshal([]byte(content), &expr)
+	if err != nil {
+		return
+	}
+	if len(expr) != 1 {
+		err = errors.New("content has to contain exactly one concept")
+		return
+	}
+	for concept, raw := range expr {
+		var ptr interface{}
+		ptr, err = newValue(concept)
+		if err != nil {
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(ptr)
+	}
+	return
+}
+
+// base64Encoding implements the base64 content encoding
+type base64Encoding struct{}
+
+// Encode returns the base64 representation of content
+func (base64Encoding) Encode(content string) (encoded string, err error) {
+	encoded = base64.StdEncoding.EncodeToString([]byte(content))
+	return
+}
+
+// Decode returns the content of a base64 representation
+func (base64Encoding) Decode(encoded string) (content string, err error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	content = string(raw)
+	return
+}
+
+// codecRegistry holds the content languages, encodings and ontologies known to the agents of an
+// agency
+type codecRegistry struct {
+	mutex      *sync.Mutex
+	languages  map[string]ContentLanguage
+	encodings  map[string]ContentEncoding
+	ontologies map[string]*Ontology
+}
+
+// newCodecRegistry creates a registry with the built-in languages and encodings
+func newCodecRegistry() (reg *codecRegistry) {
+	reg = &codecRegistry{
+		mutex:      &sync.Mutex{},
+		languages:  map[string]ContentLanguage{LanguageJSON: jsonLanguage{}},
+		encodings:  map[string]ContentEncoding{EncodingBase64: base64Encoding{}},
+		ontologies: make(map[string]*Ontology),
+	}
+	return
+}
+
+// marshal returns the content of value and the ontology and language it is expressed in
+func (reg *codecRegistry) marshal(msg schemas.ACLMessage,
+	value interface{}) (ret schemas.ACLMessage, err error) {
+	ret = msg
+	if ret.Language == "" {
+		ret.Language = LanguageJSON
+	}
+	reg.mutex.Lock()
+	lang, okLang := reg.languages[ret.Language]
+	enc, okEnc := reg.encodings[ret.Encoding]
+	ont, okOnt := reg.ontologies[ret.Ontology]
+	if ret.Ontology == "" {
+		okOnt = false
+		for name := range reg.ontologies {
+			if reg.ontologies[name].contains(value) {
+				if okOnt {
+					reg.mutex.Unlock()
+					err = errors.New("ambiguous ontology")
+					return
+				}
+				ont, okOnt = reg.ontologies[name], true
+			}
+		}
+	}
+	reg.mutex.Unlock()
+	switch {
+	case !okLang:
+		err = errors.New("unknown language " + ret.Language)
+	case !okEnc && ret.Encoding != "":
+		err = errors.New("unknown encoding " + ret.Encoding)
+	case !okOnt:
+		err = errors.New("unknown ontology " + ret.Ontology)
+	}
+	if err != nil {
+		return
+	}
+	ret.Ontology = ont.name
+	concept, value, err := ont.concept(value)
+	if err != nil {
+		return
+	}
+	ret.Content, err = lang.Marshal(concept, value)
+	if err != nil || enc == nil {
+		return
+	}
+	ret.Content, err = enc.Encode(ret.Content)
+	return
+}
+
+// unmarshal returns the validated value contained in the content of msg
+func (reg *codecRegistry) unmarshal(msg schemas.ACLMessage) (value interface{}, err error) {
+	language := msg.Language
+	if language == "" {
+		language = LanguageJSON
+	}
+	reg.mutex.Lock()
+	lang, okLang := reg.languages[language]
+	enc, okEnc := reg.encodings[msg.Encoding]
+	ont, okOnt := reg.ontologies[msg.Ontology]
+	reg.mutex.Unlock()
+	switch {
+	case !okLang:
+		err = errors.New("unknown language " + language)
+	case !okEnc && msg.Encoding != "":
+		err = errors.New("unknown encoding " + msg.Encoding)
+	case !okOnt:
+		err = errors.New("unknown ontology " + msg.Ontology)
+	}
+	if err != nil {
+		return
+	}
+	content := msg.Content
+	if enc != nil {
+		content, err = enc.Decode(content)
+		if err != nil {
+			return
+		}
+	}
+	var ptr interface{}
+	err = lang.Unmarshal(content, func(concept string) (interface{}, error) {
+		var err error
+		ptr, err = ont.newValue(concept)
+		return ptr, err
+	})
+	if err != nil {
+		return
+	}
+	if ptr == nil {
+		err = errors.New("content without concept")
+		return
+	}
+	_, value, err = ont.concept(ptr)
+	return
+}
+
+// RegisterLanguage registers a content language with the given name for all agents of the
+// agency. An existing language with the same name is replaced
+func (acl *ACL) RegisterLanguage(name string, lang ContentLanguage) (err error) {
+	if lang == nil {
+		err = errors.New("illegal language")
+		return
+	}
+	acl.codecs.mutex.Lock()
+	acl.codecs.languages[name] = lang
+	acl.codecs.mutex.Unlock()
+	return
+}
+
+// RegisterEncoding registers a content encoding with the given name for all agents of the
+// agency. An existing encoding with the same name is replaced
+func (acl *ACL) RegisterEncoding(name string, enc ContentEncoding) (err error) {
+	if enc == nil {
+		err = errors.New("illegal encoding")
+		return
+	}
+	acl.codecs.mutex.Lock()
+	acl.codecs.encodings[name] = enc
+	acl.codecs.mutex.Unlock()
+	return
+}
+
+// RegisterOntology registers an ontology for all agents of the agency. An existing ontology with
+// the same name is replaced
+func (acl *ACL) RegisterOntology(ont *Ontology) (err error) {
+	if ont == nil {
+		err = errors.New("illegal ontology")
+		return
+	}
+	acl.codecs.mutex.Lock()
+	acl.codecs.ontologies[ont.name] = ont
+	acl.codecs.mutex.Unlock()
+	return
+}
+
+// SetContent sets the content of msg to the expression of value. The language, encoding and
+// ontology of msg are used; if no language is set JSON is used and if no ontology is set the
+// registered ontology containing the type of value is used. The value is validated before it is
+// marshalled
+func (acl *ACL) SetContent(msg *schemas.ACLMessage, value interface{}) (err error) {
+	ret, err := acl.codecs.marshal(*msg, value)
+	if err != nil {
+		return
+	}
+	*msg = ret
+	return
+}
+
+// SendContent sets the content of msg to the expression of value and sends it
+func (acl *ACL) SendContent(msg schemas.ACLMessage, value interface{}) (err error) {
+	err = acl.SetContent(&msg, value)
+	if err != nil {
+		return
+	}
+	err = acl.SendMessage(msg)
+	return
+}
+
+// Content returns the validated value contained in the content of msg. The value has the type
+// registered for its concept. If the content cannot be decoded or is invalid, msg is answered
+// with a not-understood message
+func (acl *ACL) Content(msg schemas.ACLMessage) (value interface{}, err error) {
+	value, err = acl.codecs.unmarshal(msg)
+	if err != nil && msg.Performative != schemas.FIPAPerfNotUnderstood {
+		reply, _ := acl.NewReply(msg, schemas.FIPAPerfNotUnderstood, err.Error())
+		reply.Language = ""
+		reply.Encoding = ""
+		reply.Ontology = ""
+		acl.SendMessage(reply)
+	}
+	return
+}
@@ -0,0 +1,497 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// composite behaviors that structure the execution of other behaviors
+
+package agency
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// ParallelWhenAll lets a parallel behavior terminate when all children have terminated
+	ParallelWhenAll = 0
+	// ParallelWhenAny lets a parallel behavior terminate when one child has terminated
+	ParallelWhenAny = 1
+)
+
+// wakerBehavior describes an action that is performed once after a delay
+type wakerBehavior struct {
+	ag      *Agent        // agent
+	delay   time.Duration // delay before execution
+	handle  func() error  // handler function
+	ctrl    chan int      // control signals
+	done    chan struct{} // closed when task has returned
+	logInfo *log.Logger
+}
+
+// NewOneShotBehavior creates a behavior that executes handle once and terminates
+func (agent *Agent) NewOneShotBehavior(handle func() error) (behavior Behavior, err error) {
+	behavior, err = agent.NewWakerBehavior(0, handle)
+	return
+}
+
+// NewWakerBehavior creates a behavior that executes handle once after the delay has expired and
+// terminates
+func (agent *Agent) NewWakerBehavior(delay time.Duration,
+	handle func() error) (behavior Behavior, err error) {
+	if handle == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	if delay < 0 {
+		err = errors.New("illegal delay")
+		return
+	}
+	wakeBehavior := &wakerBehavior{
+		ag:      agent,
+		delay:   delay,
+		handle:  handle,
+		ctrl:    make(chan int, 10),
+		done:    make(chan struct{}),
+		logInfo: agent.logInfo,
+	}
+	behavior = wakeBehavior
+	return
+}
+
+// Start initiates the waiting for the delay
+func (wakeBehavior *wakerBehavior) Start() {
+	go wakeBehavior.task()
+}
+
+// task waits for the delay and executes the handle function
+func (wakeBehavior *wakerBehavior) task() {
+	defer close(wakeBehavior.done)
+	defer wakeBehavior.ag.recoverPanic("waker behavior")
+	timer := time.NewTimer(wakeBehavior.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		wakeBehavior.ag.waitResumed()
+		wakeBehavior.handle()
+	case <-wakeBehavior.ctrl:
+	case <-wakeBehavior.ag.ctx.Done():
+	}
+}
+
+// Stop cancels the execution if it has not been performed yet
+func (wakeBehavior *wakerBehavior) Stop() {
+	wakeBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the behavior has terminated
+func (wakeBehavior *wakerBehavior) Done() <-chan struct{} {
+	return wakeBehavior.done
+}
+
+// sequentialBehavior executes its children one after another
+type sequentialBehavior struct {
+	ag       *Agent        // agent
+	children []Behavior    // behaviors to be executed in order
+	ctrl     chan int      // control signals
+	done     chan struct{} // closed when task has returned
+	logInfo  *log.Logger
+}
+
+// NewSequentialBehavior creates a behavior that starts its children one after another. A child
+// is started as soon as the previous child has terminated. The behavior terminates after the
+// last child has terminated. Stopping the behavior stops the currently executed child. Message
+// and periodic behaviors only terminate if their handler returns ErrBehaviorDone
+func (agent *Agent) NewSequentialBehavior(children ...Behavior) (behavior Behavior, err error) {
+	if len(children) == 0 {
+		err = errors.New("no children")
+		return
+	}
+	for i := range children {
+		if children[i] == nil {
+			err = errors.New("illegal child")
+			return
+		}
+	}
+	seqBehavior := &sequentialBehavior{
+		ag:       agent,
+		children: children,
+		ctrl:     make(chan int, 10),
+		done:     make(chan struct{}),
+		logInfo:  agent.logInfo,
+	}
+	behavior = seqBehavior
+	return
+}
+
+// Start initiates the execution of the first child
+func (seqBehavior *sequentialBehavior) Start() {
+	go seqBehavior.task()
+}
+
+// task executes the children one after another
+func (seqBehavior *sequentialBehavior) task() {
+	defer close(seqBehavior.done)
+	for i := range seqBehavior.children {
+		if !runChild(seqBehavior.ag, seqBehavior.children[i], seqBehavior.ctrl) {
+			seqBehavior.logInfo.Println("Terminating sequential behavior for agent ",
+				seqBehavior.ag.GetAgentID())
+			return
+		}
+	}
+}
+
+// Stop terminates the behavior and the currently executed child
+func (seqBehavior *sequentialBehavior) Stop() {
+	seqBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the behavior has terminated
+func (seqBehavior *sequentialBehavior) Done() <-chan struct{} {
+	return seqBehavior.done
+}
+
+// parallelBehavior executes its children concurrently
+type parallelBehavior struct {
+	ag         *Agent        // agent
+	children   []Behavior    // behaviors to be executed concurrently
+	completion int           // number of terminated children after which the behavior terminates
+	ctrl       chan int      // control signals
+	done       chan struct{} // closed when task has returned
+	logInfo    *log.Logger
+}
+
+// NewParallelBehavior creates a behavior that starts all children at once. The behavior
+// terminates as soon as the number of terminated children has reached completion. Use
+// ParallelWhenAll to wait for all children and ParallelWhenAny to wait for the first one. The
+// remaining children are stopped when the behavior terminates
+func (agent *Agent) NewParallelBehavior(completion int,
+	children ...Behavior) (behavior Behavior, err error) {
+	if len(children) == 0 {
+		err = errors.New("no children")
+		return
+	}
+	for i := range children {
+		if children[i] == nil {
+			err = errors.New("illegal child")
+			return
+		}
+	}
+	if completion < 0 || completion > len(children) {
+		err = errors.New("illegal completion")
+		return
+	}
+	if completion == ParallelWhenAll {
+		completion = len(children)
+	}
+	parBehavior := &parallelBehavior{
+		ag:         agent,
+		children:   children,
+		completion: completion,
+		ctrl:       make(chan int, 10),
+		done:       make(chan struct{}),
+		logInfo:    agent.logInfo,
+	}
+	behavior = parBehavior
+	return
+}
+
+// Start initiates the execution of all children
+func (parBehavior *parallelBehavior) Start() {
+	go parBehavior.task()
+}
+
+// task executes all children and waits for the completion condition
+func (parBehavior *parallelBehavior) task() {
+	defer close(parBehavior.done)
+	finished := make(chan int, len(parBehavior.children))
+	running := make(map[int]bool)
+	for i := range parBehavior.children {
+		running[i] = true
+		parBehavior.children[i].Start()
+		go func(i int) {
+			<-parBehavior.children[i].Done()
+			finished <- i
+		}(i)
+	}
+	defer func() {
+		for i := range running {
+			parBehavior.children[i].Stop()
+		}
+	}()
+	for len(parBehavior.children)-len(running) < parBehavior.completion {
+		select {
+		case i := <-finished:
+			delete(running, i)
+		case command := <-parBehavior.ctrl:
+			switch command {
+			case -1:
+				parBehavior.logInfo.Println("Terminating parallel behavior for agent ",
+					parBehavior.ag.GetAgentID())
+				return
+			}
+		case <-parBehavior.ag.ctx.Done():
+			running = nil
+			return
+		}
+	}
+}
+
+// Stop terminates the behavior and all children that are still running
+func (parBehavior *parallelBehavior) Stop() {
+	parBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the behavior has terminated
+func (parBehavior *parallelBehavior) Done() <-chan struct{} {
+	return parBehavior.done
+}
+
+// fsmState is a state of a finite state machine behavior
+type fsmState struct {
+	newBehavior func() (Behavior, error) // creates the behavior executed in the state
+	onEnd       func() string            // returns the event that triggers the transition
+	last        bool                     // the fsm terminates after a last state
+}
+
+// FSMBehavior is a finite state machine whose states are behaviors. Each time a state is entered
+// a new behavior is created for it. When the behavior of a state has terminated the event of
+// the state selects the transition to the next state. The FSM terminates after a last state has
+// been executed. Message and periodic behaviors only terminate if their handler returns
+// ErrBehaviorDone
+type FSMBehavior struct {
+	ag          *Agent                       // agent
+	mutex       *sync.Mutex                  // mutex for states and transitions
+	states      map[string]fsmState          // states by name
+	first       string                       // name of the first state
+	transitions map[string]map[string]string // next state by event for each state
+	defaults    map[string]string            // next state if no transition matches the event
+	ctrl        chan int                     // control signals
+	done        chan struct{}                // closed when task has returned
+	logInfo     *log.Logger
+}
+
+// NewFSMBehavior creates an empty finite state machine behavior. States and transitions have to
+// be registered before the behavior is started
+func (agent *Agent) NewFSMBehavior() (fsm *FSMBehavior, err error) {
+	fsm = &FSMBehavior{
+		ag:          agent,
+		mutex:       &sync.Mutex{},
+		states:      make(map[string]fsmState),
+		transitions: make(map[string]map[string]string),
+		defaults:    make(map[string]string),
+		ctrl:        make(chan int, 10),
+		done:        make(chan struct{}),
+		logInfo:     agent.logInfo,
+	}
+	return
+}
+
+// RegisterFirstState registers the state the FSM starts with
+func (fsm *FSMBehavior) RegisterFirstState(name string, newBehavior func() (Behavior, error),
+	onEnd func() string) (err error) {
+	err = fsm.registerState(name, fsmState{newBehavior: newBehavior, onEnd: onEnd})
+	if err != nil {
+		return
+	}
+	fsm.mutex.Lock()
+	fsm.first = name
+	fsm.mutex.Unlock()
+	return
+}
+
+// RegisterState registers a state. newBehavior is called each time the state is entered. onEnd
+// is called after the behavior has terminated and returns the event that selects the next state.
+// If onEnd is nil the default transition is taken
+func (fsm *FSMBehavior) RegisterState(name string, newBehavior func() (Behavior, error),
+	onEnd func() string) (err error) {
+	err = fsm.registerState(name, fsmState{newBehavior: newBehavior, onEnd: onEnd})
+	return
+}
+
+// RegisterLastState registers a state after which the FSM terminates
+func (fsm *FSMBehavior) RegisterLastState(name string,
+	newBehavior func() (Behavior, error)) (err error) {
+	err = fsm.registerState(name, fsmState{newBehavior: newBehavior, last: true})
+	return
+}
+
+// registerState adds a state to the FSM
+func (fsm *FSMBehavior) registerState(name string, state fsmState) (err error) {
+	if state.newBehavior == nil {
+		err = errors.New("illegal behavior")
+		return
+	}
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	if _, ok := fsm.states[name]; ok {
+		err = errors.New("state already registered")
+		return
+	}
+	fsm.states[name] = state
+	return
+}
+
+// RegisterTransition registers the transition from one state to another that is taken if the
+// event returned by the source state matches
+func (fsm *FSMBehavior) RegisterTransition(from string, to string, event string) (err error) {
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	err = fsm.checkTransition(from, to)
+	if err != nil {
+		return
+	}
+	if _, ok := fsm.transitions[from]; !ok {
+		fsm.transitions[from] = make(map[string]string)
+	}
+	fsm.transitions[from][event] = to
+	return
+}
+
+// RegisterDefaultTransition registers the transition that is taken if no other transition of the
+// source state matches its event
+func (fsm *FSMBehavior) RegisterDefaultTransition(from string, to string) (err error) {
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	err = fsm.checkTransition(from, to)
+	if err != nil {
+		return
+	}
+	fsm.defaults[from] = to
+	return
+}
+
+// checkTransition checks if both states of a transition exist and the source is not a last state
+func (fsm *FSMBehavior) checkTransition(from string, to string) (err error) {
+	state, ok := fsm.states[from]
+	if !ok {
+		err = errors.New("unknown state " + from)
+		return
+	}
+	if state.last {
+		err = errors.New("transition from last state")
+		return
+	}
+	if _, ok = fsm.states[to]; !ok {
+		err = errors.New("unknown state " + to)
+	}
+	return
+}
+
+// Start initiates the execution of the first state
+func (fsm *FSMBehavior) Start() {
+	go fsm.task()
+}
+
+// task executes the states and transitions of the FSM. An FSM that cannot continue because of a
+// missing state or transition is handled as failure of the agent
+func (fsm *FSMBehavior) task() {
+	defer close(fsm.done)
+	defer fsm.ag.recoverPanic("fsm behavior")
+	fsm.mutex.Lock()
+	name := fsm.first
+	fsm.mutex.Unlock()
+	for {
+		fsm.mutex.Lock()
+		state, ok := fsm.states[name]
+		fsm.mutex.Unlock()
+		if !ok {
+			fsm.ag.fail(errors.New("fsm behavior: unknown state " + name))
+			return
+		}
+		behavior, err := state.newBehavior()
+		if err != nil {
+			fsm.ag.fail(errors.New("fsm behavior: state " + name + ": " + err.Error()))
+			return
+		}
+		if !runChild(fsm.ag, behavior, fsm.ctrl) {
+			fsm.logInfo.Println("Terminating fsm behavior for agent ", fsm.ag.GetAgentID())
+			return
+		}
+		if state.last {
+			return
+		}
+		event := ""
+		if state.onEnd != nil {
+			event = state.onEnd()
+		}
+		fsm.mutex.Lock()
+		next, ok := fsm.transitions[name][event]
+		if !ok {
+			next, ok = fsm.defaults[name]
+		}
+		fsm.mutex.Unlock()
+		if !ok {
+			fsm.ag.fail(errors.New("fsm behavior: no transition from state " + name +
+				" for event " + event))
+			return
+		}
+		name = next
+	}
+}
+
+// Stop terminates the FSM and the behavior of the current state
+func (fsm *FSMBehavior) Stop() {
+	fsm.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the FSM has terminated
+func (fsm *FSMBehavior) Done() <-chan struct{} {
+	return fsm.done
+}
+
+// runChild starts a child behavior of a composite behavior and waits for its termination. The
+// child is stopped if a stop signal is received on ctrl. false is returned if the composite
+// behavior has to terminate because of a stop signal or termination of the agent
+func runChild(ag *Agent, child Behavior, ctrl chan int) (ok bool) {
+	child.Start()
+	select {
+	case <-child.Done():
+		ok = true
+	case <-ctrl:
+		child.Stop()
+	case <-ag.ctx.Done():
+	}
+	return
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// implementation of the FIPA Contract Net interaction protocol as agent behaviors
+
+package agency
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// defaultResultTimeout is the time to wait for the results of accepted proposals if no result
+// timeout is configured
+const defaultResultTimeout = time.Minute
+
+// CFPConfig holds the parameters of a call for proposals issued by a contract net initiator
+type CFPConfig struct {
+	Participants  []int         // IDs of agents the cfp is sent to
+	ServiceDesc   string        // if set the cfp is also sent to all agents offering this DF service
+	Content       string        // content of the cfp
+	Deadline      time.Duration // time to wait for proposals
+	ResultTimeout time.Duration // time to wait for the results of accepted proposals; 1 min if 0
+}
+
+// contractNetInitiatorBehavior performs one contract net as initiator
+type contractNetInitiatorBehavior struct {
+	ag            *Agent // agent
+	cfp           CFPConfig
+	selectWinners func([]schemas.ACLMessage) []schemas.ACLMessage // selection of proposals to accept
+	handleResult  func(schemas.ACLMessage) error                  // handler for results of winners
+	ctrl          chan int                                        // control signals
+	done          chan struct{}                                   // closed when task has returned
+	logInfo       *log.Logger
+}
+
+// NewContractNetInitiatorBehavior creates a behavior that sends a call for proposals to all
+// participants and collects their proposals until the deadline has expired or all participants
+// have answered. selectWinners is called with all received proposals and returns the ones to be
+// accepted; all others are rejected. Results reported by the winners are passed to handleResult
+// until all winners have answered or the result timeout has expired
+func (agent *Agent) NewContractNetInitiatorBehavior(cfp CFPConfig,
+	selectWinners func(proposals []schemas.ACLMessage) []schemas.ACLMessage,
+	handleResult func(schemas.ACLMessage) error) (behavior Behavior, err error) {
+	if selectWinners == nil {
+		err = errors.New("illegal winner selection")
+		return
+	}
+	if cfp.Deadline <= 0 {
+		err = errors.New("illegal deadline")
+		return
+	}
+	if len(cfp.Participants) == 0 && cfp.ServiceDesc == "" {
+		err = errors.New("no participants")
+		return
+	}
+	if cfp.ResultTimeout < 0 {
+		err = errors.New("illegal result timeout")
+		return
+	}
+	if cfp.ResultTimeout == 0 {
+		cfp.ResultTimeout = defaultResultTimeout
+	}
+	cnetBehavior := &contractNetInitiatorBehavior{
+		ag:            agent,
+		cfp:           cfp,
+		selectWinners: selectWinners,
+		handleResult:  handleResult,
+		ctrl:          make(chan int, 10),
+		done:          make(chan struct{}),
+		logInfo:       agent.logInfo,
+	}
+	behavior = cnetBehavior
+	return
+}
+
+// Start initiates the contract net
+func (cnetBehavior *contractNetInitiatorBehavior) Start() {
+	go cnetBehavior.task()
+}
+
+// Stop aborts the contract net
+func (cnetBehavior *contractNetInitiatorBehavior) Stop() {
+	cnetBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the contract net has ended
+func (cnetBehavior *contractNetInitiatorBehavior) Done() <-chan struct{} {
+	return cnetBehavior.done
+}
+
+// task executes the single steps of the contract net
+func (cnetBehavior *contractNetInitiatorBehavior) task() {
+	defer close(cnetBehavior.done)
+	defer cnetBehavior.ag.recoverPanic("contract net initiator behavior")
+	agentID := cnetBehavior.ag.GetAgentID()
+	cnetBehavior.logInfo.Println("Starting contract net initiator behavior for agent ", agentID)
+	span := cnetBehavior.ag.ACL.startSpan("contract net")
+	defer cnetBehavior.ag.ACL.endSpan(span, nil)
+	participants, err := cnetBehavior.participants()
+	if err != nil {
+		cnetBehavior.ag.logError.Println("Contract net of agent ", agentID, ": ", err)
+		return
+	}
+
+	// call for proposals
+	cfpConv, err := cnetBehavior.ag.ACL.NewConversation(cnetBehavior.cfp.Deadline)
+	if err != nil {
+		cnetBehavior.ag.logError.Println("Contract net of agent ", agentID, ": ", err)
+		return
+	}
+	defer cfpConv.Close()
+	for i := range participants {
+		var msg schemas.ACLMessage
+		msg, _ = cnetBehavior.ag.ACL.NewMessage(participants[i], schemas.FIPAProtContractNet,
+			schemas.FIPAPerfCallForProposal, cnetBehavior.cfp.Content)
+		setSpan(&msg, span)
+		err = cfpConv.SendMessage(msg)
+		if err != nil {
+			cnetBehavior.ag.logError.Println("Contract net of agent ", agentID, ": ", err)
+		}
+	}
+	answers, ok := cnetBehavior.collect(cfpConv, len(participants))
+	if !ok {
+		cnetBehavior.logInfo.Println("Terminating contract net initiator behavior for agent ",
+			agentID)
+		return
+	}
+	var proposals []schemas.ACLMessage
+	for i := range answers {
+		if answers[i].Performative == schemas.FIPAPerfPropose {
+			proposals = append(proposals, answers[i])
+		}
+	}
+
+	// accept winners and reject all other proposals
+	winners := cnetBehavior.selectWinners(proposals)
+	accepted := make(map[int]bool)
+	for i := range winners {
+		accepted[winners[i].Sender] = true
+	}
+	resConv, err := cnetBehavior.ag.ACL.NewConversation(cnetBehavior.cfp.ResultTimeout)
+	if err != nil {
+		cnetBehavior.ag.logError.Println("Contract net of agent ", agentID, ": ", err)
+		return
+	}
+	defer resConv.Close()
+	for i := range proposals {
+		perf := schemas.FIPAPerfRejectProposal
+		if accepted[proposals[i].Sender] {
+			perf = schemas.FIPAPerfAcceptProposal
+		}
+		var msg schemas.ACLMessage
+		msg, _ = cnetBehavior.ag.ACL.NewReply(proposals[i], perf, proposals[i].Content)
+		if perf == schemas.FIPAPerfAcceptProposal {
+			err = resConv.SendMessage(msg)
+		} else {
+			err = cnetBehavior.ag.ACL.SendMessage(msg)
+		}
+		if err != nil {
+			cnetBehavior.ag.logError.Println("Contract net of agent ", agentID, ": ", err)
+		}
+	}
+
+	// results of winners
+	if cnetBehavior.handleResult == nil || len(accepted) == 0 {
+		return
+	}
+	results, ok := cnetBehavior.collect(resConv, len(accepted))
+	if !ok {
+		cnetBehavior.logInfo.Println("Terminating contract net initiator behavior for agent ",
+			agentID)
+		return
+	}
+	for i := range results {
+		cnetBehavior.handleResult(results[i])
+	}
+	cnetBehavior.logInfo.Println("Finished contract net initiator behavior for agent ", agentID)
+}
+
+// participants returns the IDs of all agents the cfp is sent to
+func (cnetBehavior *contractNetInitiatorBehavior) participants() (participants []int, err error) {
+	known := make(map[int]bool)
+	for _, id := range cnetBehavior.cfp.Participants {
+		if !known[id] {
+			known[id] = true
+			participants = append(participants, id)
+		}
+	}
+	if cnetBehavior.cfp.ServiceDesc != "" {
+		if cnetBehavior.ag.DF == nil {
+			err = errors.New("df not available")
+			return
+		}
+		var svcs []schemas.Service
+		svcs, err = cnetBehavior.ag.DF.SearchForService(cnetBehavior.cfp.ServiceDesc)
+		if err != nil {
+			return
+		}
+		for i := range svcs {
+			if !known[svcs[i].AgentID] {
+				known[svcs[i].AgentID] = true
+				participants = append(participants, svcs[i].AgentID)
+			}
+		}
+	}
+	if len(participants) == 0 {
+		err = errors.New("no participants")
+	}
+	return
+}
+
+// collect receives replies of a conversation until replies of num different senders have been
+// received or the reply-by time has expired (see recvReplies). Further replies of a sender are
+// ignored; failure notices of the platform are counted for each undeliverable message
+func (cnetBehavior *contractNetInitiatorBehavior) collect(conv *Conversation,
+	num int) (msgs []schemas.ACLMessage, ok bool) {
+	senders := make(map[int]bool)
+	ok = true
+	for len(msgs) < num {
+		missing := num - len(msgs)
+		var replies []schemas.ACLMessage
+		replies, ok = conv.recvReplies(missing, cnetBehavior.ctrl)
+		for i := range replies {
+			if senders[replies[i].Sender] {
+				continue
+			}
+			if replies[i].Sender != schemas.SystemAgentID {
+				senders[replies[i].Sender] = true
+			}
+			msgs = append(msgs, replies[i])
+		}
+		if !ok || len(replies) < missing {
+			return
+		}
+	}
+	return
+}
+
+// NewContractNetParticipantBehavior creates a behavior that answers calls for proposals.
+// handleCFP decides whether to propose and returns the proposal; otherwise, or if it returns an
+// error, the cfp is refused.
+// Calls for proposals whose deadline has already expired are ignored. handleAccept executes an
+// accepted proposal and returns its result which is sent to the initiator as inform, or as
+// failure if an error is returned. handleReject is called for rejected proposals and may be nil
+func (agent *Agent) NewContractNetParticipantBehavior(
+	handleCFP func(cfp schemas.ACLMessage) (propose bool, proposal string, err error),
+	handleAccept func(accept schemas.ACLMessage) (result string, err error),
+	handleReject func(reject schemas.ACLMessage) error) (behavior Behavior, err error) {
+	if handleCFP == nil || handleAccept == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	handlePerformative := map[int]func(schemas.ACLMessage) error{
+		schemas.FIPAPerfCallForProposal: func(cfp schemas.ACLMessage) (err error) {
+			if !cfp.ReplyBy.IsZero() && time.Now().After(cfp.ReplyBy) {
+				return
+			}
+			propose, proposal, err := handleCFP(cfp)
+			if err != nil {
+				// the initiator does not have to wait for the deadline
+				reply, _ := agent.ACL.NewReply(cfp, schemas.FIPAPerfRefuse, err.Error())
+				agent.ACL.SendMessage(reply)
+				return
+			}
+			perf := schemas.FIPAPerfRefuse
+			if propose {
+				perf = schemas.FIPAPerfPropose
+			}
+			reply, _ := agent.ACL.NewReply(cfp, perf, proposal)
+			err = agent.ACL.SendMessage(reply)
+			return
+		},
+		schemas.FIPAPerfAcceptProposal: func(accept schemas.ACLMessage) (err error) {
+			result, err := handleAccept(accept)
+			perf := schemas.FIPAPerfInform
+			if err != nil {
+				perf = schemas.FIPAPerfFailure
+				result = err.Error()
+			}
+			reply, _ := agent.ACL.NewReply(accept, perf, result)
+			err = agent.ACL.SendMessage(reply)
+			return
+		},
+		schemas.FIPAPerfRejectProposal: func(reject schemas.ACLMessage) (err error) {
+			if handleReject != nil {
+				err = handleReject(reject)
+			}
+			return
+		},
+	}
+	behavior, err = agent.NewMessageBehavior(schemas.FIPAProtContractNet, handlePerformative,
+		func(msg schemas.ACLMessage) (err error) {
+			agent.logInfo.Println("Ignoring contract net message for agent ", msg.Receiver)
+			return
+		})
+	return
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// provides request/reply conversations on top of the ACL. Outgoing messages of a conversation
+// carry a reply-with expression; replies referencing it are routed to the waiting conversation
+// instead of the general inbox
+
+package agency
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// convIDBase is the first reply-with ID assigned to conversations. IDs of conversations are kept
+// apart from reply-with expressions chosen by the user, which are typically small numbers
+const convIDBase = 1 << 30
+
+// ReplyTimeoutError is returned if no reply has been received before the reply-by time of a
+// conversation has expired
+type ReplyTimeoutError struct {
+	ConversationID int       // ID of the conversation
+	ReplyBy        time.Time // expired reply-by time
+}
+
+// Error returns the error message
+func (e *ReplyTimeoutError) Error() string {
+	return "no reply in conversation " + strconv.Itoa(e.ConversationID) + " before " +
+		e.ReplyBy.String()
+}
+
+// Conversation is a request/reply exchange initiated by an agent
+type Conversation struct {
+	acl     *ACL
+	id      int       // reply-with ID used for correlation of replies
+	replyBy time.Time // latest time replies are accepted
+	msgIn   *msgQueue // reply inbox
+}
+
+// NewConversation opens a new conversation. Replies are accepted until timeout has expired. A
+// timeout of zero means that replies are awaited without deadline
+func (acl *ACL) NewConversation(timeout time.Duration) (conv *Conversation, err error) {
+	conv = &Conversation{
+		acl:   acl,
+		msgIn: newMsgQueue(acl.inboxCapacity()),
+	}
+	if timeout > 0 {
+		conv.replyBy = time.Now().Add(timeout)
+	}
+	acl.mutex.Lock()
+	if !acl.active {
+		acl.mutex.Unlock()
+		conv = nil
+		err = errors.New("acl not active")
+		return
+	}
+	acl.convCounter++
+	conv.id = convIDBase + acl.convCounter
+	acl.msgInConv[conv.id] = conv.msgIn
+	acl.mutex.Unlock()
+	return
+}
+
+// GetID returns the ID of the conversation
+func (conv *Conversation) GetID() int {
+	return conv.id
+}
+
+// SendMessage sends a message as part of the conversation. ConversationID (if not set),
+// ReplyWith and ReplyBy of the message are set accordingly
+func (conv *Conversation) SendMessage(msg schemas.ACLMessage) (err error) {
+	if msg.ConversationID == 0 {
+		msg.ConversationID = conv.id
+	}
+	msg.ReplyWith = strconv.Itoa(conv.id)
+	msg.ReplyBy = conv.replyBy
+	err = conv.acl.SendMessage(msg)
+	return
+}
+
+// RecvReply waits for the next reply. A ReplyTimeoutError is returned if the reply-by time of
+// the conversation expires
+func (conv *Conversation) RecvReply() (msg schemas.ACLMessage, err error) {
+	msg, err = conv.RecvReplyContext(context.Background())
+	return
+}
+
+// RecvReplyContext waits for the next reply like RecvReply. Waiting is aborted when ctx is done
+// or the agent is terminated
+func (conv *Conversation) RecvReplyContext(ctx context.Context) (msg schemas.ACLMessage,
+	err error) {
+	var timeout <-chan time.Time
+	if !conv.replyBy.IsZero() {
+		timer := time.NewTimer(time.Until(conv.replyBy))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		var ok bool
+		msg, ok = conv.msgIn.tryGet()
+		if ok {
+			return
+		}
+		select {
+		case <-conv.msgIn.ready():
+		case <-timeout:
+			err = &ReplyTimeoutError{
+				ConversationID: conv.id,
+				ReplyBy:        conv.replyBy,
+			}
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-conv.acl.ctx.Done():
+			err = errors.New("acl not active")
+			return
+		}
+	}
+}
+
+// RecvReplies collects all replies received until the reply-by time has expired or num
+// replies have been received. No error is returned on expiration of the reply-by time
+func (conv *Conversation) RecvReplies(num int) (msgs []schemas.ACLMessage, err error) {
+	msgs, err = conv.RecvRepliesContext(context.Background(), num)
+	return
+}
+
+// RecvRepliesContext collects replies like RecvReplies. Collecting is aborted with an error
+// when ctx is done or the agent is terminated
+func (conv *Conversation) RecvRepliesContext(ctx context.Context,
+	num int) (msgs []schemas.ACLMessage, err error) {
+	for len(msgs) < num {
+		var msg schemas.ACLMessage
+		msg, err = conv.RecvReplyContext(ctx)
+		if err != nil {
+			if _, ok := err.(*ReplyTimeoutError); ok {
+				err = nil
+			}
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// recvReplies receives replies until num replies have been received, the reply-by time has
+// expired or a stop signal is received on ctrl. false is returned if a stop signal has been
+// received or the agent has been terminated
+func (conv *Conversation) recvReplies(num int, ctrl chan int) (msgs []schemas.ACLMessage,
+	ok bool) {
+	var timeout <-chan time.Time
+	if !conv.replyBy.IsZero() {
+		timer := time.NewTimer(time.Until(conv.replyBy))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(msgs) < num {
+		select {
+		case <-conv.msgIn.ready():
+			if msg, ok := conv.msgIn.tryGet(); ok {
+				msgs = append(msgs, msg)
+			}
+		case <-timeout:
+			return msgs, true
+		case command := <-ctrl:
+			if command == -1 {
+				return msgs, false
+			}
+		case <-conv.acl.ctx.Done():
+			return msgs, false
+		}
+	}
+	return msgs, true
+}
+
+// Close closes the conversation. Replies received afterwards are delivered like any other
+// message
+func (conv *Conversation) Close() {
+	conv.acl.mutex.Lock()
+	delete(conv.acl.msgInConv, conv.id)
+	conv.acl.mutex.Unlock()
+}
+
+// SendMessageWaitReply sends a message and waits for the correlated reply. A
+// ReplyTimeoutError is returned if no reply has been received within timeout
+func (acl *ACL) SendMessageWaitReply(msg schemas.ACLMessage,
+	timeout time.Duration) (reply schemas.ACLMessage, err error) {
+	reply, err = acl.SendMessageWaitReplyContext(context.Background(), msg, timeout)
+	return
+}
+
+// SendMessageWaitReplyContext sends a message and waits for the correlated reply like
+// SendMessageWaitReply. Waiting is aborted when ctx is done or the agent is terminated
+func (acl *ACL) SendMessageWaitReplyContext(ctx context.Context, msg schemas.ACLMessage,
+	timeout time.Duration) (reply schemas.ACLMessage, err error) {
+	var conv *Conversation
+	conv, err = acl.NewConversation(timeout)
+	if err != nil {
+		return
+	}
+	defer conv.Close()
+	err = conv.SendMessage(msg)
+	if err != nil {
+		return
+	}
+	reply, err = conv.RecvReplyContext(ctx)
+	return
+}
+
+// NewReply returns a reply to msg with the given performative and content. Protocol,
+// conversation and content description are taken from msg and InReplyTo references its
+// reply-with expression. The reply has at least the priority of msg
+func (acl *ACL) NewReply(msg schemas.ACLMessage, perf int,
+	content string) (reply schemas.ACLMessage, err error) {
+	reply, err = acl.NewMessage(msg.Sender, msg.Protocol, perf, content)
+	reply.ConversationID = msg.ConversationID
+	reply.Language = msg.Language
+	reply.Encoding = msg.Encoding
+	reply.Ontology = msg.Ontology
+	reply.InReplyTo, _ = strconv.Atoi(msg.ReplyWith)
+	reply.TraceID = msg.TraceID
+	reply.SpanID = msg.SpanID
+	if msg.Priority > reply.Priority {
+		// replies to urgent messages are urgent as well
+		reply.Priority = msg.Priority
+	}
+	return
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// time-stepped co-simulation of agents
+
+package agency
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// cosim holds the progress of the agency in the time-stepped co-simulation and counts the
+// messages exchanged with other agencies. The AMS advances to the next step when all agencies
+// are done and all messages sent to other agencies have been received
+type cosim struct {
+	agency   string
+	timeout  time.Duration // maximum duration of a step
+	started  bool          // all agents of the agency have been started
+	step     int           // last started step; -1 before the first step
+	time     time.Time     // virtual time of step
+	done     bool          // all step behaviors have finished step
+	failed   int           // number of step behaviors that failed in step
+	sent     int           // messages handed over to other agencies
+	received int           // messages received from other agencies
+	lost     int           // messages that could not be sent to other agencies
+	pending  int           // messages of local agents not handed over to their receiver yet
+	mutex    *sync.Mutex
+	logError *log.Logger
+	logInfo  *log.Logger
+}
+
+// newCosim creates the co-simulation state of an agency. nil is returned if the co-simulation is
+// not active
+func newCosim(agency string, config schemas.CosimConfig, logErr *log.Logger,
+	logInf *log.Logger) (c *cosim) {
+	if !config.Active {
+		return
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	c = &cosim{
+		agency:   agency,
+		timeout:  timeout,
+		step:     -1,
+		mutex:    &sync.Mutex{},
+		logError: logErr,
+		logInfo:  logInf,
+	}
+	logInf.Println("Co-simulation active; step timeout: ", timeout)
+	return
+}
+
+// now returns the virtual time of the current step. ok is false before the first step and if the
+// co-simulation is not active
+func (c *cosim) now() (t time.Time, ok bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	t = c.time
+	ok = c.step >= 0
+	c.mutex.Unlock()
+	return
+}
+
+// currentStep returns the number of the current step; -1 before the first step and if the
+// co-simulation is not active
+func (c *cosim) currentStep() (step int) {
+	if c == nil {
+		return -1
+	}
+	c.mutex.Lock()
+	step = c.step
+	c.mutex.Unlock()
+	return
+}
+
+// setStarted marks that all agents of the agency have been started
+func (c *cosim) setStarted() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.started = true
+	c.mutex.Unlock()
+}
+
+// start sets step as current step. false is returned if step has already been started
+func (c *cosim) start(step schemas.CosimStep) (ok bool) {
+	c.mutex.Lock()
+	if step.Step > c.step {
+		c.step = step.Step
+		c.time = step.Time
+		c.done = false
+		c.failed = 0
+		ok = true
+	}
+	c.mutex.Unlock()
+	return
+}
+
+// finish marks step as done
+func (c *cosim) finish(step int, failed int) {
+	c.mutex.Lock()
+	if c.step == step {
+		c.done = true
+		c.failed = failed
+	}
+	c.mutex.Unlock()
+}
+
+// countSent counts messages handed over to other agencies
+func (c *cosim) countSent(num int) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.sent += num
+	c.mutex.Unlock()
+}
+
+// countReceived counts messages received from other agencies
+func (c *cosim) countReceived(num int) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.received += num
+	c.mutex.Unlock()
+}
+
+// countLost counts messages that could not be sent to other agencies
+func (c *cosim) countLost(num int) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.lost += num
+	c.mutex.Unlock()
+}
+
+// countPending counts messages sent by local agents that have not been handed over to their
+// receiver yet, e.g. because they are delayed by fault injection. Handed over messages are
+// counted with a negative num
+func (c *cosim) countPending(num int) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.pending += num
+	c.mutex.Unlock()
+}
+
+// report returns the progress of the agency
+func (c *cosim) report() (rep schemas.CosimReport) {
+	c.mutex.Lock()
+	rep = schemas.CosimReport{
+		Agency:   c.agency,
+		Ready:    c.started,
+		Step:     c.step,
+		Done:     c.done,
+		Failed:   c.failed,
+		Sent:     c.sent,
+		Received: c.received,
+		Lost:     c.lost,
+		Pending:  c.pending,
+	}
+	c.mutex.Unlock()
+	return
+}
+
+// getCosimReport returns the progress of the agency in the co-simulation. The agency is ready
+// as soon as all agents have been started and have either registered a step behavior or
+// returned from their task
+func (agency *Agency) getCosimReport() (rep schemas.CosimReport, err error) {
+	if agency.cosim == nil {
+		err = errors.New("co-simulation not active")
+		return
+	}
+	rep = agency.cosim.report()
+	rep.Ready = rep.Ready && agency.stepReady()
+	return
+}
+
+// startStep executes step for all local agents if it has not been started yet. The step is
+// executed asynchronously; its progress is returned by getCosimReport
+func (agency *Agency) startStep(step schemas.CosimStep) (err error) {
+	if agency.cosim == nil {
+		err = errors.New("co-simulation not active")
+		return
+	}
+	if step.Step < 0 {
+		err = errors.New("invalid step " + strconv.Itoa(step.Step))
+		return
+	}
+	if !agency.cosim.start(step) {
+		return
+	}
+	go agency.runStep(step)
+	return
+}
+
+// runStep executes the step behaviors of all local agents and waits until they have finished
+// step or the step timeout has expired
+func (agency *Agency) runStep(step schemas.CosimStep) {
+	deadline := time.Now().Add(agency.cosim.timeout)
+	for !agency.stepReady() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	var behaviors []*stepBehavior
+	agency.mutex.Lock()
+	for _, ag := range agency.localAgents {
+		behaviors = append(behaviors, ag.getStepBehaviors()...)
+	}
+	agency.mutex.Unlock()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := 0
+	for i := range behaviors {
+		wg.Add(1)
+		go func(behavior *stepBehavior) {
+			defer wg.Done()
+			err := behavior.execute(step, deadline)
+			if err != nil {
+				agency.logError.Println("Step ", step.Step, " of agent ",
+					behavior.ag.GetAgentID(), " failed: ", err)
+				mutex.Lock()
+				failed++
+				mutex.Unlock()
+			}
+		}(behaviors[i])
+	}
+	wg.Wait()
+	agency.cosim.finish(step.Step, failed)
+}
+
+// stepReady checks if all local agents are ready for the next step
+func (agency *Agency) stepReady() (ready bool) {
+	agency.mutex.Lock()
+	defer agency.mutex.Unlock()
+	for _, ag := range agency.localAgents {
+		if !ag.stepReady() {
+			return
+		}
+	}
+	ready = true
+	return
+}
@@ -0,0 +1,396 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// handling of undeliverable messages: retries with backoff, notification of the sender and
+// dead-letter queue
+
+package agency
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+const (
+	deliveryRetries    = 5                      // number of retries for undeliverable messages
+	deliveryBackoff    = time.Millisecond * 100 // delay before first retry; doubled for each retry
+	retryQueueCapacity = 100                    // maximum number of messages waiting per receiver
+	retryQueuesMax     = 1000                   // maximum number of receivers with waiting messages
+	deadLetterCapacity = 1000                   // maximum number of messages in dead-letter queue
+)
+
+// deadLetterKey is the named state the dead letters of an agent are stored in
+const deadLetterKey = client.SystemStatePrefix + "deadletters"
+
+// deadLetter is an entry of the dead-letter queue together with the ID of the local agent it is
+// stored for
+type deadLetter struct {
+	schemas.DeadLetter
+	agentID int
+}
+
+// deliverLocal delivers a message received from a remote agency to a local agent
+func (agency *Agency) deliverLocal(msg schemas.ACLMessage) (err error) {
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[msg.Receiver]
+	agency.mutex.Unlock()
+	if !ok {
+		err = errors.New("receiver is not a local agent")
+		return
+	}
+	err = ag.ACL.deliver(msg)
+	return
+}
+
+// deliverRemote delivers a message received from a remote agency to a local agent. If delivery
+// fails or the receiver cannot keep up, the message is queued for redelivery by retryDelivery.
+// Messages to a receiver with queued messages are queued as well in order to keep their order
+func (agency *Agency) deliverRemote(msg schemas.ACLMessage) (err error) {
+	agency.mutex.Lock()
+	_, queued := agency.retryQueues[msg.Receiver]
+	agency.mutex.Unlock()
+	if !queued {
+		err = agency.deliverLocal(msg)
+		if err == nil || err == ErrInboxFull {
+			return
+		}
+	}
+	agency.mutex.Lock()
+	if agency.retryQueues == nil {
+		agency.retryQueues = make(map[int][]schemas.ACLMessage)
+	}
+	queue, queued := agency.retryQueues[msg.Receiver]
+	switch {
+	case queued && len(queue) >= retryQueueCapacity:
+		err = errors.New("retry queue of receiver is full")
+	case !queued && len(agency.retryQueues) >= retryQueuesMax:
+		err = errors.New("too many receivers with undelivered messages")
+	default:
+		agency.retryQueues[msg.Receiver] = append(queue, msg)
+		if !queued {
+			go agency.retryDelivery(msg.Receiver)
+		}
+		agency.mutex.Unlock()
+		return
+	}
+	agency.mutex.Unlock()
+	agency.addDeadLetter(msg, err.Error(), msg.Receiver)
+	return
+}
+
+// retryDelivery is to be executed as go routine for each receiver with messages received from a
+// remote agency that could not be delivered to it, e.g. because the agent is restarting. Delivery
+// of the queued messages is retried in order with exponential backoff. If the receiver stays
+// unreachable, all queued messages are returned to their sender agencies. A receiver that is
+// slower than its senders is waited for without giving up
+func (agency *Agency) retryDelivery(receiver int) {
+	delay := deliveryBackoff
+	failed := 1
+	for {
+		if failed > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		agency.mutex.Lock()
+		msg := agency.retryQueues[receiver][0]
+		agency.mutex.Unlock()
+		err := agency.deliverLocal(msg)
+		if err == errDeliveryQueueFull {
+			delay = deliveryBackoff
+			failed = 0
+			time.Sleep(deliveryBackoff)
+			continue
+		}
+		if err == nil || err == ErrInboxFull {
+			delay = deliveryBackoff
+			failed = 0
+			agency.mutex.Lock()
+			queue := agency.retryQueues[receiver][1:]
+			if len(queue) == 0 {
+				delete(agency.retryQueues, receiver)
+			} else {
+				agency.retryQueues[receiver] = queue
+			}
+			agency.mutex.Unlock()
+			if len(queue) == 0 {
+				return
+			}
+			continue
+		}
+		failed++
+		if failed > deliveryRetries {
+			agency.mutex.Lock()
+			queue := agency.retryQueues[receiver]
+			delete(agency.retryQueues, receiver)
+			agency.mutex.Unlock()
+			for i := range queue {
+				agency.returnMsg(queue[i], err)
+			}
+			return
+		}
+	}
+}
+
+// returnMsg returns a message that could not be delivered to a local agent to the sender agency.
+// If that fails, the message is put into the dead-letter queue
+func (agency *Agency) returnMsg(msg schemas.ACLMessage, reason error) {
+	agency.logInfo.Println("Returning undeliverable message for agent ", msg.Receiver,
+		" to agency ", msg.AgencySender)
+	var err error
+	var httpStatus int
+	delay := deliveryBackoff
+	for i := 0; i < deliveryRetries; i++ {
+		httpStatus, err = agency.agencyClient.ReturnMsg(msg.AgencySender, msg)
+		if err == nil && httpStatus == http.StatusCreated {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err == nil {
+		err = errors.New("wrong http code: " + strconv.Itoa(httpStatus))
+	}
+	agency.logError.Println("Could not return undeliverable message: ", err)
+	agency.addDeadLetter(msg, reason.Error(), msg.Receiver)
+}
+
+// undeliverable puts a message of a local sender that could not be delivered into the
+// dead-letter queue and notifies the sender with a failure message from the system sender
+func (agency *Agency) undeliverable(msg schemas.ACLMessage, reason string) {
+	agency.addDeadLetter(msg, reason, msg.Sender)
+	agency.mutex.Lock()
+	ag, ok := agency.localAgents[msg.Sender]
+	agency.mutex.Unlock()
+	if !ok {
+		return
+	}
+	failure := schemas.ACLMessage{
+		Timestamp:      time.Now(),
+		Performative:   schemas.FIPAPerfFailure,
+		Sender:         schemas.SystemAgentID,
+		Receiver:       msg.Sender,
+		Content:        "undeliverable to agent " + strconv.Itoa(msg.Receiver) + ": " + reason,
+		Protocol:       msg.Protocol,
+		ConversationID: msg.ConversationID,
+	}
+	failure.InReplyTo, _ = strconv.Atoi(msg.ReplyWith)
+	err := ag.ACL.deliver(failure)
+	if err != nil {
+		agency.logError.Println("Could not notify agent ", msg.Sender,
+			" about undeliverable message: ", err)
+	}
+}
+
+// addDeadLetter appends a message to the dead-letter queue. The oldest entry is dropped if the
+// queue is full. The dead letters of agentID are persisted with the logger
+func (agency *Agency) addDeadLetter(msg schemas.ACLMessage, reason string, agentID int) {
+	agency.logError.Println("Undeliverable message from agent ", msg.Sender, " to agent ",
+		msg.Receiver, ": ", reason)
+	agency.mutex.Lock()
+	if len(agency.deadLetters) >= deadLetterCapacity {
+		agency.deadLetters = agency.deadLetters[1:]
+	}
+	agency.deadLetters = append(agency.deadLetters, deadLetter{
+		DeadLetter: schemas.DeadLetter{
+			Message:   msg,
+			Reason:    reason,
+			Timestamp: time.Now(),
+		},
+		agentID: agentID,
+	})
+	if agency.deadLetterDirty == nil {
+		agency.deadLetterDirty = make(map[int]bool)
+	}
+	_, flushing := agency.deadLetterDirty[agentID]
+	agency.deadLetterDirty[agentID] = true
+	agency.mutex.Unlock()
+	if !flushing {
+		go agency.flushDeadLetters(agentID)
+	}
+}
+
+// flushDeadLetters persists the dead letters of agentID until no new dead letters have been
+// added during the last store. Only one flush runs per agent, so that dead letters added in
+// the meantime are stored together
+func (agency *Agency) flushDeadLetters(agentID int) {
+	for {
+		agency.mutex.Lock()
+		if !agency.deadLetterDirty[agentID] {
+			delete(agency.deadLetterDirty, agentID)
+			agency.mutex.Unlock()
+			return
+		}
+		agency.deadLetterDirty[agentID] = false
+		agency.mutex.Unlock()
+		agency.storeDeadLetters(agentID)
+	}
+}
+
+// getDeadLetters returns the content of the dead-letter queue
+func (agency *Agency) getDeadLetters() (deadLetters []schemas.DeadLetter, err error) {
+	agency.mutex.Lock()
+	deadLetters = make([]schemas.DeadLetter, len(agency.deadLetters))
+	for i := range agency.deadLetters {
+		deadLetters[i] = agency.deadLetters[i].DeadLetter
+	}
+	agency.mutex.Unlock()
+	return
+}
+
+// clearDeadLetters empties the dead-letter queue
+func (agency *Agency) clearDeadLetters() (err error) {
+	agency.mutex.Lock()
+	var agentIDs []int
+	for agentID := range agency.deadLetterRevs {
+		agentIDs = append(agentIDs, agentID)
+	}
+	agency.deadLetters = nil
+	agency.mutex.Unlock()
+	for i := range agentIDs {
+		agency.storeDeadLetters(agentIDs[i])
+	}
+	return
+}
+
+// deadLetterLogger returns a logger for the dead letters of agentID; nil is returned if the
+// logger is not active or agentID is not a clonemap agent
+func (agency *Agency) deadLetterLogger(agentID int) (agLog *client.AgentLogger) {
+	agency.mutex.Lock()
+	logCol := agency.logCollector
+	active := agency.loggerConfig.Active
+	agency.mutex.Unlock()
+	if logCol == nil || !active || agentID < 0 {
+		return
+	}
+	agLog = logCol.NewSystemLogger(agentID, agency.logError, agency.logInfo)
+	return
+}
+
+// storeDeadLetters persists the dead letters of agentID as named state with the logger
+func (agency *Agency) storeDeadLetters(agentID int) {
+	agLog := agency.deadLetterLogger(agentID)
+	if agLog == nil {
+		return
+	}
+	agency.deadLetterMutex.Lock()
+	defer agency.deadLetterMutex.Unlock()
+	deadLetters := []schemas.DeadLetter{}
+	agency.mutex.Lock()
+	for i := range agency.deadLetters {
+		if agency.deadLetters[i].agentID == agentID {
+			deadLetters = append(deadLetters, agency.deadLetters[i].DeadLetter)
+		}
+	}
+	revision := agency.deadLetterRevs[agentID]
+	agency.mutex.Unlock()
+	js, err := json.Marshal(deadLetters)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 2; i++ {
+		var newRevision int
+		newRevision, err = agLog.UpdateNamedState(deadLetterKey, revision, string(js))
+		if err == nil {
+			revision = newRevision
+			break
+		}
+		if err != client.ErrRevisionConflict {
+			break
+		}
+		// the dead letters have been stored by another agency, e.g. before a migration
+		_, revision, err = agLog.GetNamedState(deadLetterKey)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		agency.logError.Println("Could not store dead letters of agent ", agentID, ": ", err)
+		return
+	}
+	agency.mutex.Lock()
+	if agency.deadLetterRevs == nil {
+		agency.deadLetterRevs = make(map[int]int)
+	}
+	agency.deadLetterRevs[agentID] = revision
+	agency.mutex.Unlock()
+}
+
+// loadDeadLetters restores the dead letters of the given agents persisted with the logger
+func (agency *Agency) loadDeadLetters(agents []schemas.AgentInfo) {
+	for i := range agents {
+		agLog := agency.deadLetterLogger(agents[i].ID)
+		if agLog == nil {
+			return
+		}
+		state, revision, err := agLog.GetNamedState(deadLetterKey)
+		if err != nil || revision == 0 {
+			continue
+		}
+		var deadLetters []schemas.DeadLetter
+		err = json.Unmarshal([]byte(state), &deadLetters)
+		if err != nil {
+			agency.logError.Println("Invalid dead letters of agent ", agents[i].ID, ": ", err)
+			continue
+		}
+		agency.mutex.Lock()
+		for j := range deadLetters {
+			if len(agency.deadLetters) >= deadLetterCapacity {
+				agency.deadLetters = agency.deadLetters[1:]
+			}
+			agency.deadLetters = append(agency.deadLetters,
+				deadLetter{DeadLetter: deadLetters[j], agentID: agents[i].ID})
+		}
+		if agency.deadLetterRevs == nil {
+			agency.deadLetterRevs = make(map[int]int)
+		}
+		agency.deadLetterRevs[agents[i].ID] = revision
+		agency.mutex.Unlock()
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// injection of faults into the message path of the agency
+
+package agency
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// reorderTimeout is the maximum time a message is held back to be overtaken by the next one
+const reorderTimeout = time.Millisecond * 100
+
+// kinds of random decisions made for a message
+const (
+	decisionDrop = iota + 1
+	decisionDuplicate
+	decisionJitter
+	decisionReorder
+)
+
+// faultInjector applies link faults to messages sent by local agents and drops messages
+// between partitioned agencies. All methods can be called on a nil object in which case no
+// faults are injected. Random decisions are derived from the seed of the agency and the
+// sequence number of a message on its link, so that they do not depend on the interleaving of
+// concurrent senders
+type faultInjector struct {
+	agency   string                // name of the local agency
+	config   schemas.FaultConfig   // current configuration
+	seed     uint64                // seed of the agency derived from config.Seed and the agency name
+	seqs     map[[2]int]uint64     // number of messages sent per sender and receiver
+	held     map[[2]int]*heldBatch // messages held back for reordering per sender and receiver
+	mutex    *sync.Mutex
+	logError *log.Logger
+	logInfo  *log.Logger
+}
+
+// heldMessage is a message together with the function that delivers it
+type heldMessage struct {
+	msg     schemas.ACLMessage
+	deliver func(schemas.ACLMessage) error
+}
+
+// heldBatch contains a message and its duplicates that are held back until the next message on
+// the same link has been delivered
+type heldBatch struct {
+	msgs []heldMessage
+	done []func() // called after the messages have been handed over
+}
+
+// newFaultInjector returns a fault injector without faults
+func newFaultInjector(agency string, logErr *log.Logger, logInf *log.Logger) (f *faultInjector) {
+	f = &faultInjector{
+		agency:   agency,
+		seqs:     make(map[[2]int]uint64),
+		held:     make(map[[2]int]*heldBatch),
+		mutex:    &sync.Mutex{},
+		logError: logErr,
+		logInfo:  logInf,
+	}
+	return
+}
+
+// setConfig replaces the fault configuration. The sequence numbers of links are reset and
+// partitions are timed relative to config.Start, or to the current time if it is zero. Messages
+// held back for reordering are released
+func (f *faultInjector) setConfig(config schemas.FaultConfig) (err error) {
+	if f == nil {
+		err = errors.New("fault injection not available")
+		return
+	}
+	for _, link := range config.Links {
+		if link.Drop < 0 || link.Drop > 1 || link.Duplicate < 0 || link.Duplicate > 1 ||
+			link.Reorder < 0 || link.Reorder > 1 {
+			err = errors.New("probabilities have to be between 0 and 1")
+			return
+		}
+		if link.Latency < 0 || link.Jitter < 0 {
+			err = errors.New("negative latency or jitter")
+			return
+		}
+	}
+	for _, part := range config.Partitions {
+		if part.Start < 0 || part.Duration < 0 {
+			err = errors.New("negative start or duration of partition")
+			return
+		}
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	if config.Start.IsZero() {
+		config.Start = time.Now()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(f.agency))
+	f.mutex.Lock()
+	held := f.held
+	f.held = make(map[[2]int]*heldBatch)
+	f.seqs = make(map[[2]int]uint64)
+	f.config = config
+	f.seed = mix(uint64(config.Seed) ^ h.Sum64())
+	f.mutex.Unlock()
+	for _, h := range held {
+		f.deliver(h.msgs, h.done)
+	}
+	f.logInfo.Println("New fault configuration; active: ", config.Active, ", seed: ", config.Seed)
+	return
+}
+
+// getConfig returns the current fault configuration including the seed in use
+func (f *faultInjector) getConfig() (config schemas.FaultConfig, err error) {
+	if f == nil {
+		err = errors.New("fault injection not available")
+		return
+	}
+	f.mutex.Lock()
+	config = f.config
+	f.mutex.Unlock()
+	return
+}
+
+// send hands msg over to deliver after applying the faults of the first matching link.
+// Messages with added latency are delivered asynchronously and errors are logged. Lost
+// messages are reported as sent. done is called once msg and its duplicates have been handed
+// over to deliver or msg has been dropped
+func (f *faultInjector) send(msg schemas.ACLMessage, deliver func(schemas.ACLMessage) error,
+	done func()) (err error) {
+	if f == nil {
+		err = deliver(msg)
+		done()
+		return
+	}
+	f.mutex.Lock()
+	link, ok := f.matchLink(msg)
+	if !ok {
+		f.mutex.Unlock()
+		err = deliver(msg)
+		done()
+		return
+	}
+	key := [2]int{msg.Sender, msg.Receiver}
+	seq := f.seqs[key]
+	f.seqs[key]++
+	if link.Drop > 0 && f.random(key, seq, decisionDrop) < link.Drop {
+		f.mutex.Unlock()
+		f.logInfo.Println("Fault injection: dropping message from ", msg.Sender, " to ",
+			msg.Receiver)
+		done()
+		return
+	}
+	msgs := []heldMessage{{msg: msg, deliver: deliver}}
+	if link.Duplicate > 0 && f.random(key, seq, decisionDuplicate) < link.Duplicate {
+		msgs = append(msgs, msgs[0])
+	}
+	delay := time.Duration(link.Latency) * time.Millisecond
+	if link.Jitter > 0 {
+		jitter := int(f.random(key, seq, decisionJitter) * float64(2*link.Jitter+1))
+		delay += time.Duration(jitter-link.Jitter) * time.Millisecond
+	}
+	dones := []func(){done}
+	held, isHeld := f.held[key]
+	if isHeld {
+		// the held message is overtaken by this one
+		delete(f.held, key)
+		msgs = append(msgs, held.msgs...)
+		dones = append(dones, held.done...)
+	} else if link.Reorder > 0 && f.random(key, seq, decisionReorder) < link.Reorder {
+		held = &heldBatch{msgs: msgs, done: dones}
+		f.held[key] = held
+		f.mutex.Unlock()
+		time.AfterFunc(reorderTimeout, func() {
+			f.mutex.Lock()
+			h, ok := f.held[key]
+			if ok && h == held {
+				delete(f.held, key)
+			}
+			f.mutex.Unlock()
+			if ok && h == held {
+				f.deliver(msgs, dones)
+			}
+		})
+		return
+	}
+	f.mutex.Unlock()
+	if delay > 0 {
+		go func() {
+			time.Sleep(delay)
+			f.deliver(msgs, dones)
+		}()
+		return
+	}
+	err = msgs[0].deliver(msgs[0].msg)
+	f.deliver(msgs[1:], dones)
+	return
+}
+
+// deliver hands messages over to their deliver function in order and logs errors. The done
+// functions are called afterwards
+func (f *faultInjector) deliver(msgs []heldMessage, done []func()) {
+	for i := range msgs {
+		err := msgs[i].deliver(msgs[i].msg)
+		if err != nil {
+			f.logError.Println("Fault injection: message from ", msgs[i].msg.Sender, " to ",
+				msgs[i].msg.Receiver, " not delivered: ", err)
+		}
+	}
+	for i := range done {
+		done[i]()
+	}
+}
+
+// random returns a number in [0, 1) for the given kind of decision about the message with
+// sequence number seq on the link key. The number only depends on the seed of the agency and
+// its arguments
+func (f *faultInjector) random(key [2]int, seq uint64, kind uint64) float64 {
+	x := mix(f.seed ^ uint64(int64(key[0])))
+	x = mix(x ^ uint64(int64(key[1])))
+	x = mix(x ^ seq)
+	x = mix(x ^ kind)
+	return float64(x>>11) / (1 << 53)
+}
+
+// mix scrambles the bits of x (finalizer of splitmix64)
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// matchLink returns the first link that matches sender and receiver of msg. The mutex has to
+// be locked
+func (f *faultInjector) matchLink(msg schemas.ACLMessage) (link schemas.LinkFault, ok bool) {
+	if !f.config.Active {
+		return
+	}
+	for _, link = range f.config.Links {
+		if containsID(link.Senders, msg.Sender) && containsID(link.Receivers, msg.Receiver) {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// containsID returns true if ids is empty or contains id
+func containsID(ids []int, id int) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for i := range ids {
+		if ids[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// partitioned returns true if the local agency is currently separated from the remote agency
+func (f *faultInjector) partitioned(remote string) (ret bool) {
+	if f == nil || remote == "" {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.config.Active {
+		return
+	}
+	now := time.Now()
+	for _, part := range f.config.Partitions {
+		start := f.config.Start.Add(time.Duration(part.Start) * time.Millisecond)
+		if now.Before(start) {
+			continue
+		}
+		if part.Duration > 0 && !now.Before(start.Add(time.Duration(part.Duration)*
+			time.Millisecond)) {
+			continue
+		}
+		if containsName(part.Agencies, f.agency) != containsName(part.Agencies, remote) {
+			ret = true
+			return
+		}
+	}
+	return
+}
+
+// containsName returns true if names contains name
+func containsName(names []string, name string) bool {
+	for i := range names {
+		if names[i] == name {
+			return true
+		}
+	}
+	return false
+}
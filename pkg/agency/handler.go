@@ -47,13 +47,17 @@ THE SOFTWARE.
 package agency
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
 	"github.com/RWTH-ACS/clonemap/pkg/common/httpreply"
+	"github.com/RWTH-ACS/clonemap/pkg/common/metrics"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 	"github.com/gorilla/mux"
 )
@@ -100,24 +104,95 @@ func (agency *Agency) handlePostAgent(w http.ResponseWriter, r *http.Request) {
 func (agency *Agency) handlePostMsgs(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
 	var body []byte
-	body, cmapErr = ioutil.ReadAll(r.Body)
+	maxSize := agency.maxMsgSize()
+	body, cmapErr = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxSize)))
 	if cmapErr != nil {
 		httpErr = httpreply.InvalidBodyError(w)
 		agency.logErrors(r.URL.Path, cmapErr, httpErr)
 		return
 	}
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case aclwire.EncodingGzip:
+		body, cmapErr = aclwire.Decompress(body, maxSize)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			agency.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	default:
+		httpErr = httpreply.UnsupportedMediaTypeError(w)
+		agency.logErrors(r.URL.Path, errors.New("unsupported content encoding "+
+			r.Header.Get("Content-Encoding")), httpErr)
+		return
+	}
 	var msgs []schemas.ACLMessage
-	cmapErr = json.Unmarshal(body, &msgs)
-	if cmapErr != nil {
-		httpErr = httpreply.JSONUnmarshalError(w)
-		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	switch contentType {
+	case aclwire.ContentTypeProtobuf:
+		msgs, cmapErr = aclwire.UnmarshalProtobuf(body)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			agency.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	case aclwire.ContentTypeJSON, "":
+		cmapErr = json.Unmarshal(body, &msgs)
+		if cmapErr != nil {
+			httpErr = httpreply.JSONUnmarshalError(w)
+			agency.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	default:
+		httpErr = httpreply.UnsupportedMediaTypeError(w)
+		agency.logErrors(r.URL.Path, errors.New("unsupported content type "+contentType), httpErr)
 		return
 	}
-	agency.msgIn <- msgs
+	if seq := r.Header.Get(streamHeaderSequence); seq != "" {
+		// batch of a message stream sent via http; discard it if already received via the stream
+		var num uint64
+		num, cmapErr = strconv.ParseUint(seq, 10, 64)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			agency.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+		if !agency.claimBatch(r.Header.Get(streamHeaderAgency), r.Header.Get(streamHeaderSession),
+			num) {
+			msgs = nil
+		}
+	}
+	if len(msgs) > 0 {
+		agency.msgIn <- msgs
+	}
 	httpErr = httpreply.Created(w, cmapErr, "text/plain", []byte("Resource Created"))
 	agency.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handleStream is the handler for get requests to path /api/agency/stream. The connection is
+// upgraded to a message stream from the requesting agency
+func (agency *Agency) handleStream(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	if r.Header.Get("Upgrade") != streamProtocol {
+		httpErr = httpreply.UpgradeRequiredError(w, streamProtocol)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		cmapErr = errors.New("connection cannot be upgraded")
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	conn, rw, cmapErr := hijacker.Hijack()
+	if cmapErr != nil {
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	agency.serveStream(conn, rw, r.Header.Get(streamHeaderAgency), r.Header.Get(streamHeaderSession))
+}
+
 // handlePostUndeliverableMsg is the handler for post requests to path /api/agency/msgundeliv
 func (agency *Agency) handlePostUndeliverableMsg(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
@@ -140,6 +215,23 @@ func (agency *Agency) handlePostUndeliverableMsg(w http.ResponseWriter, r *http.
 	agency.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handleGetDeadLetters is the handler for get requests to path /api/agency/deadletters
+func (agency *Agency) handleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var deadLetters []schemas.DeadLetter
+	deadLetters, cmapErr = agency.getDeadLetters()
+	httpErr = httpreply.Resource(w, deadLetters, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleDeleteDeadLetters is the handler for delete requests to path /api/agency/deadletters
+func (agency *Agency) handleDeleteDeadLetters(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	cmapErr = agency.clearDeadLetters()
+	httpErr = httpreply.Deleted(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // handleDeleteAgentID is the handler for delete requests to path /api/agency/agents/{agentid}
 func (agency *Agency) handleDeleteAgentID(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
@@ -178,6 +270,127 @@ func (agency *Agency) handleGetAgentStatus(w http.ResponseWriter, r *http.Reques
 	agency.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handlePostAgentSuspend is the handler for post requests to path
+// /api/agency/agents/{agentid}/suspend
+func (agency *Agency) handlePostAgentSuspend(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	agentID, cmapErr := strconv.Atoi(vars["agentid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.suspendAgent(agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentResume is the handler for post requests to path
+// /api/agency/agents/{agentid}/resume
+func (agency *Agency) handlePostAgentResume(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	agentID, cmapErr := strconv.Atoi(vars["agentid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.resumeAgent(agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentRestart is the handler for post requests to path
+// /api/agency/agents/{agentid}/restart
+func (agency *Agency) handlePostAgentRestart(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	agentID, cmapErr := strconv.Atoi(vars["agentid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.restartAgent(agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentMigrate is the handler for post requests to path
+// /api/agency/agents/{agentid}/migrate
+func (agency *Agency) handlePostAgentMigrate(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	agentID, cmapErr := strconv.Atoi(vars["agentid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var target schemas.Address
+	cmapErr = json.Unmarshal(body, &target)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.migrateAgent(agentID, target.Agency)
+	httpErr = httpreply.Updated(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostMigration is the handler for post requests to path /api/agency/migrations
+func (agency *Agency) handlePostMigration(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var migration schemas.AgentMigration
+	cmapErr = json.Unmarshal(body, &migration)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.receiveMigration(migration)
+	httpErr = httpreply.Created(w, cmapErr, "text/plain", []byte("Resource Created"))
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetAgentInbox is the handler for get requests to path /api/agency/agents/{agentid}/inbox
+func (agency *Agency) handleGetAgentInbox(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	agentID, cmapErr := strconv.Atoi(vars["agentid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var stats schemas.InboxStats
+	stats, cmapErr = agency.getAgentInbox(agentID)
+	if cmapErr != nil {
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Resource(w, stats, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // handlePutAgentCustom is the handler for put requests to path /api/agency/agents/{agentid}/custom
 func (agency *Agency) handlePutAgentCustom(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
@@ -207,6 +420,92 @@ func (agency *Agency) handlePutAgentCustom(w http.ResponseWriter, r *http.Reques
 	agency.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handleGetFaults is the handler for get requests to path /api/agency/faults
+func (agency *Agency) handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var config schemas.FaultConfig
+	config, cmapErr = agency.faults.getConfig()
+	httpErr = httpreply.Resource(w, config, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePutFaults is the handler for put requests to path /api/agency/faults
+func (agency *Agency) handlePutFaults(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var config schemas.FaultConfig
+	cmapErr = json.Unmarshal(body, &config)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.faults.setConfig(config)
+	httpErr = httpreply.Updated(w, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetCosim is the handler for get requests to path /api/agency/cosim
+func (agency *Agency) handleGetCosim(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var report schemas.CosimReport
+	report, cmapErr = agency.getCosimReport()
+	httpErr = httpreply.Resource(w, report, cmapErr)
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostCosimStep is the handler for post requests to path /api/agency/cosim/step
+func (agency *Agency) handlePostCosimStep(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var step schemas.CosimStep
+	cmapErr = json.Unmarshal(body, &step)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = agency.startStep(step)
+	httpErr = httpreply.Created(w, cmapErr, "text/plain", []byte("Ressource Created"))
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetMetrics is the handler for get requests to path /metrics. The statistics of the
+// agency and its agents are returned in the Prometheus text format
+func (agency *Agency) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	if agency.metrics == nil {
+		cmapErr = errors.New("metrics not available")
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	agency.collectMetrics()
+	var buf bytes.Buffer
+	cmapErr = agency.metrics.registry.WriteText(&buf)
+	if cmapErr != nil {
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		agency.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	_, httpErr = w.Write(buf.Bytes())
+	agency.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // methodNotAllowed is the default handler for valid paths but invalid methods
 func (agency *Agency) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	httpErr := httpreply.MethodNotAllowed(w)
@@ -247,11 +546,27 @@ func (agency *Agency) server(port int) (serv *http.Server) {
 	s.Path("/agency").Methods("PUT", "POST", "DELETE").HandlerFunc(agency.methodNotAllowed)
 	s.Path("/agency/agents").Methods("POST").HandlerFunc(agency.handlePostAgent)
 	s.Path("/agency/agents").Methods("PUT", "GET", "DELETE").HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/migrations").Methods("POST").HandlerFunc(agency.handlePostMigration)
+	s.Path("/agency/migrations").Methods("PUT", "GET", "DELETE").
+		HandlerFunc(agency.methodNotAllowed)
 	s.Path("/agency/msgs").Methods("POST").HandlerFunc(agency.handlePostMsgs)
 	s.Path("/agency/msgs").Methods("PUT", "GET", "DELETE").HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/stream").Methods("GET").HandlerFunc(agency.handleStream)
+	s.Path("/agency/stream").Methods("PUT", "POST", "DELETE").HandlerFunc(agency.methodNotAllowed)
 	s.Path("/agency/msgundeliv").Methods("POST").HandlerFunc(agency.handlePostUndeliverableMsg)
 	s.Path("/agency/msgundeliv").Methods("PUT", "GET", "DELETE").
 		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/deadletters").Methods("GET").HandlerFunc(agency.handleGetDeadLetters)
+	s.Path("/agency/deadletters").Methods("DELETE").HandlerFunc(agency.handleDeleteDeadLetters)
+	s.Path("/agency/deadletters").Methods("PUT", "POST").HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/faults").Methods("GET").HandlerFunc(agency.handleGetFaults)
+	s.Path("/agency/faults").Methods("PUT").HandlerFunc(agency.handlePutFaults)
+	s.Path("/agency/faults").Methods("POST", "DELETE").HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/cosim").Methods("GET").HandlerFunc(agency.handleGetCosim)
+	s.Path("/agency/cosim").Methods("PUT", "POST", "DELETE").HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/cosim/step").Methods("POST").HandlerFunc(agency.handlePostCosimStep)
+	s.Path("/agency/cosim/step").Methods("PUT", "GET", "DELETE").
+		HandlerFunc(agency.methodNotAllowed)
 	s.Path("/agency/agents/{agentid}").Methods("DELETE").HandlerFunc(agency.handleDeleteAgentID)
 	s.Path("/agency/agents/{agentid}").Methods("PUT", "GET", "POST").
 		HandlerFunc(agency.methodNotAllowed)
@@ -259,11 +574,33 @@ func (agency *Agency) server(port int) (serv *http.Server) {
 		HandlerFunc(agency.handleGetAgentStatus)
 	s.Path("/agency/agents/{agentid}/status").Methods("PUT", "DELETE", "POST").
 		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/agents/{agentid}/suspend").Methods("POST").
+		HandlerFunc(agency.handlePostAgentSuspend)
+	s.Path("/agency/agents/{agentid}/suspend").Methods("PUT", "DELETE", "GET").
+		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/agents/{agentid}/resume").Methods("POST").
+		HandlerFunc(agency.handlePostAgentResume)
+	s.Path("/agency/agents/{agentid}/resume").Methods("PUT", "DELETE", "GET").
+		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/agents/{agentid}/restart").Methods("POST").
+		HandlerFunc(agency.handlePostAgentRestart)
+	s.Path("/agency/agents/{agentid}/restart").Methods("PUT", "DELETE", "GET").
+		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/agents/{agentid}/migrate").Methods("POST").
+		HandlerFunc(agency.handlePostAgentMigrate)
+	s.Path("/agency/agents/{agentid}/migrate").Methods("PUT", "DELETE", "GET").
+		HandlerFunc(agency.methodNotAllowed)
+	s.Path("/agency/agents/{agentid}/inbox").Methods("GET").
+		HandlerFunc(agency.handleGetAgentInbox)
+	s.Path("/agency/agents/{agentid}/inbox").Methods("PUT", "DELETE", "POST").
+		HandlerFunc(agency.methodNotAllowed)
 	s.Path("/agency/agents/{agentid}/custom").Methods("PUT").
 		HandlerFunc(agency.handlePutAgentCustom)
 	s.Path("/agency/agents/{agentid}/custom").Methods("GET", "DELETE", "POST").
 		HandlerFunc(agency.methodNotAllowed)
 	s.Use(agency.loggingMiddleware)
+	r.Path("/metrics").Methods("GET").HandlerFunc(agency.handleGetMetrics)
+	r.Path("/metrics").Methods("PUT", "DELETE", "POST").HandlerFunc(agency.methodNotAllowed)
 	r.PathPrefix("").HandlerFunc(agency.resourceNotFound)
 	serv = &http.Server{
 		Addr:    ":" + strconv.Itoa(port),
@@ -0,0 +1,297 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// capacity and overflow policies of agent inboxes
+
+package agency
+
+import (
+	"errors"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// defaultInboxCapacity is the capacity of inboxes if not specified otherwise
+const defaultInboxCapacity = 1000
+
+// ErrInboxFull is returned to local senders of messages rejected due to a full inbox
+var ErrInboxFull = errors.New("inbox full")
+
+// errDeliveryQueueFull is returned by deliver if the inbox and the delivery queue of a priority
+// level are full under the block policy
+var errDeliveryQueueFull = errors.New("delivery queue full")
+
+// newInbox creates the agent inbox according to the inbox config and returns the overflow policy
+func newInbox(config schemas.InboxConfig) (msgIn *msgQueue, policy string, err error) {
+	capacity := config.Capacity
+	if capacity <= 0 {
+		capacity = defaultInboxCapacity
+	}
+	msgIn = newMsgQueue(capacity)
+	switch config.Policy {
+	case schemas.InboxBlock, schemas.InboxDropOldest, schemas.InboxDropNewest,
+		schemas.InboxReject:
+		policy = config.Policy
+	case "":
+		policy = schemas.InboxBlock
+	default:
+		policy = schemas.InboxBlock
+		err = errors.New("unknown inbox policy " + config.Policy)
+	}
+	return
+}
+
+// inboxCapacity returns the capacity used for inboxes of behaviors and conversations
+func (acl *ACL) inboxCapacity() int {
+	return acl.msgIn.capacity
+}
+
+// enqueue adds msg to inbox and applies the overflow policy if the priority level of msg is
+// full. With the block policy enqueue waits for space if block is true and returns false
+// otherwise. Rejected messages are answered with a failure and ErrInboxFull is returned
+func (acl *ACL) enqueue(inbox *msgQueue, msg schemas.ACLMessage,
+	block bool) (handled bool, err error) {
+	if inbox.tryPut(msg) {
+		handled = true
+		err = acl.logger.NewLog("msg", "ACL receive", msg.String())
+		return
+	}
+	switch acl.inboxPolicy {
+	case schemas.InboxDropNewest:
+		handled = true
+		err = acl.overflow(msg, "ACL inbox overflow; dropping newest message", false)
+	case schemas.InboxReject:
+		handled = true
+		err = acl.reject(msg)
+	case schemas.InboxDropOldest:
+		handled = true
+		if old, dropped := inbox.putDropOldest(msg); dropped {
+			acl.overflow(old, "ACL inbox overflow; dropping oldest message", false)
+		}
+		err = acl.logger.NewLog("msg", "ACL receive", msg.String())
+	default:
+		if block {
+			err = inbox.put(msg)
+			if err != nil {
+				return
+			}
+			handled = true
+			err = acl.logger.NewLog("msg", "ACL receive", msg.String())
+		}
+	}
+	return
+}
+
+// reject answers a message that does not fit into the inbox with a failure and returns
+// ErrInboxFull. Failures are dropped instead to avoid loops
+func (acl *ACL) reject(msg schemas.ACLMessage) (err error) {
+	if msg.Performative == schemas.FIPAPerfFailure {
+		err = acl.overflow(msg, "ACL inbox overflow; dropping failure message", false)
+		return
+	}
+	acl.overflow(msg, "ACL inbox overflow; rejecting message", true)
+	reply, replyErr := acl.NewReply(msg, schemas.FIPAPerfFailure, "inbox full")
+	if replyErr == nil {
+		go acl.SendMessage(reply)
+	} else {
+		acl.logError.Println("Could not reject message for agent ", acl.agentID, ": ",
+			replyErr)
+	}
+	err = ErrInboxFull
+	return
+}
+
+// addPending keeps a message skipped by selective receive. The capacity and the overflow policy
+// of the inbox apply to the pending messages as well. With the block policy the capacity is
+// ensured by not taking further messages from the inbox (see pendingFull)
+func (acl *ACL) addPending(msg schemas.ACLMessage) {
+	acl.mutex.Lock()
+	if len(acl.msgPending) < acl.msgIn.capacity || acl.inboxPolicy == schemas.InboxBlock {
+		acl.msgPending = append(acl.msgPending, msg)
+		acl.notifyPending()
+		acl.mutex.Unlock()
+		return
+	}
+	switch acl.inboxPolicy {
+	case schemas.InboxDropOldest:
+		old := acl.msgPending[0]
+		acl.msgPending = append(acl.msgPending[1:], msg)
+		acl.notifyPending()
+		acl.mutex.Unlock()
+		acl.overflow(old, "ACL inbox overflow; dropping oldest message", false)
+	case schemas.InboxReject:
+		acl.mutex.Unlock()
+		acl.reject(msg)
+	default:
+		acl.mutex.Unlock()
+		acl.overflow(msg, "ACL inbox overflow; dropping newest message", false)
+	}
+}
+
+// pendingFull indicates if selective receive has to wait for other receivers before taking
+// further messages from the inbox, which is the case with the block policy if the pending
+// messages have reached the capacity of the inbox; the mutex has to be held
+func (acl *ACL) pendingFull() bool {
+	return acl.inboxPolicy == schemas.InboxBlock && len(acl.msgPending) >= acl.msgIn.capacity
+}
+
+// pendingChange returns a channel that is closed when the pending messages change; the mutex
+// has to be held
+func (acl *ACL) pendingChange() <-chan struct{} {
+	if acl.pendingChanged == nil {
+		acl.pendingChanged = make(chan struct{})
+	}
+	return acl.pendingChanged
+}
+
+// notifyPending wakes up all receivers waiting for a change of the pending messages; the mutex
+// has to be held
+func (acl *ACL) notifyPending() {
+	if acl.pendingChanged != nil {
+		close(acl.pendingChanged)
+		acl.pendingChanged = nil
+	}
+}
+
+// overflow counts and logs a message that has been dropped or rejected due to overflow
+func (acl *ACL) overflow(msg schemas.ACLMessage, reason string, reject bool) (err error) {
+	acl.mutex.Lock()
+	if reject {
+		acl.numRejected++
+	} else {
+		acl.numDropped++
+	}
+	acl.mutex.Unlock()
+	acl.metrics.msgDiscarded(acl.agentID)
+	acl.logInfo.Println(reason, " for agent ", acl.agentID)
+	err = acl.logger.NewLog("msg", reason, msg.String())
+	return
+}
+
+// deliver delivers a message received from the agency without blocking the agency. If the inbox
+// is full under the block policy, the message is queued and delivered in order once the agent
+// has taken messages from its inbox. Each priority level has its own queue, so that queued bulk
+// messages do not delay urgent ones. errDeliveryQueueFull is returned if the queue is full as
+// well; the agency then waits for space for this receiver only
+func (acl *ACL) deliver(msg schemas.ACLMessage) (err error) {
+	level := priorityLevel(msg.Priority)
+	acl.mutex.Lock()
+	if !acl.active {
+		acl.mutex.Unlock()
+		err = errors.New("acl not active")
+		return
+	}
+	if acl.queueLen[level] == 0 {
+		acl.mutex.Unlock()
+		var delivered bool
+		delivered, err = acl.receive(msg, false)
+		if delivered || err != nil {
+			return
+		}
+		acl.mutex.Lock()
+	}
+	if acl.queueLen[level] >= cap(acl.deliverQueue[level]) {
+		acl.mutex.Unlock()
+		err = errDeliveryQueueFull
+		return
+	}
+	acl.queueLen[level]++
+	start := !acl.queueRunning[level]
+	acl.queueRunning[level] = true
+	acl.mutex.Unlock()
+	if start {
+		go acl.drainQueue(level)
+	}
+	acl.deliverQueue[level] <- msg
+	return
+}
+
+// drainQueue is to be executed as go routine. It delivers queued messages of one priority level
+// until the queue is empty
+func (acl *ACL) drainQueue(level int) {
+	for {
+		acl.mutex.Lock()
+		if acl.queueLen[level] == 0 {
+			acl.queueRunning[level] = false
+			acl.mutex.Unlock()
+			return
+		}
+		acl.mutex.Unlock()
+		msg := <-acl.deliverQueue[level]
+		err := acl.newIncomingMessage(msg)
+		if err != nil {
+			acl.logError.Println("Delivery of queued message to agent ", acl.agentID,
+				" failed: ", err)
+		}
+		acl.mutex.Lock()
+		acl.queueLen[level]--
+		acl.mutex.Unlock()
+	}
+}
+
+// GetInboxStats returns the number of messages waiting in the inboxes of the agent and the
+// number of messages discarded due to overflow
+func (acl *ACL) GetInboxStats() (stats schemas.InboxStats, err error) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	if !acl.active {
+		err = errors.New("acl not active")
+		return
+	}
+	stats = schemas.InboxStats{
+		Capacity:  acl.msgIn.capacity,
+		Policy:    acl.inboxPolicy,
+		Depth:     acl.msgIn.len(),
+		Pending:   len(acl.msgPending),
+		Queued:    acl.queueLen[0] + acl.queueLen[1] + acl.queueLen[2],
+		Protocols: make(map[int]int),
+		Dropped:   acl.numDropped,
+		Rejected:  acl.numRejected,
+		Buffered:  len(acl.msgSuspended),
+	}
+	for prot, inbox := range acl.msgInProtocol {
+		stats.Protocols[prot] = inbox.len()
+	}
+	return
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// provides predicates for the selective receive of ACL messages
+
+package agency
+
+import (
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// MessageMatcher is a predicate for the selective receive of messages
+type MessageMatcher func(schemas.ACLMessage) bool
+
+// MatchSender matches messages sent by the given agent
+func MatchSender(sender int) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return msg.Sender == sender
+	}
+}
+
+// MatchPerformative matches messages with the given performative
+func MatchPerformative(perf int) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return msg.Performative == perf
+	}
+}
+
+// MatchProtocol matches messages with the given protocol
+func MatchProtocol(prot int) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return msg.Protocol == prot
+	}
+}
+
+// MatchConversationID matches messages that belong to the given conversation
+func MatchConversationID(convID int) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return msg.ConversationID == convID
+	}
+}
+
+// MatchOntology matches messages with the given ontology
+func MatchOntology(ontology string) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return msg.Ontology == ontology
+	}
+}
+
+// MatchAll matches messages that match all given predicates
+func MatchAll(matchers ...MessageMatcher) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		for i := range matchers {
+			if !matchers[i](msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAny matches messages that match at least one of the given predicates
+func MatchAny(matchers ...MessageMatcher) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		for i := range matchers {
+			if matchers[i](msg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchNot matches messages that do not match the given predicate
+func MatchNot(matcher MessageMatcher) MessageMatcher {
+	return func(msg schemas.ACLMessage) bool {
+		return !matcher(msg)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// statistics of agents and agency exposed via /metrics
+
+package agency
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/metrics"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// agencyMetrics holds the counters and histograms of an agency. All methods can be called on a
+// nil object in which case nothing is recorded
+type agencyMetrics struct {
+	registry        *metrics.Registry
+	msgsSent        *metrics.Counter   // ACL messages sent per agent and protocol
+	msgsReceived    *metrics.Counter   // ACL messages received per agent and protocol
+	sendErrors      *metrics.Counter   // failed sends per agent
+	handlerDuration *metrics.Histogram // duration of protocol handlers per agent and protocol
+	handlerErrors   *metrics.Counter   // errors returned by protocol handlers
+	inboxDepth      *metrics.Gauge     // messages waiting in the inboxes per agent
+	inboxDiscarded  *metrics.Counter   // messages dropped or rejected due to overflow per agent
+	localAgents     *metrics.Gauge     // number of local agents
+	remoteAgencies  *metrics.Gauge     // number of known remote agencies
+	remoteQueue     *metrics.Gauge     // messages waiting to be sent per remote agency
+	remoteMsgs      *metrics.Counter   // messages sent per remote agency
+	remoteDuration  *metrics.Histogram // duration of sending a batch per remote agency
+	agencyMsgsIn    *metrics.Counter   // messages received from other agencies
+	mqttPublished   *metrics.Counter   // mqtt messages published per agent
+	mqttReceived    *metrics.Counter   // mqtt messages received per agent
+	mqttErrors      *metrics.Counter   // failed mqtt publishes per agent
+	dfRequests      *metrics.Counter   // requests to the DF per operation and status code
+	dfDuration      *metrics.Histogram // duration of requests to the DF per operation
+}
+
+// newAgencyMetrics registers all metrics of an agency
+func newAgencyMetrics() (m *agencyMetrics) {
+	reg := metrics.NewRegistry()
+	m = &agencyMetrics{
+		registry: reg,
+		msgsSent: reg.NewCounter("clonemap_agent_messages_sent_total",
+			"Number of ACL messages sent by an agent.", "agent", "protocol"),
+		msgsReceived: reg.NewCounter("clonemap_agent_messages_received_total",
+			"Number of ACL messages delivered to an agent.", "agent", "protocol"),
+		sendErrors: reg.NewCounter("clonemap_agent_send_errors_total",
+			"Number of ACL messages that could not be sent by an agent.", "agent"),
+		handlerDuration: reg.NewHistogram("clonemap_agent_handler_duration_seconds",
+			"Duration of message handlers of protocol behaviors.", nil, "agent", "protocol"),
+		handlerErrors: reg.NewCounter("clonemap_agent_handler_errors_total",
+			"Number of errors returned by message handlers of protocol behaviors.", "agent",
+			"protocol"),
+		inboxDepth: reg.NewGauge("clonemap_agent_inbox_messages",
+			"Number of messages waiting in the inboxes of an agent.", "agent"),
+		inboxDiscarded: reg.NewCounter("clonemap_agent_inbox_discarded_messages_total",
+			"Number of messages dropped or rejected due to inbox overflow.", "agent"),
+		localAgents: reg.NewGauge("clonemap_agency_agents",
+			"Number of agents located in the agency."),
+		remoteAgencies: reg.NewGauge("clonemap_agency_remote_agencies",
+			"Number of remote agencies messages have been sent to."),
+		remoteQueue: reg.NewGauge("clonemap_agency_remote_queue_messages",
+			"Number of messages waiting to be sent to a remote agency.", "agency"),
+		remoteMsgs: reg.NewCounter("clonemap_agency_remote_messages_sent_total",
+			"Number of messages sent to a remote agency.", "agency"),
+		remoteDuration: reg.NewHistogram("clonemap_agency_remote_send_duration_seconds",
+			"Duration of sending a batch of messages to a remote agency.", nil, "agency"),
+		agencyMsgsIn: reg.NewCounter("clonemap_agency_messages_received_total",
+			"Number of messages received from other agencies."),
+		mqttPublished: reg.NewCounter("clonemap_mqtt_messages_published_total",
+			"Number of MQTT messages published by an agent.", "agent"),
+		mqttReceived: reg.NewCounter("clonemap_mqtt_messages_received_total",
+			"Number of MQTT messages delivered to an agent.", "agent"),
+		mqttErrors: reg.NewCounter("clonemap_mqtt_publish_errors_total",
+			"Number of MQTT messages that could not be published by an agent.", "agent"),
+		dfRequests: reg.NewCounter("clonemap_df_requests_total",
+			"Number of requests to the DF.", "op", "code"),
+		dfDuration: reg.NewHistogram("clonemap_df_request_duration_seconds",
+			"Duration of requests to the DF.", nil, "op"),
+	}
+	return
+}
+
+// msgSent records an ACL message sent by a local agent
+func (m *agencyMetrics) msgSent(msg schemas.ACLMessage, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.sendErrors.Inc(strconv.Itoa(msg.Sender))
+		return
+	}
+	m.msgsSent.Inc(strconv.Itoa(msg.Sender), strconv.Itoa(msg.Protocol))
+}
+
+// msgReceived records an ACL message delivered to a local agent
+func (m *agencyMetrics) msgReceived(msg schemas.ACLMessage) {
+	if m == nil {
+		return
+	}
+	m.msgsReceived.Inc(strconv.Itoa(msg.Receiver), strconv.Itoa(msg.Protocol))
+}
+
+// msgDiscarded counts a message that has been dropped or rejected due to inbox overflow
+func (m *agencyMetrics) msgDiscarded(agentID int) {
+	if m == nil {
+		return
+	}
+	m.inboxDiscarded.Inc(strconv.Itoa(agentID))
+}
+
+// observeHandler records the execution of a message handler of a protocol behavior
+func (m *agencyMetrics) observeHandler(agentID int, protocol int, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	agent := strconv.Itoa(agentID)
+	prot := strconv.Itoa(protocol)
+	m.handlerDuration.Observe(time.Since(start).Seconds(), agent, prot)
+	if err != nil {
+		m.handlerErrors.Inc(agent, prot)
+	}
+}
+
+// remoteSent records a batch of messages sent to a remote agency
+func (m *agencyMetrics) remoteSent(agency string, num int, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.remoteMsgs.Add(float64(num), agency)
+	m.remoteDuration.Observe(time.Since(start).Seconds(), agency)
+}
+
+// agencyReceived records messages received from other agencies
+func (m *agencyMetrics) agencyReceived(num int) {
+	if m == nil {
+		return
+	}
+	m.agencyMsgsIn.Add(float64(num))
+}
+
+// mqttPublish records an mqtt message published by an agent
+func (m *agencyMetrics) mqttPublish(agentID int, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.mqttErrors.Inc(strconv.Itoa(agentID))
+		return
+	}
+	m.mqttPublished.Inc(strconv.Itoa(agentID))
+}
+
+// mqttReceive records an mqtt message delivered to an agent
+func (m *agencyMetrics) mqttReceive(agentID int) {
+	if m == nil {
+		return
+	}
+	m.mqttReceived.Inc(strconv.Itoa(agentID))
+}
+
+// observeDF records a request to the DF; it is used as observer of the DF client
+func (m *agencyMetrics) observeDF(op string, httpStatus int, dur time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	code := strconv.Itoa(httpStatus)
+	if err != nil {
+		code = "error"
+	}
+	m.dfRequests.Inc(op, code)
+	m.dfDuration.Observe(dur.Seconds(), op)
+}
+
+// collectMetrics updates the gauges that reflect the current state of the agency
+func (agency *Agency) collectMetrics() {
+	m := agency.metrics
+	if m == nil {
+		return
+	}
+	agency.mutex.Lock()
+	acls := make(map[int]*ACL, len(agency.localAgents))
+	for id, ag := range agency.localAgents {
+		acls[id] = ag.ACL
+	}
+	queues := make(map[string]int, len(agency.remoteAgencies))
+	for name, remAgency := range agency.remoteAgencies {
+		queues[name] = remAgency.msgIn.len()
+	}
+	agency.mutex.Unlock()
+	m.inboxDepth.Reset()
+	m.remoteQueue.Reset()
+	m.localAgents.Set(float64(len(acls)))
+	m.remoteAgencies.Set(float64(len(queues)))
+	for id, acl := range acls {
+		stats, err := acl.GetInboxStats()
+		if err != nil {
+			continue
+		}
+		depth := stats.Depth + stats.Pending + stats.Queued + stats.Buffered
+		for _, num := range stats.Protocols {
+			depth += num
+		}
+		m.inboxDepth.Set(float64(depth), strconv.Itoa(id))
+	}
+	for name, num := range queues {
+		m.remoteQueue.Set(float64(num), name)
+	}
+}
@@ -45,6 +45,7 @@ THE SOFTWARE.
 package agency
 
 import (
+	"context"
 	"errors"
 	"log"
 	"strconv"
@@ -63,6 +64,7 @@ type mqttCollector struct {
 	config       schemas.MQTTConfig       // indicates if mqtt is active (switch via env)
 	mutex        *sync.Mutex              // mutex for message inbox map
 	subscription map[string][]*AgentMQTT  // map for subscription topics to agents' mqtt object
+	metrics      *agencyMetrics           // statistics of published and received messages
 	// numDeliverer int                      // number of go routines for delivery
 	logError *log.Logger
 	logInfo  *log.Logger
@@ -243,6 +245,7 @@ type AgentMQTT struct {
 	msgInTopic map[string]chan schemas.MQTTMessage // message inbox for messages with specified topic
 	msgIn      chan schemas.MQTTMessage            // mqtt message inbox
 	agentID    int
+	ctx        context.Context // done when the agent is terminated
 	logger     *client.AgentLogger
 	logError   *log.Logger
 	logInfo    *log.Logger
@@ -250,12 +253,14 @@ type AgentMQTT struct {
 }
 
 // newAgentMQTT returns a new pubsub connector of type mqtt
-func (mqttCol *mqttCollector) newAgentMQTT(agentID int, cmaplog *client.AgentLogger,
+func (mqttCol *mqttCollector) newAgentMQTT(ctx context.Context, agentID int,
+	cmaplog *client.AgentLogger,
 	logErr *log.Logger, logInf *log.Logger) (mq *AgentMQTT) {
 	mq = &AgentMQTT{
 		collector: mqttCol,
 		mutex:     &sync.Mutex{},
 		agentID:   agentID,
+		ctx:       ctx,
 		logger:    cmaplog,
 		logError:  logErr,
 		logInfo:   logInf,
@@ -269,6 +274,9 @@ func (mqttCol *mqttCollector) newAgentMQTT(agentID int, cmaplog *client.AgentLog
 
 // close closes the mqtt
 func (mq *AgentMQTT) close() {
+	if mq == nil {
+		return
+	}
 	for t := range mq.subTopic {
 		mq.Unsubscribe(t)
 	}
@@ -328,6 +336,7 @@ func (mq *AgentMQTT) SendMessage(msg schemas.MQTTMessage, qos int) (err error) {
 	}
 	mq.mutex.Unlock()
 	err = mq.collector.publish(msg, qos)
+	mq.collector.metrics.mqttPublish(mq.agentID, err)
 	if err != nil {
 		return
 	}
@@ -365,8 +374,17 @@ func (mq *AgentMQTT) RecvMessages() (num int, msgs []schemas.MQTTMessage, err er
 	}
 }
 
-// RecvMessageWait retrieves next message and blocks if no message is available
+// RecvMessageWait retrieves next message and blocks if no message is available. An error is
+// returned if the agent is terminated while waiting
 func (mq *AgentMQTT) RecvMessageWait() (msg schemas.MQTTMessage, err error) {
+	msg, err = mq.RecvMessageWaitContext(context.Background())
+	return
+}
+
+// RecvMessageWaitContext retrieves next message and blocks until a message is available, ctx is
+// done or the agent is terminated
+func (mq *AgentMQTT) RecvMessageWaitContext(ctx context.Context) (msg schemas.MQTTMessage,
+	err error) {
 	mq.mutex.Lock()
 	if !mq.active {
 		mq.mutex.Unlock()
@@ -374,8 +392,13 @@ func (mq *AgentMQTT) RecvMessageWait() (msg schemas.MQTTMessage, err error) {
 		return
 	}
 	mq.mutex.Unlock()
-	err = nil
-	msg = <-mq.msgIn
+	select {
+	case msg = <-mq.msgIn:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-mq.ctx.Done():
+		err = errors.New("mqtt not active")
+	}
 	return
 }
 
@@ -391,10 +414,13 @@ func (mq *AgentMQTT) newIncomingMQTTMessage(msg schemas.MQTTMessage) {
 	mq.mutex.Lock()
 	inbox, ok := mq.msgInTopic[msg.Topic]
 	mq.mutex.Unlock()
-	if ok {
-		inbox <- msg
-	} else {
-		mq.msgIn <- msg
+	if !ok {
+		inbox = mq.msgIn
+	}
+	select {
+	case inbox <- msg:
+		mq.collector.metrics.mqttReceive(mq.agentID)
+	case <-mq.ctx.Done():
 	}
 }
 
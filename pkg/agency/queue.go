@@ -0,0 +1,221 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// priority-aware message queues used as inboxes of agents and for messages to remote agencies
+
+package agency
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// numPriorities is the number of priority levels of message queues
+const numPriorities = 3
+
+// errQueueClosed is returned by put if the queue has been closed
+var errQueueClosed = errors.New("queue closed")
+
+// priorityLevel returns the index of the queue level for prio; level 0 is served first
+func priorityLevel(prio int) int {
+	switch {
+	case prio >= schemas.PriorityHigh:
+		return 0
+	case prio <= schemas.PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// msgQueue is a message queue with one FIFO queue per priority level. Messages with higher
+// priority are taken first. The capacity applies to each level separately, so that a flood of
+// bulk messages cannot block urgent messages
+type msgQueue struct {
+	levels   [numPriorities][]schemas.ACLMessage // queued messages per priority level
+	capacity int                                 // capacity of each level
+	mutex    *sync.Mutex
+	space    *sync.Cond    // signals that messages have been taken or the queue has been closed
+	notify   chan struct{} // signals that messages are available
+	closed   bool          // indicates that put does not wait for space anymore
+}
+
+// newMsgQueue creates a new message queue
+func newMsgQueue(capacity int) (queue *msgQueue) {
+	queue = &msgQueue{
+		capacity: capacity,
+		mutex:    &sync.Mutex{},
+		notify:   make(chan struct{}, 1),
+	}
+	queue.space = sync.NewCond(queue.mutex)
+	return
+}
+
+// tryPut adds msg to the queue. false is returned if the level of msg is full
+func (queue *msgQueue) tryPut(msg schemas.ACLMessage) (ok bool) {
+	level := priorityLevel(msg.Priority)
+	queue.mutex.Lock()
+	if len(queue.levels[level]) < queue.capacity {
+		queue.levels[level] = append(queue.levels[level], msg)
+		ok = true
+	}
+	queue.mutex.Unlock()
+	if ok {
+		queue.signal()
+	}
+	return
+}
+
+// put adds msg to the queue and waits for space if the level of msg is full. errQueueClosed is
+// returned if the queue is closed before msg could be added
+func (queue *msgQueue) put(msg schemas.ACLMessage) (err error) {
+	level := priorityLevel(msg.Priority)
+	queue.mutex.Lock()
+	for len(queue.levels[level]) >= queue.capacity && !queue.closed {
+		queue.space.Wait()
+	}
+	if queue.closed {
+		queue.mutex.Unlock()
+		err = errQueueClosed
+		return
+	}
+	queue.levels[level] = append(queue.levels[level], msg)
+	queue.mutex.Unlock()
+	queue.signal()
+	return
+}
+
+// putDropOldest adds msg to the queue. If the level of msg is full, the oldest message of this
+// level is removed and returned
+func (queue *msgQueue) putDropOldest(msg schemas.ACLMessage) (old schemas.ACLMessage,
+	dropped bool) {
+	level := priorityLevel(msg.Priority)
+	queue.mutex.Lock()
+	if len(queue.levels[level]) >= queue.capacity && len(queue.levels[level]) > 0 {
+		old = queue.levels[level][0]
+		queue.levels[level] = queue.levels[level][1:]
+		dropped = true
+	}
+	queue.levels[level] = append(queue.levels[level], msg)
+	queue.mutex.Unlock()
+	queue.signal()
+	return
+}
+
+// tryGet takes the next message with the highest priority. false is returned if the queue is
+// empty
+func (queue *msgQueue) tryGet() (msg schemas.ACLMessage, ok bool) {
+	queue.mutex.Lock()
+	for i := range queue.levels {
+		if len(queue.levels[i]) == 0 {
+			continue
+		}
+		msg = queue.levels[i][0]
+		queue.levels[i][0] = schemas.ACLMessage{}
+		queue.levels[i] = queue.levels[i][1:]
+		ok = true
+		break
+	}
+	remaining := queue.length()
+	queue.mutex.Unlock()
+	if ok {
+		queue.space.Broadcast()
+		if remaining > 0 {
+			// pass on the notification to other receivers
+			queue.signal()
+		}
+	}
+	return
+}
+
+// get takes the next message with the highest priority and waits if the queue is empty
+func (queue *msgQueue) get() (msg schemas.ACLMessage) {
+	for {
+		var ok bool
+		msg, ok = queue.tryGet()
+		if ok {
+			return
+		}
+		<-queue.notify
+	}
+}
+
+// close releases all senders waiting for space. Messages put afterwards are rejected
+func (queue *msgQueue) close() {
+	queue.mutex.Lock()
+	queue.closed = true
+	queue.mutex.Unlock()
+	queue.space.Broadcast()
+}
+
+// ready returns a channel that receives a value when messages have been added to the queue.
+// It is to be used in select statements in combination with tryGet
+func (queue *msgQueue) ready() <-chan struct{} {
+	return queue.notify
+}
+
+// len returns the number of messages in the queue
+func (queue *msgQueue) len() (num int) {
+	queue.mutex.Lock()
+	num = queue.length()
+	queue.mutex.Unlock()
+	return
+}
+
+// length returns the number of messages in the queue; the mutex has to be held
+func (queue *msgQueue) length() (num int) {
+	for i := range queue.levels {
+		num += len(queue.levels[i])
+	}
+	return
+}
+
+// signal notifies a waiting receiver
+func (queue *msgQueue) signal() {
+	select {
+	case queue.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,481 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// behaviors that are executed according to a schedule of wall-clock times
+
+package agency
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MissedRunSkip skips all runs that have been missed
+	MissedRunSkip = iota
+	// MissedRunOnce executes the latest missed run once and skips all others
+	MissedRunOnce
+	// MissedRunAll executes all missed runs immediately one after another
+	MissedRunAll
+)
+
+// missedRunTolerance is the delay in addition to the jitter after which a run counts as missed
+const missedRunTolerance = time.Second
+
+// Clock is the source of time for scheduled behaviors
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer delivers the current time on its channel once its duration has expired
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock implements the Clock interface with the system time
+type systemClock struct{}
+
+// systemTimer implements the Timer interface with a timer of the time package
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// Now returns the current system time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a timer of the time package
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// C returns the channel of the timer
+func (timer systemTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+// Stop stops the timer
+func (timer systemTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+// Schedule determines the times at which a scheduled behavior is executed
+type Schedule interface {
+	// Next returns the first activation strictly after the given time. ok is false if there is
+	// no further activation
+	Next(after time.Time) (next time.Time, ok bool)
+}
+
+// ScheduleConfig contains the execution options of a scheduled behavior
+type ScheduleConfig struct {
+	MissedRuns int           // policy for runs missed while handling or suspended (MissedRunX)
+	Jitter     time.Duration // each run is delayed by a random duration of up to Jitter
+	Clock      Clock         // source of time; the system clock is used if nil
+}
+
+// fixedRateSchedule is activated at start and every period thereafter
+type fixedRateSchedule struct {
+	start  time.Time
+	period time.Duration
+}
+
+// NewFixedRateSchedule returns a schedule that is activated at start and every period thereafter.
+// Activations are calculated from start so that execution does not drift. Use a truncated start
+// time, e.g. time.Now().Truncate(15 * time.Minute), to align activations to the wall clock
+func NewFixedRateSchedule(start time.Time, period time.Duration) (schedule Schedule, err error) {
+	if period <= 0 {
+		err = errors.New("illegal period")
+		return
+	}
+	schedule = fixedRateSchedule{start: start, period: period}
+	return
+}
+
+// Next returns the first activation after the given time
+func (sched fixedRateSchedule) Next(after time.Time) (next time.Time, ok bool) {
+	ok = true
+	if after.Before(sched.start) {
+		next = sched.start
+		return
+	}
+	periods := after.Sub(sched.start)/sched.period + 1
+	next = sched.start.Add(periods * sched.period)
+	return
+}
+
+// timestampSchedule is activated at a list of explicit times
+type timestampSchedule []time.Time
+
+// NewTimestampSchedule returns a schedule that is activated at each of the given times
+func NewTimestampSchedule(times ...time.Time) (schedule Schedule, err error) {
+	if len(times) == 0 {
+		err = errors.New("no timestamps")
+		return
+	}
+	sched := make(timestampSchedule, len(times))
+	copy(sched, times)
+	sort.Slice(sched, func(i, j int) bool { return sched[i].Before(sched[j]) })
+	schedule = sched
+	return
+}
+
+// Next returns the first timestamp after the given time
+func (sched timestampSchedule) Next(after time.Time) (next time.Time, ok bool) {
+	i := sort.Search(len(sched), func(i int) bool { return sched[i].After(after) })
+	if i < len(sched) {
+		next = sched[i]
+		ok = true
+	}
+	return
+}
+
+// cronField is a bit set of the values allowed in one field of a cron expression
+type cronField uint64
+
+// has checks if value is contained in the field
+func (field cronField) has(value int) bool {
+	return field&(1<<uint(value)) != 0
+}
+
+// cronSchedule is activated at the times matching a cron expression
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow cronField
+	domStar, dowStar                      bool // day of month or week is not restricted
+}
+
+// cronDescriptors are the predefined cron expressions
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression and returns the corresponding schedule. The expression
+// consists of the five fields minute, hour, day of month, month and day of week or of six fields
+// with an additional leading second field. Each field is a comma separated list of values, ranges
+// (a-b) and steps (*/n, a-b/n, a/n); * matches all values. Days of the week are numbered from 0
+// (Sunday) to 6; 7 is Sunday as well. If both day fields are restricted a day matches if either
+// field matches. The predefined expressions @yearly, @monthly, @weekly, @daily and @hourly are
+// supported. Times are evaluated in the location of the time passed to Next
+func ParseCron(expr string) (schedule Schedule, err error) {
+	if desc, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = desc
+	}
+	fields := strings.Fields(expr)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+	if len(fields) != 6 {
+		err = errors.New("cron expression requires 5 or 6 fields")
+		return
+	}
+	bounds := [][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var parsed [6]cronField
+	for i := range fields {
+		parsed[i], err = parseCronField(fields[i], bounds[i][0], bounds[i][1])
+		if err != nil {
+			return
+		}
+	}
+	if parsed[5].has(7) {
+		parsed[5] |= 1
+	}
+	schedule = &cronSchedule{
+		second:  parsed[0],
+		minute:  parsed[1],
+		hour:    parsed[2],
+		dom:     parsed[3],
+		month:   parsed[4],
+		dow:     parsed[5],
+		domStar: fields[3] == "*" || fields[3] == "?",
+		dowStar: fields[5] == "*" || fields[5] == "?",
+	}
+	return
+}
+
+// parseCronField parses one field of a cron expression with the allowed values min to max
+func parseCronField(expr string, min int, max int) (field cronField, err error) {
+	if expr == "?" {
+		expr = "*"
+	}
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		hasStep := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				err = errors.New("illegal step in cron field " + expr)
+				return
+			}
+			part = part[:i]
+			hasStep = true
+		}
+		var lo, hi int
+		if part == "*" {
+			lo, hi = min, max
+		} else if i := strings.Index(part, "-"); i >= 0 {
+			lo, err = strconv.Atoi(part[:i])
+			if err == nil {
+				hi, err = strconv.Atoi(part[i+1:])
+			}
+		} else {
+			lo, err = strconv.Atoi(part)
+			hi = lo
+			if hasStep {
+				hi = max
+			}
+		}
+		if err != nil || lo < min || hi > max || lo > hi {
+			err = errors.New("illegal cron field " + expr)
+			return
+		}
+		for v := lo; v <= hi; v += step {
+			field |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+// Next returns the first time after the given time that matches the cron expression. Times
+// are only searched within the next five years
+func (sched *cronSchedule) Next(after time.Time) (next time.Time, ok bool) {
+	loc := after.Location()
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		hour, min, sec := t.Clock()
+		switch {
+		case !sched.month.has(int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !sched.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case !sched.hour.has(hour):
+			t = time.Date(year, month, day, hour+1, 0, 0, 0, loc)
+		case !sched.minute.has(min):
+			t = time.Date(year, month, day, hour, min+1, 0, 0, loc)
+		case !sched.second.has(sec):
+			t = t.Add(time.Second)
+		default:
+			next = t
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// dayMatches checks if the day of t matches the day of month and day of week fields
+func (sched *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := sched.dom.has(t.Day())
+	dowMatch := sched.dow.has(int(t.Weekday()))
+	if sched.domStar || sched.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// scheduledBehavior describes an action that is performed according to a schedule
+type scheduledBehavior struct {
+	ag       *Agent                          // agent
+	schedule Schedule                        // activation times
+	config   ScheduleConfig                  // execution options
+	handle   func(scheduled time.Time) error // handler function
+	ctrl     chan int                        // control signals
+	done     chan struct{}                   // closed when task has returned
+	logInfo  *log.Logger
+}
+
+// NewScheduledBehavior creates a behavior that executes handle at each activation of the
+// schedule. The scheduled time of the run is passed to handle. Runs that are due while handle is
+// executed or the agent is suspended are treated according to the missed runs policy. The
+// behavior terminates when the schedule has no further activation
+func (agent *Agent) NewScheduledBehavior(schedule Schedule, config ScheduleConfig,
+	handle func(scheduled time.Time) error) (behavior Behavior, err error) {
+	if handle == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	if schedule == nil {
+		err = errors.New("illegal schedule")
+		return
+	}
+	if config.MissedRuns < MissedRunSkip || config.MissedRuns > MissedRunAll {
+		err = errors.New("illegal missed runs policy")
+		return
+	}
+	if config.Jitter < 0 {
+		err = errors.New("illegal jitter")
+		return
+	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	schedBehavior := &scheduledBehavior{
+		ag:       agent,
+		schedule: schedule,
+		config:   config,
+		handle:   handle,
+		ctrl:     make(chan int, 10),
+		done:     make(chan struct{}),
+		logInfo:  agent.logInfo,
+	}
+	behavior = schedBehavior
+	return
+}
+
+// NewCronBehavior creates a scheduled behavior with the schedule of the cron expression
+func (agent *Agent) NewCronBehavior(expr string, config ScheduleConfig,
+	handle func(scheduled time.Time) error) (behavior Behavior, err error) {
+	schedule, err := ParseCron(expr)
+	if err != nil {
+		return
+	}
+	behavior, err = agent.NewScheduledBehavior(schedule, config, handle)
+	return
+}
+
+// Start initiates the execution of the schedule with the first activation after now
+func (schedBehavior *scheduledBehavior) Start() {
+	go schedBehavior.task(schedBehavior.config.Clock.Now())
+}
+
+// task waits for the activations of the schedule and executes the handle function
+func (schedBehavior *scheduledBehavior) task(start time.Time) {
+	defer close(schedBehavior.done)
+	defer schedBehavior.ag.recoverPanic("scheduled behavior")
+	clock := schedBehavior.config.Clock
+	next, ok := schedBehavior.schedule.Next(start)
+	for ok {
+		wait := next.Sub(clock.Now())
+		if schedBehavior.config.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(schedBehavior.config.Jitter)))
+		}
+		timer := clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case command := <-schedBehavior.ctrl:
+			switch command {
+			case -1:
+				timer.Stop()
+				schedBehavior.logInfo.Println("Terminating scheduled behavior for agent ",
+					schedBehavior.ag.GetAgentID())
+				return
+			}
+		case <-schedBehavior.ag.ctx.Done():
+			timer.Stop()
+			return
+		}
+		// missed runs are executed without waiting for the timer
+		for ok {
+			schedBehavior.ag.waitResumed()
+			if !schedBehavior.missed(next) && schedBehavior.handle(next) == ErrBehaviorDone {
+				return
+			}
+			next, ok = schedBehavior.nextRun(next)
+			if !ok || next.After(clock.Now()) {
+				break
+			}
+		}
+	}
+}
+
+// missed indicates if run is skipped according to the missed runs policy. With MissedRunSkip
+// runs are skipped that are late by more than the jitter and missedRunTolerance. With
+// MissedRunOnce runs are skipped if the following run is due as well
+func (schedBehavior *scheduledBehavior) missed(run time.Time) bool {
+	now := schedBehavior.config.Clock.Now()
+	switch schedBehavior.config.MissedRuns {
+	case MissedRunSkip:
+		return now.Sub(run) > schedBehavior.config.Jitter+missedRunTolerance
+	case MissedRunOnce:
+		following, more := schedBehavior.schedule.Next(run)
+		return more && !following.After(now)
+	}
+	return false
+}
+
+// nextRun returns the run following last according to the missed runs policy
+func (schedBehavior *scheduledBehavior) nextRun(last time.Time) (next time.Time, ok bool) {
+	next, ok = schedBehavior.schedule.Next(last)
+	now := schedBehavior.config.Clock.Now()
+	if !ok || next.After(now) {
+		return
+	}
+	switch schedBehavior.config.MissedRuns {
+	case MissedRunSkip:
+		next, ok = schedBehavior.schedule.Next(now)
+	case MissedRunOnce:
+		for {
+			following, more := schedBehavior.schedule.Next(next)
+			if !more || following.After(now) {
+				break
+			}
+			next = following
+		}
+	}
+	return
+}
+
+// Stop terminates the scheduled execution
+func (schedBehavior *scheduledBehavior) Stop() {
+	schedBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the scheduled execution has terminated
+func (schedBehavior *scheduledBehavior) Done() <-chan struct{} {
+	return schedBehavior.done
+}
@@ -0,0 +1,441 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// persistent message streams between agencies: one long-lived connection per pair of agencies
+// with ordered delivery, acknowledgements and automatic reconnects
+
+package agency
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+const (
+	streamProtocol       = "clonemap-acl/1"    // protocol name used for the connection upgrade
+	streamHeaderAgency   = "Clonemap-Agency"   // header field holding the name of the sending agency
+	streamHeaderSession  = "Clonemap-Session"  // header field holding the session of the stream
+	streamHeaderSequence = "Clonemap-Sequence" // header field holding the sequence number of a batch
+	streamWindow         = 100                 // maximum number of unacknowledged batches
+	streamMaxFrameSize   = 1 << 26             // maximum size of one frame
+	streamConnectRetries = 3                   // number of connection attempts before falling back
+	streamBackoff        = time.Millisecond * 100
+	streamRetryInterval  = time.Second * 30 // time http is used after the stream failed
+)
+
+// frame types
+const (
+	streamFrameData byte = 1 // batch of messages
+	streamFrameAck  byte = 2 // acknowledgement of all batches up to seq
+)
+
+// errStreamUnsupported indicates that the remote agency does not accept streams
+var errStreamUnsupported = errors.New("remote agency does not support message streams")
+
+// streamBatch is a batch of messages sent via a stream
+type streamBatch struct {
+	seq  uint64
+	msgs []schemas.ACLMessage
+}
+
+// streamSession holds the last batch delivered from a remote agency. Sequence numbers start
+// from zero for every new session, i.e. every restart of the sending agency
+type streamSession struct {
+	id  string
+	seq uint64
+}
+
+// msgStream is the sending side of a message stream to a remote agency. Batches are kept until
+// they are acknowledged and are resent in order after a reconnect. Batches that cannot be sent
+// via the stream are handed over to fallback in order. They keep their sequence number, so that
+// the remote agency can discard batches it has already received via the stream
+type msgStream struct {
+	remName   string
+	localName string
+	port      int
+	session   string
+	mutex     *sync.Mutex
+	cond      *sync.Cond // signals acknowledgements and connection loss
+	conn      net.Conn
+	writer    *bufio.Writer
+	seq       uint64        // sequence number of the last batch
+	unacked   []streamBatch // sent batches which have not been acknowledged yet
+	fallback  func(session string, batch streamBatch)
+	logError  *log.Logger
+}
+
+// newMsgStream creates the sending side of a stream to remote agency. The connection is
+// established with the first batch
+func newMsgStream(remName string, localName string, port int,
+	fallback func(session string, batch streamBatch), logErr *log.Logger) (s *msgStream) {
+	s = &msgStream{
+		remName:   remName,
+		localName: localName,
+		port:      port,
+		session:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		mutex:     &sync.Mutex{},
+		fallback:  fallback,
+		logError:  logErr,
+	}
+	s.cond = sync.NewCond(s.mutex)
+	return
+}
+
+// send sends a batch of messages. It blocks if too many batches are unacknowledged. If the
+// connection cannot be (re-)established, all unacknowledged batches are handed over to
+// fallback and an error is returned
+func (s *msgStream) send(msgs []schemas.ACLMessage) (err error) {
+	s.mutex.Lock()
+	s.seq++
+	batch := streamBatch{seq: s.seq, msgs: msgs}
+	for {
+		if s.conn == nil {
+			err = s.connect()
+			if err != nil {
+				break
+			}
+		}
+		if len(s.unacked) < streamWindow {
+			break
+		}
+		s.cond.Wait()
+	}
+	if err == nil {
+		s.unacked = append(s.unacked, batch)
+		err = s.writeBatch(batch)
+		if err != nil {
+			// reconnect resends all unacknowledged batches
+			s.closeConn()
+			err = s.connect()
+		}
+	} else {
+		s.unacked = append(s.unacked, batch)
+	}
+	var failed []streamBatch
+	if err != nil {
+		failed = s.takeUnacked()
+	}
+	s.mutex.Unlock()
+	s.sendFallback(failed)
+	return
+}
+
+// sendFallback hands batches over to fallback in order
+func (s *msgStream) sendFallback(batches []streamBatch) {
+	for i := range batches {
+		s.fallback(s.session, batches[i])
+	}
+}
+
+// connect establishes the connection and resends unacknowledged batches; mutex has to be locked.
+// The mutex is released while waiting between two attempts
+func (s *msgStream) connect() (err error) {
+	delay := streamBackoff
+	for i := 0; i < streamConnectRetries; i++ {
+		if i > 0 {
+			s.mutex.Unlock()
+			time.Sleep(delay)
+			s.mutex.Lock()
+			delay *= 2
+			if s.conn != nil {
+				// connection has been established concurrently
+				err = nil
+				return
+			}
+		}
+		err = s.dial()
+		if err == errStreamUnsupported {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		for j := range s.unacked {
+			err = s.writeBatch(s.unacked[j])
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return
+		}
+		s.closeConn()
+	}
+	return
+}
+
+// dial opens a connection to the remote agency and upgrades it to a message stream
+func (s *msgStream) dial() (err error) {
+	var ip string
+	ip, err = getIP(s.remName)
+	if err != nil {
+		return
+	}
+	dialer := net.Dialer{Timeout: time.Second * 5, KeepAlive: time.Second * 15}
+	var conn net.Conn
+	conn, err = dialer.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(s.port)))
+	if err != nil {
+		return
+	}
+	var req *http.Request
+	req, err = http.NewRequest("GET", "http://"+s.remName+"/api/agency/stream", nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", streamProtocol)
+	req.Header.Set(streamHeaderAgency, s.localName)
+	req.Header.Set(streamHeaderSession, s.session)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var resp *http.Response
+	resp, err = http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		err = errStreamUnsupported
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.conn = conn
+	s.writer = bufio.NewWriter(conn)
+	go s.readAcks(conn, reader)
+	return
+}
+
+// writeBatch writes one batch to the connection; mutex has to be locked
+func (s *msgStream) writeBatch(batch streamBatch) (err error) {
+	err = writeFrame(s.writer, streamFrameData, batch.seq, aclwire.MarshalProtobuf(batch.msgs))
+	if err != nil {
+		return
+	}
+	err = s.writer.Flush()
+	return
+}
+
+// readAcks is to be executed as go routine. It reads acknowledgements from the connection and
+// reconnects if the connection is lost while batches are unacknowledged
+func (s *msgStream) readAcks(conn net.Conn, reader *bufio.Reader) {
+	for {
+		typ, seq, _, err := readFrame(reader)
+		s.mutex.Lock()
+		if err != nil {
+			var failed []streamBatch
+			if s.conn == conn {
+				s.closeConn()
+				if len(s.unacked) > 0 {
+					s.logError.Println("Lost message stream to agency ", s.remName, ": ", err)
+					err = s.connect()
+					if err != nil {
+						failed = s.takeUnacked()
+					}
+				}
+			}
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+			s.sendFallback(failed)
+			return
+		}
+		if typ == streamFrameAck {
+			i := 0
+			for i < len(s.unacked) && s.unacked[i].seq <= seq {
+				i++
+			}
+			s.unacked = s.unacked[i:]
+			s.cond.Broadcast()
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// takeUnacked removes and returns all unacknowledged batches; mutex has to be locked
+func (s *msgStream) takeUnacked() (batches []streamBatch) {
+	batches = s.unacked
+	s.unacked = nil
+	return
+}
+
+// closeConn closes the connection; mutex has to be locked
+func (s *msgStream) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.writer = nil
+	}
+}
+
+// claimBatch records the batch seq of session from remote agency remName as delivered. false is
+// returned if the batch has already been delivered via the stream or via http. A new session
+// replaces the previous session of the remote agency
+func (agency *Agency) claimBatch(remName string, session string, seq uint64) (ok bool) {
+	agency.mutex.Lock()
+	defer agency.mutex.Unlock()
+	sess, known := agency.streamSessions[remName]
+	if known && sess.id == session && seq <= sess.seq {
+		return
+	}
+	agency.streamSessions[remName] = streamSession{id: session, seq: seq}
+	ok = true
+	return
+}
+
+// serveStream is the receiving side of a message stream. Batches are delivered in order and
+// acknowledged once all buffered batches have been delivered. Batches that have already been
+// delivered before a reconnect or via http are only acknowledged. The connection is closed
+// without acknowledgement if a batch cannot be decoded
+func (agency *Agency) serveStream(conn net.Conn, rw *bufio.ReadWriter, remName string,
+	session string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	_, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n" +
+		"Upgrade: " + streamProtocol + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		agency.logError.Println(err)
+		return
+	}
+	agency.logInfo.Println("Opened message stream from agency ", remName)
+	agency.mutex.Lock()
+	sess, ok := agency.streamSessions[remName]
+	if !ok || sess.id != session {
+		agency.streamSessions[remName] = streamSession{id: session}
+	}
+	agency.mutex.Unlock()
+	for {
+		var typ byte
+		var seq uint64
+		var payload []byte
+		typ, seq, payload, err = readFrame(rw.Reader)
+		if err != nil {
+			if err != io.EOF {
+				agency.logError.Println(err)
+			}
+			return
+		}
+		if typ != streamFrameData {
+			continue
+		}
+		var msgs []schemas.ACLMessage
+		msgs, err = aclwire.UnmarshalProtobuf(payload)
+		if err != nil {
+			agency.logError.Println("Invalid batch in message stream from ", remName, ": ", err)
+			return
+		}
+		if agency.claimBatch(remName, session, seq) {
+			for i := range msgs {
+				agency.deliverRemote(msgs[i])
+			}
+			agency.cosim.countReceived(len(msgs))
+		}
+		agency.mutex.Lock()
+		sess = agency.streamSessions[remName]
+		agency.mutex.Unlock()
+		if sess.id == session && rw.Reader.Buffered() == 0 {
+			err = writeFrame(rw.Writer, streamFrameAck, sess.seq, nil)
+			if err == nil {
+				err = rw.Flush()
+			}
+			if err != nil {
+				agency.logError.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// writeFrame writes a frame consisting of type, sequence number, payload length and payload
+func writeFrame(w *bufio.Writer, typ byte, seq uint64, payload []byte) (err error) {
+	var header [13]byte
+	header[0] = typ
+	binary.BigEndian.PutUint64(header[1:9], seq)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	_, err = w.Write(header[:])
+	if err != nil {
+		return
+	}
+	_, err = w.Write(payload)
+	return
+}
+
+// readFrame reads a frame written by writeFrame
+func readFrame(r *bufio.Reader) (typ byte, seq uint64, payload []byte, err error) {
+	var header [13]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return
+	}
+	typ = header[0]
+	seq = binary.BigEndian.Uint64(header[1:9])
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length > streamMaxFrameSize {
+		err = errors.New("frame too large")
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// implementation of the FIPA Subscribe interaction protocol as agent behaviors
+
+package agency
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// maxSubscriberFailures is the number of failed deliveries after which a subscriber is removed
+const maxSubscriberFailures = 3
+
+// Publisher is a behavior that manages subscribers according to the FIPA Subscribe protocol and
+// informs them about published values
+type Publisher struct {
+	ag              *Agent                        // agent
+	mutex           *sync.Mutex                   // mutex for subscribers and last value
+	subscribers     map[int]*subscription         // subscription of each subscriber
+	lastToken       int                           // last token assigned to a subscription
+	handleSubscribe func(schemas.ACLMessage) bool // decides if subscription is accepted
+	lastValue       *string                       // last published value
+	msgBehavior     Behavior                      // handling of subscribe and cancel messages
+	logInfo         *log.Logger
+}
+
+// subscription holds the state of one subscriber
+type subscription struct {
+	msg      schemas.ACLMessage // subscribe message
+	token    int                // reply-with of inform messages; identifies failure notices
+	failures int                // number of failed deliveries
+}
+
+// NewPublisherBehavior creates a behavior that accepts subscribe and cancel messages of the
+// FIPA Subscribe protocol. handleSubscribe decides whether a subscription is accepted
+// (agree) or refused; if it is nil all subscriptions are accepted. New subscribers immediately
+// receive the last published value
+func (agent *Agent) NewPublisherBehavior(
+	handleSubscribe func(subscribe schemas.ACLMessage) bool) (pub *Publisher, err error) {
+	pub = &Publisher{
+		ag:              agent,
+		mutex:           &sync.Mutex{},
+		subscribers:     make(map[int]*subscription),
+		handleSubscribe: handleSubscribe,
+		logInfo:         agent.logInfo,
+	}
+	handlePerformative := map[int]func(schemas.ACLMessage) error{
+		schemas.FIPAPerfSubscribe: pub.subscribe,
+		schemas.FIPAPerfCancel:    pub.cancel,
+		schemas.FIPAPerfFailure:   pub.failure,
+	}
+	pub.msgBehavior, err = agent.NewMessageBehavior(schemas.FIPAProtSubscribe,
+		handlePerformative, func(msg schemas.ACLMessage) error { return nil })
+	if err != nil {
+		pub = nil
+	}
+	return
+}
+
+// Start initiates the handling of subscriptions
+func (pub *Publisher) Start() {
+	pub.msgBehavior.Start()
+}
+
+// Stop terminates the handling of subscriptions
+func (pub *Publisher) Stop() {
+	pub.msgBehavior.Stop()
+}
+
+// Done returns a channel that is closed when the handling of subscriptions has terminated
+func (pub *Publisher) Done() <-chan struct{} {
+	return pub.msgBehavior.Done()
+}
+
+// Publish sends value to all subscribers as inform message. Subscribers that cannot be reached
+// anymore or whose deliveries have failed repeatedly are removed
+func (pub *Publisher) Publish(value string) (err error) {
+	pub.mutex.Lock()
+	pub.lastValue = &value
+	subscribers := make([]subscription, 0, len(pub.subscribers))
+	for _, sub := range pub.subscribers {
+		subscribers = append(subscribers, *sub)
+	}
+	pub.mutex.Unlock()
+	for i := range subscribers {
+		pub.inform(subscribers[i], value)
+	}
+	return
+}
+
+// GetSubscribers returns the IDs of all subscribers
+func (pub *Publisher) GetSubscribers() (subscribers []int) {
+	pub.mutex.Lock()
+	for id := range pub.subscribers {
+		subscribers = append(subscribers, id)
+	}
+	pub.mutex.Unlock()
+	return
+}
+
+// inform sends value to one subscriber and removes the subscriber if it is not reachable
+func (pub *Publisher) inform(sub subscription, value string) {
+	msg, _ := pub.ag.ACL.NewReply(sub.msg, schemas.FIPAPerfInform, value)
+	msg.ReplyWith = strconv.Itoa(sub.token)
+	err := pub.ag.ACL.SendMessage(msg)
+	if err != nil {
+		pub.logInfo.Println("Removing unreachable subscriber ", sub.msg.Sender, " of agent ",
+			pub.ag.GetAgentID())
+		pub.mutex.Lock()
+		if pub.subscribers[sub.msg.Sender] != nil &&
+			pub.subscribers[sub.msg.Sender].token == sub.token {
+			delete(pub.subscribers, sub.msg.Sender)
+		}
+		pub.mutex.Unlock()
+	}
+}
+
+// subscribe handles subscribe messages
+func (pub *Publisher) subscribe(msg schemas.ACLMessage) (err error) {
+	if pub.handleSubscribe != nil && !pub.handleSubscribe(msg) {
+		var reply schemas.ACLMessage
+		reply, _ = pub.ag.ACL.NewReply(msg, schemas.FIPAPerfRefuse, "")
+		err = pub.ag.ACL.SendMessage(reply)
+		return
+	}
+	pub.mutex.Lock()
+	// tokens are negative so that failure notices are not taken for replies to conversations
+	pub.lastToken--
+	sub := subscription{msg: msg, token: pub.lastToken}
+	pub.subscribers[msg.Sender] = &sub
+	lastValue := pub.lastValue
+	pub.mutex.Unlock()
+	var reply schemas.ACLMessage
+	reply, _ = pub.ag.ACL.NewReply(msg, schemas.FIPAPerfAgree, "")
+	err = pub.ag.ACL.SendMessage(reply)
+	if err != nil {
+		return
+	}
+	if lastValue != nil {
+		pub.inform(sub, *lastValue)
+	}
+	return
+}
+
+// cancel handles cancel messages
+func (pub *Publisher) cancel(msg schemas.ACLMessage) (err error) {
+	pub.mutex.Lock()
+	delete(pub.subscribers, msg.Sender)
+	pub.mutex.Unlock()
+	return
+}
+
+// failure handles failures reported by subscribers and notices about inform messages that could
+// not be delivered. A subscriber is removed after maxSubscriberFailures failed deliveries
+func (pub *Publisher) failure(msg schemas.ACLMessage) (err error) {
+	if msg.Sender != schemas.SystemAgentID {
+		err = pub.cancel(msg)
+		return
+	}
+	pub.mutex.Lock()
+	defer pub.mutex.Unlock()
+	for id, sub := range pub.subscribers {
+		if sub.token != msg.InReplyTo {
+			continue
+		}
+		sub.failures++
+		if sub.failures >= maxSubscriberFailures {
+			pub.logInfo.Println("Removing subscriber ", id, " of agent ", pub.ag.GetAgentID(),
+				" after ", sub.failures, " failed deliveries")
+			delete(pub.subscribers, id)
+		}
+		break
+	}
+	return
+}
+
+// subscriberBehavior subscribes to a publisher and handles its inform messages
+type subscriberBehavior struct {
+	ag           *Agent                         // agent
+	publisher    int                            // ID of publishing agent
+	content      string                         // content of subscribe message
+	handleInform func(schemas.ACLMessage) error // handler for published values
+	ctrl         chan int                       // control signals
+	done         chan struct{}                  // closed when task has returned
+	logInfo      *log.Logger
+}
+
+// NewSubscriberBehavior creates a behavior that subscribes to the publisher agent with the given
+// content. Published values are passed to handleInform. The subscription is cancelled when the
+// behavior is stopped
+func (agent *Agent) NewSubscriberBehavior(publisher int, content string,
+	handleInform func(schemas.ACLMessage) error) (behavior Behavior, err error) {
+	if handleInform == nil {
+		err = errors.New("illegal handler")
+		return
+	}
+	subBehavior := &subscriberBehavior{
+		ag:           agent,
+		publisher:    publisher,
+		content:      content,
+		handleInform: handleInform,
+		ctrl:         make(chan int, 10),
+		done:         make(chan struct{}),
+		logInfo:      agent.logInfo,
+	}
+	behavior = subBehavior
+	return
+}
+
+// Start sends the subscription and initiates the handling of published values
+func (subBehavior *subscriberBehavior) Start() {
+	go subBehavior.task()
+}
+
+// task subscribes and handles published values until the behavior is stopped
+func (subBehavior *subscriberBehavior) task() {
+	defer close(subBehavior.done)
+	defer subBehavior.ag.recoverPanic("subscriber behavior")
+	agentID := subBehavior.ag.GetAgentID()
+	subBehavior.logInfo.Println("Starting subscriber behavior for agent ", agentID,
+		" and publisher ", subBehavior.publisher)
+	conv, err := subBehavior.ag.ACL.NewConversation(0)
+	if err != nil {
+		subBehavior.ag.logError.Println("Subscription of agent ", agentID, ": ", err)
+		return
+	}
+	defer conv.Close()
+	msg, _ := subBehavior.ag.ACL.NewMessage(subBehavior.publisher, schemas.FIPAProtSubscribe,
+		schemas.FIPAPerfSubscribe, subBehavior.content)
+	span := subBehavior.ag.ACL.startSpan("subscription")
+	defer subBehavior.ag.ACL.endSpan(span, nil)
+	setSpan(&msg, span)
+	err = conv.SendMessage(msg)
+	if err != nil {
+		subBehavior.ag.logError.Println("Subscription of agent ", agentID, ": ", err)
+		return
+	}
+	for {
+		select {
+		case <-conv.msgIn.ready():
+			var ok bool
+			msg, ok = conv.msgIn.tryGet()
+			if !ok {
+				continue
+			}
+			subBehavior.ag.waitResumed()
+			switch msg.Performative {
+			case schemas.FIPAPerfInform:
+				subBehavior.handleInform(msg)
+			case schemas.FIPAPerfRefuse, schemas.FIPAPerfFailure:
+				subBehavior.logInfo.Println("Subscription of agent ", agentID, " refused by ",
+					subBehavior.publisher)
+				return
+			}
+		case command := <-subBehavior.ctrl:
+			switch command {
+			case -1:
+				msg, _ = subBehavior.ag.ACL.NewMessage(subBehavior.publisher,
+					schemas.FIPAProtSubscribe, schemas.FIPAPerfCancel, subBehavior.content)
+				msg.ConversationID = conv.GetID()
+				setSpan(&msg, span)
+				subBehavior.ag.ACL.SendMessage(msg)
+				subBehavior.logInfo.Println("Terminating subscriber behavior for agent ", agentID,
+					" and publisher ", subBehavior.publisher)
+				return
+			}
+		case <-subBehavior.ag.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop cancels the subscription
+func (subBehavior *subscriberBehavior) Stop() {
+	subBehavior.ctrl <- -1
+}
+
+// Done returns a channel that is closed when the subscription has ended
+func (subBehavior *subscriberBehavior) Done() <-chan struct{} {
+	return subBehavior.done
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// supervision of local agents: restart policies with backoff for agents whose task or behaviors
+// failed
+
+package agency
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/RWTH-ACS/clonemap/pkg/status"
+)
+
+const (
+	defaultMaxRestarts       = 5                      // maximum number of restarts with policy onfailure
+	defaultRestartBackoff    = time.Millisecond * 100 // delay before first restart
+	defaultMaxRestartBackoff = time.Second * 30       // maximum delay before restart
+)
+
+// superviseAgent applies the restart policy of an agent whose task or behavior failed. The
+// agent is restarted after a backoff delay as long as the policy permits it and terminated
+// otherwise. Failures and restarts are reported to the ams and the logger
+func (agency *Agency) superviseAgent(ag *Agent, failure error) {
+	agentID := ag.GetAgentID()
+	agentInfo := ag.getAgentInfo()
+	config := agentInfo.Spec.Supervision
+	restart := false
+	switch config.Policy {
+	case schemas.RestartAlways:
+		restart = true
+	case schemas.RestartOnFailure:
+		maxRestarts := config.MaxRestarts
+		if maxRestarts <= 0 {
+			maxRestarts = defaultMaxRestarts
+		}
+		restart = agentInfo.Status.Restarts < maxRestarts
+	}
+	if !restart {
+		agency.logError.Println("Terminating failed agent ", agentID)
+		ag.Terminate()
+		ag.setStatus(status.Error)
+		agency.reportStatus(ag)
+		return
+	}
+	agency.reportStatus(ag)
+	time.Sleep(restartBackoff(config, agentInfo.Status.Restarts))
+
+	agency.logInfo.Println("Restarting failed agent ", agentID)
+	agentInfo.Status.Restarts++
+	newAg, err := agency.replaceAgent(ag, agentInfo)
+	if err != nil {
+		// agent has been removed, migrated or restarted in the meantime
+		agency.logInfo.Println("Restart of failed agent ", agentID, " skipped: ", err)
+		return
+	}
+	newAg.Logger.NewLog("status", "Agent restarted after failure", "restart "+
+		strconv.Itoa(agentInfo.Status.Restarts)+": "+failure.Error())
+	agency.reportStatus(newAg)
+}
+
+// restartBackoff returns the delay before the next restart of an agent that has already been
+// restarted the given number of times
+func restartBackoff(config schemas.SupervisionConfig, restarts int) (delay time.Duration) {
+	delay = defaultRestartBackoff
+	if config.Backoff > 0 {
+		delay = time.Duration(config.Backoff) * time.Millisecond
+	}
+	maxDelay := defaultMaxRestartBackoff
+	if config.MaxBackoff > 0 {
+		maxDelay = time.Duration(config.MaxBackoff) * time.Millisecond
+	}
+	for i := 0; i < restarts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return
+}
+
+// reportStatus sends the status of a local agent to the ams
+func (agency *Agency) reportStatus(ag *Agent) {
+	agency.mutex.Lock()
+	masID := agency.info.MASID
+	agency.mutex.Unlock()
+	_, err := agency.amsClient.PutAgentStatus(masID, ag.GetAgentID(), ag.getStatus())
+	if err != nil {
+		agency.logError.Println("Reporting status of agent ", ag.GetAgentID(), " failed: ", err)
+	}
+}
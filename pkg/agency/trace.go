@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// tracing of message exchanges. Every message carries the ID of its trace and of the span that
+// caused it to be sent or delivered. Spans are recorded when a message is sent by an agent,
+// transmitted to and received by another agency and delivered to the receiving agent. Replies
+// continue the trace of the message they answer
+
+package agency
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/tracing"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// newTracer creates the tracer of the agency according to config. Spans are exported to the
+// collector if configured and to the logger otherwise. nil is returned if tracing is not active
+func (agency *Agency) newTracer(config schemas.TracingConfig) (tracer *tracing.Tracer) {
+	if !config.Active {
+		return
+	}
+	var exporter tracing.Exporter
+	if config.Collector != "" {
+		exporter = tracing.NewOTLPExporter(config.Collector, time.Second*10, time.Second*1, 2)
+	} else if agency.loggerConfig.Active {
+		logClient := client.NewLoggerClient(agency.loggerConfig.Host, agency.loggerConfig.Port,
+			time.Second*60, time.Second*1, 4)
+		logClient.SetTransport(agency.transport)
+		masID := agency.info.MASID
+		exporter = tracing.ExporterFunc(func(spans []schemas.Span) (err error) {
+			_, err = logClient.PostSpans(masID, spans)
+			return
+		})
+	} else {
+		agency.logError.Println("Tracing requires a collector or the logger; spans are dropped")
+		return
+	}
+	tracer = tracing.NewTracer(agency.info.MASID, agency.info.Name, exporter, agency.logError)
+	return
+}
+
+// traceMessage starts a span for the handling of msg as child of the span carried by msg. The
+// new span is set as span of msg. nil is returned if tracer is nil
+func traceMessage(tracer *tracing.Tracer, msg *schemas.ACLMessage, name string, kind int,
+	agentID int) (span *schemas.Span) {
+	span = tracer.Start(name, kind, agentID, msg.TraceID, msg.SpanID)
+	if span == nil {
+		return
+	}
+	span.Attributes = map[string]string{
+		"clonemap.msg.sender":       strconv.Itoa(msg.Sender),
+		"clonemap.msg.receiver":     strconv.Itoa(msg.Receiver),
+		"clonemap.msg.protocol":     strconv.Itoa(msg.Protocol),
+		"clonemap.msg.performative": strconv.Itoa(msg.Performative),
+	}
+	if msg.ConversationID != 0 {
+		span.Attributes["clonemap.msg.conversation"] = strconv.Itoa(msg.ConversationID)
+	}
+	setSpan(msg, span)
+	return
+}
+
+// setSpan sets span as the span of msg. msg is not changed if span is nil
+func setSpan(msg *schemas.ACLMessage, span *schemas.Span) {
+	if span == nil {
+		return
+	}
+	msg.TraceID = span.TraceID
+	msg.SpanID = span.SpanID
+}
+
+// endSpans ends spans of a batch of messages
+func endSpans(tracer *tracing.Tracer, spans []*schemas.Span) {
+	for i := range spans {
+		tracer.End(spans[i], nil)
+	}
+}
+
+// startSpan starts a new trace for an operation of the agent that involves several messages,
+// e.g. the execution of an interaction protocol. Messages belonging to the operation are
+// assigned to it with setSpan. nil is returned if tracing is not active
+func (acl *ACL) startSpan(name string) (span *schemas.Span) {
+	span = acl.tracer.Start(name, schemas.SpanKindInternal, acl.agentID, "", "")
+	return
+}
+
+// endSpan ends a span started with startSpan
+func (acl *ACL) endSpan(span *schemas.Span, err error) {
+	acl.tracer.End(span, err)
+}
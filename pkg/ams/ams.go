@@ -54,6 +54,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/client"
@@ -63,12 +64,16 @@ import (
 
 // AMS contains storage and deployment object
 type AMS struct {
-	stor         storage     // interface for local or distributed storage
-	depl         deployment  // interface for local or cloud deployment
-	logInfo      *log.Logger // logger for info logging
-	logError     *log.Logger // logger for error logging
+	stor         storage           // interface for local or distributed storage
+	depl         deployment        // interface for local or cloud deployment
+	deplType     string            // local, minikube or production
+	transport    http.RoundTripper // transport of requests to other modules; default if nil
+	logInfo      *log.Logger       // logger for info logging
+	logError     *log.Logger       // logger for error logging
 	agencyClient *client.AgencyClient
 	dfClient     *client.DFClient
+	cosims       map[int]*coordinator // time coordinators of MAS in co-simulation mode
+	cosimMutex   *sync.Mutex          // protects cosims
 }
 
 // StartAMS starts an AMS instance. It initializes the cluster and storage object and starts API
@@ -98,6 +103,36 @@ func StartAMS() (err error) {
 	return
 }
 
+// NewLocalHandler returns the http handler of an AMS with local storage and local deployment.
+// Agencies are started by the stub at stubHost and all requests to other modules are sent via
+// transport. It is used to run all modules of clonemap within one process
+func NewLocalHandler(stubHost string, transport http.RoundTripper, logErr *log.Logger,
+	logInf *log.Logger) (handler http.Handler) {
+	ams := &AMS{
+		stor:     newLocalStorage(),
+		deplType: "local",
+		depl: &localDeployment{
+			hostName:   stubHost,
+			httpClient: &http.Client{Timeout: time.Second * 10, Transport: transport},
+		},
+		transport:    transport,
+		logError:     logErr,
+		logInfo:      logInf,
+		agencyClient: client.NewAgencyClient(time.Second*10, time.Millisecond*100, 4),
+		dfClient:     client.NewDFClient("df", 12000, time.Second*10, time.Millisecond*100, 4),
+		cosims:       make(map[int]*coordinator),
+		cosimMutex:   &sync.Mutex{},
+	}
+	ams.agencyClient.SetTransport(transport)
+	ams.dfClient.SetTransport(transport)
+	ams.stor.setCloneMAPInfo(schemas.CloneMAP{
+		Version: "v0.1",
+		Uptime:  time.Now(),
+	})
+	handler = ams.server(9000).Handler
+	return
+}
+
 // init initializes deployment and storage. The deployment type is read from an environment
 // variable.
 func (ams *AMS) init() (err error) {
@@ -112,8 +147,11 @@ func (ams *AMS) init() (err error) {
 		return
 	}
 	ams.logInfo.Println("Starting AMS")
+	ams.cosims = make(map[int]*coordinator)
+	ams.cosimMutex = &sync.Mutex{}
 
 	deplType := os.Getenv("CLONEMAP_DEPLOYMENT_TYPE")
+	ams.deplType = deplType
 	switch deplType {
 	case "local":
 		ams.logInfo.Println("Local deployment")
@@ -158,6 +196,9 @@ func (ams *AMS) getCloneMAPInfo() (ret schemas.CloneMAP, err error) {
 // getMASsShort returns specs of all MAS
 func (ams *AMS) getMASsShort() (ret []schemas.MASInfoShort, err error) {
 	ret, err = ams.stor.getMASsShort()
+	for i := range ret {
+		ams.applyCosimStatus(ret[i].ID, &ret[i].Status)
+	}
 	return
 }
 
@@ -170,6 +211,9 @@ func (ams *AMS) getMASs() (ret schemas.MASs, err error) {
 // getMASInfo returns info of one MAS
 func (ams *AMS) getMASInfo(masID int) (ret schemas.MASInfo, err error) {
 	ret, err = ams.stor.getMASInfo(masID)
+	if err == nil {
+		ams.applyCosimStatus(masID, &ret.Status)
+	}
 	return
 }
 
@@ -212,6 +256,12 @@ func (ams *AMS) updateAgentAddress(masID int, agentID int, address schemas.Addre
 	return
 }
 
+// updateAgentStatus sets status of agent as reported by its agency
+func (ams *AMS) updateAgentStatus(masID int, agentID int, agentStatus schemas.Status) (err error) {
+	err = ams.stor.setAgentStatus(masID, agentID, agentStatus)
+	return
+}
+
 // updateAgentCustom sets custom config of agent and sends PUT to agency
 func (ams *AMS) updateAgentCustom(masID int, agentID int, custom string) (err error) {
 	err = ams.stor.setAgentCustom(masID, agentID, custom)
@@ -281,6 +331,16 @@ func (ams *AMS) createMAS(masSpec schemas.MASSpec) (ret schemas.MASInfo, err err
 	}
 	ret.ID = masID
 
+	// all agencies share the seed and start of faults for reproducible decisions
+	if ret.Config.Faults.Active {
+		if ret.Config.Faults.Seed == 0 {
+			ret.Config.Faults.Seed = time.Now().UnixNano()
+		}
+		if ret.Config.Faults.Start.IsZero() {
+			ret.Config.Faults.Start = time.Now()
+		}
+	}
+
 	go ams.startMAS(masID, ret, numAgencies)
 
 	return
@@ -294,7 +354,7 @@ func (ams *AMS) startMAS(masID int, masInfo schemas.MASInfo, numAgencies []int)
 		return
 	}
 	ams.logInfo.Println("Stored MAS data")
-	if os.Getenv("CLONEMAP_DEPLOYMENT_TYPE") == "local" {
+	if ams.deplType == "local" {
 		_, err = ams.dfClient.PostGraph(masID, masInfo.Graph)
 		if err != nil {
 			ams.logInfo.Println(err.Error())
@@ -311,6 +371,9 @@ func (ams *AMS) startMAS(masID int, masInfo schemas.MASInfo, numAgencies []int)
 		return
 	}
 	ams.logInfo.Println("Started agencies")
+	if masInfo.Config.Cosim.Active {
+		ams.startCosim(masID, masInfo.Config.Cosim)
+	}
 
 	return
 }
@@ -363,7 +426,8 @@ func (ams *AMS) configureMAS(masSpec schemas.MASSpec) (masInfo schemas.MASInfo,
 	agentID := 0
 	for i := range masSpec.ImageGroups {
 		for j := range masSpec.ImageGroups[i].Agents {
-			masInfo.Agents.Inst[agentID].Spec = masSpec.ImageGroups[i].Agents[j]
+			masInfo.Agents.Inst[agentID].Spec = groupSupervision(masSpec.ImageGroups[i].Agents[j],
+				masSpec.ImageGroups[i].Config)
 			masInfo.Agents.Inst[agentID].ID = agentID
 			masInfo.Agents.Inst[agentID].AgencyID = j / masSpec.Config.NumAgentsPerAgency
 			masInfo.Agents.Inst[agentID].ImageGroupID = i
@@ -419,6 +483,7 @@ func (ams *AMS) checkModules(configIn schemas.MASConfig) (configOut schemas.MASC
 		}
 		dfClient := client.NewDFClient(configOut.DF.Host, configOut.DF.Port, time.Second,
 			time.Second, 3)
+		dfClient.SetTransport(ams.transport)
 		configOut.DF.Active = dfClient.Alive()
 	}
 	if configOut.Logger.Active {
@@ -430,8 +495,13 @@ func (ams *AMS) checkModules(configIn schemas.MASConfig) (configOut schemas.MASC
 		}
 		logClient := client.NewLoggerClient(configOut.Logger.Host, configOut.Logger.Port,
 			time.Second, time.Second, 3)
+		logClient.SetTransport(ams.transport)
 		configOut.Logger.Active = logClient.Alive()
 	}
+	if configOut.Tracing.Active && configOut.Tracing.Collector == "" && !configOut.Logger.Active {
+		// spans are sent to the logger if no collector is specified
+		configOut.Tracing.Active = false
+	}
 	if configOut.MQTT.Active {
 		if configOut.MQTT.Host == "" {
 			configOut.MQTT.Host = "mqtt"
@@ -440,6 +510,15 @@ func (ams *AMS) checkModules(configIn schemas.MASConfig) (configOut schemas.MASC
 			configOut.MQTT.Port = 1883
 		}
 	}
+	if configOut.Gateway.Active {
+		if configOut.Gateway.Host == "" {
+			configOut.Gateway.Host = "gateway"
+		}
+		gwClient := client.NewGatewayClient(configOut.Gateway.Host, 10000, time.Second,
+			time.Second, 3)
+		gwClient.SetTransport(ams.transport)
+		configOut.Gateway.Active = gwClient.Alive()
+	}
 	return
 }
 
@@ -457,6 +536,7 @@ func (ams *AMS) removeAllMAS() (err error) {
 
 // removeMAS removes specified mas if it exists
 func (ams *AMS) removeMAS(masID int) (err error) {
+	ams.stopCosim(masID)
 	err = ams.depl.deleteMAS(masID)
 	if err != nil {
 		return
@@ -465,6 +545,17 @@ func (ams *AMS) removeMAS(masID int) (err error) {
 	return
 }
 
+// groupSupervision returns the agent spec with the supervision of the image group applied if
+// no restart policy is specified for the agent
+func groupSupervision(spec schemas.AgentSpec,
+	config schemas.ImageGroupConfig) (ret schemas.AgentSpec) {
+	ret = spec
+	if ret.Supervision.Policy == "" {
+		ret.Supervision = config.Supervision
+	}
+	return
+}
+
 // createAgents creates new agents and adds them to an existing mas; returns slice with new
 // agent ids
 func (ams *AMS) createAgents(masID int, groupSpecs []schemas.ImageGroupSpec) (ret []int,
@@ -482,7 +573,7 @@ func (ams *AMS) createAgents(masID int, groupSpecs []schemas.ImageGroupSpec) (re
 			var agentID int
 			var agencyID int
 			newAgency, agentID, agencyID, err = ams.stor.addAgent(masID, imID,
-				groupSpecs[i].Agents[j])
+				groupSupervision(groupSpecs[i].Agents[j], groupSpecs[i].Config))
 			if err != nil {
 				return
 			}
@@ -557,6 +648,120 @@ func (ams *AMS) removeAgent(masID int, agentID int) (err error) {
 	return
 }
 
+// suspendAgent suspends an agent. Its behaviors are paused and incoming messages are buffered
+func (ams *AMS) suspendAgent(masID int, agentID int) (err error) {
+	err = ams.controlAgent(masID, agentID, ams.agencyClient.SuspendAgent, status.Suspended)
+	return
+}
+
+// resumeAgent resumes a suspended agent
+func (ams *AMS) resumeAgent(masID int, agentID int) (err error) {
+	err = ams.controlAgent(masID, agentID, ams.agencyClient.ResumeAgent, status.Running)
+	return
+}
+
+// restartAgent restarts an agent with its current spec. The agent keeps its ID
+func (ams *AMS) restartAgent(masID int, agentID int) (err error) {
+	err = ams.controlAgent(masID, agentID, ams.agencyClient.RestartAgent, status.Running)
+	return
+}
+
+// migrateAgent moves a running agent to another agency of its image group. The agency of the
+// agent hands over spec, state and pending messages to the target agency before the new address
+// of the agent is stored. If the request fails, the new address is stored nevertheless in case
+// the target agency already runs the agent
+func (ams *AMS) migrateAgent(masID int, agentID int, target string) (err error) {
+	var agentInfo schemas.AgentInfo
+	agentInfo, err = ams.stor.getAgentInfo(masID, agentID)
+	if err != nil {
+		return
+	}
+	if agentInfo.Address.Agency == "" {
+		err = errors.New("agent is not active")
+		return
+	}
+	if agentInfo.Address.Agency == target {
+		return
+	}
+	var agencies schemas.Agencies
+	agencies, err = ams.stor.getAgencies(masID)
+	if err != nil {
+		return
+	}
+	agencyID := -1
+	for i := range agencies.Inst {
+		if agencies.Inst[i].ImageGroupID == agentInfo.ImageGroupID &&
+			agencies.Inst[i].Name == target {
+			agencyID = agencies.Inst[i].ID
+			break
+		}
+	}
+	if agencyID < 0 {
+		err = errors.New("target agency is not part of the image group of the agent")
+		return
+	}
+	var httpStatus int
+	httpStatus, err = ams.agencyClient.MigrateAgent(agentInfo.Address.Agency, agentID, target)
+	if err != nil || httpStatus != http.StatusOK {
+		// the reply may have been lost although the target agency accepted the agent
+		_, targetStatus, errTarget := ams.agencyClient.GetAgentStatus(target, agentID)
+		if errTarget == nil && targetStatus == http.StatusOK {
+			ams.logInfo.Println("Agent ", agentID, " found in target agency ", target,
+				" after failed migration request")
+			httpStatus, err = http.StatusOK, nil
+		}
+	}
+	if err != nil {
+		return
+	}
+	if httpStatus == http.StatusNotFound {
+		err = errors.New("NotFoundError")
+		return
+	} else if httpStatus != http.StatusOK {
+		err = errors.New("error migrating agent " + strconv.Itoa(agentID) + ": agency replied " +
+			strconv.Itoa(httpStatus))
+		return
+	}
+	err = ams.stor.moveAgent(masID, agentID, agencyID)
+	if err != nil {
+		return
+	}
+	err = ams.stor.setAgentStatus(masID, agentID, schemas.Status{
+		Code:       status.Running,
+		LastUpdate: time.Now(),
+	})
+	return
+}
+
+// controlAgent sends a lifecycle request to the agency of the agent and stores the resulting
+// status of the agent
+func (ams *AMS) controlAgent(masID int, agentID int,
+	request func(agency string, agentID int) (int, error), code int) (err error) {
+	var addr schemas.Address
+	addr, err = ams.stor.getAgentAddress(masID, agentID)
+	if err != nil {
+		return
+	}
+	var httpStatus int
+	httpStatus, err = request(addr.Agency, agentID)
+	if err != nil {
+		return
+	}
+	if httpStatus == http.StatusNotFound {
+		err = errors.New("NotFoundError")
+		return
+	} else if httpStatus != http.StatusOK {
+		err = errors.New("error controlling agent " + strconv.Itoa(agentID) + ": agency replied " +
+			strconv.Itoa(httpStatus))
+		return
+	}
+	err = ams.stor.setAgentStatus(masID, agentID, schemas.Status{
+		Code:       code,
+		LastUpdate: time.Now(),
+	})
+	return
+}
+
 // postAgentToAgency sends a post request to agency with info about agent to start
 func (ams *AMS) postAgentToAgency(agentInfo schemas.AgentInfo) (err error) {
 	var httpStatus int
@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// coordination of the time-stepped co-simulation of a MAS
+
+package ams
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/RWTH-ACS/clonemap/pkg/status"
+)
+
+// cosimPollInterval is the interval in which the progress of the agencies is requested
+const cosimPollInterval = time.Millisecond * 10
+
+// coordinator executes the steps of a MAS in co-simulation mode
+type coordinator struct {
+	masID  int
+	config schemas.CosimConfig
+	status schemas.CosimStatus
+	mutex  *sync.Mutex
+	stop   chan struct{} // closed when the MAS is removed
+}
+
+// startCosim starts the time coordinator of a MAS
+func (ams *AMS) startCosim(masID int, config schemas.CosimConfig) {
+	coord := &coordinator{
+		masID:  masID,
+		config: config,
+		status: schemas.CosimStatus{Active: true, Step: -1},
+		mutex:  &sync.Mutex{},
+		stop:   make(chan struct{}),
+	}
+	ams.cosimMutex.Lock()
+	ams.cosims[masID] = coord
+	ams.cosimMutex.Unlock()
+	go ams.coordinate(coord)
+}
+
+// stopCosim stops the time coordinator of a MAS
+func (ams *AMS) stopCosim(masID int) {
+	ams.cosimMutex.Lock()
+	coord, ok := ams.cosims[masID]
+	if ok {
+		delete(ams.cosims, masID)
+		close(coord.stop)
+	}
+	ams.cosimMutex.Unlock()
+}
+
+// getCosimStatus returns the progress of the co-simulation of a MAS
+func (ams *AMS) getCosimStatus(masID int) (cosimStatus schemas.CosimStatus, err error) {
+	_, err = ams.stor.getMASInfo(masID)
+	if err != nil {
+		return
+	}
+	cosimStatus = ams.cosimStatus(masID)
+	return
+}
+
+// cosimStatus returns the progress of the co-simulation of a MAS without checking if the MAS
+// exists
+func (ams *AMS) cosimStatus(masID int) (cosimStatus schemas.CosimStatus) {
+	cosimStatus.Step = -1
+	ams.cosimMutex.Lock()
+	coord, ok := ams.cosims[masID]
+	ams.cosimMutex.Unlock()
+	if ok {
+		coord.mutex.Lock()
+		cosimStatus = coord.status
+		coord.mutex.Unlock()
+	}
+	return
+}
+
+// applyCosimStatus sets the status of a MAS to error if its co-simulation has been halted
+func (ams *AMS) applyCosimStatus(masID int, masStatus *schemas.Status) {
+	cosimStatus := ams.cosimStatus(masID)
+	if cosimStatus.Halted && masStatus.Code == status.Running {
+		masStatus.Code = status.Error
+		masStatus.LastError = "co-simulation halted: " + cosimStatus.LastError
+	}
+}
+
+// coordinate is to be executed as go routine. It waits until all agencies are ready and starts
+// one step after another. A step is completed when all agencies have finished it and no
+// messages between agencies are in flight. The co-simulation is halted if a step fails or
+// times out
+func (ams *AMS) coordinate(coord *coordinator) {
+	stepSize := time.Duration(coord.config.StepSize) * time.Millisecond
+	timeout := time.Duration(coord.config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	start := coord.config.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	ams.logInfo.Println("Waiting for agencies of co-simulation of MAS ", coord.masID)
+	for {
+		agencies, err := ams.getAgencyNames(coord.masID)
+		if err == nil {
+			var reports []schemas.CosimReport
+			reports, err = ams.getCosimReports(agencies)
+			if err == nil && cosimReady(reports) {
+				break
+			}
+		}
+		select {
+		case <-coord.stop:
+			return
+		case <-time.After(cosimPollInterval):
+		}
+	}
+	ams.logInfo.Println("Starting co-simulation of MAS ", coord.masID)
+	for step := 0; coord.config.NumSteps <= 0 || step < coord.config.NumSteps; step++ {
+		cosimStep := schemas.CosimStep{
+			Step: step,
+			Time: start.Add(stepSize * time.Duration(step)),
+		}
+		err := ams.executeStep(coord, cosimStep, time.Now().Add(timeout))
+		if err != nil {
+			ams.logError.Println("Halting co-simulation of MAS ", coord.masID, " in step ", step,
+				": ", err)
+			coord.mutex.Lock()
+			coord.status.Halted = true
+			coord.status.LastError = "step " + strconv.Itoa(step) + ": " + err.Error()
+			coord.mutex.Unlock()
+			return
+		}
+		coord.mutex.Lock()
+		coord.status.Step = step
+		coord.status.Time = cosimStep.Time
+		coord.mutex.Unlock()
+		select {
+		case <-coord.stop:
+			return
+		default:
+		}
+	}
+	coord.mutex.Lock()
+	coord.status.Finished = true
+	coord.mutex.Unlock()
+	ams.logInfo.Println("Finished co-simulation of MAS ", coord.masID)
+}
+
+// executeStep starts step in all agencies and waits until it is completed or deadline is
+// reached. The step is completed when all agencies are done, no messages are pending within an
+// agency and the number of received and lost messages reaches the number of messages sent to
+// other agencies in two consecutive requests. More received than sent messages, e.g. due to
+// duplicates injected as faults, do not prevent completion
+func (ams *AMS) executeStep(coord *coordinator, step schemas.CosimStep,
+	deadline time.Time) (err error) {
+	var agencies []string
+	agencies, err = ams.getAgencyNames(coord.masID)
+	if err != nil {
+		return
+	}
+	for i := range agencies {
+		var httpStatus int
+		httpStatus, err = ams.agencyClient.PostCosimStep(agencies[i], step)
+		if err == nil && httpStatus != http.StatusCreated {
+			err = errors.New("agency " + agencies[i] + " did not start step, http status " +
+				strconv.Itoa(httpStatus))
+		}
+		if err != nil {
+			return
+		}
+	}
+	var last []int // counters of the last request
+	for {
+		var reports []schemas.CosimReport
+		reports, err = ams.getCosimReports(agencies)
+		if err != nil {
+			return
+		}
+		done := true
+		failed := 0
+		counters := make([]int, 3)
+		for i := range reports {
+			done = done && reports[i].Step == step.Step && reports[i].Done &&
+				reports[i].Pending == 0
+			failed += reports[i].Failed
+			counters[0] += reports[i].Sent
+			counters[1] += reports[i].Received
+			counters[2] += reports[i].Lost
+		}
+		if done && counters[1]+counters[2] >= counters[0] && last != nil &&
+			counters[0] == last[0] && counters[1] == last[1] && counters[2] == last[2] {
+			if failed > 0 {
+				err = errors.New(strconv.Itoa(failed) + " step behaviors failed")
+			}
+			return
+		}
+		if done {
+			last = counters
+		} else {
+			last = nil
+		}
+		if time.Now().After(deadline) {
+			err = errors.New("timeout")
+			return
+		}
+		select {
+		case <-coord.stop:
+			err = errors.New("co-simulation stopped")
+			return
+		case <-time.After(cosimPollInterval):
+		}
+	}
+}
+
+// getAgencyNames returns the names of all agencies of a MAS
+func (ams *AMS) getAgencyNames(masID int) (names []string, err error) {
+	var agencies schemas.Agencies
+	agencies, err = ams.stor.getAgencies(masID)
+	if err != nil {
+		return
+	}
+	for i := range agencies.Inst {
+		names = append(names, agencies.Inst[i].Name)
+	}
+	return
+}
+
+// getCosimReports requests the progress of all agencies
+func (ams *AMS) getCosimReports(agencies []string) (reports []schemas.CosimReport, err error) {
+	reports = make([]schemas.CosimReport, len(agencies))
+	for i := range agencies {
+		var httpStatus int
+		reports[i], httpStatus, err = ams.agencyClient.GetCosim(agencies[i])
+		if err == nil && httpStatus != http.StatusOK {
+			err = errors.New("cannot get co-simulation progress of agency " + agencies[i])
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// cosimReady checks if all agencies are ready for the first step
+func cosimReady(reports []schemas.CosimReport) (ready bool) {
+	if len(reports) == 0 {
+		return
+	}
+	for i := range reports {
+		if !reports[i].Ready {
+			return
+		}
+	}
+	ready = true
+	return
+}
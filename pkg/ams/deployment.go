@@ -73,6 +73,7 @@ type deployment interface {
 // localDeployment implements the Cluster interface for a local instance of the MAP
 type localDeployment struct {
 	hostName   string
+	httpClient *http.Client // client for requests to the stub
 	containers []map[string]schemas.StubAgencyConfig
 }
 
@@ -97,8 +98,7 @@ func (localdepl *localDeployment) newMAS(masID int, images schemas.ImageGroups,
 			}
 			js, _ := json.Marshal(temp)
 			var statusCode int
-			httpClient := &http.Client{Timeout: time.Second * 10}
-			_, statusCode, err = httpretry.Post(httpClient, "http://"+localdepl.hostName+
+			_, statusCode, err = httpretry.Post(localdepl.httpClient, "http://"+localdepl.hostName+
 				":8000/api/container", " ", js, time.Second*2, 2)
 			if err != nil {
 				return
@@ -128,8 +128,7 @@ func (localdepl *localDeployment) newImageGroup(masID int,
 		}
 		js, _ := json.Marshal(temp)
 		var statusCode int
-		httpClient := &http.Client{Timeout: time.Second * 10}
-		_, statusCode, err = httpretry.Post(httpClient, "http://"+localdepl.hostName+
+		_, statusCode, err = httpretry.Post(localdepl.httpClient, "http://"+localdepl.hostName+
 			":8000/api/container", " ", js, time.Second*2, 2)
 		if err == nil {
 			if statusCode != http.StatusCreated {
@@ -151,8 +150,7 @@ func (localdepl *localDeployment) scaleImageGroup(masID int, imID int,
 		temp.AgencyID++
 		js, _ := json.Marshal(temp)
 		var statusCode int
-		httpClient := &http.Client{Timeout: time.Second * 10}
-		_, statusCode, err = httpretry.Post(httpClient, "http://"+localdepl.hostName+
+		_, statusCode, err = httpretry.Post(localdepl.httpClient, "http://"+localdepl.hostName+
 			":8000/api/container", " ", js, time.Second*2, 2)
 		if err == nil {
 			if statusCode != http.StatusCreated {
@@ -167,8 +165,7 @@ func (localdepl *localDeployment) scaleImageGroup(masID int, imID int,
 
 // deleteMAS triggers the cluster manager to delete all agency containers
 func (localdepl *localDeployment) deleteMAS(masID int) (err error) {
-	httpClient := &http.Client{Timeout: time.Second * 10}
-	_, err = httpretry.Delete(httpClient, "http://"+localdepl.hostName+
+	_, err = httpretry.Delete(localdepl.httpClient, "http://"+localdepl.hostName+
 		":8000/api/container/"+strconv.Itoa(masID), nil,
 		time.Second*2, 2)
 	return
@@ -176,7 +173,7 @@ func (localdepl *localDeployment) deleteMAS(masID int) (err error) {
 
 // newLocalDeployment returns Deployment interface with localCluster type
 func newLocalDeployment() (depl deployment, err error) {
-	var temp localDeployment
+	temp := localDeployment{httpClient: &http.Client{Timeout: time.Second * 10}}
 	if val, ok := os.LookupEnv("CLONEMAP_STUB_HOSTNAME"); ok {
 		temp.hostName = val
 	} else {
@@ -140,6 +140,20 @@ func (stor *etcdStorage) setAgentCustom(masID int, agentID int, custom string) (
 	return
 }
 
+// setAgentStatus sets status of agent
+func (stor *etcdStorage) setAgentStatus(masID int, agentID int,
+	status schemas.Status) (err error) {
+	var agentInfo schemas.AgentInfo
+	agentInfo, err = stor.getAgentInfo(masID, agentID)
+	if err != nil {
+		return
+	}
+	agentInfo.Status = status
+	err = stor.etcdPutResource("ams/mas/"+strconv.Itoa(masID)+"/agent/"+strconv.Itoa(agentID),
+		agentInfo)
+	return
+}
+
 // registerMAS registers a new MAS with the storage and returns its ID
 func (stor *etcdStorage) registerMAS() (masID int, err error) {
 	// store new ams and determine ID
@@ -587,6 +601,74 @@ func (stor *etcdStorage) deleteAgent(masID int, agentID int) (err error) {
 	return
 }
 
+// moveAgent assigns an agent to another agency of its image group
+func (stor *etcdStorage) moveAgent(masID int, agentID int, agencyID int) (err error) {
+	var agentInfo schemas.AgentInfo
+	agentInfo, err = stor.getAgentInfo(masID, agentID)
+	if err != nil {
+		return
+	}
+
+	stor.mutex.Lock()
+	imID := agentInfo.ImageGroupID
+	if len(stor.mas[masID].ImageGroups.Inst)-1 < imID {
+		stor.mutex.Unlock()
+		err = errors.New("imagegroup does not exist")
+		return
+	}
+	oldAgencyID := agentInfo.AgencyID
+	if len(stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst)-1 < oldAgencyID ||
+		len(stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst)-1 < agencyID {
+		stor.mutex.Unlock()
+		err = errors.New("agency does not exist")
+		return
+	}
+	stor.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// use STM for atomic puts and retry in case values have been altered during function execution
+	_, err = concurrency.NewSTMRepeatable(ctx, stor.client, func(s concurrency.STM) error {
+		stor.mutex.Lock()
+		oldAgency := stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst[oldAgencyID]
+		newAgency := stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst[agencyID]
+		stor.mutex.Unlock()
+
+		agents := make([]int, 0, len(oldAgency.Agents))
+		for i := range oldAgency.Agents {
+			if oldAgency.Agents[i] != agentID {
+				agents = append(agents, oldAgency.Agents[i])
+			}
+		}
+		oldAgency.Agents = agents
+		newAgency.Agents = append(append([]int{}, newAgency.Agents...), agentID)
+		agentInfo.AgencyID = agencyID
+		agentInfo.Address.Agency = newAgency.Name
+
+		var res []byte
+		res, err = json.Marshal(oldAgency)
+		if err != nil {
+			return err
+		}
+		s.Put("ams/mas/"+strconv.Itoa(masID)+"/im/"+strconv.Itoa(imID)+"/agency/"+
+			strconv.Itoa(oldAgencyID), string(res))
+		res, err = json.Marshal(newAgency)
+		if err != nil {
+			return err
+		}
+		s.Put("ams/mas/"+strconv.Itoa(masID)+"/im/"+strconv.Itoa(imID)+"/agency/"+
+			strconv.Itoa(agencyID), string(res))
+		res, err = json.Marshal(agentInfo)
+		if err != nil {
+			return err
+		}
+		s.Put("ams/mas/"+strconv.Itoa(masID)+"/agent/"+strconv.Itoa(agentID), string(res))
+
+		return err
+	})
+	cancel()
+	return
+}
+
 // newEtcdStorage returns Storage interface with etcdStorage type
 func newEtcdStorage(logErr *log.Logger) (stor storage, err error) {
 	temp := etcdStorage{logError: logErr}
@@ -412,6 +412,19 @@ func (stor *fiwareStorage) setAgentCustom(masID int, agentID int, custom string)
 	return
 }
 
+// setAgentStatus sets status of agent
+func (stor *fiwareStorage) setAgentStatus(masID int, agentID int,
+	status schemas.Status) (err error) {
+
+	return
+}
+
+// moveAgent assigns an agent to another agency of its image group
+func (stor *fiwareStorage) moveAgent(masID int, agentID int, agencyID int) (err error) {
+
+	return
+}
+
 // getAgencies returns specs of all agencies in MAS
 func (stor *fiwareStorage) getAgencies(masID int) (ret schemas.Agencies, err error) {
 	// check if mas exists
@@ -295,6 +295,119 @@ func (ams *AMS) handleDeleteAgentID(w http.ResponseWriter, r *http.Request) {
 	ams.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handlePutAgentStatus is the handler for put requests to path
+// /api/clonemap/mas/{masid}/agents/{agentid}/status
+func (ams *AMS) handlePutAgentStatus(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var agentStatus schemas.Status
+	cmapErr = json.Unmarshal(body, &agentStatus)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = ams.updateAgentStatus(masID, agentID, agentStatus)
+	if cmapErr != nil {
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Updated(w, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentSuspend is the handler for post requests to path
+// /api/clonemap/mas/{masid}/agents/{agentid}/suspend
+func (ams *AMS) handlePostAgentSuspend(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = ams.suspendAgent(masID, agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentResume is the handler for post requests to path
+// /api/clonemap/mas/{masid}/agents/{agentid}/resume
+func (ams *AMS) handlePostAgentResume(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = ams.resumeAgent(masID, agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentRestart is the handler for post requests to path
+// /api/clonemap/mas/{masid}/agents/{agentid}/restart
+func (ams *AMS) handlePostAgentRestart(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = ams.restartAgent(masID, agentID)
+	httpErr = httpreply.Updated(w, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostAgentMigrate is the handler for post requests to path
+// /api/clonemap/mas/{masid}/agents/{agentid}/migrate
+func (ams *AMS) handlePostAgentMigrate(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var target schemas.Address
+	cmapErr = json.Unmarshal(body, &target)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = ams.migrateAgent(masID, agentID, target.Agency)
+	if cmapErr != nil {
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Updated(w, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // handleGetAgentAddress is the handler for get requests to path
 // /api/clonemap/mas/{masid}/agents/{agentid}/address
 func (ams *AMS) handleGetAgentAddress(w http.ResponseWriter, r *http.Request) {
@@ -405,6 +518,22 @@ func (ams *AMS) handleGetAgentName(w http.ResponseWriter, r *http.Request) {
 	ams.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handleGetCosim is the handler for get requests to path /api/clonemap/mas/{masid}/cosim
+func (ams *AMS) handleGetCosim(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	masID, cmapErr := strconv.Atoi(vars["masid"])
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		ams.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var status schemas.CosimStatus
+	status, cmapErr = ams.getCosimStatus(masID)
+	httpErr = httpreply.Resource(w, status, cmapErr)
+	ams.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // handleGetAgencies is the handler for get requests to path /api/cloumap/mas/{masid}/agencies
 func (ams *AMS) handleGetAgencies(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
@@ -542,6 +671,26 @@ func (ams *AMS) server(port int) (serv *http.Server) {
 		HandlerFunc(ams.handlePutAgentAddress)
 	s.Path("/clonemap/mas/{masid}/agents/{agentid}/address").Methods("DELETE", "POST").
 		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/status").Methods("PUT").
+		HandlerFunc(ams.handlePutAgentStatus)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/status").Methods("DELETE", "POST", "GET").
+		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/suspend").Methods("POST").
+		HandlerFunc(ams.handlePostAgentSuspend)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/suspend").Methods("DELETE", "PUT", "GET").
+		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/resume").Methods("POST").
+		HandlerFunc(ams.handlePostAgentResume)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/resume").Methods("DELETE", "PUT", "GET").
+		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/restart").Methods("POST").
+		HandlerFunc(ams.handlePostAgentRestart)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/restart").Methods("DELETE", "PUT", "GET").
+		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/migrate").Methods("POST").
+		HandlerFunc(ams.handlePostAgentMigrate)
+	s.Path("/clonemap/mas/{masid}/agents/{agentid}/migrate").Methods("DELETE", "PUT", "GET").
+		HandlerFunc(ams.methodNotAllowed)
 	s.Path("/clonemap/mas/{masid}/agents/{agentid}/custom").Methods("PUT").
 		HandlerFunc(ams.handlePutAgentCustom)
 	s.Path("/clonemap/mas/{masid}/agents/{agentid}/custom").Methods("DELETE", "POST", "GET").
@@ -553,6 +702,9 @@ func (ams *AMS) server(port int) (serv *http.Server) {
 	s.Path("/clonemap/mas/{masid}/agencies").Methods("GET").HandlerFunc(ams.handleGetAgencies)
 	s.Path("/clonemap/mas/{masid}/agencies").Methods("PUT", "DELETE", "POST").
 		HandlerFunc(ams.methodNotAllowed)
+	s.Path("/clonemap/mas/{masid}/cosim").Methods("GET").HandlerFunc(ams.handleGetCosim)
+	s.Path("/clonemap/mas/{masid}/cosim").Methods("PUT", "DELETE", "POST").
+		HandlerFunc(ams.methodNotAllowed)
 	s.Path("/clonemap/mas/{masid}/imgroup/{imid}/agency/{agencyid}").Methods("GET").
 		HandlerFunc(ams.handleGetAgencyID)
 	s.Path("/clonemap/mas/{masid}/imgroup/{imid}/agency/{agencyid}").
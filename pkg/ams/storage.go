@@ -95,6 +95,9 @@ type storage interface {
 	// setAgentCustom sets custom config of agent
 	setAgentCustom(masID int, agentID int, custom string) (err error)
 
+	// setAgentStatus sets status of agent
+	setAgentStatus(masID int, agentID int, status schemas.Status) (err error)
+
 	// getAgencies returns specs of all agencies in MAS
 	getAgencies(masID int) (ret schemas.Agencies, err error)
 
@@ -123,6 +126,9 @@ type storage interface {
 
 	// deleteAgent deletes an agent
 	deleteAgent(masID int, agentID int) (err error)
+
+	// moveAgent assigns an agent to another agency of its image group
+	moveAgent(masID int, agentID int, agencyID int) (err error)
 }
 
 // CommData helper struct for communication data
@@ -391,6 +397,10 @@ func (stor *localStorage) getAgencyInfoFull(masID int, imID int,
 	ret.Logger = stor.mas[masID].Config.Logger
 	ret.DF = stor.mas[masID].Config.DF
 	ret.MQTT = stor.mas[masID].Config.MQTT
+	ret.Gateway = stor.mas[masID].Config.Gateway
+	ret.Tracing = stor.mas[masID].Config.Tracing
+	ret.Faults = stor.mas[masID].Config.Faults
+	ret.Cosim = stor.mas[masID].Config.Cosim
 	ret.MASName = stor.mas[masID].Config.Name
 	ret.MASCustom = stor.mas[masID].Config.Custom
 	ret.Status = stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst[agencyID].Status
@@ -440,13 +450,20 @@ func (stor *localStorage) storeMAS(masID int, masInfo schemas.MASInfo) (err erro
 	return
 }
 
-// createMASStorage returns a filled masStorage object
+// createMASStorage returns a filled masStorage object. The agents and agencies of masInfo are
+// copied since masInfo is handed out to the requester of the MAS concurrently
 func createMASStorage(masID int, masInfo schemas.MASInfo) (ret schemas.MASInfo) {
 	ret = masInfo
 	ret.Status.Code = status.Running
 	ret.Status.LastUpdate = time.Now()
 
 	ret.ID = masID
+	ret.Agents.Inst = append([]schemas.AgentInfo(nil), masInfo.Agents.Inst...)
+	ret.ImageGroups.Inst = append([]schemas.ImageGroupInfo(nil), masInfo.ImageGroups.Inst...)
+	for i := range ret.ImageGroups.Inst {
+		ret.ImageGroups.Inst[i].Agencies.Inst = append([]schemas.AgencyInfo(nil),
+			masInfo.ImageGroups.Inst[i].Agencies.Inst...)
+	}
 	for i := 0; i < ret.Agents.Counter; i++ {
 		ret.Agents.Inst[i].MASID = masID
 		ret.Agents.Inst[i].Address.Agency = "mas-" + strconv.Itoa(masID) +
@@ -617,6 +634,39 @@ func (stor *localStorage) deleteAgent(masID int, agentID int) (err error) {
 	return
 }
 
+// moveAgent assigns an agent to another agency of its image group
+func (stor *localStorage) moveAgent(masID int, agentID int, agencyID int) (err error) {
+	var agentInfo schemas.AgentInfo
+	agentInfo, err = stor.getAgentInfo(masID, agentID)
+	if err != nil {
+		return
+	}
+	imID := agentInfo.ImageGroupID
+	stor.mutex.Lock()
+	if len(stor.mas[masID].ImageGroups.Inst)-1 < imID {
+		stor.mutex.Unlock()
+		err = errors.New("imagegroup does not exist")
+		return
+	}
+	if len(stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst)-1 < agencyID {
+		stor.mutex.Unlock()
+		err = errors.New("agency does not exist")
+		return
+	}
+	stor.mutex.Unlock()
+	err = stor.removeAgentFromAgency(masID, agentID)
+	if err != nil {
+		return
+	}
+	stor.mutex.Lock()
+	agencyInfo := &stor.mas[masID].ImageGroups.Inst[imID].Agencies.Inst[agencyID]
+	agencyInfo.Agents = append(agencyInfo.Agents, agentID)
+	stor.mas[masID].Agents.Inst[agentID].AgencyID = agencyID
+	stor.mas[masID].Agents.Inst[agentID].Address.Agency = agencyInfo.Name
+	stor.mutex.Unlock()
+	return
+}
+
 // removeAgentFromAgency removes the ID of the agent from the agency's list of agents
 func (stor *localStorage) removeAgentFromAgency(masID int, agentID int) (err error) {
 	var agentInfo schemas.AgentInfo
@@ -48,19 +48,33 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
 	"github.com/RWTH-ACS/clonemap/pkg/common/httpretry"
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 	"github.com/RWTH-ACS/clonemap/pkg/status"
 )
 
+// compressionMinSize is the minimum size of message batches to be compressed; compressing
+// smaller batches costs more time than is saved in transmission
+const compressionMinSize = 1024
+
+// jsonOnlyExpiry is the duration after which agencies that only accepted JSON are served with the
+// configured encoding again, e.g. after they have been updated
+const jsonOnlyExpiry = time.Minute * 10
+
 // AgencyClient is the ams client
 type AgencyClient struct {
-	httpClient *http.Client  // http client
-	Port       int           // ams port
-	delay      time.Duration // delay between two retries
-	numRetries int           // number of retries
+	httpClient  *http.Client  // http client
+	Port        int           // ams port
+	Encoding    string        // content type used for messages (aclwire.ContentTypeJSON or ContentTypeProtobuf)
+	Compression bool          // indicates if messages are compressed with gzip
+	delay       time.Duration // delay between two retries
+	numRetries  int           // number of retries
+	mutex       *sync.Mutex
+	jsonOnly    map[string]time.Time // agencies that only accept JSON encoded messages until the given time
 }
 
 // GetInfo requests the agency info
@@ -126,6 +140,46 @@ func (cli *AgencyClient) DeleteAgent(agency string, agentID int) (httpStatus int
 	return
 }
 
+// SuspendAgent requests an agent to suspend its behaviors. Incoming messages are buffered until
+// the agent is resumed
+func (cli *AgencyClient) SuspendAgent(agency string, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/agents/"+
+		strconv.Itoa(agentID)+"/suspend", "text/plain", nil, time.Second*2, 2)
+	return
+}
+
+// ResumeAgent requests a suspended agent to resume
+func (cli *AgencyClient) ResumeAgent(agency string, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/agents/"+
+		strconv.Itoa(agentID)+"/resume", "text/plain", nil, time.Second*2, 2)
+	return
+}
+
+// RestartAgent requests an agent to be restarted with its current spec
+func (cli *AgencyClient) RestartAgent(agency string, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/agents/"+
+		strconv.Itoa(agentID)+"/restart", "text/plain", nil, time.Second*2, 2)
+	return
+}
+
+// MigrateAgent requests an agent to be migrated to the target agency
+func (cli *AgencyClient) MigrateAgent(agency string, agentID int, target string) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(schemas.Address{Agency: target})
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/agents/"+
+		strconv.Itoa(agentID)+"/migrate", "application/json", js, time.Second*2, 2)
+	return
+}
+
+// PostMigration hands over a migrating agent to the agency
+func (cli *AgencyClient) PostMigration(agency string, migration schemas.AgentMigration) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(migration)
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/migrations",
+		"application/json", js, time.Second*2, 2)
+	return
+}
+
 // GetAgentStatus requests status from agent and returns it
 func (cli *AgencyClient) GetAgentStatus(agency string, agentID int) (agentStatus schemas.Status,
 	httpStatus int, err error) {
@@ -146,11 +200,80 @@ func (cli *AgencyClient) GetAgentStatus(agency string, agentID int) (agentStatus
 	return
 }
 
-// PostMsgs post an agent message to the agent
+// GetAgentInbox requests the state of the inboxes of agent
+func (cli *AgencyClient) GetAgentInbox(agency string, agentID int) (stats schemas.InboxStats,
+	httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix(agency)+"/api/agency/agents/"+
+		strconv.Itoa(agentID)+"/inbox", time.Second*2, 2)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &stats)
+	return
+}
+
+// PostMsgs post an agent message to the agent. Messages are sent with the configured encoding.
+// Agencies which do not support it (i.e. older versions) answer with an error and are served
+// with plain JSON for some time. A bad request is only treated as unsupported encoding if the
+// agency accepts the same batch encoded as JSON
 func (cli *AgencyClient) PostMsgs(agency string, msgs []schemas.ACLMessage) (httpStatus int, err error) {
-	js, _ := json.Marshal(msgs)
-	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+"/api/agency/msgs",
-		"application/json", js, time.Second*2, 2)
+	httpStatus, err = cli.PostMsgsHeader(agency, msgs, nil)
+	return
+}
+
+// PostMsgsHeader posts messages like PostMsgs with additional header fields
+func (cli *AgencyClient) PostMsgsHeader(agency string, msgs []schemas.ACLMessage,
+	header http.Header) (httpStatus int, err error) {
+	cli.mutex.Lock()
+	jsonOnly := time.Now().Before(cli.jsonOnly[agency])
+	cli.mutex.Unlock()
+	if jsonOnly || (cli.Encoding == aclwire.ContentTypeJSON && !cli.Compression) {
+		httpStatus, err = cli.postMsgs(agency, msgs, header, aclwire.ContentTypeJSON, false)
+		return
+	}
+	httpStatus, err = cli.postMsgs(agency, msgs, header, cli.Encoding, cli.Compression)
+	if err != nil || (httpStatus != http.StatusBadRequest &&
+		httpStatus != http.StatusUnsupportedMediaType) {
+		return
+	}
+	// the batch has been rejected and is resent with JSON which is understood by all agencies
+	rejected := httpStatus
+	httpStatus, err = cli.postMsgs(agency, msgs, header, aclwire.ContentTypeJSON, false)
+	if err != nil {
+		return
+	}
+	if rejected == http.StatusUnsupportedMediaType ||
+		(httpStatus >= 200 && httpStatus < 300) {
+		cli.mutex.Lock()
+		cli.jsonOnly[agency] = time.Now().Add(jsonOnlyExpiry)
+		cli.mutex.Unlock()
+	}
+	return
+}
+
+// postMsgs posts messages with the given encoding and additional header fields
+func (cli *AgencyClient) postMsgs(agency string, msgs []schemas.ACLMessage, extra http.Header,
+	contentType string, compression bool) (httpStatus int, err error) {
+	var body []byte
+	body, err = aclwire.Marshal(msgs, contentType)
+	if err != nil {
+		return
+	}
+	header := http.Header{}
+	for key := range extra {
+		header.Set(key, extra.Get(key))
+	}
+	header.Set("Content-Type", contentType)
+	if compression && len(body) > compressionMinSize {
+		body, err = aclwire.Compress(body)
+		if err != nil {
+			return
+		}
+		header.Set("Content-Encoding", aclwire.EncodingGzip)
+	}
+	_, httpStatus, err = httpretry.PostHeader(cli.httpClient, cli.prefix(agency)+"/api/agency/msgs",
+		header, body, time.Second*2, 2)
 	return
 }
 
@@ -162,6 +285,73 @@ func (cli *AgencyClient) ReturnMsg(agency string, msg schemas.ACLMessage) (httpS
 	return
 }
 
+// GetDeadLetters requests the messages in the dead-letter queue of the agency
+func (cli *AgencyClient) GetDeadLetters(agency string) (deadLetters []schemas.DeadLetter,
+	httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix(agency)+
+		"/api/agency/deadletters", time.Second*2, 2)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &deadLetters)
+	if err != nil {
+		deadLetters = []schemas.DeadLetter{}
+	}
+	return
+}
+
+// DeleteDeadLetters empties the dead-letter queue of the agency
+func (cli *AgencyClient) DeleteDeadLetters(agency string) (httpStatus int, err error) {
+	httpStatus, err = httpretry.Delete(cli.httpClient, cli.prefix(agency)+
+		"/api/agency/deadletters", nil, time.Second*2, 2)
+	return
+}
+
+// GetFaults requests the fault injection config of an agency
+func (cli *AgencyClient) GetFaults(agency string) (config schemas.FaultConfig, httpStatus int,
+	err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix(agency)+"/api/agency/faults",
+		time.Second*2, 2)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &config)
+	return
+}
+
+// PutFaults sets the fault injection config of an agency
+func (cli *AgencyClient) PutFaults(agency string, config schemas.FaultConfig) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(config)
+	_, httpStatus, err = httpretry.Put(cli.httpClient, cli.prefix(agency)+"/api/agency/faults", js,
+		time.Second*2, 2)
+	return
+}
+
+// GetCosim requests the progress of an agency in the co-simulation
+func (cli *AgencyClient) GetCosim(agency string) (report schemas.CosimReport, httpStatus int,
+	err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix(agency)+"/api/agency/cosim",
+		time.Second*2, 2)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &report)
+	return
+}
+
+// PostCosimStep starts a step of the co-simulation in an agency
+func (cli *AgencyClient) PostCosimStep(agency string, step schemas.CosimStep) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(step)
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix(agency)+
+		"/api/agency/cosim/step", "application/json", js, time.Second*2, 2)
+	return
+}
+
 // PutAgentCustom puts agent custom data
 func (cli *AgencyClient) PutAgentCustom(agency string, agentID int, custom string) (httpStatus int,
 	err error) {
@@ -170,6 +360,12 @@ func (cli *AgencyClient) PutAgentCustom(agency string, agentID int, custom strin
 	return
 }
 
+// SetTransport replaces the transport of the http client, e.g. by an in-memory transport for
+// tests. It has to be called before the client is used
+func (cli *AgencyClient) SetTransport(transport http.RoundTripper) {
+	cli.httpClient.Transport = transport
+}
+
 func (cli *AgencyClient) prefix(agency string) (ret string) {
 	ret = "http://" + agency + ":" + strconv.Itoa(cli.Port)
 	return
@@ -178,10 +374,14 @@ func (cli *AgencyClient) prefix(agency string) (ret string) {
 // NewAgencyClient creates a new AMS client
 func NewAgencyClient(timeout time.Duration, del time.Duration, numRet int) (cli *AgencyClient) {
 	cli = &AgencyClient{
-		httpClient: &http.Client{Timeout: timeout},
-		Port:       10000,
-		delay:      del,
-		numRetries: numRet,
+		httpClient:  &http.Client{Timeout: timeout},
+		Port:        10000,
+		Encoding:    aclwire.ContentTypeProtobuf,
+		Compression: false,
+		delay:       del,
+		numRetries:  numRet,
+		mutex:       &sync.Mutex{},
+		jsonOnly:    make(map[string]time.Time),
 	}
 	return
 }
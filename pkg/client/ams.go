@@ -64,6 +64,7 @@ type AMSClient struct {
 	Port       int           // ams port
 	delay      time.Duration // delay between two retries
 	numRetries int           // number of retries
+	noDNS      bool          // host is passed to the transport without DNS lookup
 }
 
 // Alive tests if alive
@@ -204,6 +205,51 @@ func (cli *AMSClient) DeleteAgent(masID int, agentID int) (httpStatus int, err e
 	return
 }
 
+// PutAgentStatus updates the status of an agent
+func (cli *AMSClient) PutAgentStatus(masID int, agentID int, agentStatus schemas.Status) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(agentStatus)
+	_, httpStatus, err = httpretry.Put(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/agents/"+strconv.Itoa(agentID)+"/status", js, time.Second*2, 2)
+	return
+}
+
+// SuspendAgent requests an agent to suspend its behaviors. Incoming messages are buffered until
+// the agent is resumed
+func (cli *AMSClient) SuspendAgent(masID int, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/agents/"+strconv.Itoa(agentID)+"/suspend", "text/plain", nil,
+		time.Second*2, 2)
+	return
+}
+
+// ResumeAgent requests a suspended agent to resume
+func (cli *AMSClient) ResumeAgent(masID int, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/agents/"+strconv.Itoa(agentID)+"/resume", "text/plain", nil,
+		time.Second*2, 2)
+	return
+}
+
+// RestartAgent requests an agent to be restarted with its current spec
+func (cli *AMSClient) RestartAgent(masID int, agentID int) (httpStatus int, err error) {
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/agents/"+strconv.Itoa(agentID)+"/restart", "text/plain", nil,
+		time.Second*2, 2)
+	return
+}
+
+// MigrateAgent requests an agent to be migrated to the target agency. The target agency has to
+// belong to the image group of the agent
+func (cli *AMSClient) MigrateAgent(masID int, agentID int, target string) (httpStatus int,
+	err error) {
+	js, _ := json.Marshal(schemas.Address{Agency: target})
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/agents/"+strconv.Itoa(agentID)+"/migrate", "application/json", js,
+		time.Second*2, 2)
+	return
+}
+
 // GetAgencies requests agency information
 func (cli *AMSClient) GetAgencies(masID int) (agencies schemas.Agencies, httpStatus int, err error) {
 	var body []byte
@@ -219,6 +265,18 @@ func (cli *AMSClient) GetAgencies(masID int) (agencies schemas.Agencies, httpSta
 	return
 }
 
+// GetCosim requests the progress of the co-simulation of a MAS
+func (cli *AMSClient) GetCosim(masID int) (status schemas.CosimStatus, httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/clonemap/mas/"+
+		strconv.Itoa(masID)+"/cosim", time.Second*2, 2)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &status)
+	return
+}
+
 // GetAgencyInfo requests agency information
 func (cli *AMSClient) GetAgencyInfo(masID int, imID int, agencyID int) (agency schemas.AgencyInfoFull,
 	httpStatus int, err error) {
@@ -237,7 +295,18 @@ func (cli *AMSClient) GetAgencyInfo(masID int, imID int, agencyID int) (agency s
 	return
 }
 
+// SetTransport replaces the transport of the http client, e.g. by an in-memory transport for
+// tests. The host name is passed to the transport without DNS lookup. It has to be called
+// before the client is used
+func (cli *AMSClient) SetTransport(transport http.RoundTripper) {
+	cli.httpClient.Transport = transport
+	cli.noDNS = transport != nil
+}
+
 func (cli *AMSClient) getIP() (ret string) {
+	if cli.noDNS {
+		return cli.Host
+	}
 	for {
 		ips, err := net.LookupHost(cli.Host)
 		if len(ips) > 0 && err == nil {
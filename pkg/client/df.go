@@ -47,6 +47,7 @@ package client
 import (
 
 	//"fmt"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -68,6 +69,9 @@ type DFClient struct {
 	port       int           // ams port
 	delay      time.Duration // delay between two retries
 	numRetries int           // number of retries
+	// Observer is called after each request to the DF with the name of the operation; it is
+	// used for statistics and may be nil
+	Observer func(op string, httpStatus int, dur time.Duration, err error)
 }
 
 // Alive tests if alive
@@ -83,10 +87,20 @@ func (cli *DFClient) Alive() (alive bool) {
 // PostSvc post an mas
 func (cli *DFClient) PostSvc(masID int, svc schemas.Service) (retSvc schemas.Service, httpStatus int,
 	err error) {
+	retSvc, httpStatus, err = cli.PostSvcContext(context.Background(), masID, svc)
+	return
+}
+
+// PostSvcContext posts a service; the request is aborted when ctx is done
+func (cli *DFClient) PostSvcContext(ctx context.Context, masID int,
+	svc schemas.Service) (retSvc schemas.Service, httpStatus int, err error) {
 	var body []byte
 	js, _ := json.Marshal(svc)
-	body, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/df/"+
-		strconv.Itoa(masID)+"/svc", "application/json", js, time.Second*2, 2)
+	start := time.Now()
+	body, httpStatus, err = httpretry.DoContext(ctx, cli.httpClient, "POST", cli.prefix()+
+		"/api/df/"+strconv.Itoa(masID)+"/svc", http.Header{"Content-Type": {"application/json"}},
+		js, time.Second*2, 2)
+	cli.observe("post_svc", start, httpStatus, err)
 	if err != nil {
 		return
 	}
@@ -97,9 +111,19 @@ func (cli *DFClient) PostSvc(masID int, svc schemas.Service) (retSvc schemas.Ser
 // GetSvc requests mas information
 func (cli *DFClient) GetSvc(masID int, desc string) (svc []schemas.Service, httpStatus int,
 	err error) {
+	svc, httpStatus, err = cli.GetSvcContext(context.Background(), masID, desc)
+	return
+}
+
+// GetSvcContext requests services with matching description; the request is aborted when ctx
+// is done
+func (cli *DFClient) GetSvcContext(ctx context.Context, masID int,
+	desc string) (svc []schemas.Service, httpStatus int, err error) {
 	var body []byte
-	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/df/"+
-		strconv.Itoa(masID)+"/svc/desc/"+desc, time.Second*2, 2)
+	start := time.Now()
+	body, httpStatus, err = httpretry.DoContext(ctx, cli.httpClient, "GET", cli.prefix()+
+		"/api/df/"+strconv.Itoa(masID)+"/svc/desc/"+desc, nil, nil, time.Second*2, 2)
+	cli.observe("get_svc", start, httpStatus, err)
 	if err != nil {
 		return
 	}
@@ -109,11 +133,22 @@ func (cli *DFClient) GetSvc(masID int, desc string) (svc []schemas.Service, http
 
 // GetLocalSvc requests mas information
 func (cli *DFClient) GetLocalSvc(masID int, desc string, nodeID int,
+	dist float64) (svc []schemas.Service, httpStatus int, err error) {
+	svc, httpStatus, err = cli.GetLocalSvcContext(context.Background(), masID, desc, nodeID,
+		dist)
+	return
+}
+
+// GetLocalSvcContext requests services with matching description within distance of the node;
+// the request is aborted when ctx is done
+func (cli *DFClient) GetLocalSvcContext(ctx context.Context, masID int, desc string, nodeID int,
 	dist float64) (svc []schemas.Service, httpStatus int, err error) {
 	var body []byte
-	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/df/"+
-		strconv.Itoa(masID)+"/svc/desc/"+desc+"/node/"+strconv.Itoa(nodeID)+"/dist/"+
-		fmt.Sprintf("%f", dist), time.Second*2, 2)
+	start := time.Now()
+	body, httpStatus, err = httpretry.DoContext(ctx, cli.httpClient, "GET", cli.prefix()+
+		"/api/df/"+strconv.Itoa(masID)+"/svc/desc/"+desc+"/node/"+strconv.Itoa(nodeID)+"/dist/"+
+		fmt.Sprintf("%f", dist), nil, nil, time.Second*2, 2)
+	cli.observe("get_local_svc", start, httpStatus, err)
 	if err != nil {
 		return
 	}
@@ -123,8 +158,17 @@ func (cli *DFClient) GetLocalSvc(masID int, desc string, nodeID int,
 
 // DeleteSvc removes service from df
 func (cli *DFClient) DeleteSvc(masID int, svcID string) (httpStatus int, err error) {
-	httpStatus, err = httpretry.Delete(cli.httpClient, cli.prefix()+"/api/df/"+strconv.Itoa(masID)+
-		"/svc/id/"+svcID, nil, time.Second*2, 2)
+	httpStatus, err = cli.DeleteSvcContext(context.Background(), masID, svcID)
+	return
+}
+
+// DeleteSvcContext removes service from df; the request is aborted when ctx is done
+func (cli *DFClient) DeleteSvcContext(ctx context.Context, masID int, svcID string) (httpStatus int,
+	err error) {
+	start := time.Now()
+	_, httpStatus, err = httpretry.DoContext(ctx, cli.httpClient, "DELETE", cli.prefix()+
+		"/api/df/"+strconv.Itoa(masID)+"/svc/id/"+svcID, nil, nil, time.Second*2, 2)
+	cli.observe("delete_svc", start, httpStatus, err)
 	return
 }
 
@@ -159,6 +203,19 @@ func (cli *DFClient) getIP() (ret string) {
 	return
 }
 
+// SetTransport replaces the transport of the http client, e.g. by an in-memory transport for
+// tests. It has to be called before the client is used
+func (cli *DFClient) SetTransport(transport http.RoundTripper) {
+	cli.httpClient.Transport = transport
+}
+
+// observe reports a finished request to the observer if one is set
+func (cli *DFClient) observe(op string, start time.Time, httpStatus int, err error) {
+	if cli.Observer != nil {
+		cli.Observer(op, httpStatus, time.Since(start), err)
+	}
+}
+
 func (cli *DFClient) prefix() (ret string) {
 	ret = "http://" + cli.host + ":" + strconv.Itoa(cli.port)
 	return
@@ -192,6 +249,14 @@ type AgentDF struct {
 
 // RegisterService registers a new service with the DF
 func (df *AgentDF) RegisterService(svc schemas.Service) (id string, err error) {
+	id, err = df.RegisterServiceContext(context.Background(), svc)
+	return
+}
+
+// RegisterServiceContext registers a new service with the DF. The request is aborted when ctx
+// is done
+func (df *AgentDF) RegisterServiceContext(ctx context.Context, svc schemas.Service) (id string,
+	err error) {
 	df.mutex.Lock()
 	if !df.active {
 		df.mutex.Unlock()
@@ -220,7 +285,7 @@ func (df *AgentDF) RegisterService(svc schemas.Service) (id string, err error) {
 	svc.NodeID = nodeID
 	svc.CreatedAt = time.Now()
 	svc.ChangedAt = svc.CreatedAt
-	svc, _, err = df.dfClient.PostSvc(masID, svc)
+	svc, _, err = df.dfClient.PostSvcContext(ctx, masID, svc)
 	id = svc.GUID
 	if err != nil {
 		return
@@ -233,6 +298,14 @@ func (df *AgentDF) RegisterService(svc schemas.Service) (id string, err error) {
 
 // SearchForService search for a service with given description
 func (df *AgentDF) SearchForService(desc string) (svc []schemas.Service, err error) {
+	svc, err = df.SearchForServiceContext(context.Background(), desc)
+	return
+}
+
+// SearchForServiceContext search for a service with given description. The request is aborted
+// when ctx is done
+func (df *AgentDF) SearchForServiceContext(ctx context.Context, desc string) (svc []schemas.Service,
+	err error) {
 	df.mutex.Lock()
 	if !df.active {
 		df.mutex.Unlock()
@@ -241,7 +314,7 @@ func (df *AgentDF) SearchForService(desc string) (svc []schemas.Service, err err
 	masID := df.masID
 	df.mutex.Unlock()
 	var temp []schemas.Service
-	temp, _, err = df.dfClient.GetSvc(masID, desc)
+	temp, _, err = df.dfClient.GetSvcContext(ctx, masID, desc)
 	if err != nil {
 		return
 	}
@@ -255,6 +328,14 @@ func (df *AgentDF) SearchForService(desc string) (svc []schemas.Service, err err
 
 // SearchForLocalService search for a service with given description
 func (df *AgentDF) SearchForLocalService(desc string, dist float64) (svc []schemas.Service, err error) {
+	svc, err = df.SearchForLocalServiceContext(context.Background(), desc, dist)
+	return
+}
+
+// SearchForLocalServiceContext search for a service with given description within distance of
+// the node of the agent. The request is aborted when ctx is done
+func (df *AgentDF) SearchForLocalServiceContext(ctx context.Context, desc string,
+	dist float64) (svc []schemas.Service, err error) {
 	df.mutex.Lock()
 	if !df.active {
 		df.mutex.Unlock()
@@ -264,7 +345,7 @@ func (df *AgentDF) SearchForLocalService(desc string, dist float64) (svc []schem
 	nodeID := df.nodeID
 	df.mutex.Unlock()
 	var temp []schemas.Service
-	temp, _, err = df.dfClient.GetLocalSvc(masID, desc, nodeID, dist)
+	temp, _, err = df.dfClient.GetLocalSvcContext(ctx, masID, desc, nodeID, dist)
 	if err != nil {
 		return
 	}
@@ -278,6 +359,13 @@ func (df *AgentDF) SearchForLocalService(desc string, dist float64) (svc []schem
 
 // DeregisterService registers a new service with the DF
 func (df *AgentDF) DeregisterService(svcID string) (err error) {
+	err = df.DeregisterServiceContext(context.Background(), svcID)
+	return
+}
+
+// DeregisterServiceContext deregisters a service with the DF. The request is aborted when ctx
+// is done
+func (df *AgentDF) DeregisterServiceContext(ctx context.Context, svcID string) (err error) {
 	df.mutex.Lock()
 	if !df.active {
 		df.mutex.Unlock()
@@ -301,7 +389,7 @@ func (df *AgentDF) DeregisterService(svcID string) (err error) {
 	df.mutex.Lock()
 	delete(df.registeredServices, desc)
 	df.mutex.Unlock()
-	_, err = df.dfClient.DeleteSvc(masID, svcID)
+	_, err = df.dfClient.DeleteSvcContext(ctx, masID, svcID)
 	return
 }
 
@@ -324,6 +412,9 @@ func NewAgentDF(masID int, agentID int, nodeID int, active bool, dfCli *DFClient
 
 // close closes the DF module
 func (df *AgentDF) Close() {
+	if df == nil {
+		return
+	}
 	for d := range df.registeredServices {
 		svc := df.registeredServices[d]
 		df.DeregisterService(svc.GUID)
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/httpretry"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// GatewayClient is the client for the gateway to other agent platforms
+type GatewayClient struct {
+	httpClient *http.Client  // http client
+	host       string        // gateway host name
+	port       int           // gateway port
+	delay      time.Duration // delay between two retries
+	numRetries int           // number of retries
+}
+
+// Alive tests if alive
+func (cli *GatewayClient) Alive() (alive bool) {
+	alive = false
+	_, httpStatus, err := httpretry.Get(cli.httpClient, cli.prefix()+"/api/alive", time.Second*2, 2)
+	if err == nil && httpStatus == http.StatusOK {
+		alive = true
+	}
+	return
+}
+
+// GetForeignAgents requests all foreign agents known to the agents of a MAS
+func (cli *GatewayClient) GetForeignAgents(masID int) (agents []schemas.ForeignAgent,
+	httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/gateway/"+
+		strconv.Itoa(masID)+"/agents", cli.delay, cli.numRetries)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &agents)
+	return
+}
+
+// PostForeignAgent registers a foreign agent with the gateway and returns it with the ID the
+// agents of a MAS use to address it
+func (cli *GatewayClient) PostForeignAgent(masID int,
+	agent schemas.ForeignAgent) (ret schemas.ForeignAgent, httpStatus int, err error) {
+	var body []byte
+	js, _ := json.Marshal(agent)
+	body, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/gateway/"+
+		strconv.Itoa(masID)+"/agents", "application/json", js, cli.delay, cli.numRetries)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &ret)
+	return
+}
+
+// SetTransport replaces the transport of the http client, e.g. by an in-memory transport for
+// tests. It has to be called before the client is used
+func (cli *GatewayClient) SetTransport(transport http.RoundTripper) {
+	cli.httpClient.Transport = transport
+}
+
+func (cli *GatewayClient) prefix() (ret string) {
+	ret = "http://" + cli.host + ":" + strconv.Itoa(cli.port)
+	return
+}
+
+// NewGatewayClient creates a new gateway client
+func NewGatewayClient(host string, port int, timeout time.Duration, del time.Duration,
+	numRet int) (cli *GatewayClient) {
+	cli = &GatewayClient{
+		httpClient: &http.Client{Timeout: timeout},
+		host:       host,
+		port:       port,
+		delay:      del,
+		numRetries: numRet,
+	}
+	return
+}
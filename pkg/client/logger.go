@@ -45,11 +45,16 @@ THE SOFTWARE.
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,6 +62,21 @@ import (
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 )
 
+var (
+	// ErrStateNotFound is returned if a named state or revision does not exist
+	ErrStateNotFound = errors.New("state not found")
+	// ErrRevisionConflict is returned by compare-and-swap updates of a named state if the state
+	// has been modified concurrently
+	ErrRevisionConflict = errors.New("revision conflict")
+	// ErrReservedState is returned if an agent tries to modify a named state reserved for
+	// clonemap
+	ErrReservedState = errors.New("named state is reserved")
+)
+
+// SystemStatePrefix is the prefix of the named states clonemap stores for an agent, e.g. its
+// dead letters. Agents can read these states but not modify them
+const SystemStatePrefix = "_clonemap."
+
 // LoggerClient is the ams client
 type LoggerClient struct {
 	httpClient *http.Client  // http client
@@ -121,9 +141,16 @@ func (cli *LoggerClient) UpdateStates(masID int, states []schemas.State) (httpSt
 // GetState requests state from logger
 func (cli *LoggerClient) GetState(masID int, agentID int) (state schemas.State, httpStatus int,
 	err error) {
+	state, httpStatus, err = cli.GetStateContext(context.Background(), masID, agentID)
+	return
+}
+
+// GetStateContext requests state from logger; the request is aborted when ctx is done
+func (cli *LoggerClient) GetStateContext(ctx context.Context, masID int,
+	agentID int) (state schemas.State, httpStatus int, err error) {
 	var body []byte
-	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/state/"+
-		strconv.Itoa(masID)+"/"+strconv.Itoa(agentID), time.Second*2, 4)
+	body, httpStatus, err = httpretry.DoContext(ctx, cli.httpClient, "GET", cli.prefix()+
+		"/api/state/"+strconv.Itoa(masID)+"/"+strconv.Itoa(agentID), nil, nil, time.Second*2, 4)
 	if err != nil {
 		return
 	}
@@ -134,11 +161,170 @@ func (cli *LoggerClient) GetState(masID int, agentID int) (state schemas.State,
 	return
 }
 
+// GetStateKeys requests the names of all named states of an agent
+func (cli *LoggerClient) GetStateKeys(masID int, agentID int) (keys []string, httpStatus int,
+	err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.statePrefix(masID, agentID)+"/keys",
+		time.Second*2, 4)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &keys)
+	if err != nil {
+		keys = []string{}
+	}
+	return
+}
+
+// GetNamedState requests the latest revision of a named state
+func (cli *LoggerClient) GetNamedState(masID int, agentID int,
+	key string) (rev schemas.StateRevision, httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.statePrefix(masID, agentID)+
+		"/keys/"+url.PathEscape(key), time.Second*2, 4)
+	if err != nil {
+		return
+	}
+	rev, err = stateRevision(body, httpStatus)
+	return
+}
+
+// PutNamedState stores a new revision of a named state if its current revision equals
+// update.Revision. ErrRevisionConflict is returned otherwise. The request is not retried since
+// a retry of an applied update would result in a conflict
+func (cli *LoggerClient) PutNamedState(masID int, agentID int, key string,
+	update schemas.StateUpdate) (rev schemas.StateRevision, httpStatus int, err error) {
+	js, _ := json.Marshal(update)
+	var body []byte
+	body, httpStatus, err = cli.requestOnce("PUT", cli.statePrefix(masID, agentID)+
+		"/keys/"+url.PathEscape(key), js)
+	if err != nil {
+		return
+	}
+	rev, err = stateRevision(body, httpStatus)
+	return
+}
+
+// GetStateHistory requests all revisions of a named state in ascending order
+func (cli *LoggerClient) GetStateHistory(masID int, agentID int,
+	key string) (revs []schemas.StateRevision, httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.statePrefix(masID, agentID)+
+		"/keys/"+url.PathEscape(key)+"/revisions", time.Second*2, 4)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &revs)
+	if err != nil {
+		revs = []schemas.StateRevision{}
+	}
+	return
+}
+
+// GetStateRevision requests a specific revision of a named state
+func (cli *LoggerClient) GetStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.statePrefix(masID, agentID)+
+		"/keys/"+url.PathEscape(key)+"/revisions/"+strconv.Itoa(revision), time.Second*2, 4)
+	if err != nil {
+		return
+	}
+	rev, err = stateRevision(body, httpStatus)
+	return
+}
+
+// RestoreStateRevision stores the content of an older revision as new revision of a named
+// state. The request is not retried since a retry would append another revision
+func (cli *LoggerClient) RestoreStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = cli.requestOnce("POST", cli.statePrefix(masID, agentID)+
+		"/keys/"+url.PathEscape(key)+"/revisions/"+strconv.Itoa(revision)+"/restore", nil)
+	if err != nil {
+		return
+	}
+	rev, err = stateRevision(body, httpStatus)
+	return
+}
+
+// requestOnce sends a request without retrying it in case of an error; it is used for requests
+// that are not idempotent
+func (cli *LoggerClient) requestOnce(method string, url string, content []byte) (body []byte,
+	httpStatus int, err error) {
+	var req *http.Request
+	req, err = http.NewRequest(method, url, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp *http.Response
+	resp, err = cli.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	httpStatus = resp.StatusCode
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+// PostSpans posts spans of traced message exchanges to the logger
+func (cli *LoggerClient) PostSpans(masID int, spans []schemas.Span) (httpStatus int, err error) {
+	js, _ := json.Marshal(spans)
+	_, httpStatus, err = httpretry.Post(cli.httpClient, cli.prefix()+"/api/tracing/"+
+		strconv.Itoa(masID), "application/json", js, time.Second*2, 4)
+	return
+}
+
+// GetTrace requests all spans of a trace
+func (cli *LoggerClient) GetTrace(masID int, traceID string) (spans []schemas.Span,
+	httpStatus int, err error) {
+	var body []byte
+	body, httpStatus, err = httpretry.Get(cli.httpClient, cli.prefix()+"/api/tracing/"+
+		strconv.Itoa(masID)+"/"+traceID, time.Second*2, 4)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &spans)
+	if err != nil {
+		spans = []schemas.Span{}
+	}
+	return
+}
+
+// SetTransport replaces the transport of the http client, e.g. by an in-memory transport for
+// tests. It has to be called before the client is used
+func (cli *LoggerClient) SetTransport(transport http.RoundTripper) {
+	cli.httpClient.Transport = transport
+}
+
 func (cli *LoggerClient) prefix() (ret string) {
 	ret = "http://" + cli.host + ":" + strconv.Itoa(cli.port)
 	return
 }
 
+func (cli *LoggerClient) statePrefix(masID int, agentID int) (ret string) {
+	ret = cli.prefix() + "/api/state/" + strconv.Itoa(masID) + "/" + strconv.Itoa(agentID)
+	return
+}
+
+// stateRevision parses the response of a request for a named state
+func stateRevision(body []byte, httpStatus int) (rev schemas.StateRevision, err error) {
+	switch httpStatus {
+	case http.StatusOK, http.StatusCreated:
+		err = json.Unmarshal(body, &rev)
+	case http.StatusNotFound:
+		err = ErrStateNotFound
+	case http.StatusConflict:
+		err = ErrRevisionConflict
+	default:
+		err = errors.New("state request failed with status " + strconv.Itoa(httpStatus))
+	}
+	return
+}
+
 // NewLoggerClient creates a new Logger client
 func NewLoggerClient(host string, port int, timeout time.Duration, del time.Duration,
 	numRet int) (cli *LoggerClient) {
@@ -160,6 +346,7 @@ type LogCollector struct {
 	stateIn  chan schemas.State
 	client   *LoggerClient
 	config   schemas.LoggerConfig
+	interval time.Duration // maximum time logs are collected before they are sent
 	logError *log.Logger
 	logInfo  *log.Logger
 }
@@ -197,7 +384,7 @@ func (logCol *LogCollector) storeLogs() (err error) {
 			tempTime := time.Now()
 			for {
 				time.Sleep(100 * time.Millisecond)
-				if time.Since(tempTime).Seconds() > 15 || len(logCol.logIn) > 50 {
+				if time.Since(tempTime) > logCol.interval || len(logCol.logIn) > 50 {
 					break
 				}
 			}
@@ -253,14 +440,25 @@ func (logCol *LogCollector) storeState() (err error) {
 // NewLogCollector creates an agency logger client
 func NewLogCollector(masID int, config schemas.LoggerConfig, logErr *log.Logger,
 	logInf *log.Logger) (logCol *LogCollector) {
+	var cli *LoggerClient
+	if config.Active {
+		cli = NewLoggerClient(config.Host, config.Port, time.Second*60, time.Second*1, 4)
+	}
+	logCol = NewLogCollectorClient(masID, config, cli, time.Second*15, logErr, logInf)
+	return
+}
+
+// NewLogCollectorClient creates an agency logger client that uses cli for requests to the
+// logger. Logs are sent at the latest after interval
+func NewLogCollectorClient(masID int, config schemas.LoggerConfig, cli *LoggerClient,
+	interval time.Duration, logErr *log.Logger, logInf *log.Logger) (logCol *LogCollector) {
 	logCol = &LogCollector{
 		masID:    masID,
 		logError: logErr,
 		logInfo:  logInf,
 		config:   config,
-	}
-	if logCol.config.Active {
-		logCol.client = NewLoggerClient(config.Host, config.Port, time.Second*60, time.Second*1, 4)
+		client:   cli,
+		interval: interval,
 	}
 	logCol.logIn = make(chan schemas.LogMessage, 10000)
 	logCol.stateIn = make(chan schemas.State, 10000)
@@ -277,10 +475,12 @@ type AgentLogger struct {
 	client   *LoggerClient
 	logOut   chan schemas.LogMessage // logging inbox
 	stateOut chan schemas.State
+	state    *string // last state set with UpdateState; it may not be stored yet
 	mutex    *sync.Mutex
 	logError *log.Logger
 	logInfo  *log.Logger
 	active   bool
+	system   bool // named states with SystemStatePrefix may be modified
 }
 
 // NewLog sends a new logging message to the logging service
@@ -320,6 +520,7 @@ func (agLog *AgentLogger) UpdateState(state string) (err error) {
 		agLog.mutex.Unlock()
 		return errors.New("agLog not active")
 	}
+	agLog.state = &state
 	agLog.mutex.Unlock()
 	agState := schemas.State{
 		MASID:     agLog.masID,
@@ -330,21 +531,143 @@ func (agLog *AgentLogger) UpdateState(state string) (err error) {
 	return
 }
 
-// RestoreState loads state saved in database and return it
+// RestoreState loads state saved in database and return it. If the state has been updated by
+// this agent, the last state is returned even if it has not been stored yet
 func (agLog *AgentLogger) RestoreState() (state string, err error) {
+	state, err = agLog.RestoreStateContext(context.Background())
+	return
+}
+
+// RestoreStateContext loads state like RestoreState. The request to the logger is aborted when
+// ctx is done
+func (agLog *AgentLogger) RestoreStateContext(ctx context.Context) (state string, err error) {
 	agLog.mutex.Lock()
 	if !agLog.active {
 		agLog.mutex.Unlock()
 		err = errors.New("agLog not active")
 		return
 	}
+	if agLog.state != nil {
+		state = *agLog.state
+		agLog.mutex.Unlock()
+		return
+	}
 	agLog.mutex.Unlock()
 	var agState schemas.State
-	agState, _, err = agLog.client.GetState(agLog.masID, agLog.agentID)
+	agState, _, err = agLog.client.GetStateContext(ctx, agLog.masID, agLog.agentID)
 	state = agState.State
 	return
 }
 
+// StateKeys returns the names of all named states of the agent
+func (agLog *AgentLogger) StateKeys() (keys []string, err error) {
+	if !agLog.isActive() {
+		err = errors.New("agLog not active")
+		return
+	}
+	keys, _, err = agLog.client.GetStateKeys(agLog.masID, agLog.agentID)
+	return
+}
+
+// GetNamedState returns the latest revision of the named state key. Revision 0 and an empty
+// state are returned if the state does not exist yet
+func (agLog *AgentLogger) GetNamedState(key string) (state string, revision int, err error) {
+	if !agLog.isActive() {
+		err = errors.New("agLog not active")
+		return
+	}
+	var rev schemas.StateRevision
+	rev, _, err = agLog.client.GetNamedState(agLog.masID, agLog.agentID, key)
+	if err == ErrStateNotFound {
+		err = nil
+		return
+	}
+	state = rev.State
+	revision = rev.Revision
+	return
+}
+
+// UpdateNamedState stores state as new revision of the named state key if the current revision
+// equals revision (0 if the state does not exist yet) and returns the new revision.
+// ErrRevisionConflict is returned if the state has been modified concurrently
+func (agLog *AgentLogger) UpdateNamedState(key string, revision int,
+	state string) (newRevision int, err error) {
+	if !agLog.isActive() {
+		err = errors.New("agLog not active")
+		return
+	}
+	if agLog.reserved(key) {
+		err = ErrReservedState
+		return
+	}
+	var rev schemas.StateRevision
+	rev, _, err = agLog.client.PutNamedState(agLog.masID, agLog.agentID, key,
+		schemas.StateUpdate{Revision: revision, State: state})
+	newRevision = rev.Revision
+	return
+}
+
+// StateHistory returns all revisions of the named state key in ascending order
+func (agLog *AgentLogger) StateHistory(key string) (revs []schemas.StateRevision, err error) {
+	if !agLog.isActive() {
+		err = errors.New("agLog not active")
+		return
+	}
+	revs, _, err = agLog.client.GetStateHistory(agLog.masID, agLog.agentID, key)
+	return
+}
+
+// RestoreNamedState rolls the named state key back to an older revision. The content of that
+// revision is stored as new revision and returned together with the new revision number
+func (agLog *AgentLogger) RestoreNamedState(key string, revision int) (state string,
+	newRevision int, err error) {
+	if !agLog.isActive() {
+		err = errors.New("agLog not active")
+		return
+	}
+	if agLog.reserved(key) {
+		err = ErrReservedState
+		return
+	}
+	var rev schemas.StateRevision
+	rev, _, err = agLog.client.RestoreStateRevision(agLog.masID, agLog.agentID, key, revision)
+	state = rev.State
+	newRevision = rev.Revision
+	return
+}
+
+// reserved indicates if the named state key is reserved for clonemap and may not be modified by
+// this logger
+func (agLog *AgentLogger) reserved(key string) bool {
+	return !agLog.system && strings.HasPrefix(key, SystemStatePrefix)
+}
+
+// isActive indicates if the logger is active
+func (agLog *AgentLogger) isActive() (active bool) {
+	if agLog == nil {
+		return
+	}
+	agLog.mutex.Lock()
+	active = agLog.active
+	agLog.mutex.Unlock()
+	return
+}
+
+// LastState returns the last state set with UpdateState. false is returned if the state has
+// not been updated by this agent
+func (agLog *AgentLogger) LastState() (state string, ok bool) {
+	if agLog == nil {
+		return
+	}
+	agLog.mutex.Lock()
+	if agLog.state != nil {
+		state = *agLog.state
+		ok = true
+	}
+	agLog.mutex.Unlock()
+	return
+}
+
 // NewAgentLogger craetes a new object of type AgentLogger
 func (logCol *LogCollector) NewAgentLogger(agentID int, logErr *log.Logger,
 	logInf *log.Logger) (agLog *AgentLogger) {
@@ -362,8 +685,20 @@ func (logCol *LogCollector) NewAgentLogger(agentID int, logErr *log.Logger,
 	return
 }
 
+// NewSystemLogger creates a logger for agentID that may also modify the named states reserved
+// for clonemap
+func (logCol *LogCollector) NewSystemLogger(agentID int, logErr *log.Logger,
+	logInf *log.Logger) (agLog *AgentLogger) {
+	agLog = logCol.NewAgentLogger(agentID, logErr, logInf)
+	agLog.system = true
+	return
+}
+
 // close closes the logger
 func (agLog *AgentLogger) Close() {
+	if agLog == nil {
+		return
+	}
 	agLog.mutex.Lock()
 	agLog.logInfo.Println("Closing Logger of agent ", agLog.agentID)
 	agLog.active = false
@@ -0,0 +1,315 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package clonemaptest runs a complete MAS within one process for testing agent behavior. The
+// AMS, DF, logger and all agencies are started in-process and communicate via an in-memory
+// transport instead of http and DNS. A test passes the spec of the MAS and the task of the
+// agents to Start and inspects the exchanged messages, agent states and logs via the returned
+// handle:
+//
+//	mas, err := clonemaptest.Start(spec, task)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer mas.Stop()
+//	msgs, err := mas.WaitMessages(2, time.Second*5)
+package clonemaptest
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/agency"
+	"github.com/RWTH-ACS/clonemap/pkg/ams"
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/df"
+	"github.com/RWTH-ACS/clonemap/pkg/logger"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/RWTH-ACS/clonemap/pkg/status"
+)
+
+// stubHost is the host name of the stub replacing the kubestub
+const stubHost = "kubestub"
+
+// pollInterval is the interval in which the state of the MAS is checked while waiting
+const pollInterval = time.Millisecond * 10
+
+// MAS is the handle of a MAS running in-process
+type MAS struct {
+	ID       int                  // ID of the MAS
+	AMS      *client.AMSClient    // client for the AMS of the MAS
+	DF       *client.DFClient     // client for the DF of the MAS
+	Logger   *client.LoggerClient // client for the logger of the MAS
+	trans    *transport
+	stub     *stub
+	msgs     []schemas.ACLMessage // all messages delivered to agents
+	msgCond  *sync.Cond
+	mutex    *sync.Mutex
+	stopped  bool
+	logError *log.Logger
+}
+
+// Start starts the AMS, DF, logger and the agencies of the MAS specified by spec. Every agent
+// executes task. The logger and DF are always active, MQTT and the gateway are not supported. Start
+// returns as soon as all agencies have been started. All log topics are activated if none is
+// activated in spec
+func Start(spec schemas.MASSpec, task func(*agency.Agent) error) (mas *MAS, err error) {
+	mas = &MAS{
+		trans:    newTransport(),
+		mutex:    &sync.Mutex{},
+		logError: log.New(os.Stderr, "[ERROR] ", log.LstdFlags),
+	}
+	mas.msgCond = sync.NewCond(mas.mutex)
+	logInf := log.New(ioutil.Discard, "", log.LstdFlags)
+	mas.stub = &stub{
+		trans:     mas.trans,
+		task:      task,
+		onDeliver: mas.recordMessage,
+		agencies:  make(map[string]*agency.Agency),
+		mutex:     &sync.Mutex{},
+		logError:  mas.logError,
+		logInfo:   logInf,
+	}
+	mas.trans.register(stubHost+":8000", http.HandlerFunc(mas.stub.handleAPI))
+	mas.trans.register("ams:9000", ams.NewLocalHandler(stubHost, mas.trans, mas.logError, logInf))
+	mas.trans.register("df:12000", df.NewLocalHandler(mas.logError, logInf))
+	mas.trans.register("logger:11000", logger.NewLocalHandler(mas.logError, logInf))
+
+	mas.AMS = client.NewAMSClient(time.Second*10, time.Millisecond*100, 4)
+	mas.AMS.SetTransport(mas.trans)
+	mas.DF = client.NewDFClient("df", 12000, time.Second*10, time.Millisecond*100, 4)
+	mas.DF.SetTransport(mas.trans)
+	mas.Logger = client.NewLoggerClient("logger", 11000, time.Second*10, time.Millisecond*100, 4)
+	mas.Logger.SetTransport(mas.trans)
+
+	spec.Config.Logger.Active = true
+	if !spec.Config.Logger.TopicMsg && !spec.Config.Logger.TopicApp &&
+		!spec.Config.Logger.TopicStatus && !spec.Config.Logger.TopicDebug {
+		spec.Config.Logger.TopicMsg = true
+		spec.Config.Logger.TopicApp = true
+		spec.Config.Logger.TopicStatus = true
+		spec.Config.Logger.TopicDebug = true
+	}
+	spec.Config.DF.Active = true
+	spec.Config.MQTT = schemas.MQTTConfig{}
+	spec.Config.Gateway = schemas.GatewayConfig{}
+	var httpStatus int
+	httpStatus, err = mas.AMS.PostMAS(spec)
+	if err == nil && httpStatus != http.StatusCreated {
+		err = errors.New("cannot create MAS, http status " + http.StatusText(httpStatus))
+	}
+	if err != nil {
+		mas.stub.stopAll()
+		return
+	}
+	err = mas.waitAgencies(time.Second * 10)
+	if err != nil {
+		mas.Stop()
+	}
+	return
+}
+
+// waitAgencies waits until all agencies of the MAS have been started
+func (mas *MAS) waitAgencies(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var agencies schemas.Agencies
+		agencies, _, err = mas.AMS.GetAgencies(mas.ID)
+		if err == nil && len(agencies.Inst) > 0 {
+			ready := true
+			for i := range agencies.Inst {
+				if !mas.trans.isReady(agencyHost(mas.ID, agencies.Inst[i].ImageGroupID,
+					agencies.Inst[i].ID)) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				return
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+	err = errors.New("timeout while starting agencies")
+	return
+}
+
+// recordMessage stores a message delivered to an agent
+func (mas *MAS) recordMessage(msg schemas.ACLMessage) {
+	mas.mutex.Lock()
+	mas.msgs = append(mas.msgs, msg)
+	mas.mutex.Unlock()
+	mas.msgCond.Broadcast()
+}
+
+// Messages returns all messages that have been delivered to agents so far in the order of
+// delivery
+func (mas *MAS) Messages() (msgs []schemas.ACLMessage) {
+	mas.mutex.Lock()
+	msgs = make([]schemas.ACLMessage, len(mas.msgs))
+	copy(msgs, mas.msgs)
+	mas.mutex.Unlock()
+	return
+}
+
+// WaitMessages waits until at least num messages have been delivered to agents and returns all
+// delivered messages. An error is returned if less messages are delivered within timeout
+func (mas *MAS) WaitMessages(num int, timeout time.Duration) (msgs []schemas.ACLMessage,
+	err error) {
+	timer := time.AfterFunc(timeout, func() {
+		mas.mutex.Lock()
+		mas.msgCond.Broadcast()
+		mas.mutex.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	mas.mutex.Lock()
+	for len(mas.msgs) < num && time.Now().Before(deadline) {
+		mas.msgCond.Wait()
+	}
+	msgs = make([]schemas.ACLMessage, len(mas.msgs))
+	copy(msgs, mas.msgs)
+	mas.mutex.Unlock()
+	if len(msgs) < num {
+		err = errors.New("timeout while waiting for messages")
+	}
+	return
+}
+
+// Agents returns the info of all agents of the MAS as stored in the AMS
+func (mas *MAS) Agents() (agents []schemas.AgentInfo, err error) {
+	var ags schemas.Agents
+	ags, _, err = mas.AMS.GetAgents(mas.ID)
+	agents = ags.Inst
+	return
+}
+
+// AgentStatus returns the status of an agent as reported by its agency
+func (mas *MAS) AgentStatus(agentID int) (agStatus schemas.Status, err error) {
+	var address schemas.Address
+	address, _, err = mas.AMS.GetAgentAddress(mas.ID, agentID)
+	if err != nil {
+		return
+	}
+	agencyClient := client.NewAgencyClient(time.Second*10, time.Millisecond*100, 4)
+	agencyClient.SetTransport(mas.trans)
+	agStatus, _, err = agencyClient.GetAgentStatus(address.Agency, agentID)
+	return
+}
+
+// WaitRunning waits until all agents of the MAS are running
+func (mas *MAS) WaitRunning(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	var agents []schemas.AgentInfo
+	agents, err = mas.Agents()
+	if err != nil {
+		return
+	}
+	for i := range agents {
+		for {
+			var agStatus schemas.Status
+			agStatus, err = mas.AgentStatus(agents[i].ID)
+			if err == nil && agStatus.Code == status.Running {
+				break
+			}
+			if time.Now().After(deadline) {
+				err = errors.New("timeout while waiting for running agents")
+				return
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+	return
+}
+
+// State returns the last state of an agent that has been sent to the logger
+func (mas *MAS) State(agentID int) (state schemas.State, err error) {
+	state, _, err = mas.Logger.GetState(mas.ID, agentID)
+	return
+}
+
+// Logs returns the latest num log messages of an agent with topic that have been sent to the
+// logger. Logs are sent by the agencies every 100 ms
+func (mas *MAS) Logs(agentID int, topic string, num int) (logs []schemas.LogMessage, err error) {
+	logs, _, err = mas.Logger.GetLatestLogs(mas.ID, agentID, topic, num)
+	return
+}
+
+// WaitCosim waits until all steps of the co-simulation have been executed and returns the final
+// status of the co-simulation. An error is returned if the co-simulation has been halted
+func (mas *MAS) WaitCosim(timeout time.Duration) (cosimStatus schemas.CosimStatus, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cosimStatus, _, err = mas.AMS.GetCosim(mas.ID)
+		if err == nil && cosimStatus.Finished {
+			return
+		}
+		if err == nil && cosimStatus.Halted {
+			err = errors.New("co-simulation halted: " + cosimStatus.LastError)
+			return
+		}
+		if time.Now().After(deadline) {
+			err = errors.New("timeout while waiting for co-simulation")
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Stop terminates all agents and agencies of the MAS
+func (mas *MAS) Stop() {
+	mas.mutex.Lock()
+	if mas.stopped {
+		mas.mutex.Unlock()
+		return
+	}
+	mas.stopped = true
+	mas.mutex.Unlock()
+	mas.stub.stopAll()
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package clonemaptest
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/agency"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/RWTH-ACS/clonemap/pkg/status"
+)
+
+// TestMAS starts a MAS with four agents in two agencies. Each agent sends a message to the next
+// agent, waits for the message of the previous agent and stores the content as state
+func TestMAS(t *testing.T) {
+	numAgents := 4
+	spec := schemas.MASSpec{
+		Config: schemas.MASConfig{
+			Name:               "test",
+			NumAgentsPerAgency: 2,
+		},
+		ImageGroups: []schemas.ImageGroupSpec{
+			{
+				Config: schemas.ImageGroupConfig{Image: "test"},
+				Agents: make([]schemas.AgentSpec, numAgents),
+			},
+		},
+	}
+	task := func(ag *agency.Agent) (err error) {
+		id := ag.GetAgentID()
+		msg, err := ag.ACL.NewMessage((id+1)%numAgents, schemas.FIPAProtNone,
+			schemas.FIPAPerfInform, "hello from "+strconv.Itoa(id))
+		if err != nil {
+			return
+		}
+		err = ag.ACL.SendMessage(msg)
+		if err != nil {
+			return
+		}
+		msg, err = ag.ACL.RecvMessageWait()
+		if err != nil {
+			return
+		}
+		err = ag.Logger.NewLog("app", "received", msg.Content)
+		if err != nil {
+			return
+		}
+		err = ag.Logger.UpdateState(msg.Content)
+		return
+	}
+
+	mas, err := Start(spec, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mas.Stop()
+
+	agents, err := mas.Agents()
+	if err != nil || len(agents) != numAgents {
+		t.Fatal("wrong agents ", agents, err)
+	}
+	if agents[0].Address.Agency == agents[numAgents-1].Address.Agency {
+		t.Fatal("agents are expected in different agencies")
+	}
+	msgs, err := mas.WaitMessages(numAgents, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(map[int]string)
+	for i := range msgs {
+		received[msgs[i].Receiver] = msgs[i].Content
+	}
+	for i := 0; i < numAgents; i++ {
+		exp := "hello from " + strconv.Itoa((i+numAgents-1)%numAgents)
+		if received[i] != exp {
+			t.Error("agent ", i, " received ", received[i], ", expected ", exp)
+		}
+	}
+
+	// states and logs are sent to the logger asynchronously
+	deadline := time.Now().Add(time.Second * 5)
+	for i := 0; i < numAgents; i++ {
+		exp := "hello from " + strconv.Itoa((i+numAgents-1)%numAgents)
+		for {
+			state, stateErr := mas.State(i)
+			logs, logErr := mas.Logs(i, "app", 10)
+			if stateErr == nil && logErr == nil && state.State == exp && len(logs) == 1 &&
+				logs[0].AdditionalData == exp {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("agent ", i, ": wrong state ", state, " or logs ", logs)
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+// TestCosim executes a co-simulation with four agents in two agencies. In every step each agent
+// sends a message to the next agent that has to be received in the following step
+func TestCosim(t *testing.T) {
+	numAgents := 4
+	numSteps := 5
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	spec := schemas.MASSpec{
+		Config: schemas.MASConfig{
+			Name:               "cosim",
+			NumAgentsPerAgency: 2,
+			Cosim: schemas.CosimConfig{
+				Active:   true,
+				StepSize: 1000,
+				NumSteps: numSteps,
+				Start:    start,
+				Timeout:  5000,
+			},
+		},
+		ImageGroups: []schemas.ImageGroupSpec{
+			{
+				Config: schemas.ImageGroupConfig{Image: "test"},
+				Agents: make([]schemas.AgentSpec, numAgents),
+			},
+		},
+	}
+	var mutex sync.Mutex
+	finished := make([]int, numSteps) // number of agents that have finished a step
+	var errs []string
+	task := func(ag *agency.Agent) (err error) {
+		received := 0
+		behavior, err := ag.NewStepBehavior(func(step int, now time.Time) (err error) {
+			id := ag.GetAgentID()
+			mutex.Lock()
+			if step > 0 && finished[step-1] != numAgents {
+				errs = append(errs, "agent "+strconv.Itoa(id)+" started step "+
+					strconv.Itoa(step)+" before all agents finished the previous step")
+			}
+			mutex.Unlock()
+			if !now.Equal(start.Add(time.Second*time.Duration(step))) || !ag.Now().Equal(now) ||
+				ag.Step() != step {
+				mutex.Lock()
+				errs = append(errs, "agent "+strconv.Itoa(id)+": wrong time "+now.String()+
+					" in step "+strconv.Itoa(step))
+				mutex.Unlock()
+			}
+			// all messages sent in previous steps have to be delivered at the beginning of a step
+			num, _, _ := ag.ACL.RecvMessages()
+			received += num
+			if received < step {
+				mutex.Lock()
+				errs = append(errs, "agent "+strconv.Itoa(id)+" received "+
+					strconv.Itoa(received)+" messages until step "+strconv.Itoa(step))
+				mutex.Unlock()
+			}
+			if id == 0 {
+				// the other agents have to wait for the slowest agent
+				time.Sleep(time.Millisecond * 20)
+			}
+			msg, err := ag.ACL.NewMessage((id+1)%numAgents, schemas.FIPAProtNone,
+				schemas.FIPAPerfInform, strconv.Itoa(step))
+			if err != nil {
+				return
+			}
+			err = ag.ACL.SendMessage(msg)
+			mutex.Lock()
+			finished[step]++
+			mutex.Unlock()
+			return
+		})
+		if err != nil {
+			return
+		}
+		behavior.Start()
+		return
+	}
+
+	mas, err := Start(spec, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mas.Stop()
+	cosimStatus, err := mas.WaitCosim(time.Second * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cosimStatus.Step != numSteps-1 || cosimStatus.LastError != "" ||
+		!cosimStatus.Time.Equal(start.Add(time.Second*time.Duration(numSteps-1))) {
+		t.Error("wrong co-simulation status ", cosimStatus)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := range finished {
+		if finished[i] != numAgents {
+			t.Error("step ", i, " finished by ", finished[i], " agents")
+		}
+	}
+	for i := range errs {
+		t.Error(errs[i])
+	}
+}
+
+// TestCosimHalt checks that the co-simulation is halted if a step behavior fails and that the
+// error is reported in the status of the MAS
+func TestCosimHalt(t *testing.T) {
+	numSteps := 5
+	failStep := 2
+	spec := schemas.MASSpec{
+		Config: schemas.MASConfig{
+			Name:               "cosim",
+			NumAgentsPerAgency: 2,
+			Cosim: schemas.CosimConfig{
+				Active:   true,
+				StepSize: 1000,
+				NumSteps: numSteps,
+				Start:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				Timeout:  5000,
+			},
+		},
+		ImageGroups: []schemas.ImageGroupSpec{
+			{
+				Config: schemas.ImageGroupConfig{Image: "test"},
+				Agents: make([]schemas.AgentSpec, 2),
+			},
+		},
+	}
+	var mutex sync.Mutex
+	lastStep := -1
+	task := func(ag *agency.Agent) (err error) {
+		behavior, err := ag.NewStepBehavior(func(step int, now time.Time) (err error) {
+			mutex.Lock()
+			if step > lastStep {
+				lastStep = step
+			}
+			mutex.Unlock()
+			if step == failStep && ag.GetAgentID() == 0 {
+				err = errors.New("step failed")
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		behavior.Start()
+		return
+	}
+
+	mas, err := Start(spec, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mas.Stop()
+	_, err = mas.WaitCosim(time.Second * 10)
+	if err == nil {
+		t.Fatal("co-simulation not halted")
+	}
+	cosimStatus, _, err := mas.AMS.GetCosim(mas.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cosimStatus.Halted || cosimStatus.Finished || cosimStatus.Step != failStep-1 ||
+		cosimStatus.LastError == "" {
+		t.Error("wrong co-simulation status ", cosimStatus)
+	}
+	info, _, err := mas.AMS.GetMAS(mas.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status.Code != status.Error || info.Status.LastError == "" {
+		t.Error("wrong MAS status ", info.Status)
+	}
+	// give the AMS the chance to wrongly start another step
+	time.Sleep(time.Millisecond * 200)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if lastStep != failStep {
+		t.Error("step ", lastStep, " executed after failed step ", failStep)
+	}
+}
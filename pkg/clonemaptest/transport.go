@@ -0,0 +1,276 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// in-memory transport of http requests between modules and stub for starting agencies
+
+package clonemaptest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RWTH-ACS/clonemap/pkg/agency"
+	"github.com/RWTH-ACS/clonemap/pkg/common/httpreply"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// route is the destination of requests to one host
+type route struct {
+	handler http.Handler
+	ready   chan struct{} // closed as soon as handler is set
+}
+
+// transport is an http.RoundTripper that passes requests directly to the handler registered for
+// the host of the request. Requests to hosts that are registered but not yet ready are blocked
+// until the handler is set
+type transport struct {
+	routes map[string]*route
+	mutex  *sync.Mutex
+}
+
+// newTransport creates an empty transport
+func newTransport() (trans *transport) {
+	trans = &transport{
+		routes: make(map[string]*route),
+		mutex:  &sync.Mutex{},
+	}
+	return
+}
+
+// RoundTrip serves req with the handler of the host
+func (trans *transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	trans.mutex.Lock()
+	rt, ok := trans.routes[req.URL.Host]
+	trans.mutex.Unlock()
+	if !ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		err = errors.New("unknown host " + req.URL.Host)
+		return
+	}
+	select {
+	case <-rt.ready:
+	case <-req.Context().Done():
+		err = req.Context().Err()
+		return
+	}
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	rec := httptest.NewRecorder()
+	rt.handler.ServeHTTP(rec, req)
+	resp = rec.Result()
+	resp.Request = req
+	return
+}
+
+// register sets handler for host
+func (trans *transport) register(host string, handler http.Handler) {
+	rt := trans.reserve(host)
+	rt.handler = handler
+	close(rt.ready)
+}
+
+// reserve registers host without handler. Requests to host are blocked until the handler is set
+func (trans *transport) reserve(host string) (rt *route) {
+	rt = &route{ready: make(chan struct{})}
+	trans.mutex.Lock()
+	trans.routes[host] = rt
+	trans.mutex.Unlock()
+	return
+}
+
+// isReady checks if the handler of host is set
+func (trans *transport) isReady(host string) (ready bool) {
+	trans.mutex.Lock()
+	rt, ok := trans.routes[host]
+	trans.mutex.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-rt.ready:
+		ready = true
+	default:
+	}
+	return
+}
+
+// remove deletes the route of host
+func (trans *transport) remove(host string) {
+	trans.mutex.Lock()
+	delete(trans.routes, host)
+	trans.mutex.Unlock()
+}
+
+// stub replaces the kubestub. Agencies are started within the process instead of containers
+type stub struct {
+	trans     *transport
+	task      func(*agency.Agent) error
+	onDeliver func(schemas.ACLMessage)
+	agencies  map[string]*agency.Agency // agencies by host
+	mutex     *sync.Mutex
+	logError  *log.Logger
+	logInfo   *log.Logger
+}
+
+// handleAPI is the handler for requests to path /api/container
+func (st *stub) handleAPI(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	respath := strings.Split(r.URL.EscapedPath(), "/")
+	switch {
+	case len(respath) == 3 && respath[2] == "container" && r.Method == "POST":
+		var body []byte
+		body, cmapErr = ioutil.ReadAll(r.Body)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			break
+		}
+		var config schemas.StubAgencyConfig
+		cmapErr = json.Unmarshal(body, &config)
+		if cmapErr != nil {
+			httpErr = httpreply.JSONUnmarshalError(w)
+			break
+		}
+		st.createAgency(config)
+		httpErr = httpreply.Created(w, nil, "text/plain", []byte("Ressource Created"))
+	case len(respath) == 4 && respath[2] == "container" && r.Method == "DELETE":
+		var masID int
+		masID, cmapErr = strconv.Atoi(respath[3])
+		if cmapErr != nil {
+			httpErr = httpreply.NotFoundError(w)
+			break
+		}
+		st.deleteMAS(masID)
+		httpErr = httpreply.Deleted(w, nil)
+	default:
+		cmapErr = errors.New("Error - wrong path: " + r.URL.EscapedPath())
+		httpErr = httpreply.NotFoundError(w)
+	}
+	if cmapErr != nil {
+		st.logError.Println(r.URL.Path, cmapErr)
+	}
+	if httpErr != nil {
+		st.logError.Println(r.URL.Path, httpErr)
+	}
+}
+
+// createAgency starts an agency in a separate go routine. Requests to the agency are blocked
+// until it has received its configuration
+func (st *stub) createAgency(config schemas.StubAgencyConfig) {
+	hostname := fmt.Sprintf("mas-%d-im-%d-agency-%d", config.MASID, config.ImageGroupID,
+		config.AgencyID)
+	host := agencyHost(config.MASID, config.ImageGroupID, config.AgencyID)
+	rt := st.trans.reserve(host)
+	go func() {
+		ag, err := agency.NewLocalAgency(agency.LocalConfig{
+			Name:      hostname,
+			Transport: st.trans,
+			OnDeliver: st.onDeliver,
+			LogError:  st.logError,
+			LogInfo:   st.logInfo,
+		}, st.task)
+		if err != nil {
+			st.logError.Println("Cannot start agency ", hostname, ": ", err)
+			rt.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				httpreply.CMAPError(w, err.Error())
+			})
+			close(rt.ready)
+			return
+		}
+		st.mutex.Lock()
+		st.agencies[host] = ag
+		st.mutex.Unlock()
+		rt.handler = ag.Handler()
+		close(rt.ready)
+	}()
+}
+
+// deleteMAS stops all agencies of the MAS
+func (st *stub) deleteMAS(masID int) {
+	suffix := ".mas" + strconv.Itoa(masID) + "agencies:10000"
+	st.mutex.Lock()
+	var agencies []*agency.Agency
+	for host, ag := range st.agencies {
+		if strings.HasSuffix(host, suffix) {
+			agencies = append(agencies, ag)
+			delete(st.agencies, host)
+			st.trans.remove(host)
+		}
+	}
+	st.mutex.Unlock()
+	for i := range agencies {
+		agencies[i].Stop()
+	}
+}
+
+// stopAll stops all agencies
+func (st *stub) stopAll() {
+	st.mutex.Lock()
+	var agencies []*agency.Agency
+	for host, ag := range st.agencies {
+		agencies = append(agencies, ag)
+		delete(st.agencies, host)
+	}
+	st.mutex.Unlock()
+	for i := range agencies {
+		agencies[i].Stop()
+	}
+}
+
+// agencyHost returns host and port of the agency
+func agencyHost(masID int, imID int, agencyID int) (host string) {
+	host = fmt.Sprintf("mas-%d-im-%d-agency-%d.mas%dagencies:10000", masID, imID, agencyID,
+		masID)
+	return
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package aclwire implements the encodings of ACL message batches exchanged between agencies.
+// Besides JSON a compact binary encoding is supported which is compatible to the protocol buffers
+// wire format of the following message definition:
+//
+//	message ACLMessage {
+//	  int64 ts = 1; // unix time in nanoseconds, omitted for zero time
+//	  int64 perf = 2;
+//	  int64 sender = 3;
+//	  string agencys = 4;
+//	  int64 receiver = 5;
+//	  string agencyr = 6;
+//	  int64 repto = 7;
+//	  string content = 8;
+//	  string lang = 9;
+//	  string enc = 10;
+//	  string ont = 11;
+//	  int64 prot = 12;
+//	  int64 convid = 13;
+//	  string repwith = 14;
+//	  int64 inrepto = 15;
+//	  int64 repby = 16; // unix time in nanoseconds, omitted for zero time
+//	  int64 prio = 17;
+//	}
+//	message ACLMessageBatch {
+//	  repeated ACLMessage msgs = 1;
+//	}
+//
+// Batches can optionally be compressed with gzip.
+package aclwire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// content types and encodings of message batches
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	EncodingGzip        = "gzip"
+)
+
+// DefaultMaxSize is the default maximum size of a decompressed message batch
+const DefaultMaxSize = 1 << 26
+
+// ErrTooLarge is returned if decompressed data exceeds the maximum size
+var ErrTooLarge = errors.New("decompressed data too large")
+
+// wire types of the protocol buffers encoding
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Marshal encodes a batch of messages according to the content type
+func Marshal(msgs []schemas.ACLMessage, contentType string) (data []byte, err error) {
+	switch contentType {
+	case ContentTypeJSON:
+		data, err = json.Marshal(msgs)
+	case ContentTypeProtobuf:
+		data = MarshalProtobuf(msgs)
+	default:
+		err = errors.New("unsupported content type " + contentType)
+	}
+	return
+}
+
+// Unmarshal decodes a batch of messages according to the content type
+func Unmarshal(data []byte, contentType string) (msgs []schemas.ACLMessage, err error) {
+	switch contentType {
+	case ContentTypeJSON:
+		err = json.Unmarshal(data, &msgs)
+	case ContentTypeProtobuf:
+		msgs, err = UnmarshalProtobuf(data)
+	default:
+		err = errors.New("unsupported content type " + contentType)
+	}
+	return
+}
+
+// Compress compresses data with gzip
+func Compress(data []byte) (ret []byte, err error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(data)
+	if err != nil {
+		return
+	}
+	err = zw.Close()
+	ret = buf.Bytes()
+	return
+}
+
+// Decompress decompresses gzip compressed data. ErrTooLarge is returned if the decompressed data
+// exceeds maxSize bytes
+func Decompress(data []byte, maxSize int) (ret []byte, err error) {
+	var zr *gzip.Reader
+	zr, err = gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	ret, err = ioutil.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err == nil && len(ret) > maxSize {
+		ret = nil
+		err = ErrTooLarge
+	}
+	return
+}
+
+// MarshalProtobuf encodes a batch of messages in the binary format
+func MarshalProtobuf(msgs []schemas.ACLMessage) (data []byte) {
+	var msgBuf []byte
+	for i := range msgs {
+		msgBuf = appendMessage(msgBuf[:0], msgs[i])
+		data = appendTag(data, 1, wireBytes)
+		data = appendUvarint(data, uint64(len(msgBuf)))
+		data = append(data, msgBuf...)
+	}
+	return
+}
+
+// UnmarshalProtobuf decodes a batch of messages in the binary format
+func UnmarshalProtobuf(data []byte) (msgs []schemas.ACLMessage, err error) {
+	msgs = []schemas.ACLMessage{}
+	dec := decoder{data: data}
+	for !dec.done() {
+		var field, wire int
+		field, wire, err = dec.tag()
+		if err != nil {
+			return
+		}
+		if field != 1 || wire != wireBytes {
+			err = dec.skip(wire)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		var msgData []byte
+		msgData, err = dec.bytes()
+		if err != nil {
+			return
+		}
+		var msg schemas.ACLMessage
+		msg, err = unmarshalMessage(msgData)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// appendMessage appends the encoding of one message to buf
+func appendMessage(buf []byte, msg schemas.ACLMessage) []byte {
+	buf = appendTime(buf, 1, msg.Timestamp)
+	buf = appendInt(buf, 2, msg.Performative)
+	buf = appendInt(buf, 3, msg.Sender)
+	buf = appendString(buf, 4, msg.AgencySender)
+	buf = appendInt(buf, 5, msg.Receiver)
+	buf = appendString(buf, 6, msg.AgencyReceiver)
+	buf = appendInt(buf, 7, msg.ReplyTo)
+	buf = appendString(buf, 8, msg.Content)
+	buf = appendString(buf, 9, msg.Language)
+	buf = appendString(buf, 10, msg.Encoding)
+	buf = appendString(buf, 11, msg.Ontology)
+	buf = appendInt(buf, 12, msg.Protocol)
+	buf = appendInt(buf, 13, msg.ConversationID)
+	buf = appendString(buf, 14, msg.ReplyWith)
+	buf = appendInt(buf, 15, msg.InReplyTo)
+	buf = appendTime(buf, 16, msg.ReplyBy)
+	buf = appendInt(buf, 17, msg.Priority)
+	buf = appendString(buf, 18, msg.TraceID)
+	buf = appendString(buf, 19, msg.SpanID)
+	return buf
+}
+
+// unmarshalMessage decodes one message. Unknown fields are skipped
+func unmarshalMessage(data []byte) (msg schemas.ACLMessage, err error) {
+	dec := decoder{data: data}
+	for !dec.done() {
+		var field, wire int
+		field, wire, err = dec.tag()
+		if err != nil {
+			return
+		}
+		switch wire {
+		case wireVarint:
+			var v int64
+			v, err = dec.varint()
+			if err == nil {
+				setInt(&msg, field, v)
+			}
+		case wireBytes:
+			var b []byte
+			b, err = dec.bytes()
+			if err == nil {
+				setString(&msg, field, string(b))
+			}
+		default:
+			err = dec.skip(wire)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// setInt sets the integer field of msg; unknown fields are ignored
+func setInt(msg *schemas.ACLMessage, field int, v int64) {
+	switch field {
+	case 1:
+		msg.Timestamp = time.Unix(0, v)
+	case 2:
+		msg.Performative = int(v)
+	case 3:
+		msg.Sender = int(v)
+	case 5:
+		msg.Receiver = int(v)
+	case 7:
+		msg.ReplyTo = int(v)
+	case 12:
+		msg.Protocol = int(v)
+	case 13:
+		msg.ConversationID = int(v)
+	case 15:
+		msg.InReplyTo = int(v)
+	case 16:
+		msg.ReplyBy = time.Unix(0, v)
+	case 17:
+		msg.Priority = int(v)
+	}
+}
+
+// setString sets the string field of msg; unknown fields are ignored
+func setString(msg *schemas.ACLMessage, field int, v string) {
+	switch field {
+	case 4:
+		msg.AgencySender = v
+	case 6:
+		msg.AgencyReceiver = v
+	case 8:
+		msg.Content = v
+	case 9:
+		msg.Language = v
+	case 10:
+		msg.Encoding = v
+	case 11:
+		msg.Ontology = v
+	case 14:
+		msg.ReplyWith = v
+	case 18:
+		msg.TraceID = v
+	case 19:
+		msg.SpanID = v
+	}
+}
+
+// appendTag appends the key of a field
+func appendTag(buf []byte, field int, wire int) []byte {
+	return appendUvarint(buf, uint64(field)<<3|uint64(wire))
+}
+
+// appendInt appends an integer field; zero values are omitted
+func appendInt(buf []byte, field int, v int) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireVarint)
+	return appendUvarint(buf, uint64(int64(v)))
+}
+
+// appendString appends a string field; empty strings are omitted
+func appendString(buf []byte, field int, v string) []byte {
+	if v == "" {
+		return buf
+	}
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// appendTime appends a time field as unix time in nanoseconds; zero time is omitted
+func appendTime(buf []byte, field int, v time.Time) []byte {
+	if v.IsZero() {
+		return buf
+	}
+	buf = appendTag(buf, field, wireVarint)
+	return appendUvarint(buf, uint64(v.UnixNano()))
+}
+
+// decoder reads fields of the protocol buffers wire format
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// done indicates if all data has been read
+func (dec *decoder) done() bool {
+	return dec.pos >= len(dec.data)
+}
+
+// uvarint reads an unsigned varint
+func (dec *decoder) uvarint() (v uint64, err error) {
+	v, n := binary.Uvarint(dec.data[dec.pos:])
+	if n <= 0 {
+		err = errors.New("invalid varint")
+		return
+	}
+	dec.pos += n
+	return
+}
+
+// varint reads a signed varint encoded as two's complement
+func (dec *decoder) varint() (v int64, err error) {
+	var u uint64
+	u, err = dec.uvarint()
+	v = int64(u)
+	return
+}
+
+// tag reads the key of a field
+func (dec *decoder) tag() (field int, wire int, err error) {
+	var key uint64
+	key, err = dec.uvarint()
+	if err != nil {
+		return
+	}
+	field = int(key >> 3)
+	wire = int(key & 7)
+	if field == 0 {
+		err = errors.New("invalid field number")
+	}
+	return
+}
+
+// bytes reads a length delimited field
+func (dec *decoder) bytes() (b []byte, err error) {
+	var l uint64
+	l, err = dec.uvarint()
+	if err != nil {
+		return
+	}
+	if l > uint64(len(dec.data)-dec.pos) {
+		err = errors.New("invalid length")
+		return
+	}
+	b = dec.data[dec.pos : dec.pos+int(l)]
+	dec.pos += int(l)
+	return
+}
+
+// skip skips the value of a field with unknown field number
+func (dec *decoder) skip(wire int) (err error) {
+	switch wire {
+	case wireVarint:
+		_, err = dec.uvarint()
+	case wireBytes:
+		_, err = dec.bytes()
+	case wireFixed64, wireFixed32:
+		n := 8
+		if wire == wireFixed32 {
+			n = 4
+		}
+		if len(dec.data)-dec.pos < n {
+			return errors.New("invalid length")
+		}
+		dec.pos += n
+	default:
+		err = errors.New("unsupported wire type")
+	}
+	return
+}
+
+// appendUvarint appends an unsigned varint
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
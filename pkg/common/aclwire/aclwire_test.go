@@ -0,0 +1,208 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package aclwire
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+func TestProtobuf(t *testing.T) {
+	msgs := []schemas.ACLMessage{
+		{
+			Timestamp:      time.Unix(0, 1600000000123456789),
+			Performative:   schemas.FIPAPerfRequest,
+			Sender:         3,
+			AgencySender:   "mas-0-agency-0-im-0.mas0agencies",
+			Receiver:       12,
+			AgencyReceiver: "mas-0-agency-1-im-0.mas0agencies",
+			ReplyTo:        -1,
+			Content:        "hello world",
+			Language:       "json",
+			Encoding:       "utf-8",
+			Ontology:       "test",
+			Protocol:       schemas.FIPAProtContractNet,
+			ConversationID: 42,
+			ReplyWith:      "7",
+			InReplyTo:      5,
+			ReplyBy:        time.Unix(0, 1600000001000000000),
+			Priority:       schemas.PriorityLow,
+			TraceID:        "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:         "00f067aa0ba902b7",
+		},
+		{},
+	}
+	data := MarshalProtobuf(msgs)
+	ret, err := UnmarshalProtobuf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msgs, ret) {
+		t.Errorf("wrong messages after decoding: %v", ret)
+	}
+
+	// unknown fields are skipped
+	var msgData []byte
+	msgData = appendInt(msgData, 3, 7)
+	msgData = appendInt(msgData, 99, 1)
+	msgData = appendString(msgData, 100, "unknown")
+	msgData = appendTag(msgData, 101, wireFixed64)
+	msgData = append(msgData, 1, 2, 3, 4, 5, 6, 7, 8)
+	msgData = appendTag(msgData, 102, wireFixed32)
+	msgData = append(msgData, 1, 2, 3, 4)
+	data = appendTag(nil, 1, wireBytes)
+	data = appendUvarint(data, uint64(len(msgData)))
+	data = append(data, msgData...)
+	data = appendString(data, 2, "unknown batch field")
+	ret, err = UnmarshalProtobuf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 1 || ret[0].Sender != 7 {
+		t.Errorf("wrong messages after decoding with unknown fields: %v", ret)
+	}
+
+	// truncated data is rejected
+	data = MarshalProtobuf(msgs[:1])
+	_, err = UnmarshalProtobuf(data[:len(data)-3])
+	if err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := MarshalProtobuf(pingPongMsgs(100))
+	comp, err := Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comp) >= len(data) {
+		t.Error("compressed data is not smaller than original data")
+	}
+	ret, err := Decompress(comp, DefaultMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, ret) {
+		t.Error("wrong data after decompression")
+	}
+	ret, err = Decompress(comp, len(data))
+	if err != nil || len(ret) != len(data) {
+		t.Error("decompression with exact maximum size failed ", err)
+	}
+	_, err = Decompress(comp, len(data)-1)
+	if err != ErrTooLarge {
+		t.Error("expected too large error, got ", err)
+	}
+}
+
+// pingPongMsgs creates a batch of messages as sent by the ping pong benchmark in
+// examples/benchmark
+func pingPongMsgs(num int) (msgs []schemas.ACLMessage) {
+	msgs = make([]schemas.ACLMessage, num)
+	for i := range msgs {
+		msgs[i] = schemas.ACLMessage{
+			Timestamp:      time.Now(),
+			Performative:   schemas.FIPAPerfInform,
+			Sender:         i,
+			AgencySender:   "mas-0-agency-0-im-0.mas0agencies",
+			Receiver:       i + num,
+			AgencyReceiver: "mas-0-agency-1-im-0.mas0agencies",
+			Content:        "hello world",
+			Protocol:       schemas.FIPAProtQuery,
+		}
+	}
+	return
+}
+
+func benchmarkMarshal(b *testing.B, contentType string, compression bool, num int) {
+	msgs := pingPongMsgs(num)
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := Marshal(msgs, contentType)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if compression {
+			data, err = Compress(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size)/float64(num), "bytes/msg")
+}
+
+func benchmarkUnmarshal(b *testing.B, contentType string, num int) {
+	data, err := Marshal(pingPongMsgs(num), contentType)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		_, err = Unmarshal(data, contentType)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B)      { benchmarkMarshal(b, ContentTypeJSON, false, 1) }
+func BenchmarkMarshalProtobuf(b *testing.B)  { benchmarkMarshal(b, ContentTypeProtobuf, false, 1) }
+func BenchmarkMarshalJSONBatch(b *testing.B) { benchmarkMarshal(b, ContentTypeJSON, false, 100) }
+func BenchmarkMarshalProtobufBatch(b *testing.B) {
+	benchmarkMarshal(b, ContentTypeProtobuf, false, 100)
+}
+func BenchmarkMarshalJSONGzip(b *testing.B)     { benchmarkMarshal(b, ContentTypeJSON, true, 100) }
+func BenchmarkMarshalProtobufGzip(b *testing.B) { benchmarkMarshal(b, ContentTypeProtobuf, true, 100) }
+func BenchmarkUnmarshalJSON(b *testing.B)       { benchmarkUnmarshal(b, ContentTypeJSON, 1) }
+func BenchmarkUnmarshalProtobuf(b *testing.B)   { benchmarkUnmarshal(b, ContentTypeProtobuf, 1) }
+func BenchmarkUnmarshalJSONBatch(b *testing.B)  { benchmarkUnmarshal(b, ContentTypeJSON, 100) }
+func BenchmarkUnmarshalProtobufBatch(b *testing.B) {
+	benchmarkUnmarshal(b, ContentTypeProtobuf, 100)
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package fipaacl implements the FIPA-ACL string representation (FIPA SC00070) and the
+// envelope and message framing of the FIPA HTTP message transport protocol (FIPA SC00084,
+// SC00085) used by other agent platforms like JADE. A message is represented as
+//
+//	(inform
+//	  :sender (agent-identifier :name a@platform :addresses (sequence http://host:7778/acc))
+//	  :receiver (set (agent-identifier :name b@platform))
+//	  :content "some content"
+//	  :conversation-id c1)
+package fipaacl
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// AID is a FIPA agent identifier
+type AID struct {
+	Name      string   // globally unique name of the agent
+	Addresses []string // transport addresses of the agent
+}
+
+// Message is a FIPA-ACL message. All parameters are kept in their string representation
+type Message struct {
+	Performative   string
+	Sender         AID
+	Receivers      []AID
+	ReplyTo        []AID
+	Content        string
+	Language       string
+	Encoding       string
+	Ontology       string
+	Protocol       string
+	ConversationID string
+	ReplyWith      string
+	InReplyTo      string
+	ReplyBy        time.Time // zero if not set
+}
+
+// dateLayout is the layout of FIPA date time tokens
+const dateLayout = "20060102T150405.000"
+
+// FormatDate returns the FIPA date time token of t in UTC
+func FormatDate(t time.Time) string {
+	return strings.Replace(t.UTC().Format(dateLayout), ".", "", 1) + "Z"
+}
+
+// ParseDate parses a FIPA date time token. Tokens without type designator are interpreted as UTC
+func ParseDate(s string) (t time.Time, err error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "+"), "-")
+	s = strings.TrimSuffix(strings.ToUpper(s), "Z")
+	if len(s) == len(dateLayout)-1 {
+		s = s[:15] + "." + s[15:]
+	}
+	t, err = time.Parse(dateLayout, s)
+	return
+}
+
+// Marshal returns the string representation of msg
+func Marshal(msg Message) string {
+	var b strings.Builder
+	b.WriteString("(" + msg.Performative)
+	if msg.Sender.Name != "" {
+		b.WriteString("\n :sender " + marshalAID(msg.Sender))
+	}
+	if len(msg.Receivers) > 0 {
+		b.WriteString("\n :receiver " + marshalAIDSet(msg.Receivers))
+	}
+	if len(msg.ReplyTo) > 0 {
+		b.WriteString("\n :reply-to " + marshalAIDSet(msg.ReplyTo))
+	}
+	params := []struct{ name, value string }{
+		{"content", msg.Content},
+		{"language", msg.Language},
+		{"encoding", msg.Encoding},
+		{"ontology", msg.Ontology},
+		{"protocol", msg.Protocol},
+		{"conversation-id", msg.ConversationID},
+		{"reply-with", msg.ReplyWith},
+		{"in-reply-to", msg.InReplyTo},
+	}
+	for _, param := range params {
+		if param.value == "" {
+			continue
+		}
+		if param.name == "content" {
+			// content is always transmitted as string
+			b.WriteString("\n :content " + quote(param.value))
+		} else {
+			b.WriteString("\n :" + param.name + " " + marshalWord(param.value))
+		}
+	}
+	if !msg.ReplyBy.IsZero() {
+		b.WriteString("\n :reply-by " + FormatDate(msg.ReplyBy))
+	}
+	b.WriteString(" )")
+	return b.String()
+}
+
+// marshalAID returns the expression of an agent identifier
+func marshalAID(aid AID) string {
+	ret := "(agent-identifier :name " + marshalWord(aid.Name)
+	if len(aid.Addresses) > 0 {
+		ret += " :addresses (sequence"
+		for _, addr := range aid.Addresses {
+			ret += " " + marshalWord(addr)
+		}
+		ret += ")"
+	}
+	return ret + ")"
+}
+
+// marshalAIDSet returns the expression of a set of agent identifiers
+func marshalAIDSet(aids []AID) string {
+	ret := "(set"
+	for _, aid := range aids {
+		ret += " " + marshalAID(aid)
+	}
+	return ret + ")"
+}
+
+// marshalWord returns s as word if possible and as string otherwise
+func marshalWord(s string) string {
+	if isWord(s) {
+		return s
+	}
+	return quote(s)
+}
+
+// isWord checks if s can be represented as word
+func isWord(s string) bool {
+	if s == "" || strings.ContainsAny(s[:1], "#0123456789-@") {
+		return false
+	}
+	for _, r := range s {
+		if r <= 0x20 || r == 0x7f || strings.ContainsRune("()\"", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// quote returns s as string literal
+func quote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// expr is an element of the string representation, either a token or a list of expressions
+type expr struct {
+	token  string
+	quoted bool // token was a string literal
+	list   []expr
+	isList bool
+}
+
+// Parse parses the string representation of a message
+func Parse(s string) (msg Message, err error) {
+	p := &parser{input: s}
+	var e expr
+	e, err = p.parseExpr()
+	if err != nil {
+		return
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		err = errors.New("unexpected input after message")
+		return
+	}
+	if !e.isList || len(e.list) == 0 || e.list[0].isList || e.list[0].quoted {
+		err = errors.New("message has to start with performative")
+		return
+	}
+	msg.Performative = strings.ToLower(e.list[0].token)
+	params, err := parseParams(e.list[1:])
+	if err != nil {
+		return
+	}
+	fields := map[string]*string{
+		"content":         &msg.Content,
+		"language":        &msg.Language,
+		"encoding":        &msg.Encoding,
+		"ontology":        &msg.Ontology,
+		"protocol":        &msg.Protocol,
+		"conversation-id": &msg.ConversationID,
+		"reply-with":      &msg.ReplyWith,
+		"in-reply-to":     &msg.InReplyTo,
+	}
+	for name, value := range params {
+		if field, ok := fields[name]; ok {
+			if value.isList {
+				err = errors.New("illegal value of parameter " + name)
+				return
+			}
+			*field = value.token
+			continue
+		}
+		// user defined parameters (X-...) are ignored
+		switch name {
+		case "sender":
+			msg.Sender, err = parseAID(value)
+		case "receiver":
+			msg.Receivers, err = parseAIDSet(value)
+		case "reply-to":
+			msg.ReplyTo, err = parseAIDSet(value)
+		case "reply-by":
+			msg.ReplyBy, err = ParseDate(value.token)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseParams returns the values of a list of parameters of the form :name value
+func parseParams(list []expr) (params map[string]expr, err error) {
+	params = make(map[string]expr)
+	if len(list)%2 != 0 {
+		err = errors.New("parameter without value")
+		return
+	}
+	for i := 0; i < len(list); i += 2 {
+		name := list[i]
+		if name.isList || name.quoted || !strings.HasPrefix(name.token, ":") {
+			err = errors.New("illegal parameter name")
+			return
+		}
+		params[strings.ToLower(name.token[1:])] = list[i+1]
+	}
+	return
+}
+
+// parseAID parses an agent identifier expression
+func parseAID(e expr) (aid AID, err error) {
+	if !e.isList || len(e.list) == 0 || strings.ToLower(e.list[0].token) != "agent-identifier" {
+		err = errors.New("illegal agent identifier")
+		return
+	}
+	params, err := parseParams(e.list[1:])
+	if err != nil {
+		return
+	}
+	name, ok := params["name"]
+	if !ok || name.isList {
+		err = errors.New("agent identifier without name")
+		return
+	}
+	aid.Name = name.token
+	if addrs, ok := params["addresses"]; ok {
+		var values []expr
+		values, err = parseCollection(addrs, "sequence")
+		if err != nil {
+			return
+		}
+		for i := range values {
+			if values[i].isList {
+				err = errors.New("illegal address")
+				return
+			}
+			aid.Addresses = append(aid.Addresses, values[i].token)
+		}
+	}
+	return
+}
+
+// parseAIDSet parses a set of agent identifiers
+func parseAIDSet(e expr) (aids []AID, err error) {
+	values, err := parseCollection(e, "set")
+	if err != nil {
+		return
+	}
+	for i := range values {
+		var aid AID
+		aid, err = parseAID(values[i])
+		if err != nil {
+			return
+		}
+		aids = append(aids, aid)
+	}
+	return
+}
+
+// parseCollection returns the elements of a set or sequence expression
+func parseCollection(e expr, kind string) (values []expr, err error) {
+	if !e.isList || len(e.list) == 0 || strings.ToLower(e.list[0].token) != kind {
+		err = errors.New("expected " + kind)
+		return
+	}
+	values = e.list[1:]
+	return
+}
+
+// maxDepth is the maximum nesting depth of expressions accepted by the parser
+const maxDepth = 64
+
+// parser splits the string representation into expressions
+type parser struct {
+	input string
+	pos   int
+	depth int // nesting depth of the current expression
+}
+
+// skipSpace advances the position to the next non whitespace character
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// parseExpr parses the next expression
+func (p *parser) parseExpr() (e expr, err error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		err = errors.New("unexpected end of message")
+		return
+	}
+	switch c := p.input[p.pos]; {
+	case c == '(':
+		if p.depth >= maxDepth {
+			err = errors.New("expressions nested too deeply")
+			return
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		p.pos++
+		e.isList = true
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.input) {
+				err = errors.New("missing closing parenthesis")
+				return
+			}
+			if p.input[p.pos] == ')' {
+				p.pos++
+				return
+			}
+			var elem expr
+			elem, err = p.parseExpr()
+			if err != nil {
+				return
+			}
+			e.list = append(e.list, elem)
+		}
+	case c == ')':
+		err = errors.New("unexpected closing parenthesis")
+	case c == '"':
+		e.token, err = p.parseString()
+		e.quoted = true
+	case c == '#':
+		e.token, err = p.parseByteString()
+		e.quoted = true
+	default:
+		start := p.pos
+		for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) &&
+			p.input[p.pos] != '(' && p.input[p.pos] != ')' {
+			p.pos++
+		}
+		e.token = p.input[start:p.pos]
+	}
+	return
+}
+
+// parseString parses a string literal with escaped quotes
+func (p *parser) parseString() (s string, err error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		c := p.input[p.pos]
+		switch c {
+		case '\\':
+			if p.pos+1 < len(p.input) {
+				p.pos++
+				c = p.input[p.pos]
+			}
+		case '"':
+			p.pos++
+			s = b.String()
+			return
+		}
+		b.WriteByte(c)
+	}
+	err = errors.New("unterminated string")
+	return
+}
+
+// parseByteString parses a byte length encoded string of the form #<length>"<bytes>
+func (p *parser) parseByteString() (s string, err error) {
+	end := strings.IndexByte(p.input[p.pos:], '"')
+	if end < 0 {
+		err = errors.New("illegal byte length encoded string")
+		return
+	}
+	start := p.pos + end + 1
+	length, err := strconv.Atoi(p.input[p.pos+1 : p.pos+end])
+	if err != nil || length < 0 || length > len(p.input)-start {
+		err = errors.New("illegal byte length encoded string")
+		return
+	}
+	s = p.input[start : start+length]
+	p.pos = start + length
+	return
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package fipaacl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringRepresentation(t *testing.T) {
+	msg := Message{
+		Performative: "request",
+		Sender:       AID{Name: "ping@jade", Addresses: []string{"http://host:7778/acc"}},
+		Receivers: []AID{{Name: "agent-1.mas-0@clonemap"},
+			{Name: "agent-2.mas-0@clonemap"}},
+		ReplyTo:        []AID{{Name: "other@jade"}},
+		Content:        "((action (agent-identifier :name b) \"quoted\" \\ ))",
+		Language:       "fipa-sl",
+		Ontology:       "market ontology",
+		Protocol:       "fipa-request",
+		ConversationID: "C123_456",
+		ReplyWith:      "R123",
+		InReplyTo:      "7",
+		ReplyBy:        time.Date(2021, time.March, 1, 12, 30, 15, 250000000, time.UTC),
+	}
+	ret, err := Parse(Marshal(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, ret) {
+		t.Errorf("wrong message after parsing: %v", ret)
+	}
+
+	// message as sent by JADE with byte length encoded content and user defined parameter
+	jade := `(INFORM
+ :sender  ( agent-identifier :name "pong@192.168.0.1:1099/JADE"  :addresses (sequence http://pc:7778/acc ))
+ :receiver  (set ( agent-identifier :name agent-3.mas-1@clonemap ) )
+ :content  #5"hello
+ :X-JADE-agent-classname  PongAgent
+ :reply-by 20210301T123015250
+ :conversation-id  C1 )`
+	ret, err = Parse(jade)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Performative != "inform" || ret.Sender.Name != "pong@192.168.0.1:1099/JADE" ||
+		len(ret.Sender.Addresses) != 1 || len(ret.Receivers) != 1 ||
+		ret.Receivers[0].Name != "agent-3.mas-1@clonemap" || ret.Content != "hello" ||
+		ret.ConversationID != "C1" || !ret.ReplyBy.Equal(msg.ReplyBy) {
+		t.Errorf("wrong message after parsing: %v", ret)
+	}
+
+	for _, illegal := range []string{"", "(inform", "inform", "(inform :content)",
+		"(inform :sender x)", "(inform :content \"open)", "(inform) x",
+		"(inform :content #9223372036854775807\"abc)",
+		"(inform :sender " + strings.Repeat("(", 100000)} {
+		if _, err = Parse(illegal); err == nil {
+			t.Error("Expected error for ", illegal)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	msg := Message{
+		Performative: "inform",
+		Sender:       AID{Name: "agent-0.mas-0@clonemap", Addresses: []string{"http://gw/acc"}},
+		Receivers:    []AID{{Name: "pong@jade", Addresses: []string{"http://host:7778/acc"}}},
+		Content:      "hello",
+	}
+	env := Envelope{
+		To:   msg.Receivers,
+		From: msg.Sender,
+		Date: time.Date(2021, time.March, 1, 12, 30, 15, 0, time.UTC),
+	}
+	body, contentType, err := MarshalHTTP(env, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retEnv, retMsg, err := ParseHTTP(body, contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.ACLRepresentation = RepresentationString
+	env.PayloadLength = len(Marshal(msg))
+	if !reflect.DeepEqual(env, retEnv) {
+		t.Errorf("wrong envelope after parsing: %v", retEnv)
+	}
+	if !reflect.DeepEqual(msg, retMsg) {
+		t.Errorf("wrong message after parsing: %v", retMsg)
+	}
+
+	// later parameter sets override earlier ones
+	retEnv, err = ParseEnvelope([]byte(`<?xml version="1.0"?><envelope>
+<params index="1"><to><agent-identifier><name>a@p</name></agent-identifier></to>
+<acl-representation>fipa.acl.rep.string.std</acl-representation></params>
+<params index="2"><intended-receiver><agent-identifier><name>b@p</name>
+</agent-identifier></intended-receiver></params></envelope>`))
+	if err != nil || len(retEnv.To) != 1 || retEnv.To[0].Name != "a@p" ||
+		len(retEnv.IntendedReceivers) != 1 || retEnv.IntendedReceivers[0].Name != "b@p" {
+		t.Errorf("wrong envelope after parsing: %v %v", retEnv, err)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package fipaacl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// content types and representations of the HTTP message transport protocol
+const (
+	ContentTypeEnvelope  = "application/xml"
+	ContentTypeMessage   = "application/text"
+	RepresentationString = "fipa.acl.rep.string.std"
+)
+
+// Envelope is the transport envelope of a message
+type Envelope struct {
+	To                []AID
+	From              AID
+	ACLRepresentation string
+	PayloadLength     int
+	PayloadEncoding   string
+	Date              time.Time
+	IntendedReceivers []AID // receivers this copy of the message is to be delivered to
+}
+
+// xmlEnvelope is the XML representation of an envelope (FIPA SC00085)
+type xmlEnvelope struct {
+	XMLName xml.Name    `xml:"envelope"`
+	Params  []xmlParams `xml:"params"`
+}
+
+// xmlParams is one set of envelope parameters. Parameters of sets with higher index override
+// the ones with lower index
+type xmlParams struct {
+	Index             int      `xml:"index,attr"`
+	To                []xmlAID `xml:"to>agent-identifier"`
+	From              *xmlAID  `xml:"from>agent-identifier"`
+	ACLRepresentation string   `xml:"acl-representation,omitempty"`
+	PayloadLength     string   `xml:"payload-length,omitempty"`
+	PayloadEncoding   string   `xml:"payload-encoding,omitempty"`
+	Date              string   `xml:"date,omitempty"`
+	IntendedReceiver  []xmlAID `xml:"intended-receiver>agent-identifier"`
+}
+
+// xmlAID is the XML representation of an agent identifier
+type xmlAID struct {
+	Name      string   `xml:"name"`
+	Addresses []string `xml:"addresses>url"`
+}
+
+// MarshalEnvelope returns the XML representation of env
+func MarshalEnvelope(env Envelope) (data []byte, err error) {
+	params := xmlParams{
+		Index:             1,
+		To:                toXMLAIDs(env.To),
+		ACLRepresentation: env.ACLRepresentation,
+		PayloadEncoding:   env.PayloadEncoding,
+		IntendedReceiver:  toXMLAIDs(env.IntendedReceivers),
+	}
+	if env.From.Name != "" {
+		params.From = &xmlAID{Name: env.From.Name, Addresses: env.From.Addresses}
+	}
+	if env.PayloadLength > 0 {
+		params.PayloadLength = strconv.Itoa(env.PayloadLength)
+	}
+	if !env.Date.IsZero() {
+		params.Date = FormatDate(env.Date)
+	}
+	data, err = xml.Marshal(xmlEnvelope{Params: []xmlParams{params}})
+	if err != nil {
+		return
+	}
+	data = append([]byte(xml.Header), data...)
+	return
+}
+
+// ParseEnvelope parses the XML representation of an envelope
+func ParseEnvelope(data []byte) (env Envelope, err error) {
+	var xmlEnv xmlEnvelope
+	err = xml.Unmarshal(data, &xmlEnv)
+	if err != nil {
+		return
+	}
+	if len(xmlEnv.Params) == 0 {
+		err = errors.New("envelope without parameters")
+		return
+	}
+	sort.SliceStable(xmlEnv.Params, func(i, j int) bool {
+		return xmlEnv.Params[i].Index < xmlEnv.Params[j].Index
+	})
+	for _, params := range xmlEnv.Params {
+		if len(params.To) > 0 {
+			env.To = fromXMLAIDs(params.To)
+		}
+		if params.From != nil {
+			env.From = AID{Name: params.From.Name, Addresses: params.From.Addresses}
+		}
+		if params.ACLRepresentation != "" {
+			env.ACLRepresentation = params.ACLRepresentation
+		}
+		if params.PayloadLength != "" {
+			env.PayloadLength, err = strconv.Atoi(strings.TrimSpace(params.PayloadLength))
+			if err != nil {
+				return
+			}
+		}
+		if params.PayloadEncoding != "" {
+			env.PayloadEncoding = params.PayloadEncoding
+		}
+		if params.Date != "" {
+			env.Date, err = ParseDate(strings.TrimSpace(params.Date))
+			if err != nil {
+				return
+			}
+		}
+		if len(params.IntendedReceiver) > 0 {
+			env.IntendedReceivers = fromXMLAIDs(params.IntendedReceiver)
+		}
+	}
+	return
+}
+
+// toXMLAIDs converts agent identifiers to their XML representation
+func toXMLAIDs(aids []AID) (ret []xmlAID) {
+	for _, aid := range aids {
+		ret = append(ret, xmlAID{Name: aid.Name, Addresses: aid.Addresses})
+	}
+	return
+}
+
+// fromXMLAIDs converts agent identifiers from their XML representation
+func fromXMLAIDs(aids []xmlAID) (ret []AID) {
+	for _, aid := range aids {
+		ret = append(ret, AID{Name: strings.TrimSpace(aid.Name), Addresses: aid.Addresses})
+	}
+	return
+}
+
+// MarshalHTTP returns the multipart body of an HTTP request that transports msg with the
+// envelope env and its content type. Representation, payload length and date of the envelope are
+// set if missing
+func MarshalHTTP(env Envelope, msg Message) (body []byte, contentType string, err error) {
+	payload := []byte(Marshal(msg))
+	if env.ACLRepresentation == "" {
+		env.ACLRepresentation = RepresentationString
+	}
+	if env.PayloadLength == 0 {
+		env.PayloadLength = len(payload)
+	}
+	if env.Date.IsZero() {
+		env.Date = time.Now()
+	}
+	envData, err := MarshalEnvelope(env)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	parts := []struct {
+		contentType string
+		data        []byte
+	}{{ContentTypeEnvelope, envData}, {ContentTypeMessage, payload}}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		var pw io.Writer
+		pw, err = w.CreatePart(header)
+		if err != nil {
+			return
+		}
+		_, err = pw.Write(part.data)
+		if err != nil {
+			return
+		}
+	}
+	err = w.Close()
+	body = buf.Bytes()
+	contentType = "multipart/mixed; boundary=\"" + w.Boundary() + "\""
+	return
+}
+
+// ParseHTTP parses the multipart body of an HTTP request of the message transport protocol
+func ParseHTTP(body []byte, contentType string) (env Envelope, msg Message, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		err = errors.New("expected multipart body")
+		return
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var envData, payload []byte
+	for envData == nil || payload == nil {
+		var part *multipart.Part
+		part, err = r.NextPart()
+		if err != nil {
+			err = errors.New("envelope or message missing")
+			return
+		}
+		var data []byte
+		data, err = ioutil.ReadAll(part)
+		if err != nil {
+			return
+		}
+		if strings.Contains(part.Header.Get("Content-Type"), "xml") && envData == nil {
+			envData = data
+		} else {
+			payload = data
+		}
+	}
+	env, err = ParseEnvelope(envData)
+	if err != nil {
+		return
+	}
+	if env.ACLRepresentation != "" && env.ACLRepresentation != RepresentationString {
+		err = errors.New("unsupported representation " + env.ACLRepresentation)
+		return
+	}
+	msg, err = Parse(string(payload))
+	return
+}
@@ -167,6 +167,23 @@ func InvalidBodyError(w http.ResponseWriter) (err error) {
 	return
 }
 
+// UnsupportedMediaTypeError writes standard response for Unsupported Media Type Error
+func UnsupportedMediaTypeError(w http.ResponseWriter) (err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	_, err = w.Write([]byte("Unsupported Media Type"))
+	return
+}
+
+// UpgradeRequiredError writes standard response for Upgrade Required Error
+func UpgradeRequiredError(w http.ResponseWriter, protocol string) (err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Upgrade", protocol)
+	w.WriteHeader(http.StatusUpgradeRequired)
+	_, err = w.Write([]byte("Upgrade Required"))
+	return
+}
+
 // CMAPError writes standard response for cloneMAP Error
 func CMAPError(w http.ResponseWriter, description string) (err error) {
 	w.Header().Set("Content-Type", "text/plain")
@@ -188,6 +205,15 @@ func CMAPError(w http.ResponseWriter, description string) (err error) {
 	return
 }
 
+// ConflictError writes standard response for a request that conflicts with a concurrent
+// modification of the resource
+func ConflictError(w http.ResponseWriter) (err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusConflict)
+	_, err = w.Write([]byte("Conflict"))
+	return
+}
+
 // NotFoundError writes standard response for Resource not found Error
 func NotFoundError(w http.ResponseWriter) (err error) {
 	w.Header().Set("Content-Type", "text/plain")
@@ -47,6 +47,7 @@ package httpretry
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	//"fmt"
@@ -100,6 +101,43 @@ func Post(client *http.Client, url string, contentType string, content []byte,
 	return
 }
 
+// PostHeader sends a post request with additional header fields and retries in case of an error
+func PostHeader(client *http.Client, url string, header http.Header, content []byte,
+	delay time.Duration, numRetries int) (body []byte, httpStatus int, err error) {
+	var resp *http.Response
+	resp, err = doPost(client, url, header, content)
+	if err != nil {
+		for i := 0; i <= numRetries; i++ {
+			time.Sleep(delay)
+			resp, err = doPost(client, url, header, content)
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		httpStatus = resp.StatusCode
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	return
+}
+
+// doPost sends one post request with the given header fields
+func doPost(client *http.Client, url string, header http.Header, content []byte) (resp *http.Response,
+	err error) {
+	var req *http.Request
+	req, err = http.NewRequest("POST", url, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	resp, err = client.Do(req)
+	return
+}
+
 //Get sends a get request and retries in case of an error
 func Get(client *http.Client, url string, delay time.Duration, numRetries int) (body []byte,
 	httpStatus int, err error) {
@@ -192,3 +230,41 @@ func Put(client *http.Client, url string, content []byte, delay time.Duration,
 	}
 	return
 }
+
+// DoContext sends a request with the given method and retries in case of an error. The request
+// and the delay between retries are aborted when ctx is done
+func DoContext(ctx context.Context, client *http.Client, method string, url string,
+	header http.Header, content []byte, delay time.Duration, numRetries int) (body []byte,
+	httpStatus int, err error) {
+	var resp *http.Response
+	for i := 0; i <= numRetries+1; i++ {
+		if i > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				err = ctx.Err()
+				return
+			}
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
+		if err != nil {
+			return
+		}
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		resp, err = client.Do(req)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err == nil {
+		httpStatus = resp.StatusCode
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	return
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package metrics provides counters, gauges and histograms that are exposed in the Prometheus
+// text format
+
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default upper bounds of histogram buckets in seconds
+var DefBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Registry holds all metric families that are exposed together
+type Registry struct {
+	mutex    *sync.Mutex
+	families []*family
+}
+
+// family is a metric with all its label combinations
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64 // upper bounds of histogram buckets
+	mutex   *sync.Mutex
+	series  map[string]*series
+}
+
+// series is a single time series of a family
+type series struct {
+	labelValues []string
+	value       float64  // value of counter or gauge
+	counts      []uint64 // observations per histogram bucket
+	sum         float64  // sum of histogram observations
+	count       uint64   // number of histogram observations
+}
+
+// Counter is a monotonically increasing value per label combination
+type Counter struct {
+	fam *family
+}
+
+// Gauge is a value per label combination that can go up and down
+type Gauge struct {
+	fam *family
+}
+
+// Histogram counts observations per label combination in configurable buckets
+type Histogram struct {
+	fam *family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() (reg *Registry) {
+	reg = &Registry{mutex: &sync.Mutex{}}
+	return
+}
+
+// NewCounter registers a new counter with the given label names
+func (reg *Registry) NewCounter(name string, help string, labels ...string) (c *Counter) {
+	c = &Counter{fam: reg.register(name, help, "counter", nil, labels)}
+	return
+}
+
+// NewGauge registers a new gauge with the given label names
+func (reg *Registry) NewGauge(name string, help string, labels ...string) (g *Gauge) {
+	g = &Gauge{fam: reg.register(name, help, "gauge", nil, labels)}
+	return
+}
+
+// NewHistogram registers a new histogram with the given bucket upper bounds and label names.
+// DefBuckets are used if buckets is empty
+func (reg *Registry) NewHistogram(name string, help string, buckets []float64,
+	labels ...string) (h *Histogram) {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	h = &Histogram{fam: reg.register(name, help, "histogram", b, labels)}
+	return
+}
+
+// register adds a new family to the registry
+func (reg *Registry) register(name string, help string, typ string, buckets []float64,
+	labels []string) (fam *family) {
+	fam = &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		mutex:   &sync.Mutex{},
+		series:  make(map[string]*series),
+	}
+	reg.mutex.Lock()
+	reg.families = append(reg.families, fam)
+	reg.mutex.Unlock()
+	return
+}
+
+// get returns the series for the label values and creates it if necessary. The family mutex
+// has to be locked. nil is returned if the number of label values does not match
+func (fam *family) get(labelValues []string) (s *series) {
+	if len(labelValues) != len(fam.labels) {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := fam.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if fam.buckets != nil {
+			s.counts = make([]uint64, len(fam.buckets))
+		}
+		fam.series[key] = s
+	}
+	return
+}
+
+// Inc increments the counter for the label values by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values. Negative values are ignored
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.fam.mutex.Lock()
+	if s := c.fam.get(labelValues); s != nil {
+		s.value += v
+	}
+	c.fam.mutex.Unlock()
+}
+
+// Set sets the gauge for the label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.fam.mutex.Lock()
+	if s := g.fam.get(labelValues); s != nil {
+		s.value = v
+	}
+	g.fam.mutex.Unlock()
+}
+
+// Add adds v to the gauge for the label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	if g == nil {
+		return
+	}
+	g.fam.mutex.Lock()
+	if s := g.fam.get(labelValues); s != nil {
+		s.value += v
+	}
+	g.fam.mutex.Unlock()
+}
+
+// Reset removes all label combinations of the gauge
+func (g *Gauge) Reset() {
+	if g == nil {
+		return
+	}
+	g.fam.mutex.Lock()
+	g.fam.series = make(map[string]*series)
+	g.fam.mutex.Unlock()
+}
+
+// Observe adds an observation to the histogram for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	h.fam.mutex.Lock()
+	if s := h.fam.get(labelValues); s != nil {
+		i := sort.SearchFloat64s(h.fam.buckets, v)
+		if i < len(s.counts) {
+			s.counts[i]++
+		}
+		s.sum += v
+		s.count++
+	}
+	h.fam.mutex.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text format to w. Series of a family are
+// ordered by their label values
+func (reg *Registry) WriteText(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	reg.mutex.Lock()
+	families := append([]*family(nil), reg.families...)
+	reg.mutex.Unlock()
+	for _, fam := range families {
+		fam.write(bw)
+	}
+	err = bw.Flush()
+	return
+}
+
+// write writes the family to w
+func (fam *family) write(w *bufio.Writer) {
+	fam.mutex.Lock()
+	defer fam.mutex.Unlock()
+	w.WriteString("# HELP " + fam.name + " " + escapeHelp(fam.help) + "\n")
+	w.WriteString("# TYPE " + fam.name + " " + fam.typ + "\n")
+	keys := make([]string, 0, len(fam.series))
+	for k := range fam.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := fam.series[k]
+		if fam.typ != "histogram" {
+			w.WriteString(fam.name + fam.labelString(s.labelValues, "") + " " +
+				formatFloat(s.value) + "\n")
+			continue
+		}
+		var cum uint64
+		for i, b := range fam.buckets {
+			cum += s.counts[i]
+			w.WriteString(fam.name + "_bucket" + fam.labelString(s.labelValues, formatFloat(b)) +
+				" " + strconv.FormatUint(cum, 10) + "\n")
+		}
+		w.WriteString(fam.name + "_bucket" + fam.labelString(s.labelValues, "+Inf") + " " +
+			strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString(fam.name + "_sum" + fam.labelString(s.labelValues, "") + " " +
+			formatFloat(s.sum) + "\n")
+		w.WriteString(fam.name + "_count" + fam.labelString(s.labelValues, "") + " " +
+			strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// labelString returns the label set of a sample. The le label of histogram buckets is added if
+// le is not empty
+func (fam *family) labelString(labelValues []string, le string) (ret string) {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i := range labelValues {
+		pairs = append(pairs, fam.labels[i]+"=\""+escapeLabel(labelValues[i])+"\"")
+	}
+	if le != "" {
+		pairs = append(pairs, "le=\""+le+"\"")
+	}
+	if len(pairs) > 0 {
+		ret = "{" + strings.Join(pairs, ",") + "}"
+	}
+	return
+}
+
+// formatFloat formats a sample value
+func formatFloat(v float64) (ret string) {
+	switch {
+	case math.IsInf(v, 1):
+		ret = "+Inf"
+	case math.IsInf(v, -1):
+		ret = "-Inf"
+	case math.IsNaN(v):
+		ret = "NaN"
+	default:
+		ret = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return
+}
+
+// escapeHelp escapes backslashes and line feeds in help texts
+func escapeHelp(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(s)
+}
+
+// escapeLabel escapes backslashes, double quotes and line feeds in label values
+func escapeLabel(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s)
+}
+
+// ParseText parses samples in the Prometheus text format as written by WriteText. The samples
+// are returned with the metric name and label set as key, e.g. name{a="1",b="2"}
+func ParseText(r io.Reader) (samples map[string]float64, err error) {
+	samples = make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			err = errors.New("invalid sample: " + line)
+			return
+		}
+		var v float64
+		v, err = strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return
+		}
+		samples[line[:i]] = v
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestRegistry tests the text format written by the registry
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	cnt := reg.NewCounter("test_msgs_total", "Number of messages.", "agent")
+	gauge := reg.NewGauge("test_depth", "Depth of inbox.")
+	hist := reg.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1}, "prot")
+	cnt.Inc("2")
+	cnt.Add(2, "2")
+	cnt.Inc("1")
+	cnt.Add(-1, "1")
+	cnt.Inc("1", "too many")
+	gauge.Set(5)
+	hist.Observe(0.05, "a\"b")
+	hist.Observe(0.5, "a\"b")
+	hist.Observe(3, "a\"b")
+
+	var buf bytes.Buffer
+	err := reg.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `# HELP test_msgs_total Number of messages.
+# TYPE test_msgs_total counter
+test_msgs_total{agent="1"} 1
+test_msgs_total{agent="2"} 3
+# HELP test_depth Depth of inbox.
+# TYPE test_depth gauge
+test_depth 5
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{prot="a\"b",le="0.1"} 1
+test_duration_seconds_bucket{prot="a\"b",le="1"} 2
+test_duration_seconds_bucket{prot="a\"b",le="+Inf"} 3
+test_duration_seconds_sum{prot="a\"b"} 3.55
+test_duration_seconds_count{prot="a\"b"} 3
+`
+	if buf.String() != exp {
+		t.Errorf("wrong text format:\n%s", buf.String())
+	}
+
+	samples, err := ParseText(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 8 || samples[`test_msgs_total{agent="2"}`] != 3 ||
+		samples[`test_duration_seconds_bucket{prot="a\"b",le="+Inf"}`] != 3 {
+		t.Errorf("wrong parsed samples %v", samples)
+	}
+
+	gauge.Reset()
+	buf.Reset()
+	reg.WriteText(&buf)
+	if strings.Contains(buf.String(), "test_depth 5") {
+		t.Error("gauge not reset")
+	}
+}
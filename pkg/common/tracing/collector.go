@@ -0,0 +1,155 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// collector that receives spans via OTLP/HTTP and keeps them in memory. It can be used in place
+// of an OpenTelemetry collector in tests and without network access
+
+package tracing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// Collector is an in-memory OTLP/HTTP trace collector listening on the loopback interface
+type Collector struct {
+	server   *httptest.Server
+	spans    []schemas.Span
+	received chan struct{} // signals new spans to waiting callers
+	mutex    *sync.Mutex
+}
+
+// NewCollector starts a new collector
+func NewCollector() (col *Collector) {
+	col = &Collector{
+		received: make(chan struct{}, 1),
+		mutex:    &sync.Mutex{},
+	}
+	col.server = httptest.NewServer(col)
+	return
+}
+
+// URL returns the endpoint spans are to be exported to
+func (col *Collector) URL() string {
+	return col.server.URL + "/v1/traces"
+}
+
+// ServeHTTP handles OTLP export requests
+func (col *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	spans, err := UnmarshalOTLP(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	col.mutex.Lock()
+	col.spans = append(col.spans, spans...)
+	col.mutex.Unlock()
+	select {
+	case col.received <- struct{}{}:
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+// Spans returns all spans received so far
+func (col *Collector) Spans() (spans []schemas.Span) {
+	col.mutex.Lock()
+	spans = make([]schemas.Span, len(col.spans))
+	copy(spans, col.spans)
+	col.mutex.Unlock()
+	return
+}
+
+// Trace returns all spans received so far that belong to the given trace
+func (col *Collector) Trace(traceID string) (spans []schemas.Span) {
+	col.mutex.Lock()
+	for i := range col.spans {
+		if col.spans[i].TraceID == traceID {
+			spans = append(spans, col.spans[i])
+		}
+	}
+	col.mutex.Unlock()
+	return
+}
+
+// WaitSpans waits until at least num spans have been received or the timeout expires. The
+// spans received so far are returned together with false in case of a timeout
+func (col *Collector) WaitSpans(num int, timeout time.Duration) (spans []schemas.Span,
+	ok bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		spans = col.Spans()
+		if len(spans) >= num {
+			ok = true
+			return
+		}
+		select {
+		case <-col.received:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Close shuts the collector down
+func (col *Collector) Close() {
+	col.server.Close()
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// export of spans in the JSON encoding of the OpenTelemetry protocol (OTLP/HTTP)
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/httpretry"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// names of the attributes that carry clonemap specific span fields
+const (
+	attrService = "service.name"
+	attrMAS     = "clonemap.mas.id"
+	attrAgency  = "clonemap.agency"
+	attrAgent   = "clonemap.agent.id"
+)
+
+// status codes of OTLP spans
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector via OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	url        string
+	httpClient *http.Client
+	delay      time.Duration
+	numRetries int
+}
+
+// NewOTLPExporter creates an exporter for the collector endpoint url, e.g.
+// http://otel-collector:4318/v1/traces
+func NewOTLPExporter(url string, timeout time.Duration, del time.Duration,
+	numRet int) (exp *OTLPExporter) {
+	exp = &OTLPExporter{
+		url:        url,
+		httpClient: &http.Client{Timeout: timeout},
+		delay:      del,
+		numRetries: numRet,
+	}
+	return
+}
+
+// ExportSpans sends spans to the collector
+func (exp *OTLPExporter) ExportSpans(spans []schemas.Span) (err error) {
+	js, err := MarshalOTLP(spans)
+	if err != nil {
+		return
+	}
+	_, httpStatus, err := httpretry.Post(exp.httpClient, exp.url, "application/json", js,
+		exp.delay, exp.numRetries)
+	if err == nil && httpStatus != http.StatusOK {
+		err = errors.New("collector returned status " + strconv.Itoa(httpStatus))
+	}
+	return
+}
+
+// otlpTraces is the body of an OTLP export request
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// MarshalOTLP encodes spans as OTLP export request. Spans are grouped by MAS and agency which
+// form the resource of the spans
+func MarshalOTLP(spans []schemas.Span) (js []byte, err error) {
+	var req otlpTraces
+	index := make(map[string]int)
+	for i := range spans {
+		key := strconv.Itoa(spans[i].MASID) + "/" + spans[i].Agency
+		res, ok := index[key]
+		if !ok {
+			res = len(req.ResourceSpans)
+			index[key] = res
+			req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: []otlpAttribute{
+					stringAttribute(attrService, "clonemap"),
+					stringAttribute(attrMAS, strconv.Itoa(spans[i].MASID)),
+					stringAttribute(attrAgency, spans[i].Agency),
+				}},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "clonemap"}}},
+			})
+		}
+		span := otlpSpan{
+			TraceID:           spans[i].TraceID,
+			SpanID:            spans[i].SpanID,
+			ParentSpanID:      spans[i].ParentSpanID,
+			Name:              spans[i].Name,
+			Kind:              spans[i].Kind,
+			StartTimeUnixNano: strconv.FormatInt(spans[i].Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(spans[i].End.UnixNano(), 10),
+			Attributes: []otlpAttribute{stringAttribute(attrAgent,
+				strconv.Itoa(spans[i].AgentID))},
+		}
+		for key, value := range spans[i].Attributes {
+			span.Attributes = append(span.Attributes, stringAttribute(key, value))
+		}
+		if spans[i].Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: spans[i].Error}
+		}
+		scope := &req.ResourceSpans[res].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, span)
+	}
+	js, err = json.Marshal(req)
+	return
+}
+
+// UnmarshalOTLP decodes an OTLP export request with JSON encoding
+func UnmarshalOTLP(js []byte) (spans []schemas.Span, err error) {
+	var req otlpTraces
+	err = json.Unmarshal(js, &req)
+	if err != nil {
+		return
+	}
+	for _, res := range req.ResourceSpans {
+		var masID int
+		var agency string
+		for _, attr := range res.Resource.Attributes {
+			switch attr.Key {
+			case attrMAS:
+				masID, _ = strconv.Atoi(attr.Value.StringValue)
+			case attrAgency:
+				agency = attr.Value.StringValue
+			}
+		}
+		for _, scope := range res.ScopeSpans {
+			for _, s := range scope.Spans {
+				span := schemas.Span{
+					TraceID:      s.TraceID,
+					SpanID:       s.SpanID,
+					ParentSpanID: s.ParentSpanID,
+					Name:         s.Name,
+					Kind:         s.Kind,
+					MASID:        masID,
+					Agency:       agency,
+					Start:        unixNano(s.StartTimeUnixNano),
+					End:          unixNano(s.EndTimeUnixNano),
+				}
+				if s.Status.Code == otlpStatusError {
+					span.Error = s.Status.Message
+				}
+				for _, attr := range s.Attributes {
+					if attr.Key == attrAgent {
+						span.AgentID, _ = strconv.Atoi(attr.Value.StringValue)
+						continue
+					}
+					if span.Attributes == nil {
+						span.Attributes = make(map[string]string)
+					}
+					span.Attributes[attr.Key] = attr.Value.StringValue
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return
+}
+
+// stringAttribute returns an attribute with string value
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// unixNano converts a decimal timestamp in nanoseconds to time
+func unixNano(s string) time.Time {
+	ns, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package tracing records spans of distributed message exchanges and exports them in batches.
+// Trace and span IDs follow the W3C trace context format so that spans can be processed by
+// OpenTelemetry collectors
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// batchSize is the maximum number of spans exported at once
+const batchSize = 100
+
+// exportInterval is the maximum time a span is buffered before it is exported
+const exportInterval = time.Second
+
+// Exporter sends spans to a collector
+type Exporter interface {
+	ExportSpans(spans []schemas.Span) error
+}
+
+// ExporterFunc is an adapter to use an ordinary function as Exporter
+type ExporterFunc func(spans []schemas.Span) error
+
+// ExportSpans calls f(spans)
+func (f ExporterFunc) ExportSpans(spans []schemas.Span) error {
+	return f(spans)
+}
+
+// Tracer records the spans of one agency and exports them in the background. All methods can
+// be called on a nil Tracer in which case no spans are recorded
+type Tracer struct {
+	masID    int
+	agency   string
+	exporter Exporter
+	spans    chan schemas.Span
+	flush    chan chan struct{}
+	quit     chan struct{} // closed by Close
+	stopped  chan struct{} // closed when the export has been stopped
+	mutex    *sync.Mutex
+	closed   bool
+	logError *log.Logger
+}
+
+// NewTracer creates a tracer for the given MAS and agency and starts exporting spans
+func NewTracer(masID int, agency string, exporter Exporter, logErr *log.Logger) (t *Tracer) {
+	t = &Tracer{
+		masID:    masID,
+		agency:   agency,
+		exporter: exporter,
+		spans:    make(chan schemas.Span, 10000),
+		flush:    make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		mutex:    &sync.Mutex{},
+		logError: logErr,
+	}
+	go t.export()
+	return
+}
+
+// NewTraceID returns a random trace ID
+func NewTraceID() string {
+	return randomID(16)
+}
+
+// NewSpanID returns a random span ID
+func NewSpanID() string {
+	return randomID(8)
+}
+
+// randomID returns n random bytes hex encoded
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start starts a new span of the given agent. The span is a child of the span parentID within
+// the trace traceID. A new trace is started if traceID is empty. nil is returned if t is nil
+func (t *Tracer) Start(name string, kind int, agentID int, traceID string,
+	parentID string) (span *schemas.Span) {
+	if t == nil {
+		return
+	}
+	if traceID == "" {
+		traceID = NewTraceID()
+		parentID = ""
+	}
+	span = &schemas.Span{
+		TraceID:      traceID,
+		SpanID:       NewSpanID(),
+		ParentSpanID: parentID,
+		Name:         name,
+		Kind:         kind,
+		MASID:        t.masID,
+		AgentID:      agentID,
+		Agency:       t.agency,
+		Start:        time.Now(),
+	}
+	return
+}
+
+// End ends the span and hands it over for export. err is recorded as error of the span if not
+// nil. Spans are dropped if the export buffer is full
+func (t *Tracer) End(span *schemas.Span, err error) {
+	if t == nil || span == nil {
+		return
+	}
+	span.End = time.Now()
+	if err != nil {
+		span.Error = err.Error()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- *span:
+	default:
+		t.logError.Println("Span buffer full; dropping span ", span.Name)
+	}
+}
+
+// Flush blocks until all spans ended so far have been exported
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+		<-done
+	case <-t.stopped:
+	}
+}
+
+// Close exports the remaining spans and stops the tracer. Spans ended afterwards are dropped
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.quit)
+	}
+	t.mutex.Unlock()
+	<-t.stopped
+}
+
+// export collects spans and exports them once a batch is full, the export interval has expired
+// or a flush is requested
+func (t *Tracer) export() {
+	var batch []schemas.Span
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	defer close(t.stopped)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.exporter.ExportSpans(batch)
+		if err != nil {
+			t.logError.Println("Export of ", len(batch), " spans failed: ", err)
+		}
+		batch = nil
+	}
+	drain := func() {
+		for pending := len(t.spans); pending > 0; pending-- {
+			batch = append(batch, <-t.spans)
+			if len(batch) >= batchSize {
+				send()
+			}
+		}
+		send()
+	}
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-t.flush:
+			drain()
+			close(done)
+		case <-t.quit:
+			drain()
+			return
+		}
+	}
+}
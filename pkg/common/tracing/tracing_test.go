@@ -0,0 +1,105 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package tracing
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// TestTracer tests the export of spans to the collector
+func TestTracer(t *testing.T) {
+	col := NewCollector()
+	defer col.Close()
+	tracer := NewTracer(3, "mas-3-im-0-agency-0", NewOTLPExporter(col.URL(), time.Second,
+		time.Millisecond*10, 1), log.New(ioutil.Discard, "", 0))
+
+	root := tracer.Start("root", schemas.SpanKindProducer, 7, "", "")
+	if len(root.TraceID) != 32 || len(root.SpanID) != 16 || root.ParentSpanID != "" {
+		t.Fatalf("wrong IDs of root span %+v", root)
+	}
+	child := tracer.Start("child", schemas.SpanKindConsumer, 8, root.TraceID, root.SpanID)
+	child.Attributes = map[string]string{"clonemap.msg.protocol": "1"}
+	tracer.End(child, errors.New("inbox full"))
+	tracer.End(root, nil)
+	tracer.Flush()
+
+	spans := col.Trace(root.TraceID)
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	ret := spans[0]
+	if ret.SpanID != child.SpanID || ret.ParentSpanID != root.SpanID || ret.Name != "child" ||
+		ret.Kind != schemas.SpanKindConsumer || ret.MASID != 3 || ret.AgentID != 8 ||
+		ret.Agency != "mas-3-im-0-agency-0" || ret.Error != "inbox full" ||
+		ret.Attributes["clonemap.msg.protocol"] != "1" || !ret.Start.Equal(child.Start) ||
+		!ret.End.Equal(child.End) {
+		t.Errorf("wrong span after export %+v", ret)
+	}
+	if spans[1].SpanID != root.SpanID || spans[1].Error != "" {
+		t.Errorf("wrong root span after export %+v", spans[1])
+	}
+
+	tracer.Close()
+	tracer.End(tracer.Start("late", schemas.SpanKindInternal, 7, "", ""), nil)
+	tracer.Flush()
+	if len(col.Spans()) != 2 {
+		t.Error("span exported after close")
+	}
+
+	// a nil tracer records nothing
+	var none *Tracer
+	if none.Start("none", schemas.SpanKindInternal, 1, "", "") != nil {
+		t.Error("nil tracer started span")
+	}
+	none.End(nil, nil)
+	none.Flush()
+	none.Close()
+}
@@ -49,6 +49,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -81,6 +82,18 @@ func StartDF() (err error) {
 	return
 }
 
+// NewLocalHandler returns the http handler of a DF with local storage. It is used to run all
+// modules of clonemap within one process
+func NewLocalHandler(logErr *log.Logger, logInf *log.Logger) (handler http.Handler) {
+	df := &DF{
+		stor:     newLocalStorage(),
+		logError: logErr,
+		logInfo:  logInf,
+	}
+	handler = df.server(12000).Handler
+	return
+}
+
 // init initializes the storage.
 func (df *DF) init() (err error) {
 	logType := os.Getenv("CLONEMAP_LOG_LEVEL")
@@ -0,0 +1,617 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package gateway implements the gateway between clonemap and other agent platforms like JADE.
+// Messages are exchanged with other platforms via the FIPA HTTP message transport protocol in
+// the FIPA-ACL string representation. Towards clonemap agencies the gateway behaves like an
+// agency that hosts all foreign agents.
+//
+// clonemap agents are identified by the name agent-{agentid}.mas-{masid}@{platform}. Foreign
+// agents are assigned negative IDs when they first send a message or when they are registered
+// via the REST API. clonemap agents address foreign agents with these IDs. IDs are assigned per
+// MAS and derived from the name of the foreign agent, so that they usually stay valid if the
+// gateway is restarted and the agent is registered again. Assignments are not persisted, though:
+// if the names of two agents map to the same ID, the ID each of them gets depends on the order of
+// registration. Foreign agents and non-numeric conversation tokens that have not been used for a
+// while are forgotten.
+package gateway
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/common/fipaacl"
+	"github.com/RWTH-ACS/clonemap/pkg/common/httpretry"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+const (
+	foreignAgentExpiry = time.Hour * 24 // time after which unused foreign agents are forgotten
+	tokenExpiry        = time.Hour      // time after which unused tokens are forgotten
+	expiryInterval     = time.Minute    // minimum time between two removals of expired entries
+)
+
+// Gateway translates messages between clonemap agencies and other agent platforms
+type Gateway struct {
+	name         string            // hostname under which agencies reach the gateway
+	platform     string            // platform name in identifiers of clonemap agents
+	address      string            // transport address of the gateway
+	mas          map[int]*masScope // foreign agents and tokens by MAS
+	mutex        *sync.Mutex       // mutex for foreign agents and tokens
+	expired      time.Time         // time of the last removal of expired foreign agents and tokens
+	amsClient    *client.AMSClient
+	agencyClient *client.AgencyClient
+	httpClient   *http.Client // client for the message transport of other platforms
+	logInfo      *log.Logger  // logger for info logging
+	logError     *log.Logger  // logger for error logging
+}
+
+// masScope contains the foreign agents and tokens known to the agents of one MAS
+type masScope struct {
+	foreign     map[int]schemas.ForeignAgent // foreign agents by ID
+	foreignIDs  map[string]int               // IDs of foreign agents by name
+	foreignUsed map[int]time.Time            // time of last use of foreign agents by ID
+	tokens      map[int]string               // non-numeric conversation IDs and reply-with tokens
+	tokenIDs    map[string]int               // IDs of non-numeric tokens
+	tokenUsed   map[int]time.Time            // time of last use of tokens by ID
+}
+
+// performatives maps the FIPA-ACL names of performatives to their clonemap representation
+var performatives = map[string]int{
+	"accept-proposal":  schemas.FIPAPerfAcceptProposal,
+	"agree":            schemas.FIPAPerfAgree,
+	"cancel":           schemas.FIPAPerfCancel,
+	"cfp":              schemas.FIPAPerfCallForProposal,
+	"confirm":          schemas.FIPAPerfConfirm,
+	"disconfirm":       schemas.FIPAPerfDisconfirm,
+	"failure":          schemas.FIPAPerfFailure,
+	"inform":           schemas.FIPAPerfInform,
+	"inform-if":        schemas.FIPAPerfInformIf,
+	"inform-ref":       schemas.FIPAPerfInformRef,
+	"not-understood":   schemas.FIPAPerfNotUnderstood,
+	"propagate":        schemas.FIPAPerfPropagate,
+	"propose":          schemas.FIPAPerfPropose,
+	"proxy":            schemas.FIPAPerfProxy,
+	"query-if":         schemas.FIPAPerfQueryIf,
+	"query-ref":        schemas.FIPAPerfQueryRef,
+	"refuse":           schemas.FIPAPerfRefuse,
+	"reject-proposal":  schemas.FIPAPerfRejectProposal,
+	"request":          schemas.FIPAPerfRequest,
+	"request-when":     schemas.FIPAPerfRequestWhen,
+	"request-whenever": schemas.FIPAPerfRequestWhenever,
+	"subscribe":        schemas.FIPAPerfSubscribe,
+}
+
+// protocols maps the FIPA names of interaction protocols to their clonemap representation
+var protocols = map[string]int{
+	"fipa-request":               schemas.FIPAProtRequest,
+	"fipa-query":                 schemas.FIPAProtQuery,
+	"fipa-request-when":          schemas.FIPAProtRequestWhen,
+	"fipa-contract-net":          schemas.FIPAProtContractNet,
+	"fipa-iterated-contract-net": schemas.FIPAProtIteratedContractNet,
+	"fipa-auction-english":       schemas.FIPAProtEnglishAuction,
+	"fipa-auction-dutch":         schemas.FIPAProtDutchAuction,
+	"fipa-brokering":             schemas.FIPAProtBrokering,
+	"fipa-recruiting":            schemas.FIPAProtRecruiting,
+	"fipa-subscribe":             schemas.FIPAProtSubscribe,
+	"fipa-propose":               schemas.FIPAProtPropose,
+}
+
+// StartGateway starts the gateway
+func StartGateway() (err error) {
+	gw := newGateway(log.New(os.Stderr, "[ERROR] ", log.LstdFlags), nil)
+	err = gw.init()
+	if err != nil {
+		gw.logError.Println(err)
+		return
+	}
+	serv := gw.server(10000)
+	err = gw.listen(serv)
+	if err != nil {
+		gw.logError.Println(err)
+	}
+	return
+}
+
+// newGateway creates a gateway with default configuration
+func newGateway(logErr *log.Logger, logInf *log.Logger) (gw *Gateway) {
+	gw = &Gateway{
+		name:         "gateway",
+		platform:     "clonemap",
+		address:      "http://gateway:10000/acc",
+		mas:          make(map[int]*masScope),
+		mutex:        &sync.Mutex{},
+		amsClient:    client.NewAMSClient(time.Second*60, time.Second*1, 4),
+		agencyClient: client.NewAgencyClient(time.Second*60, time.Second*1, 4),
+		httpClient:   &http.Client{Timeout: time.Second * 10},
+		logInfo:      logInf,
+		logError:     logErr,
+	}
+	return
+}
+
+// init reads the configuration from environment variables
+func (gw *Gateway) init() (err error) {
+	logType := os.Getenv("CLONEMAP_LOG_LEVEL")
+	switch logType {
+	case "info":
+		gw.logInfo = log.New(os.Stdout, "[INFO] ", log.LstdFlags)
+	case "error":
+		gw.logInfo = log.New(ioutil.Discard, "", log.LstdFlags)
+	default:
+		err = errors.New("Wrong log type: " + logType)
+		return
+	}
+	gw.logInfo.Println("Starting gateway")
+	gw.name, err = os.Hostname()
+	if err != nil {
+		return
+	}
+	if platform := os.Getenv("CLONEMAP_GATEWAY_PLATFORM"); platform != "" {
+		gw.platform = platform
+	}
+	gw.address = "http://" + gw.name + ":10000/acc"
+	if address := os.Getenv("CLONEMAP_GATEWAY_ADDRESS"); address != "" {
+		gw.address = address
+	}
+	return
+}
+
+// localAID returns the agent identifier of a clonemap agent
+func (gw *Gateway) localAID(masID int, agentID int) (aid fipaacl.AID) {
+	aid.Name = "agent-" + strconv.Itoa(agentID) + ".mas-" + strconv.Itoa(masID) + "@" +
+		gw.platform
+	aid.Addresses = []string{gw.address}
+	return
+}
+
+// localAgent returns the MAS and agent ID contained in the name of a clonemap agent. ok is false
+// if name does not identify a clonemap agent
+func (gw *Gateway) localAgent(name string) (masID int, agentID int, ok bool) {
+	if !strings.HasSuffix(name, "@"+gw.platform) {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(name, "@"+gw.platform), ".")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "agent-") ||
+		!strings.HasPrefix(parts[1], "mas-") {
+		return
+	}
+	agentID, errAgent := strconv.Atoi(strings.TrimPrefix(parts[0], "agent-"))
+	masID, errMAS := strconv.Atoi(strings.TrimPrefix(parts[1], "mas-"))
+	ok = errAgent == nil && errMAS == nil && agentID >= 0 && masID >= 0
+	return
+}
+
+// scope returns the foreign agents and tokens of a MAS. Expired entries of all MAS are removed
+// beforehand. gw.mutex has to be locked
+func (gw *Gateway) scope(masID int) (scope *masScope) {
+	now := time.Now()
+	if now.Sub(gw.expired) >= expiryInterval {
+		gw.expire(now)
+	}
+	scope, ok := gw.mas[masID]
+	if !ok {
+		scope = &masScope{
+			foreign:     make(map[int]schemas.ForeignAgent),
+			foreignIDs:  make(map[string]int),
+			foreignUsed: make(map[int]time.Time),
+			tokens:      make(map[int]string),
+			tokenIDs:    make(map[string]int),
+			tokenUsed:   make(map[int]time.Time),
+		}
+		gw.mas[masID] = scope
+	}
+	return
+}
+
+// expire removes the foreign agents and tokens that have not been used within their expiry time
+// and the MAS without any entries. gw.mutex has to be locked
+func (gw *Gateway) expire(now time.Time) {
+	gw.expired = now
+	for masID, scope := range gw.mas {
+		for id, used := range scope.foreignUsed {
+			if now.Sub(used) > foreignAgentExpiry {
+				delete(scope.foreignIDs, scope.foreign[id].Name)
+				delete(scope.foreign, id)
+				delete(scope.foreignUsed, id)
+			}
+		}
+		for id, used := range scope.tokenUsed {
+			if now.Sub(used) > tokenExpiry {
+				delete(scope.tokenIDs, scope.tokens[id])
+				delete(scope.tokens, id)
+				delete(scope.tokenUsed, id)
+			}
+		}
+		if len(scope.foreign) == 0 && len(scope.tokens) == 0 {
+			delete(gw.mas, masID)
+		}
+	}
+}
+
+// hashID returns a negative ID derived from s. The next lower ID is taken if the ID is already
+// assigned to another name, so that the ID of colliding names depends on the order of their
+// assignment. schemas.SystemAgentID is never returned
+func hashID(s string, assigned func(id int) bool) (id int) {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	id = -int(h.Sum32()%0x7fffffff) - 2
+	for assigned(id) {
+		if id == -0x80000000 {
+			id = -2
+		} else {
+			id--
+		}
+	}
+	return
+}
+
+// registerForeignAgent returns the foreign agent with the name of aid in the given MAS and
+// assigns a new ID if it is not known yet. Known addresses are replaced by the ones of aid if any
+func (gw *Gateway) registerForeignAgent(masID int, aid fipaacl.AID) (agent schemas.ForeignAgent,
+	err error) {
+	if aid.Name == "" {
+		err = errors.New("agent identifier without name")
+		return
+	}
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	scope := gw.scope(masID)
+	id, ok := scope.foreignIDs[aid.Name]
+	if !ok {
+		id = hashID(aid.Name, func(id int) bool {
+			_, ok := scope.foreign[id]
+			return ok
+		})
+		scope.foreignIDs[aid.Name] = id
+	}
+	agent = scope.foreign[id]
+	agent.ID = id
+	agent.Name = aid.Name
+	if len(aid.Addresses) > 0 {
+		agent.Addresses = aid.Addresses
+	}
+	scope.foreign[id] = agent
+	scope.foreignUsed[id] = time.Now()
+	return
+}
+
+// getForeignAgents returns all foreign agents known in a MAS
+func (gw *Gateway) getForeignAgents(masID int) (agents []schemas.ForeignAgent) {
+	gw.mutex.Lock()
+	scope := gw.scope(masID)
+	agents = make([]schemas.ForeignAgent, 0, len(scope.foreign))
+	for _, agent := range scope.foreign {
+		agents = append(agents, agent)
+	}
+	gw.mutex.Unlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID > agents[j].ID })
+	return
+}
+
+// senderID returns the clonemap ID of the sender of a message from another platform in the
+// given MAS
+func (gw *Gateway) senderID(masID int, aid fipaacl.AID) (id int, err error) {
+	if _, agentID, ok := gw.localAgent(aid.Name); ok {
+		id = agentID
+		return
+	}
+	agent, err := gw.registerForeignAgent(masID, aid)
+	id = agent.ID
+	return
+}
+
+// token returns the integer representation of a conversation ID or reply-with token in the
+// given MAS. Numeric tokens are kept, others are assigned negative numbers
+func (gw *Gateway) token(masID int, s string) (id int) {
+	if s == "" {
+		return
+	}
+	id, err := strconv.Atoi(s)
+	if err == nil && id > 0 {
+		return
+	}
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	scope := gw.scope(masID)
+	id, ok := scope.tokenIDs[s]
+	if !ok {
+		id = hashID(s, func(id int) bool {
+			_, ok := scope.tokens[id]
+			return ok
+		})
+		scope.tokenIDs[s] = id
+		scope.tokens[id] = s
+	}
+	scope.tokenUsed[id] = time.Now()
+	return
+}
+
+// untoken returns the string representation of a conversation ID or reply-with token in the
+// given MAS
+func (gw *Gateway) untoken(masID int, id int) (s string) {
+	if id == 0 {
+		return
+	}
+	if id > 0 {
+		s = strconv.Itoa(id)
+		return
+	}
+	gw.mutex.Lock()
+	scope := gw.scope(masID)
+	s, ok := scope.tokens[id]
+	if ok {
+		scope.tokenUsed[id] = time.Now()
+	}
+	gw.mutex.Unlock()
+	return
+}
+
+// toCloneMAP converts a message from another platform to a clonemap message for an agent of the
+// given MAS
+func (gw *Gateway) toCloneMAP(msg fipaacl.Message, masID int, sender int,
+	receiver int) (ret schemas.ACLMessage, err error) {
+	perf, ok := performatives[msg.Performative]
+	if !ok {
+		err = errors.New("unknown performative " + msg.Performative)
+		return
+	}
+	ret = schemas.ACLMessage{
+		Timestamp:      time.Now(),
+		Performative:   perf,
+		Sender:         sender,
+		AgencySender:   gw.name,
+		Receiver:       receiver,
+		Content:        msg.Content,
+		Language:       msg.Language,
+		Encoding:       msg.Encoding,
+		Ontology:       msg.Ontology,
+		Protocol:       protocols[msg.Protocol],
+		ConversationID: gw.token(masID, msg.ConversationID),
+		InReplyTo:      gw.token(masID, msg.InReplyTo),
+		ReplyBy:        msg.ReplyBy,
+	}
+	if msg.ReplyWith != "" {
+		ret.ReplyWith = strconv.Itoa(gw.token(masID, msg.ReplyWith))
+	}
+	if len(msg.ReplyTo) > 0 {
+		ret.ReplyTo, err = gw.senderID(masID, msg.ReplyTo[0])
+	}
+	return
+}
+
+// toFIPA converts a message of a clonemap agent of the given MAS to a message for another
+// platform
+func (gw *Gateway) toFIPA(msg schemas.ACLMessage, masID int,
+	receiver schemas.ForeignAgent) (ret fipaacl.Message, err error) {
+	for name, perf := range performatives {
+		if perf == msg.Performative {
+			ret.Performative = name
+		}
+	}
+	if ret.Performative == "" {
+		err = errors.New("unknown performative " + strconv.Itoa(msg.Performative))
+		return
+	}
+	for name, prot := range protocols {
+		if prot == msg.Protocol {
+			ret.Protocol = name
+		}
+	}
+	ret.Sender = gw.localAID(masID, msg.Sender)
+	ret.Receivers = []fipaacl.AID{{Name: receiver.Name, Addresses: receiver.Addresses}}
+	ret.Content = msg.Content
+	ret.Language = msg.Language
+	ret.Encoding = msg.Encoding
+	ret.Ontology = msg.Ontology
+	ret.ConversationID = gw.untoken(masID, msg.ConversationID)
+	ret.ReplyWith = msg.ReplyWith
+	if id, convErr := strconv.Atoi(msg.ReplyWith); convErr == nil {
+		ret.ReplyWith = gw.untoken(masID, id)
+	}
+	ret.InReplyTo = gw.untoken(masID, msg.InReplyTo)
+	ret.ReplyBy = msg.ReplyBy
+	return
+}
+
+// masOfAgency returns the ID of the MAS an agency belongs to. Agency names have the form
+// mas-{masid}-im-{imid}-agency-{agencyid}
+func masOfAgency(agency string) (masID int, err error) {
+	parts := strings.Split(agency, "-")
+	if len(parts) < 2 || parts[0] != "mas" {
+		err = errors.New("illegal agency name " + agency)
+		return
+	}
+	masID, err = strconv.Atoi(parts[1])
+	return
+}
+
+// deliverLocal delivers a message received from another platform to the clonemap agents among
+// its receivers. Delivery is attempted for all receivers. The errors of failed deliveries are
+// returned combined
+func (gw *Gateway) deliverLocal(env fipaacl.Envelope, msg fipaacl.Message) (err error) {
+	receivers := env.IntendedReceivers
+	if len(receivers) == 0 {
+		receivers = env.To
+	}
+	if len(receivers) == 0 {
+		receivers = msg.Receivers
+	}
+	if len(receivers) == 0 {
+		err = errors.New("message without receiver")
+		return
+	}
+	if msg.Sender.Name == "" {
+		msg.Sender = env.From
+	}
+	var errs []string
+	for _, recv := range receivers {
+		recvErr := gw.deliverLocalMsg(msg, recv)
+		if recvErr != nil {
+			errs = append(errs, recv.Name+": "+recvErr.Error())
+		}
+	}
+	if len(errs) > 0 {
+		err = errors.New("delivery failed for " + strings.Join(errs, "; "))
+	}
+	return
+}
+
+// deliverLocalMsg delivers a message received from another platform to one clonemap agent
+func (gw *Gateway) deliverLocalMsg(msg fipaacl.Message, recv fipaacl.AID) (err error) {
+	masID, agentID, ok := gw.localAgent(recv.Name)
+	if !ok {
+		err = errors.New("unknown receiver")
+		return
+	}
+	sender, err := gw.senderID(masID, msg.Sender)
+	if err != nil {
+		return
+	}
+	cmapMsg, err := gw.toCloneMAP(msg, masID, sender, agentID)
+	if err != nil {
+		return
+	}
+	address, _, err := gw.amsClient.GetAgentAddress(masID, agentID)
+	if err != nil {
+		return
+	}
+	if address.Agency == "" {
+		err = errors.New("receiver is not active")
+		return
+	}
+	cmapMsg.AgencyReceiver = address.Agency
+	httpStatus, err := gw.agencyClient.PostMsgs(address.Agency, []schemas.ACLMessage{cmapMsg})
+	if err != nil {
+		return
+	}
+	if httpStatus != http.StatusCreated {
+		err = errors.New("delivery to agency " + address.Agency + " failed with status " +
+			strconv.Itoa(httpStatus))
+	}
+	return
+}
+
+// sendForeign sends messages of clonemap agents to the foreign agents they are addressed to.
+// Messages that cannot be delivered are returned to the agency of the sender, which notifies
+// the sender and puts them into its dead-letter queue
+func (gw *Gateway) sendForeign(msgs []schemas.ACLMessage) {
+	for i := range msgs {
+		err := gw.sendForeignMsg(msgs[i])
+		if err == nil {
+			continue
+		}
+		gw.logError.Println("Message to foreign agent ", msgs[i].Receiver, ": ", err)
+		var httpStatus int
+		httpStatus, err = gw.agencyClient.ReturnMsg(msgs[i].AgencySender, msgs[i])
+		if err == nil && httpStatus != http.StatusCreated {
+			err = errors.New("wrong http code: " + strconv.Itoa(httpStatus))
+		}
+		if err != nil {
+			gw.logError.Println("Could not return undeliverable message to agency ",
+				msgs[i].AgencySender, ": ", err)
+		}
+	}
+}
+
+// sendForeignMsg sends a message to a foreign agent. The addresses of the agent are tried one
+// after another
+func (gw *Gateway) sendForeignMsg(msg schemas.ACLMessage) (err error) {
+	masID, err := masOfAgency(msg.AgencySender)
+	if err != nil {
+		return
+	}
+	gw.mutex.Lock()
+	scope := gw.scope(masID)
+	recv, ok := scope.foreign[msg.Receiver]
+	if ok {
+		scope.foreignUsed[msg.Receiver] = time.Now()
+	}
+	gw.mutex.Unlock()
+	if !ok {
+		err = errors.New("unknown foreign agent")
+		return
+	}
+	if len(recv.Addresses) == 0 {
+		err = errors.New("no address of foreign agent " + recv.Name)
+		return
+	}
+	fipaMsg, err := gw.toFIPA(msg, masID, recv)
+	if err != nil {
+		return
+	}
+	env := fipaacl.Envelope{To: fipaMsg.Receivers, From: fipaMsg.Sender}
+	body, contentType, err := fipaacl.MarshalHTTP(env, fipaMsg)
+	if err != nil {
+		return
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Mime-Version", "1.0")
+	for _, addr := range recv.Addresses {
+		var httpStatus int
+		_, httpStatus, err = httpretry.PostHeader(gw.httpClient, addr, header, body,
+			time.Second, 2)
+		if err == nil && httpStatus == http.StatusOK {
+			gw.logInfo.Println("Sent message to foreign agent ", recv.Name)
+			return
+		}
+		if err == nil {
+			err = errors.New("delivery to " + addr + " failed with status " +
+				strconv.Itoa(httpStatus))
+		}
+	}
+	return
+}
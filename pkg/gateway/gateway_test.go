@@ -0,0 +1,352 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/common/fipaacl"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+)
+
+// newTestGateway returns a gateway that delivers messages to the agency served by agency. The
+// fake AMS returns this agency as address of every clonemap agent
+func newTestGateway(t *testing.T, agency *httptest.Server) (gw *Gateway, serv *httptest.Server,
+	ams *httptest.Server) {
+	agencyURL, _ := url.Parse(agency.URL)
+	agencyPort, _ := strconv.Atoi(agencyURL.Port())
+	ams = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js, _ := json.Marshal(schemas.Address{Agency: agencyURL.Hostname()})
+		w.Write(js)
+	}))
+	amsURL, _ := url.Parse(ams.URL)
+	gw = newGateway(log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	gw.name = "gateway"
+	gw.address = "http://gateway:10000/acc"
+	gw.amsClient.Host = amsURL.Hostname()
+	gw.amsClient.Port, _ = strconv.Atoi(amsURL.Port())
+	gw.agencyClient.Port = agencyPort
+	serv = httptest.NewServer(gw.server(10000).Handler)
+	return
+}
+
+// TestGatewayInbound tests the delivery of messages from another platform to clonemap agents
+func TestGatewayInbound(t *testing.T) {
+	received := make(chan []schemas.ACLMessage, 1)
+	agency := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		msgs, _ := aclwire.Unmarshal(body, r.Header.Get("Content-Type"))
+		received <- msgs
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer agency.Close()
+	gw, serv, ams := newTestGateway(t, agency)
+	defer serv.Close()
+	defer ams.Close()
+
+	sender := fipaacl.AID{Name: "ping@jade", Addresses: []string{"http://jade:7778/acc"}}
+	msg := fipaacl.Message{
+		Performative:   "request",
+		Sender:         sender,
+		Receivers:      []fipaacl.AID{gw.localAID(2, 5)},
+		Content:        "(ping)",
+		Protocol:       "fipa-request",
+		ConversationID: "C1234",
+		ReplyWith:      "R1",
+	}
+	body, contentType, err := fipaacl.MarshalHTTP(fipaacl.Envelope{To: msg.Receivers,
+		From: sender}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(serv.URL+"/acc", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status ", resp.StatusCode)
+	}
+	var msgs []schemas.ACLMessage
+	select {
+	case msgs = <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not delivered")
+	}
+	agents := gw.getForeignAgents(2)
+	if len(agents) != 1 || agents[0].Name != "ping@jade" || agents[0].ID >= 0 {
+		t.Fatalf("wrong foreign agents %+v", agents)
+	}
+	if len(msgs) != 1 || msgs[0].Receiver != 5 || msgs[0].Sender != agents[0].ID ||
+		msgs[0].Performative != schemas.FIPAPerfRequest ||
+		msgs[0].Protocol != schemas.FIPAProtRequest || msgs[0].Content != "(ping)" ||
+		msgs[0].AgencySender != "gateway" {
+		t.Fatalf("wrong message %+v", msgs)
+	}
+	if gw.untoken(2, msgs[0].ConversationID) != "C1234" {
+		t.Error("conversation ID not mapped")
+	}
+	if len(gw.getForeignAgents(3)) != 0 {
+		t.Error("foreign agent known in other MAS")
+	}
+
+	msg.Receivers = []fipaacl.AID{{Name: "agent-5@otherplatform"}}
+	body, contentType, _ = fipaacl.MarshalHTTP(fipaacl.Envelope{To: msg.Receivers,
+		From: sender}, msg)
+	resp, err = http.Post(serv.URL+"/acc", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("message to unknown receiver accepted")
+	}
+}
+
+// TestGatewayOutbound tests the delivery of messages from clonemap agents to another platform
+func TestGatewayOutbound(t *testing.T) {
+	received := make(chan fipaacl.Message, 1)
+	jade := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, msg, err := fipaacl.ParseHTTP(body, r.Header.Get("Content-Type"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- msg
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer jade.Close()
+	gw, serv, ams := newTestGateway(t, jade)
+	defer serv.Close()
+	defer ams.Close()
+
+	js, _ := json.Marshal(schemas.ForeignAgent{Name: "pong@jade",
+		Addresses: []string{jade.URL + "/acc"}})
+	resp, err := http.Post(serv.URL+"/api/gateway/7/agents", "application/json",
+		bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var agent schemas.ForeignAgent
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	json.Unmarshal(body, &agent)
+	if resp.StatusCode != http.StatusCreated || agent.ID >= 0 {
+		t.Fatal("registration failed ", resp.StatusCode, agent)
+	}
+
+	conv := gw.token(7, "C99")
+	msgs := []schemas.ACLMessage{{
+		Performative:   schemas.FIPAPerfInform,
+		Sender:         3,
+		AgencySender:   "mas-7-im-0-agency-0.mas7agencies",
+		Receiver:       agent.ID,
+		Content:        "pong",
+		Protocol:       schemas.FIPAProtQuery,
+		ConversationID: conv,
+	}}
+	js, _ = json.Marshal(msgs)
+	resp, err = http.Post(serv.URL+"/api/agency/msgs", "application/json", bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("unexpected status ", resp.StatusCode)
+	}
+	var msg fipaacl.Message
+	select {
+	case msg = <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not delivered")
+	}
+	if msg.Performative != "inform" || msg.Protocol != "fipa-query" || msg.Content != "pong" ||
+		msg.ConversationID != "C99" || msg.Sender.Name != "agent-3.mas-7@clonemap" ||
+		len(msg.Receivers) != 1 || msg.Receivers[0].Name != "pong@jade" {
+		t.Errorf("wrong message %+v", msg)
+	}
+}
+
+// roundTripFunc is a http transport that handles requests with a function
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TestGatewayFailures tests that failed deliveries are reported and do not prevent the
+// delivery to other receivers
+func TestGatewayFailures(t *testing.T) {
+	received := make(chan []schemas.ACLMessage, 2)
+	agency := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		msgs, _ := aclwire.Unmarshal(body, r.Header.Get("Content-Type"))
+		if len(msgs) == 1 && msgs[0].Receiver == 6 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- msgs
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer agency.Close()
+	gw, serv, ams := newTestGateway(t, agency)
+	defer serv.Close()
+	defer ams.Close()
+
+	// delivery to agent 5 succeeds although delivery to agent 6 fails
+	sender := fipaacl.AID{Name: "ping@jade", Addresses: []string{"http://jade:7778/acc"}}
+	msg := fipaacl.Message{
+		Performative: "inform",
+		Sender:       sender,
+		Receivers:    []fipaacl.AID{gw.localAID(2, 6), gw.localAID(2, 5)},
+		Content:      "hello",
+	}
+	body, contentType, _ := fipaacl.MarshalHTTP(fipaacl.Envelope{To: msg.Receivers,
+		From: sender}, msg)
+	resp, err := http.Post(serv.URL+"/acc", contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("partially failed delivery reported as success")
+	}
+	select {
+	case msgs := <-received:
+		if len(msgs) != 1 || msgs[0].Receiver != 5 {
+			t.Errorf("wrong message %+v", msgs)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not delivered to remaining receiver")
+	}
+
+	// undeliverable messages to foreign agents are returned to the agency of the sender
+	jade := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer jade.Close()
+	agent, err := gw.registerForeignAgent(7, fipaacl.AID{Name: "pong@jade",
+		Addresses: []string{jade.URL + "/acc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned := make(chan schemas.ACLMessage, 1)
+	gw.agencyClient.SetTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var msg schemas.ACLMessage
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &msg)
+		if r.URL.Path == "/api/agency/msgundeliv" {
+			returned <- msg
+		}
+		return &http.Response{StatusCode: http.StatusCreated,
+			Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	}))
+	js, _ := json.Marshal([]schemas.ACLMessage{{
+		Performative: schemas.FIPAPerfInform,
+		Sender:       3,
+		AgencySender: "mas-7-im-0-agency-0.mas7agencies",
+		Receiver:     agent.ID,
+		Content:      "pong",
+	}})
+	resp, err = http.Post(serv.URL+"/api/agency/msgs", "application/json", bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case msg := <-returned:
+		if msg.Sender != 3 || msg.Receiver != agent.ID {
+			t.Errorf("wrong returned message %+v", msg)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("undeliverable message not returned")
+	}
+}
+
+// TestGatewayExpiry tests that unused foreign agents and tokens are forgotten
+func TestGatewayExpiry(t *testing.T) {
+	gw := newGateway(log.New(ioutil.Discard, "", 0), log.New(ioutil.Discard, "", 0))
+	old, _ := gw.registerForeignAgent(2, fipaacl.AID{Name: "old@jade"})
+	recent, _ := gw.registerForeignAgent(2, fipaacl.AID{Name: "recent@jade"})
+	oldToken := gw.token(2, "C1")
+	recentToken := gw.token(2, "C2")
+	gw.registerForeignAgent(3, fipaacl.AID{Name: "other@jade"})
+
+	gw.mutex.Lock()
+	past := time.Now().Add(-foreignAgentExpiry - time.Minute)
+	gw.mas[2].foreignUsed[old.ID] = past
+	gw.mas[2].tokenUsed[oldToken] = time.Now().Add(-tokenExpiry - time.Minute)
+	gw.mas[3].foreignUsed[gw.mas[3].foreignIDs["other@jade"]] = past
+	gw.expired = time.Time{}
+	gw.mutex.Unlock()
+
+	agents := gw.getForeignAgents(2)
+	if len(agents) != 1 || agents[0].ID != recent.ID {
+		t.Errorf("wrong foreign agents %+v", agents)
+	}
+	if gw.untoken(2, oldToken) != "" || gw.untoken(2, recentToken) != "C2" {
+		t.Error("wrong tokens after expiry")
+	}
+	gw.mutex.Lock()
+	_, ok := gw.mas[3]
+	gw.mutex.Unlock()
+	if ok {
+		t.Error("MAS without foreign agents and tokens not removed")
+	}
+	if agent, _ := gw.registerForeignAgent(2, fipaacl.AID{Name: "old@jade"}); agent.ID != old.ID {
+		t.Error("expected same ID after registering again, got ", agent.ID)
+	}
+}
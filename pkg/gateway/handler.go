@@ -0,0 +1,255 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RWTH-ACS/clonemap/pkg/common/aclwire"
+	"github.com/RWTH-ACS/clonemap/pkg/common/fipaacl"
+	"github.com/RWTH-ACS/clonemap/pkg/common/httpreply"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize is the maximum size of request bodies accepted by the gateway
+const maxBodySize = 4 << 20
+
+// handleAlive is the handler for requests to path /api/alive
+func (gw *Gateway) handleAlive(w http.ResponseWriter, r *http.Request) {
+	httpErr := httpreply.Alive(w, nil)
+	gw.logErrors(r.URL.Path, nil, httpErr)
+}
+
+// handlePostMsgs is the handler for post requests to path /api/agency/msgs. Agencies post
+// messages of clonemap agents to foreign agents to this path
+func (gw *Gateway) handlePostMsgs(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	if r.Header.Get("Content-Encoding") == aclwire.EncodingGzip {
+		body, cmapErr = aclwire.Decompress(body, maxBodySize)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			gw.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	}
+	var msgs []schemas.ACLMessage
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	switch contentType {
+	case aclwire.ContentTypeProtobuf:
+		msgs, cmapErr = aclwire.UnmarshalProtobuf(body)
+		if cmapErr != nil {
+			httpErr = httpreply.InvalidBodyError(w)
+			gw.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	case aclwire.ContentTypeJSON, "":
+		cmapErr = json.Unmarshal(body, &msgs)
+		if cmapErr != nil {
+			httpErr = httpreply.JSONUnmarshalError(w)
+			gw.logErrors(r.URL.Path, cmapErr, httpErr)
+			return
+		}
+	default:
+		httpErr = httpreply.UnsupportedMediaTypeError(w)
+		gw.logErrors(r.URL.Path, errors.New("unsupported content type "+contentType), httpErr)
+		return
+	}
+	go gw.sendForeign(msgs)
+	httpErr = httpreply.Created(w, cmapErr, "text/plain", []byte("Resource Created"))
+	gw.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetAgents is the handler for get requests to path /api/gateway/{masid}/agents
+func (gw *Gateway) handleGetAgents(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var masID int
+	masID, cmapErr = getMASID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	agents := gw.getForeignAgents(masID)
+	httpErr = httpreply.Resource(w, agents, nil)
+	gw.logErrors(r.URL.Path, nil, httpErr)
+}
+
+// handlePostAgent is the handler for post requests to path /api/gateway/{masid}/agents. The
+// foreign agent is registered and returned with its clonemap ID
+func (gw *Gateway) handlePostAgent(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var masID int
+	masID, cmapErr = getMASID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var agent schemas.ForeignAgent
+	cmapErr = json.Unmarshal(body, &agent)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	agent, cmapErr = gw.registerForeignAgent(masID, fipaacl.AID{Name: agent.Name,
+		Addresses: agent.Addresses})
+	httpErr = httpreply.CreatedResource(w, agent, cmapErr)
+	gw.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostACC is the handler for post requests to path /acc. Other platforms send messages
+// to clonemap agents to this path using the FIPA HTTP message transport protocol
+func (gw *Gateway) handlePostACC(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	env, msg, cmapErr := fipaacl.ParseHTTP(body, r.Header.Get("Content-Type"))
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		gw.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = gw.deliverLocal(env, msg)
+	httpErr = httpreply.Updated(w, cmapErr)
+	gw.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// getMASID returns the masid from the path
+func getMASID(r *http.Request) (masID int, err error) {
+	vars := mux.Vars(r)
+	masID, err = strconv.Atoi(vars["masid"])
+	if err == nil && masID < 0 {
+		err = errors.New("negative masid")
+	}
+	return
+}
+
+// methodNotAllowed is the default handler for valid paths but invalid methods
+func (gw *Gateway) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	httpErr := httpreply.MethodNotAllowed(w)
+	cmapErr := errors.New("Error: Method not allowed on path " + r.URL.Path)
+	gw.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// resourceNotFound is the default handler for invalid paths
+func (gw *Gateway) resourceNotFound(w http.ResponseWriter, r *http.Request) {
+	httpErr := httpreply.NotFoundError(w)
+	cmapErr := errors.New("resource not found")
+	gw.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// logErrors logs errors if any
+func (gw *Gateway) logErrors(path string, cmapErr error, httpErr error) {
+	if cmapErr != nil {
+		gw.logError.Println(path, cmapErr)
+	}
+	if httpErr != nil {
+		gw.logError.Println(path, httpErr)
+	}
+}
+
+// loggingMiddleware logs request before calling final handler
+func (gw *Gateway) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw.logInfo.Println("Received Request: ", r.Method, " ", r.URL.EscapedPath())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// server creates the gateway server
+func (gw *Gateway) server(port int) (serv *http.Server) {
+	r := mux.NewRouter()
+	r.Path("/acc").Methods("POST").HandlerFunc(gw.handlePostACC)
+	r.Path("/acc").Methods("PUT", "GET", "DELETE").HandlerFunc(gw.methodNotAllowed)
+	s := r.PathPrefix("/api").Subrouter()
+	s.Path("/alive").Methods("GET").HandlerFunc(gw.handleAlive)
+	s.Path("/alive").Methods("POST", "PUT", "DELETE").HandlerFunc(gw.methodNotAllowed)
+	s.Path("/agency/msgs").Methods("POST").HandlerFunc(gw.handlePostMsgs)
+	s.Path("/agency/msgs").Methods("PUT", "GET", "DELETE").HandlerFunc(gw.methodNotAllowed)
+	s.Path("/gateway/{masid}/agents").Methods("GET").HandlerFunc(gw.handleGetAgents)
+	s.Path("/gateway/{masid}/agents").Methods("POST").HandlerFunc(gw.handlePostAgent)
+	s.Path("/gateway/{masid}/agents").Methods("PUT", "DELETE").HandlerFunc(gw.methodNotAllowed)
+	s.PathPrefix("").HandlerFunc(gw.resourceNotFound)
+	r.PathPrefix("").HandlerFunc(gw.resourceNotFound)
+	r.Use(gw.loggingMiddleware)
+	serv = &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: r,
+	}
+	return
+}
+
+// listen opens a http server listening and serving request
+func (gw *Gateway) listen(serv *http.Server) (err error) {
+	gw.logInfo.Println("Gateway listening on " + serv.Addr)
+	err = serv.ListenAndServe()
+	return
+}
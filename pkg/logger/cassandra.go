@@ -48,6 +48,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/RWTH-ACS/clonemap/pkg/schemas"
@@ -244,6 +245,135 @@ func (stor *cassStorage) deleteAgentState(masID int, agentID int) (err error) {
 	return
 }
 
+// getStateKeys returns the names of all named states of an agent
+func (stor *cassStorage) getStateKeys(masID int, agentID int) (keys []string, err error) {
+	iter := stor.session.Query("SELECT key FROM state_revisions WHERE masid = ? AND agentid = ? "+
+		"GROUP BY key", masID, agentID).Iter()
+	var key string
+	for iter.Scan(&key) {
+		keys = append(keys, key)
+	}
+	err = iter.Close()
+	return
+}
+
+// getStateRevision returns the specified revision of a named state; the latest revision is
+// returned if revision is 0
+func (stor *cassStorage) getStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	var query *gocql.Query
+	if revision == 0 {
+		// revisions are stored in descending order
+		query = stor.session.Query("SELECT rev FROM state_revisions WHERE masid = ? AND "+
+			"agentid = ? AND key = ? LIMIT 1", masID, agentID, key)
+	} else {
+		query = stor.session.Query("SELECT rev FROM state_revisions WHERE masid = ? AND "+
+			"agentid = ? AND key = ? AND revision = ?", masID, agentID, key, revision)
+	}
+	var js []byte
+	err = query.Scan(&js)
+	if err == gocql.ErrNotFound {
+		err = errStateNotFound
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(js, &rev)
+	return
+}
+
+// getStateHistory returns all revisions of a named state in ascending order
+func (stor *cassStorage) getStateHistory(masID int, agentID int,
+	key string) (revs []schemas.StateRevision, err error) {
+	iter := stor.session.Query("SELECT rev FROM state_revisions WHERE masid = ? AND agentid = ? "+
+		"AND key = ?", masID, agentID, key).Iter()
+	var js []byte
+	for iter.Scan(&js) {
+		var rev schemas.StateRevision
+		err = json.Unmarshal(js, &rev)
+		if err != nil {
+			iter.Close()
+			return
+		}
+		revs = append(revs, rev)
+	}
+	err = iter.Close()
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+	}
+	return
+}
+
+// compareAndSwapState stores a new revision of a named state if the current revision equals
+// update.Revision
+func (stor *cassStorage) compareAndSwapState(masID int, agentID int, key string,
+	update schemas.StateUpdate) (rev schemas.StateRevision, err error) {
+	// a stale read can only return an older revision; the lightweight transaction then fails
+	// since the next revision already exists
+	var latest schemas.StateRevision
+	latest, err = stor.getStateRevision(masID, agentID, key, 0)
+	if err == errStateNotFound {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	if latest.Revision != update.Revision {
+		err = errRevisionConflict
+		return
+	}
+	rev = schemas.StateRevision{
+		MASID:     masID,
+		AgentID:   agentID,
+		Key:       key,
+		Revision:  update.Revision + 1,
+		Timestamp: time.Now(),
+		State:     update.State,
+	}
+	var js []byte
+	js, err = json.Marshal(rev)
+	if err != nil {
+		return
+	}
+	var applied bool
+	applied, err = stor.session.Query("INSERT INTO state_revisions (masid, agentid, key, "+
+		"revision, rev) VALUES (?, ?, ?, ?, ?) IF NOT EXISTS", masID, agentID, key, rev.Revision,
+		js).MapScanCAS(map[string]interface{}{})
+	if err == nil && !applied {
+		err = errRevisionConflict
+	}
+	return
+}
+
+// restoreStateRevision stores the content of an older revision as new revision of a named
+// state
+func (stor *cassStorage) restoreStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	if revision <= 0 {
+		err = errStateNotFound
+		return
+	}
+	var old, latest schemas.StateRevision
+	old, err = stor.getStateRevision(masID, agentID, key, revision)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		// retry in case of concurrent updates
+		latest, err = stor.getStateRevision(masID, agentID, key, 0)
+		if err != nil {
+			return
+		}
+		rev, err = stor.compareAndSwapState(masID, agentID, key,
+			schemas.StateUpdate{Revision: latest.Revision, State: old.State})
+		if err != errRevisionConflict {
+			return
+		}
+	}
+	return
+}
+
 // storeLogs stores the logs in a batch operation
 func (stor *cassStorage) storeLogs(topic string) {
 	var logIn chan schemas.LogMessage
@@ -340,6 +470,43 @@ func (stor *cassStorage) storeState() {
 	}
 }
 
+// addSpans stores spans of traced message exchanges
+func (stor *cassStorage) addSpans(masID int, spans []schemas.Span) (err error) {
+	batch := gocql.NewBatch(gocql.UnloggedBatch)
+	for i := range spans {
+		var js []byte
+		js, err = json.Marshal(spans[i])
+		if err != nil {
+			return
+		}
+		batch.Query("INSERT INTO tracing (masid, traceid, spanid, t, span) VALUES (?, ?, ?, ?, ?)",
+			masID, spans[i].TraceID, spans[i].SpanID, spans[i].Start, js)
+	}
+	err = stor.session.ExecuteBatch(batch)
+	return
+}
+
+// getTrace returns all spans of a trace ordered by start time
+func (stor *cassStorage) getTrace(masID int, traceID string) (spans []schemas.Span, err error) {
+	iter := stor.session.Query("SELECT span FROM tracing WHERE masid = ? AND traceid = ?", masID,
+		traceID).Iter()
+	var js []byte
+	for iter.Scan(&js) {
+		var span schemas.Span
+		err = json.Unmarshal(js, &span)
+		if err != nil {
+			iter.Close()
+			return
+		}
+		spans = append(spans, span)
+	}
+	err = iter.Close()
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start.Before(spans[j].Start)
+	})
+	return
+}
+
 func (stor *cassStorage) disconnect() {
 	stor.session.Close()
 }
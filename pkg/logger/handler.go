@@ -140,6 +140,50 @@ func (logger *Logger) handlePutCommunication(w http.ResponseWriter, r *http.Requ
 	logger.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handlePostSpans is the handler for post requests to path /api/tracing/{masid}
+func (logger *Logger) handlePostSpans(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, cmapErr := getMASID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var spans []schemas.Span
+	cmapErr = json.Unmarshal(body, &spans)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	cmapErr = logger.addSpans(masID, spans)
+	httpErr = httpreply.Created(w, cmapErr, "text/plain", []byte("Resource Created"))
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetTrace is the handler for get requests to path /api/tracing/{masid}/{traceid}
+func (logger *Logger) handleGetTrace(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	vars := mux.Vars(r)
+	masID, cmapErr := getMASID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var spans []schemas.Span
+	spans, cmapErr = logger.getTrace(masID, vars["traceid"])
+	httpErr = httpreply.Resource(w, spans, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
 // handlePostLogMsgList is the handler for post requests to path /api/logging/{masid}/list
 func (logger *Logger) handlePostLogMsgList(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
@@ -279,8 +323,7 @@ func (logger *Logger) handlePutState(w http.ResponseWriter, r *http.Request) {
 // handlePutStateList is the handler for requests to path /api/state/{masid}/list
 func (logger *Logger) handlePutStateList(w http.ResponseWriter, r *http.Request) {
 	var cmapErr, httpErr error
-	vars := mux.Vars(r)
-	masID, cmapErr := strconv.Atoi(vars["masid"])
+	masID, cmapErr := getMASID(r)
 	if cmapErr != nil {
 		httpErr = httpreply.NotFoundError(w)
 		logger.logErrors(r.URL.Path, cmapErr, httpErr)
@@ -305,6 +348,148 @@ func (logger *Logger) handlePutStateList(w http.ResponseWriter, r *http.Request)
 	logger.logErrors(r.URL.Path, cmapErr, httpErr)
 }
 
+// handleGetStateKeys is the handler for get requests to path /api/state/{masid}/{agentid}/keys
+func (logger *Logger) handleGetStateKeys(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var keys []string
+	keys, cmapErr = logger.getStateKeys(masID, agentID)
+	httpErr = httpreply.Resource(w, keys, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetNamedState is the handler for get requests to path
+// /api/state/{masid}/{agentid}/keys/{key}
+func (logger *Logger) handleGetNamedState(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var rev schemas.StateRevision
+	rev, cmapErr = logger.getStateRevision(masID, agentID, mux.Vars(r)["key"], 0)
+	if cmapErr != nil {
+		httpErr = stateError(w, cmapErr)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Resource(w, rev, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePutNamedState is the handler for put requests to path
+// /api/state/{masid}/{agentid}/keys/{key}
+func (logger *Logger) handlePutNamedState(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var body []byte
+	body, cmapErr = ioutil.ReadAll(r.Body)
+	if cmapErr != nil {
+		httpErr = httpreply.InvalidBodyError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var update schemas.StateUpdate
+	cmapErr = json.Unmarshal(body, &update)
+	if cmapErr != nil {
+		httpErr = httpreply.JSONUnmarshalError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var rev schemas.StateRevision
+	rev, cmapErr = logger.compareAndSwapState(masID, agentID, mux.Vars(r)["key"], update)
+	if cmapErr != nil {
+		httpErr = stateError(w, cmapErr)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Resource(w, rev, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetStateHistory is the handler for get requests to path
+// /api/state/{masid}/{agentid}/keys/{key}/revisions
+func (logger *Logger) handleGetStateHistory(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, cmapErr := getAgentID(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var revs []schemas.StateRevision
+	revs, cmapErr = logger.getStateHistory(masID, agentID, mux.Vars(r)["key"])
+	httpErr = httpreply.Resource(w, revs, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handleGetStateRevision is the handler for get requests to path
+// /api/state/{masid}/{agentid}/keys/{key}/revisions/{revision}
+func (logger *Logger) handleGetStateRevision(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, revision, cmapErr := getRevision(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var rev schemas.StateRevision
+	rev, cmapErr = logger.getStateRevision(masID, agentID, mux.Vars(r)["key"], revision)
+	if cmapErr != nil {
+		httpErr = stateError(w, cmapErr)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.Resource(w, rev, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// handlePostRestoreState is the handler for post requests to path
+// /api/state/{masid}/{agentid}/keys/{key}/revisions/{revision}/restore
+func (logger *Logger) handlePostRestoreState(w http.ResponseWriter, r *http.Request) {
+	var cmapErr, httpErr error
+	masID, agentID, revision, cmapErr := getRevision(r)
+	if cmapErr != nil {
+		httpErr = httpreply.NotFoundError(w)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	var rev schemas.StateRevision
+	rev, cmapErr = logger.restoreStateRevision(masID, agentID, mux.Vars(r)["key"], revision)
+	if cmapErr != nil {
+		httpErr = stateError(w, cmapErr)
+		logger.logErrors(r.URL.Path, cmapErr, httpErr)
+		return
+	}
+	httpErr = httpreply.CreatedResource(w, rev, cmapErr)
+	logger.logErrors(r.URL.Path, cmapErr, httpErr)
+}
+
+// stateError writes the response for errors of named states
+func stateError(w http.ResponseWriter, cmapErr error) (httpErr error) {
+	switch cmapErr {
+	case errStateNotFound:
+		httpErr = httpreply.NotFoundError(w)
+	case errRevisionConflict:
+		httpErr = httpreply.ConflictError(w)
+	default:
+		httpErr = httpreply.CMAPError(w, cmapErr.Error())
+	}
+	return
+}
+
 // methodNotAllowed is the default handler for valid paths but invalid methods
 func (logger *Logger) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	httpErr := httpreply.MethodNotAllowed(w)
@@ -329,17 +514,47 @@ func (logger *Logger) logErrors(path string, cmapErr error, httpErr error) {
 	}
 }
 
+// getMASID returns the masID from the path
+func getMASID(r *http.Request) (masID int, err error) {
+	masID, err = strconv.Atoi(mux.Vars(r)["masid"])
+	if err != nil {
+		return
+	}
+	if masID < 0 {
+		err = errors.New("invalid masid")
+	}
+	return
+}
+
 // getAgentID returns the masID and agentID from the path
 func getAgentID(r *http.Request) (masID int, agentID int, err error) {
-	vars := mux.Vars(r)
-	masID, err = strconv.Atoi(vars["masid"])
+	masID, err = getMASID(r)
+	if err != nil {
+		return
+	}
+	agentID, err = strconv.Atoi(mux.Vars(r)["agentid"])
+	if err != nil {
+		return
+	}
+	if agentID < 0 {
+		err = errors.New("invalid agentid")
+	}
+	return
+}
+
+// getRevision returns the masID, agentID and revision from the path
+func getRevision(r *http.Request) (masID int, agentID int, revision int, err error) {
+	masID, agentID, err = getAgentID(r)
 	if err != nil {
 		return
 	}
-	agentID, err = strconv.Atoi(vars["agentid"])
+	revision, err = strconv.Atoi(mux.Vars(r)["revision"])
 	if err != nil {
 		return
 	}
+	if revision <= 0 {
+		err = errors.New("invalid revision")
+	}
 	return
 }
 
@@ -377,12 +592,38 @@ func (logger *Logger) server(port int) (serv *http.Server) {
 		HandlerFunc(logger.handleGetLogsTime)
 	s.Path("/logging/{masid}/{agentid}/{topic}/time/{start}/{end}").
 		Methods("POST", "PUT", "DELETE").HandlerFunc(logger.methodNotAllowed)
+	s.Path("/state/{masid}/list").Methods("PUT").HandlerFunc(logger.handlePutStateList)
+	s.Path("/state/{masid}/list").Methods("POST", "DELETE", "GET").
+		HandlerFunc(logger.methodNotAllowed)
 	s.Path("/state/{masid}/{agentid}").Methods("GET").HandlerFunc(logger.handleGetState)
 	s.Path("/state/{masid}/{agentid}").Methods("PUT").HandlerFunc(logger.handlePutState)
 	s.Path("/state/{masid}/{agentid}").Methods("POST", "DELETE").
 		HandlerFunc(logger.methodNotAllowed)
-	s.Path("/state/{masid}/list").Methods("PUT").HandlerFunc(logger.handlePutStateList)
-	s.Path("/state/{masid}/list").Methods("POST", "DELETE", "GET").
+	s.Path("/state/{masid}/{agentid}/keys").Methods("GET").HandlerFunc(logger.handleGetStateKeys)
+	s.Path("/state/{masid}/{agentid}/keys").Methods("POST", "PUT", "DELETE").
+		HandlerFunc(logger.methodNotAllowed)
+	s.Path("/state/{masid}/{agentid}/keys/{key}").Methods("GET").
+		HandlerFunc(logger.handleGetNamedState)
+	s.Path("/state/{masid}/{agentid}/keys/{key}").Methods("PUT").
+		HandlerFunc(logger.handlePutNamedState)
+	s.Path("/state/{masid}/{agentid}/keys/{key}").Methods("POST", "DELETE").
+		HandlerFunc(logger.methodNotAllowed)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions").Methods("GET").
+		HandlerFunc(logger.handleGetStateHistory)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions").Methods("POST", "PUT", "DELETE").
+		HandlerFunc(logger.methodNotAllowed)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions/{revision}").Methods("GET").
+		HandlerFunc(logger.handleGetStateRevision)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions/{revision}").
+		Methods("POST", "PUT", "DELETE").HandlerFunc(logger.methodNotAllowed)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions/{revision}/restore").Methods("POST").
+		HandlerFunc(logger.handlePostRestoreState)
+	s.Path("/state/{masid}/{agentid}/keys/{key}/revisions/{revision}/restore").
+		Methods("PUT", "GET", "DELETE").HandlerFunc(logger.methodNotAllowed)
+	s.Path("/tracing/{masid}").Methods("POST").HandlerFunc(logger.handlePostSpans)
+	s.Path("/tracing/{masid}").Methods("PUT", "GET", "DELETE").HandlerFunc(logger.methodNotAllowed)
+	s.Path("/tracing/{masid}/{traceid}").Methods("GET").HandlerFunc(logger.handleGetTrace)
+	s.Path("/tracing/{masid}/{traceid}").Methods("POST", "PUT", "DELETE").
 		HandlerFunc(logger.methodNotAllowed)
 	s.PathPrefix("").HandlerFunc(logger.resourceNotFound)
 	s.Use(logger.loggingMiddleware)
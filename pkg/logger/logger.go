@@ -49,6 +49,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -81,6 +82,18 @@ func StartLogger() {
 	}
 }
 
+// NewLocalHandler returns the http handler of a logger with local storage. It is used to run all
+// modules of clonemap within one process
+func NewLocalHandler(logErr *log.Logger, logInf *log.Logger) (handler http.Handler) {
+	logger := &Logger{
+		stor:     newLocalStorage(),
+		logError: logErr,
+		logInfo:  logInf,
+	}
+	handler = logger.server(11000).Handler
+	return
+}
+
 func (logger *Logger) init() (err error) {
 	logType := os.Getenv("CLONEMAP_LOG_LEVEL")
 	switch logType {
@@ -168,6 +181,58 @@ func (logger *Logger) updateAgentState(masID int, agentID int, agState schemas.S
 	return
 }
 
+// getStateKeys returns the names of all named states of an agent
+func (logger *Logger) getStateKeys(masID int, agentID int) (keys []string, err error) {
+	keys, err = logger.stor.getStateKeys(masID, agentID)
+	return
+}
+
+// getStateRevision returns the specified revision of a named state; the latest revision is
+// returned if revision is 0
+func (logger *Logger) getStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	rev, err = logger.stor.getStateRevision(masID, agentID, key, revision)
+	return
+}
+
+// getStateHistory returns all revisions of a named state
+func (logger *Logger) getStateHistory(masID int, agentID int,
+	key string) (revs []schemas.StateRevision, err error) {
+	revs, err = logger.stor.getStateHistory(masID, agentID, key)
+	return
+}
+
+// compareAndSwapState stores a new revision of a named state if it has not been modified
+// concurrently
+func (logger *Logger) compareAndSwapState(masID int, agentID int, key string,
+	update schemas.StateUpdate) (rev schemas.StateRevision, err error) {
+	if update.Revision < 0 {
+		err = errRevisionConflict
+		return
+	}
+	rev, err = logger.stor.compareAndSwapState(masID, agentID, key, update)
+	return
+}
+
+// restoreStateRevision makes an older revision of a named state the latest revision
+func (logger *Logger) restoreStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	rev, err = logger.stor.restoreStateRevision(masID, agentID, key, revision)
+	return
+}
+
+// addSpans stores spans of traced message exchanges
+func (logger *Logger) addSpans(masID int, spans []schemas.Span) (err error) {
+	err = logger.stor.addSpans(masID, spans)
+	return
+}
+
+// getTrace returns all spans of a trace
+func (logger *Logger) getTrace(masID int, traceID string) (spans []schemas.Span, err error) {
+	spans, err = logger.stor.getTrace(masID, traceID)
+	return
+}
+
 // addAgentLogMessageList
 func (logger *Logger) updateAgentStatesList(masID int, states []schemas.State) (err error) {
 	for i := 0; i < len(states); i++ {
@@ -46,10 +46,18 @@ package logger
 
 import (
 	"context"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/RWTH-ACS/clonemap/pkg/client"
+	"github.com/RWTH-ACS/clonemap/pkg/schemas"
 )
 
 func TestLogger(t *testing.T) {
@@ -83,3 +91,136 @@ func dummyClient(s *http.Server, t *testing.T) {
 	defer cancel()
 	s.Shutdown(ctx)
 }
+
+// TestTracing tests the storage of spans
+func TestTracing(t *testing.T) {
+	os.Setenv("CLONEMAP_DEPLOYMENT_TYPE", "local")
+	os.Setenv("CLONEMAP_LOG_LEVEL", "error")
+	var log Logger
+	err := log.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv := httptest.NewServer(log.server(11000).Handler)
+	defer serv.Close()
+	servURL, _ := url.Parse(serv.URL)
+	port, _ := strconv.Atoi(servURL.Port())
+	cli := client.NewLoggerClient(servURL.Hostname(), port, time.Second, time.Millisecond, 1)
+
+	start := time.Now()
+	spans := []schemas.Span{
+		{TraceID: "t1", SpanID: "b", ParentSpanID: "a", Name: "ACL receive", AgentID: 1,
+			Start: start.Add(time.Millisecond), End: start.Add(time.Millisecond * 2)},
+		{TraceID: "t1", SpanID: "a", Name: "ACL send", Start: start, End: start},
+		{TraceID: "t2", SpanID: "c", Name: "ACL send", Start: start, End: start},
+	}
+	httpStatus, err := cli.PostSpans(2, spans)
+	if err != nil || httpStatus != http.StatusCreated {
+		t.Fatal("posting spans failed ", httpStatus, err)
+	}
+	trace, _, err := cli.GetTrace(2, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 2 || trace[0].SpanID != "a" || trace[1].SpanID != "b" ||
+		trace[1].ParentSpanID != "a" {
+		t.Errorf("wrong trace %+v", trace)
+	}
+	trace, _, _ = cli.GetTrace(1, "t1")
+	if len(trace) != 0 {
+		t.Error("trace of other MAS returned")
+	}
+}
+
+// TestNamedState tests versioned named states with compare-and-swap updates
+func TestNamedState(t *testing.T) {
+	os.Setenv("CLONEMAP_DEPLOYMENT_TYPE", "local")
+	os.Setenv("CLONEMAP_LOG_LEVEL", "error")
+	var logger Logger
+	err := logger.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.logError = log.New(ioutil.Discard, "", log.LstdFlags)
+	serv := httptest.NewServer(logger.server(11000).Handler)
+	defer serv.Close()
+	servURL, _ := url.Parse(serv.URL)
+	port, _ := strconv.Atoi(servURL.Port())
+	cli := client.NewLoggerClient(servURL.Hostname(), port, time.Second, time.Millisecond, 1)
+	logCol := client.NewLogCollectorClient(0, schemas.LoggerConfig{Active: true}, cli,
+		time.Second, logger.logError, logger.logError)
+	agLog := logCol.NewAgentLogger(3, logger.logError, logger.logError)
+
+	state, revision, err := agLog.GetNamedState("model")
+	if err != nil || revision != 0 || state != "" {
+		t.Fatal("unexpected state of new key ", state, revision, err)
+	}
+	for i := 0; i < 3; i++ {
+		revision, err = agLog.UpdateNamedState("model", revision, "m"+strconv.Itoa(i))
+		if err != nil || revision != i+1 {
+			t.Fatal("update failed ", revision, err)
+		}
+	}
+	_, err = agLog.UpdateNamedState("model", 2, "stale")
+	if err != client.ErrRevisionConflict {
+		t.Error("expected conflict for stale revision, got ", err)
+	}
+	_, err = agLog.UpdateNamedState("model", 5, "future")
+	if err != client.ErrRevisionConflict {
+		t.Error("expected conflict for future revision, got ", err)
+	}
+	_, err = agLog.UpdateNamedState("params", 0, "p0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = agLog.UpdateNamedState(client.SystemStatePrefix+"deadletters", 0, "[]")
+	if err != client.ErrReservedState {
+		t.Error("expected reserved state to be rejected, got ", err)
+	}
+	keys, err := agLog.StateKeys()
+	if err != nil || len(keys) != 2 || keys[0] != "model" || keys[1] != "params" {
+		t.Error("wrong keys ", keys, err)
+	}
+
+	state, revision, err = agLog.RestoreNamedState("model", 2)
+	if err != nil || state != "m1" || revision != 4 {
+		t.Error("restore failed ", state, revision, err)
+	}
+	revs, err := agLog.StateHistory("model")
+	if err != nil || len(revs) != 4 {
+		t.Fatal("wrong history ", revs, err)
+	}
+	for i := range revs {
+		if revs[i].Revision != i+1 || revs[i].Key != "model" || revs[i].AgentID != 3 {
+			t.Errorf("wrong revision %+v", revs[i])
+		}
+	}
+	if revs[3].State != "m1" {
+		t.Error("wrong state of restored revision ", revs[3].State)
+	}
+	rev, _, err := cli.GetStateRevision(0, 3, "model", 1)
+	if err != nil || rev.State != "m0" {
+		t.Error("wrong revision ", rev, err)
+	}
+	_, _, err = cli.GetStateRevision(0, 3, "model", 9)
+	if err != client.ErrStateNotFound {
+		t.Error("expected missing revision, got ", err)
+	}
+	_, _, err = agLog.RestoreNamedState("params", 7)
+	if err != client.ErrStateNotFound {
+		t.Error("expected missing revision, got ", err)
+	}
+	// negative IDs are rejected and must not block the storage
+	_, httpStatus, _ := cli.PutNamedState(-1, 3, "model", schemas.StateUpdate{State: "x"})
+	if httpStatus != http.StatusNotFound {
+		t.Error("expected rejection of negative masid, got ", httpStatus)
+	}
+	_, httpStatus, _ = cli.GetStateRevision(0, -1, "model", 1)
+	if httpStatus != http.StatusNotFound {
+		t.Error("expected rejection of negative agentid, got ", httpStatus)
+	}
+	keys, err = agLog.StateKeys()
+	if err != nil || len(keys) != 2 {
+		t.Error("wrong keys ", keys, err)
+	}
+}
@@ -83,8 +83,42 @@ type storage interface {
 
 	// deleteAgentState deletes the status of an agent
 	deleteAgentState(masID int, agentID int) (err error)
+
+	// getStateKeys returns the names of all named states of an agent
+	getStateKeys(masID int, agentID int) (keys []string, err error)
+
+	// getStateRevision returns the specified revision of a named state; the latest revision is
+	// returned if revision is 0
+	getStateRevision(masID int, agentID int, key string,
+		revision int) (rev schemas.StateRevision, err error)
+
+	// getStateHistory returns all revisions of a named state in ascending order
+	getStateHistory(masID int, agentID int, key string) (revs []schemas.StateRevision, err error)
+
+	// compareAndSwapState stores a new revision of a named state if the current revision equals
+	// update.Revision
+	compareAndSwapState(masID int, agentID int, key string,
+		update schemas.StateUpdate) (rev schemas.StateRevision, err error)
+
+	// restoreStateRevision stores the content of an older revision as new revision of a named
+	// state
+	restoreStateRevision(masID int, agentID int, key string,
+		revision int) (rev schemas.StateRevision, err error)
+
+	// addSpans stores spans of traced message exchanges
+	addSpans(masID int, spans []schemas.Span) (err error)
+
+	// getTrace returns all spans of a trace ordered by start time
+	getTrace(masID int, traceID string) (spans []schemas.Span, err error)
 }
 
+var (
+	// errStateNotFound is returned if a named state or revision does not exist
+	errStateNotFound = errors.New("state not found")
+	// errRevisionConflict is returned if a named state has been modified concurrently
+	errRevisionConflict = errors.New("revision conflict")
+)
+
 // LogMessage contains the content of a single log message
 // type LogMessage struct {
 // 	Timestamp time.Time
@@ -100,6 +134,7 @@ type localStorage struct {
 
 type masStorage struct {
 	agents []agentStorage
+	traces map[string][]schemas.Span // spans by trace ID
 }
 
 type agentStorage struct {
@@ -109,12 +144,14 @@ type agentStorage struct {
 	statLogs []schemas.LogMessage
 	appLogs  []schemas.LogMessage
 	state    schemas.State
+	states   map[string][]schemas.StateRevision // revisions of named states in ascending order
 	commData []schemas.Communication
 }
 
 // addAgentLogMessage adds an entry to specified logging entry
 func (stor *localStorage) addAgentLogMessage(log schemas.LogMessage) (err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	numMAS := len(stor.mas)
 	if numMAS <= log.MASID {
 		for i := 0; i < log.MASID-numMAS+1; i++ {
@@ -146,7 +183,6 @@ func (stor *localStorage) addAgentLogMessage(log schemas.LogMessage) (err error)
 	default:
 		err = errors.New("wrong topic")
 	}
-	stor.mutex.Unlock()
 	return
 }
 
@@ -154,6 +190,7 @@ func (stor *localStorage) addAgentLogMessage(log schemas.LogMessage) (err error)
 func (stor *localStorage) getLatestAgentLogMessages(masID int, agentID int, topic string,
 	num int) (logs []schemas.LogMessage, err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			switch topic {
@@ -197,7 +234,6 @@ func (stor *localStorage) getLatestAgentLogMessages(masID int, agentID int, topi
 			}
 		}
 	}
-	stor.mutex.Unlock()
 	return
 }
 
@@ -205,6 +241,7 @@ func (stor *localStorage) getLatestAgentLogMessages(masID int, agentID int, topi
 func (stor *localStorage) getAgentLogMessagesInRange(masID int, agentID int, topic string,
 	start time.Time, end time.Time) (logs []schemas.LogMessage, err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			switch topic {
@@ -294,13 +331,13 @@ func (stor *localStorage) getAgentLogMessagesInRange(masID int, agentID int, top
 			}
 		}
 	}
-	stor.mutex.Unlock()
 	return
 }
 
 // deleteAgentLogMessages deletes all log messages og an agent
 func (stor *localStorage) deleteAgentLogMessages(masID int, agentID int) (err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			stor.mas[masID].agents[agentID].errLogs = nil
@@ -310,7 +347,6 @@ func (stor *localStorage) deleteAgentLogMessages(masID int, agentID int) (err er
 			stor.mas[masID].agents[agentID].appLogs = nil
 		}
 	}
-	stor.mutex.Unlock()
 	return
 }
 
@@ -318,6 +354,7 @@ func (stor *localStorage) deleteAgentLogMessages(masID int, agentID int) (err er
 func (stor *localStorage) updateCommunication(masID int, agentID int,
 	commData []schemas.Communication) (err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	numMAS := len(stor.mas)
 	if numMAS <= masID {
 		for i := 0; i < masID-numMAS+1; i++ {
@@ -327,11 +364,10 @@ func (stor *localStorage) updateCommunication(masID int, agentID int,
 	numAgents := len(stor.mas[masID].agents)
 	if numAgents <= agentID {
 		for i := 0; i < agentID-numAgents+1; i++ {
-			stor.mas[i].agents = append(stor.mas[i].agents, agentStorage{})
+			stor.mas[masID].agents = append(stor.mas[masID].agents, agentStorage{})
 		}
 	}
 	stor.mas[masID].agents[agentID].commData = commData
-	stor.mutex.Unlock()
 	return
 }
 
@@ -339,18 +375,19 @@ func (stor *localStorage) updateCommunication(masID int, agentID int,
 func (stor *localStorage) getCommunication(masID int,
 	agentID int) (commData []schemas.Communication, err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			commData = stor.mas[masID].agents[agentID].commData
 		}
 	}
-	stor.mutex.Unlock()
 	return
 }
 
 // updateAgentState updates the agent status
 func (stor *localStorage) updateAgentState(masID int, agentID int, state schemas.State) (err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	numMAS := len(stor.mas)
 	if numMAS <= masID {
 		for i := 0; i < masID-numMAS+1; i++ {
@@ -360,35 +397,185 @@ func (stor *localStorage) updateAgentState(masID int, agentID int, state schemas
 	numAgents := len(stor.mas[masID].agents)
 	if numAgents <= agentID {
 		for i := 0; i < agentID-numAgents+1; i++ {
-			stor.mas[i].agents = append(stor.mas[i].agents, agentStorage{})
+			stor.mas[masID].agents = append(stor.mas[masID].agents, agentStorage{})
 		}
 	}
 	stor.mas[masID].agents[agentID].state = state
-	stor.mutex.Unlock()
 	return
 }
 
 // getAgentState return the latest agent status
 func (stor *localStorage) getAgentState(masID int, agentID int) (state schemas.State, err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			state = stor.mas[masID].agents[agentID].state
 		}
 	}
-	stor.mutex.Unlock()
 	return
 }
 
 // deleteAgentState deletes the status of an agent
 func (stor *localStorage) deleteAgentState(masID int, agentID int) (err error) {
 	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
 	if masID < len(stor.mas) {
 		if agentID < len(stor.mas[masID].agents) {
 			stor.mas[masID].agents[agentID].state = schemas.State{}
+			stor.mas[masID].agents[agentID].states = nil
 		}
 	}
+	return
+}
+
+// getStateKeys returns the names of all named states of an agent
+func (stor *localStorage) getStateKeys(masID int, agentID int) (keys []string, err error) {
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	if masID < len(stor.mas) {
+		if agentID < len(stor.mas[masID].agents) {
+			for key := range stor.mas[masID].agents[agentID].states {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// getStateRevision returns the specified revision of a named state; the latest revision is
+// returned if revision is 0
+func (stor *localStorage) getStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	err = errStateNotFound
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	if masID < len(stor.mas) {
+		if agentID < len(stor.mas[masID].agents) {
+			revs := stor.mas[masID].agents[agentID].states[key]
+			if revision == 0 {
+				revision = len(revs)
+			}
+			if revision > 0 && revision <= len(revs) {
+				rev = revs[revision-1]
+				err = nil
+			}
+		}
+	}
+	return
+}
+
+// getStateHistory returns all revisions of a named state in ascending order
+func (stor *localStorage) getStateHistory(masID int, agentID int,
+	key string) (revs []schemas.StateRevision, err error) {
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	if masID < len(stor.mas) {
+		if agentID < len(stor.mas[masID].agents) {
+			revs = make([]schemas.StateRevision, len(stor.mas[masID].agents[agentID].states[key]))
+			copy(revs, stor.mas[masID].agents[agentID].states[key])
+		}
+	}
+	return
+}
+
+// compareAndSwapState stores a new revision of a named state if the current revision equals
+// update.Revision
+func (stor *localStorage) compareAndSwapState(masID int, agentID int, key string,
+	update schemas.StateUpdate) (rev schemas.StateRevision, err error) {
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	numMAS := len(stor.mas)
+	if numMAS <= masID {
+		for i := 0; i < masID-numMAS+1; i++ {
+			stor.mas = append(stor.mas, masStorage{})
+		}
+	}
+	numAgents := len(stor.mas[masID].agents)
+	if numAgents <= agentID {
+		for i := 0; i < agentID-numAgents+1; i++ {
+			stor.mas[masID].agents = append(stor.mas[masID].agents, agentStorage{})
+		}
+	}
+	rev, err = stor.mas[masID].agents[agentID].appendStateRevision(masID, agentID, key,
+		update.Revision, update.State)
+	return
+}
+
+// restoreStateRevision stores the content of an older revision as new revision of a named
+// state
+func (stor *localStorage) restoreStateRevision(masID int, agentID int, key string,
+	revision int) (rev schemas.StateRevision, err error) {
+	err = errStateNotFound
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	if masID < len(stor.mas) {
+		if agentID < len(stor.mas[masID].agents) {
+			revs := stor.mas[masID].agents[agentID].states[key]
+			if revision > 0 && revision <= len(revs) {
+				rev, err = stor.mas[masID].agents[agentID].appendStateRevision(masID, agentID,
+					key, len(revs), revs[revision-1].State)
+			}
+		}
+	}
+	return
+}
+
+// appendStateRevision appends a new revision to a named state if the current revision equals
+// revision; the mutex of the storage has to be locked
+func (agStor *agentStorage) appendStateRevision(masID int, agentID int, key string, revision int,
+	state string) (rev schemas.StateRevision, err error) {
+	if agStor.states == nil {
+		agStor.states = make(map[string][]schemas.StateRevision)
+	}
+	if len(agStor.states[key]) != revision {
+		err = errRevisionConflict
+		return
+	}
+	rev = schemas.StateRevision{
+		MASID:     masID,
+		AgentID:   agentID,
+		Key:       key,
+		Revision:  revision + 1,
+		Timestamp: time.Now(),
+		State:     state,
+	}
+	agStor.states[key] = append(agStor.states[key], rev)
+	return
+}
+
+// addSpans stores spans of traced message exchanges
+func (stor *localStorage) addSpans(masID int, spans []schemas.Span) (err error) {
+	stor.mutex.Lock()
+	numMAS := len(stor.mas)
+	if numMAS <= masID {
+		for i := 0; i < masID-numMAS+1; i++ {
+			stor.mas = append(stor.mas, masStorage{})
+		}
+	}
+	if stor.mas[masID].traces == nil {
+		stor.mas[masID].traces = make(map[string][]schemas.Span)
+	}
+	for i := range spans {
+		stor.mas[masID].traces[spans[i].TraceID] = append(stor.mas[masID].traces[spans[i].TraceID],
+			spans[i])
+	}
+	stor.mutex.Unlock()
+	return
+}
+
+// getTrace returns all spans of a trace ordered by start time
+func (stor *localStorage) getTrace(masID int, traceID string) (spans []schemas.Span, err error) {
+	stor.mutex.Lock()
+	if masID < len(stor.mas) {
+		spans = make([]schemas.Span, len(stor.mas[masID].traces[traceID]))
+		copy(spans, stor.mas[masID].traces[traceID])
+	}
 	stor.mutex.Unlock()
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start.Before(spans[j].Start)
+	})
 	return
 }
 
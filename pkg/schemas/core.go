@@ -107,12 +107,16 @@ type MASSpec struct {
 
 // MASConfig contains configuration of MAS
 type MASConfig struct {
-	Name               string       `json:"name,omitempty"`   // name/description of MAS
-	NumAgentsPerAgency int          `json:"agentsperagency"`  // number of agents per agency
-	MQTT               MQTTConfig   `json:"mqtt"`             //switch for mqtt
-	DF                 DFConfig     `json:"df"`               //switch for df
-	Logger             LoggerConfig `json:"logger"`           // logger configuration
-	Custom             string       `json:"custom,omitempty"` // custom configuration data
+	Name               string        `json:"name,omitempty"`   // name/description of MAS
+	NumAgentsPerAgency int           `json:"agentsperagency"`  // number of agents per agency
+	MQTT               MQTTConfig    `json:"mqtt"`             //switch for mqtt
+	DF                 DFConfig      `json:"df"`               //switch for df
+	Logger             LoggerConfig  `json:"logger"`           // logger configuration
+	Gateway            GatewayConfig `json:"gateway"`          // gateway configuration
+	Tracing            TracingConfig `json:"tracing"`          // message tracing configuration
+	Faults             FaultConfig   `json:"faults"`           // faults injected into messaging
+	Cosim              CosimConfig   `json:"cosim"`            // time-stepped co-simulation
+	Custom             string        `json:"custom,omitempty"` // custom configuration data
 }
 
 // ImageGroupInfo contains information about all agents that have the same image
@@ -130,8 +134,9 @@ type ImageGroupSpec struct {
 
 // ImageGroupConfig contains information about the image group
 type ImageGroupConfig struct {
-	Image      string `json:"image"`            // docker image to be used for agencies
-	PullSecret string `json:"secret,omitempty"` // image pull secret
+	Image       string            `json:"image"`            // docker image to be used for agencies
+	PullSecret  string            `json:"secret,omitempty"` // image pull secret
+	Supervision SupervisionConfig `json:"supervision"`      // default supervision of agents in group
 }
 
 // AgentInfo contains information about agent spec, address, communication, mqtt and status
@@ -147,11 +152,66 @@ type AgentInfo struct {
 
 // AgentSpec contains information about a agent running in a MAS
 type AgentSpec struct {
-	NodeID   int    `json:"nodeid"`            // id of the node the agent is attached to
-	Name     string `json:"name,omitempty"`    // name/description of agent
-	AType    string `json:"type,omitempty"`    // type of agent (application dependent)
-	ASubtype string `json:"subtype,omitempty"` // subtype of agent (application dependent)
-	Custom   string `json:"custom,omitempty"`  // custom configuration data
+	NodeID      int               `json:"nodeid"`            // id of the node the agent is attached to
+	Name        string            `json:"name,omitempty"`    // name/description of agent
+	AType       string            `json:"type,omitempty"`    // type of agent (application dependent)
+	ASubtype    string            `json:"subtype,omitempty"` // subtype of agent (application dependent)
+	Groups      []string          `json:"groups,omitempty"`  // named groups the agent is member of
+	Inbox       InboxConfig       `json:"inbox"`             // configuration of message inboxes
+	Supervision SupervisionConfig `json:"supervision"`       // restart policy in case of failures
+	Custom      string            `json:"custom,omitempty"`  // custom configuration data
+}
+
+// SupervisionConfig contains the restart policy that is applied when the task or a behavior of
+// an agent fails, i.e. returns an error or panics
+type SupervisionConfig struct {
+	Policy      string `json:"policy,omitempty"`      // restart policy (default never)
+	MaxRestarts int    `json:"maxrestarts,omitempty"` // maximum number of restarts with policy onfailure (default 5)
+	Backoff     int    `json:"backoff,omitempty"`     // delay before first restart in ms, doubled for each restart (default 100)
+	MaxBackoff  int    `json:"maxbackoff,omitempty"`  // maximum delay before restart in ms (default 30000)
+}
+
+// restart policies of agents
+const (
+	RestartNever     = "never"     // failed agents are terminated
+	RestartAlways    = "always"    // failed agents are restarted without limit
+	RestartOnFailure = "onfailure" // failed agents are restarted up to the maximum number of restarts
+)
+
+// InboxConfig contains the configuration of an agent's message inboxes
+type InboxConfig struct {
+	Capacity int    `json:"capacity,omitempty"` // capacity of each inbox and priority level (default 1000)
+	Policy   string `json:"policy,omitempty"`   // overflow policy (default block)
+}
+
+// overflow policies of agent inboxes
+const (
+	InboxBlock      = "block"      // wait until the agent has taken messages from the inbox
+	InboxDropOldest = "dropoldest" // discard the oldest message in the inbox
+	InboxDropNewest = "dropnewest" // discard the incoming message
+	InboxReject     = "reject"     // discard the incoming message and answer with failure
+)
+
+// InboxStats contains the state of an agent's message inboxes
+type InboxStats struct {
+	Capacity  int         `json:"capacity"`  // capacity of each inbox
+	Policy    string      `json:"policy"`    // overflow policy
+	Depth     int         `json:"depth"`     // number of messages in the agent inbox
+	Pending   int         `json:"pending"`   // number of messages skipped by selective receive
+	Queued    int         `json:"queued"`    // number of messages waiting for space in an inbox
+	Protocols map[int]int `json:"protocols"` // number of messages in inboxes of protocol behaviors
+	Dropped   int         `json:"dropped"`   // number of messages discarded due to overflow
+	Rejected  int         `json:"rejected"`  // number of messages rejected due to overflow
+	Buffered  int         `json:"buffered"`  // number of messages buffered while the agent is suspended
+}
+
+// AgentMigration contains everything needed to continue the execution of an agent in another
+// agency
+type AgentMigration struct {
+	ID       string       `json:"id"`              // unique ID of the migration
+	Agent    AgentInfo    `json:"agent"`           // info of agent with current custom data and new address
+	State    string       `json:"state,omitempty"` // last state saved by the agent
+	Messages []ACLMessage `json:"msgs,omitempty"`  // messages received but not yet taken by the agent
 }
 
 // Address holds the address information of an agent
@@ -161,8 +221,10 @@ type Address struct {
 
 // Status contains information about an agent's or agency's status
 type Status struct {
-	Code       int       `json:"code"`       // status code
-	LastUpdate time.Time `json:"lastupdate"` // time of last update
+	Code       int       `json:"code"`                // status code
+	LastUpdate time.Time `json:"lastupdate"`          // time of last update
+	Restarts   int       `json:"restarts,omitempty"`  // number of restarts after failures
+	LastError  string    `json:"lasterror,omitempty"` // error of last failure
 }
 
 // AgencyInfo contains information about agency spec and status (for storage)
@@ -182,17 +244,21 @@ type AgencyInfo struct {
 
 // AgencyInfoFull contains information about agency and full info about agents it conatins (for api)
 type AgencyInfoFull struct {
-	MASID        int          `json:"masid"`               // ID of MAS
-	Name         string       `json:"name"`                // name of agency (hostname of pod given by kubernetes)
-	ID           int          `json:"id"`                  // within image group unique ID (contained in name)
-	ImageGroupID int          `json:"imid"`                // ID of agency image group
-	Logger       LoggerConfig `json:"logger"`              // logger configuration
-	MQTT         MQTTConfig   `json:"mqtt"`                // MQTT configuration
-	DF           DFConfig     `json:"df"`                  // DF configuration
-	MASName      string       `json:"masname"`             // name of MAS as specified by user in MASConfig
-	MASCustom    string       `json:"mascustom,omitempty"` // custom global configuration data from MASConfig
-	Agents       []AgentInfo  `json:"agents"`
-	Status       Status       `json:"status"`
+	MASID        int           `json:"masid"`               // ID of MAS
+	Name         string        `json:"name"`                // name of agency (hostname of pod given by kubernetes)
+	ID           int           `json:"id"`                  // within image group unique ID (contained in name)
+	ImageGroupID int           `json:"imid"`                // ID of agency image group
+	Logger       LoggerConfig  `json:"logger"`              // logger configuration
+	MQTT         MQTTConfig    `json:"mqtt"`                // MQTT configuration
+	DF           DFConfig      `json:"df"`                  // DF configuration
+	Gateway      GatewayConfig `json:"gateway"`             // gateway configuration
+	Tracing      TracingConfig `json:"tracing"`             // message tracing configuration
+	Faults       FaultConfig   `json:"faults"`              // faults injected into messaging
+	Cosim        CosimConfig   `json:"cosim"`               // time-stepped co-simulation
+	MASName      string        `json:"masname"`             // name of MAS as specified by user in MASConfig
+	MASCustom    string        `json:"mascustom,omitempty"` // custom global configuration data from MASConfig
+	Agents       []AgentInfo   `json:"agents"`
+	Status       Status        `json:"status"`
 }
 
 // MASs contains informaton about how many MASs are running
@@ -260,6 +326,28 @@ type ACLMessage struct {
 	ReplyWith      string    `json:"repwith,omitempty"` // Introduces an expression that will be used by the responding agent to identify this message
 	InReplyTo      int       `json:"inrepto,omitempty"` // Denotes an expression that references an earlier action to which this message is a reply
 	ReplyBy        time.Time `json:"repby,omitempty"`   // Denotes a time and/or date expression which indicates the latest time by which the sending agent would like to receive a reply
+	Priority       int       `json:"prio,omitempty"`    // priority of the message; messages with higher priority overtake messages with lower priority
+	TraceID        string    `json:"trace,omitempty"`   // ID of the trace the message belongs to (hex encoded)
+	SpanID         string    `json:"span,omitempty"`    // ID of the span that caused the message to be sent or delivered (hex encoded)
+}
+
+// priorities of ACL messages; values above PriorityHigh and below PriorityLow are treated as
+// PriorityHigh and PriorityLow respectively
+const (
+	PriorityLow    = -1 // bulk traffic, e.g. measurements
+	PriorityNormal = 0  // default priority
+	PriorityHigh   = 1  // urgent traffic, e.g. control commands
+)
+
+// SystemAgentID is the reserved sender ID of messages generated by the platform itself, e.g.
+// failure notices for undeliverable messages
+const SystemAgentID = -1
+
+// DeadLetter holds an ACL message that could not be delivered
+type DeadLetter struct {
+	Message   ACLMessage `json:"msg"`    // undeliverable message
+	Reason    string     `json:"reason"` // reason why the message could not be delivered
+	Timestamp time.Time  `json:"ts"`     // time the message has been declared undeliverable
 }
 
 // String outputs message
@@ -344,6 +432,9 @@ func (msg ACLMessage) String() (ret string) {
 	default:
 		ret += "Performative: Unknown(" + strconv.Itoa(msg.Performative) + "); "
 	}
+	if msg.TraceID != "" {
+		ret += "Trace: " + msg.TraceID + "; Span: " + msg.SpanID + "; "
+	}
 	ret += "Content: " + msg.Content
 	return
 }
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// schemas for the time-stepped co-simulation of a MAS
+
+package schemas
+
+import "time"
+
+// CosimConfig contains the configuration of the time-stepped co-simulation of a MAS. If active,
+// the AMS acts as time coordinator and starts one step after another. A step is started as soon
+// as all agents have finished the previous step and no messages between agencies are in flight
+type CosimConfig struct {
+	Active   bool      `json:"active"`             // indicates if the MAS is executed in steps
+	StepSize int       `json:"stepsize"`           // virtual time between two steps in ms
+	NumSteps int       `json:"numsteps,omitempty"` // number of steps; unlimited if 0
+	Start    time.Time `json:"start,omitempty"`    // virtual time of step 0; start of MAS if zero
+	Timeout  int       `json:"timeout,omitempty"`  // maximum duration of one step in ms; 60000 if 0
+}
+
+// CosimStep is sent by the AMS to all agencies in order to start a step
+type CosimStep struct {
+	Step int       `json:"step"` // number of step starting at 0
+	Time time.Time `json:"time"` // virtual time of step
+}
+
+// CosimReport contains the progress of an agency in the co-simulation
+type CosimReport struct {
+	Agency   string `json:"agency"`   // name of agency
+	Ready    bool   `json:"ready"`    // all agents of the agency have been started
+	Step     int    `json:"step"`     // last started step; -1 before the first step
+	Done     bool   `json:"done"`     // all step behaviors have finished the last started step
+	Failed   int    `json:"failed"`   // number of step behaviors that failed in the last step
+	Sent     int    `json:"sent"`     // number of messages handed over to other agencies
+	Received int    `json:"received"` // number of messages received from other agencies
+	Lost     int    `json:"lost"`     // number of messages that could not be sent to other agencies
+	Pending  int    `json:"pending"`  // number of messages held back or delayed within the agency
+}
+
+// CosimStatus contains the progress of the co-simulation of a MAS
+type CosimStatus struct {
+	Active    bool      `json:"active"`              // indicates if the MAS is executed in steps
+	Step      int       `json:"step"`                // last completed step; -1 before the first step
+	Time      time.Time `json:"time"`                // virtual time of the last completed step
+	Finished  bool      `json:"finished"`            // all steps have been executed
+	Halted    bool      `json:"halted"`              // the co-simulation has been stopped after a failed step
+	LastError string    `json:"lasterror,omitempty"` // last error that occurred during a step
+}
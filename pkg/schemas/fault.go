@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// schemas for fault injection in the message path of agencies
+
+package schemas
+
+import "time"
+
+// FaultConfig contains the faults injected into the message path of an agency. The random
+// decision for a message only depends on the seed, the agency, sender, receiver and the number of
+// messages sent before on the same link
+type FaultConfig struct {
+	Active     bool        `json:"active"`               // indicates if faults are injected
+	Seed       int64       `json:"seed,omitempty"`       // seed for random decisions; chosen randomly if 0
+	Start      time.Time   `json:"start,omitempty"`      // reference time of partitions; time the config is set if zero
+	Links      []LinkFault `json:"links,omitempty"`      // faults of links between agents
+	Partitions []Partition `json:"partitions,omitempty"` // timed partitions between agencies
+}
+
+// LinkFault describes the faults of messages sent from one of the senders to one of the
+// receivers. Only the first matching link is applied to a message
+type LinkFault struct {
+	Senders   []int   `json:"senders,omitempty"`   // IDs of sending agents; all agents if empty
+	Receivers []int   `json:"receivers,omitempty"` // IDs of receiving agents; all agents if empty
+	Drop      float64 `json:"drop,omitempty"`      // probability that a message is lost
+	Latency   int     `json:"latency,omitempty"`   // added delay in ms
+	Jitter    int     `json:"jitter,omitempty"`    // maximum random deviation from latency in ms
+	Duplicate float64 `json:"duplicate,omitempty"` // probability that a message is delivered twice
+	Reorder   float64 `json:"reorder,omitempty"`   // probability that a message is overtaken by the next one
+}
+
+// Partition separates the listed agencies from all other agencies. Messages between both sides
+// are lost during the partition
+type Partition struct {
+	Agencies []string `json:"agencies"`           // names of agencies on one side of the partition
+	Start    int      `json:"start,omitempty"`    // begin in ms after the start of the fault config
+	Duration int      `json:"duration,omitempty"` // length in ms; unlimited if 0
+}
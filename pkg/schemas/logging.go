@@ -77,6 +77,24 @@ type State struct {
 	State     string    `json:"state"`     // State
 }
 
+// StateRevision contains one revision of a named state of an agent. All revisions of a state are
+// kept as history
+type StateRevision struct {
+	MASID     int       `json:"masid"`     // ID of MAS agent runs in
+	AgentID   int       `json:"agentid"`   // ID of agent
+	Key       string    `json:"key"`       // name of state
+	Revision  int       `json:"revision"`  // revision number starting at 1
+	Timestamp time.Time `json:"timestamp"` // time the revision has been stored
+	State     string    `json:"state"`     // State
+}
+
+// StateUpdate is a compare-and-swap update of a named state. It is only applied if the current
+// revision of the state equals Revision
+type StateUpdate struct {
+	Revision int    `json:"revision"` // expected current revision; 0 if the state does not exist
+	State    string `json:"state"`    // new state
+}
+
 // Communication contains information regarding communication with another agent
 type Communication struct {
 	ID         int `json:"id"`      // id of other agent
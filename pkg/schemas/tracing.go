@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Institute for Automation of Complex Power Systems,
+E.ON Energy Research Center, RWTH Aachen University
+
+This project is licensed under either of
+- Apache License, Version 2.0
+- MIT License
+at your option.
+
+Apache License, Version 2.0:
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+MIT License:
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package schemas
+
+import (
+	"time"
+)
+
+// TracingConfig contains the configuration of message tracing. Spans are sent to the collector
+// if one is specified and to the logger otherwise
+type TracingConfig struct {
+	Active    bool   `json:"active"`              // indicates if spans are recorded
+	Collector string `json:"collector,omitempty"` // OTLP/HTTP endpoint, e.g. http://otel-collector:4318/v1/traces
+}
+
+// kinds of spans as defined by OpenTelemetry
+const (
+	SpanKindInternal = 1 // operation within an agent, e.g. a protocol behavior
+	SpanKindServer   = 2 // reception of a message by an agency
+	SpanKindClient   = 3 // transmission of a message to another agency
+	SpanKindProducer = 4 // sending of a message by an agent
+	SpanKindConsumer = 5 // delivery of a message to an agent
+)
+
+// Span is a single timed operation within a trace
+type Span struct {
+	TraceID      string            `json:"trace"`                // ID of trace (32 hex digits)
+	SpanID       string            `json:"span"`                 // ID of span (16 hex digits)
+	ParentSpanID string            `json:"parent,omitempty"`     // ID of parent span; empty for root spans
+	Name         string            `json:"name"`                 // name of operation
+	Kind         int               `json:"kind"`                 // kind of span
+	MASID        int               `json:"masid"`                // ID of MAS
+	AgentID      int               `json:"agentid"`              // ID of agent that executed the operation
+	Agency       string            `json:"agency,omitempty"`     // name of agency that executed the operation
+	Start        time.Time         `json:"start"`                // start time
+	End          time.Time         `json:"end"`                  // end time
+	Attributes   map[string]string `json:"attributes,omitempty"` // further information
+	Error        string            `json:"error,omitempty"`      // error that occurred during the operation
+}
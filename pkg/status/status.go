@@ -53,4 +53,5 @@ const (
 	Running      = iota
 	Error        = iota
 	Terminated   = iota
+	Suspended    = iota
 )